@@ -0,0 +1,69 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"pvflasher/internal/archive"
+)
+
+var archiveJSON bool
+
+var archiveCmd = &cobra.Command{
+	Use:   "archive",
+	Short: "Inspect tar and zip archives of images",
+}
+
+var archiveLsCmd = &cobra.Command{
+	Use:   "ls [archive]",
+	Short: "List the images in an archive",
+	Long: `List the images in a tar or zip archive that pvflasher copy can flash:
+*.img, *.wic and *.iso entries, possibly compressed, with their size in the
+archive and their bmap, if the archive has one.
+
+They are listed in the order pvflasher copy prefers them: images with a bmap
+first, then in the order they are stored. Without --entry, pvflasher copy
+flashes the first.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := args[0]
+		if !archive.IsArchive(path) {
+			return fmt.Errorf("%s is not a tar or zip archive", path)
+		}
+		images, err := archive.ListImages(context.Background(), path)
+		if err != nil {
+			return err
+		}
+		if archiveJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(images)
+		}
+		if len(images) == 0 {
+			fmt.Printf("No images found in %s\n", path)
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tSIZE\tBMAP")
+		for _, img := range images {
+			bmapEntry := img.BmapEntry
+			if bmapEntry == "" {
+				bmapEntry = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", img.Name, formatSize(img.Size), bmapEntry)
+		}
+		return w.Flush()
+	},
+}
+
+func init() {
+	archiveLsCmd.Flags().BoolVar(&archiveJSON, "json", false, "output JSON")
+	archiveCmd.AddCommand(archiveLsCmd)
+	rootCmd.AddCommand(archiveCmd)
+}
@@ -0,0 +1,236 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/schollz/progressbar/v3"
+	"github.com/spf13/cobra"
+
+	"pvflasher/internal/archive"
+	"pvflasher/internal/bmap"
+	"pvflasher/internal/image"
+)
+
+var bmapJSON bool
+var bmapGaps int
+
+var bmapCmd = &cobra.Command{
+	Use:   "bmap",
+	Short: "Inspect and validate bmap files",
+}
+
+var bmapCheckCmd = &cobra.Command{
+	Use:   "check [bmap-file]",
+	Short: "Validate a bmap file",
+	Long: `Validate a bmap file: its XML and self-checksum, that its ranges are
+sorted, don't overlap and fit in BlocksCount, that they add up to
+MappedBlocksCount, and that every checksum matches ChecksumType.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := args[0]
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bm, err := bmap.Parse(f)
+		if err != nil {
+			return err
+		}
+		if err := bm.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s is invalid:\n%v\n", path, err)
+			return fmt.Errorf("bmap check failed")
+		}
+
+		fmt.Printf("%s: OK (format %s, %d ranges, %d of %d blocks mapped)\n",
+			path, bm.Version, len(bm.BlockMap), bm.MappedBlocksCount, bm.BlocksCount)
+		return nil
+	},
+}
+
+var bmapInfoCmd = &cobra.Command{
+	Use:   "info [bmap-file]",
+	Short: "Summarize a bmap file",
+	Long: `Summarize a bmap file: image size, how much of it is mapped, the number
+of ranges, the largest unmapped gaps, the checksum type, and whether the
+self-checksum and the checks of pvflasher bmap check pass.
+
+A damaged bmap is still summarized, but the command then exits with an error.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := args[0]
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, info, err := bmap.Inspect(f, bmapGaps)
+		if err != nil {
+			return err
+		}
+		if bmapJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(info); err != nil {
+				return err
+			}
+		} else {
+			writeBmapInfo(os.Stdout, path, info)
+		}
+
+		if (info.Integrity != "ok" && info.Integrity != "none") || len(info.Problems) > 0 {
+			return fmt.Errorf("%s is damaged or invalid", path)
+		}
+		return nil
+	},
+}
+
+// writeBmapInfo prints info as an aligned list of fields.
+func writeBmapInfo(out io.Writer, path string, info *bmap.Info) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "File:\t%s\n", path)
+	fmt.Fprintf(w, "Format:\t%s\n", info.Version)
+	fmt.Fprintf(w, "Image size:\t%s (%d bytes)\n", formatSize(info.ImageSize), info.ImageSize)
+	fmt.Fprintf(w, "Block size:\t%d\n", info.BlockSize)
+	fmt.Fprintf(w, "Mapped:\t%s in %d of %d blocks (%.1f%%)\n",
+		formatSize(info.MappedBytes), info.MappedBlocks, info.BlocksCount, info.MappedPercent)
+	fmt.Fprintf(w, "Ranges:\t%d\n", info.Ranges)
+	fmt.Fprintf(w, "Checksum type:\t%s\n", info.ChecksumType)
+	switch info.Integrity {
+	case "ok":
+		fmt.Fprintf(w, "Integrity:\tOK (%s)\n", info.FileChecksum)
+	case "none":
+		fmt.Fprintf(w, "Integrity:\tnot checked, the bmap has no self-checksum\n")
+	default:
+		fmt.Fprintf(w, "Integrity:\tFAILED: %s\n", info.Integrity)
+	}
+	w.Flush()
+
+	if len(info.LargestGaps) > 0 {
+		fmt.Fprintln(out, "Largest gaps:")
+		w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		for _, g := range info.LargestGaps {
+			fmt.Fprintf(w, "  blocks %d-%d\t%s\n", g.Start, g.End, formatSize(g.Bytes))
+		}
+		w.Flush()
+	}
+	if len(info.Problems) > 0 {
+		fmt.Fprintln(out, "Problems:")
+		for _, p := range info.Problems {
+			fmt.Fprintf(out, "  %s\n", p)
+		}
+	}
+}
+
+var bmapRangesCmd = &cobra.Command{
+	Use:   "ranges [bmap-file]",
+	Short: "List the block ranges of a bmap file",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bm, err := bmap.ParseFile(args[0])
+		if err != nil {
+			return err
+		}
+		ranges := make([]bmap.BlockRange, 0, len(bm.BlockMap))
+		for _, rng := range bm.BlockMap {
+			r, err := rng.Parse()
+			if err != nil {
+				return err
+			}
+			ranges = append(ranges, r)
+		}
+
+		if bmapJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(ranges)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "START\tEND\tBLOCKS\t%s\n", strings.ToUpper(bm.ChecksumType))
+		for _, r := range ranges {
+			fmt.Fprintf(w, "%d\t%d\t%d\t%s\n", r.Start, r.End, r.Count, r.Checksum)
+		}
+		return w.Flush()
+	},
+}
+
+var bmapMatchCmd = &cobra.Command{
+	Use:   "match [image] [bmap-file]",
+	Short: "Check an image against the range checksums of a bmap",
+	Long: `Check that an image holds the data its bmap describes, by hashing every
+mapped range of the image and comparing it with the range checksum. No device
+is involved. Compressed images and archives are decompressed on the fly.
+
+Without a bmap-file, the bmap is found next to the image the way pvflasher
+copy finds it.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		imagePath := args[0]
+		var bmapPath string
+		if len(args) == 2 {
+			bmapPath = args[1]
+		} else if bmapPath = discoverBmap(imagePath); bmapPath == "" {
+			return fmt.Errorf("no bmap found for %s; pass one as the second argument", imagePath)
+		} else {
+			fmt.Println("Auto-detected bmap:", bmapPath)
+		}
+
+		bm, err := bmap.ParseFile(bmapPath)
+		if err != nil {
+			return err
+		}
+
+		var src io.ReadCloser
+		if archive.IsArchive(imagePath) || image.IsCompressed(imagePath) || image.IsSimgFile(imagePath) || image.IsVirtualDiskFile(imagePath) {
+			src, err = openImageStream(imagePath)
+		} else {
+			src, err = os.Open(imagePath)
+		}
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		bar := progressbar.DefaultBytes(-1, "matching")
+		mismatches, err := bmap.Match(src, bm, func(done, total int64) {
+			if bar.GetMax64() != total {
+				bar.ChangeMax64(total)
+			}
+			bar.Set64(done)
+		})
+		bar.Finish()
+		if err != nil {
+			return err
+		}
+
+		for _, m := range mismatches {
+			fmt.Fprintf(os.Stderr, "range %d-%d: checksum %s, bmap says %s\n", m.Range.Start, m.Range.End, m.Got, m.Range.Checksum)
+		}
+		if len(mismatches) > 0 {
+			return fmt.Errorf("%d of %d ranges don't match %s", len(mismatches), len(bm.BlockMap), bmapPath)
+		}
+		fmt.Printf("%s matches %s (%d ranges, %d blocks)\n", imagePath, bmapPath, len(bm.BlockMap), bm.MappedBlocksCount)
+		return nil
+	},
+}
+
+func init() {
+	bmapInfoCmd.Flags().BoolVar(&bmapJSON, "json", false, "output JSON")
+	bmapInfoCmd.Flags().IntVar(&bmapGaps, "gaps", 5, "number of largest gaps to list")
+	bmapRangesCmd.Flags().BoolVar(&bmapJSON, "json", false, "output JSON")
+	addDecodeFlags(bmapMatchCmd)
+	bmapCmd.AddCommand(bmapCheckCmd)
+	bmapCmd.AddCommand(bmapInfoCmd)
+	bmapCmd.AddCommand(bmapRangesCmd)
+	bmapCmd.AddCommand(bmapMatchCmd)
+	rootCmd.AddCommand(bmapCmd)
+}
@@ -7,19 +7,31 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/schollz/progressbar/v3"
 	"github.com/spf13/cobra"
 
-	"pvflasher/pkg/flash"
+	"pvflasher/internal/checksum"
+	"pvflasher/internal/image"
 	"pvflasher/internal/platform"
+	"pvflasher/pkg/flash"
 )
 
 var bmapFile string
+var imageEntry string
+var checksumFile string
 var force bool
 var noVerify bool
 var noEject bool
 var jsonOutput bool
+var lazyUnmount bool
+var partitionTimeout time.Duration
+var requireSignature bool
+var keyringDir string
+var baseBmap string
+var trustBase bool
+var skipIdentical bool
 
 var copyCmd = &cobra.Command{
 	Use:   "copy [image] [device]",
@@ -54,36 +66,34 @@ var copyCmd = &cobra.Command{
 
 		// Auto-discover bmap if not set
 		if bmapFile == "" {
-			candidates := []string{
-				imagePath + ".bmap",
+			bmapFile = discoverBmap(imagePath)
+			if bmapFile != "" && !jsonOutput {
+				fmt.Println("Auto-detected bmap:", bmapFile)
 			}
-
-			// If image has an extension like .gz, .bz2, etc, try removing it
-			ext := filepath.Ext(imagePath)
-			switch strings.ToLower(ext) {
-			case ".gz", ".bz2", ".xz", ".zst", ".zstd", ".zip":
-				base := strings.TrimSuffix(imagePath, ext)
-				candidates = append(candidates, base+".bmap")
-			}
-
-			for _, c := range candidates {
-				if _, err := os.Stat(c); err == nil {
-					bmapFile = c
-					if !jsonOutput {
-						fmt.Println("Auto-detected bmap:", bmapFile)
-					}
-					break
-				}
+		}
+		if checksumFile == "" {
+			checksumFile = checksum.Find(imagePath)
+			if checksumFile != "" && !jsonOutput {
+				fmt.Println("Auto-detected checksum file:", checksumFile)
 			}
 		}
 
 		opts := flash.Options{
-			ImagePath:  imagePath,
-			DevicePath: devicePath,
-			BmapPath:   bmapFile,
-			Force:      force,
-			NoVerify:   noVerify,
-			NoEject:    noEject,
+			ImagePath:        imagePath,
+			DevicePath:       devicePath,
+			BmapPath:         bmapFile,
+			ImageEntry:       imageEntry,
+			ChecksumPath:     checksumFile,
+			Force:            force,
+			NoVerify:         noVerify,
+			NoEject:          noEject,
+			LazyUnmount:      lazyUnmount,
+			PartitionTimeout: partitionTimeout,
+			RequireSignature: requireSignature,
+			KeyringDir:       keyringDir,
+			BasePath:         baseBmap,
+			TrustBase:        trustBase,
+			SkipIdentical:    skipIdentical,
 			ProgressCb: func(p flash.Progress) {
 				if jsonOutput {
 					data, _ := json.Marshal(p)
@@ -119,9 +129,32 @@ var copyCmd = &cobra.Command{
 				fmt.Println(string(data))
 			} else {
 				fmt.Printf("\n✅ Flash completed successfully!\n")
+				fmt.Printf("   Image format: %s\n", result.Format)
+				if result.ImageEntry != "" {
+					fmt.Printf("   Archive entry: %s\n", result.ImageEntry)
+				}
 				fmt.Printf("   Bytes written: %d (%.2f MB)\n", result.BytesWritten, float64(result.BytesWritten)/(1024*1024))
+				if result.BytesSkipped > 0 {
+					fmt.Printf("   Bytes skipped (unchanged since base): %d (%.2f MB)\n", result.BytesSkipped, float64(result.BytesSkipped)/(1024*1024))
+				}
+				if result.BytesIdentical > 0 {
+					fmt.Printf("   Bytes skipped (identical on device): %d (%.2f MB)\n", result.BytesIdentical, float64(result.BytesIdentical)/(1024*1024))
+				}
 				fmt.Printf("   Duration: %.2fs\n", result.Duration.Seconds())
 				fmt.Printf("   Average speed: %.2f MB/s\n", result.AverageSpeed/(1024*1024))
+				if result.Checksum != "" {
+					fmt.Printf("   Image checksum: %s (matches %s)\n", result.Checksum, filepath.Base(checksumFile))
+				}
+				if s := result.Signature; s != nil {
+					fmt.Printf("   bmap signed by: %s (%s %s)\n", s.Signer, s.Scheme, s.KeyID)
+				}
+				for _, p := range result.Partitions {
+					node := p.Node
+					if node == "" {
+						node = fmt.Sprintf("#%d", p.Number)
+					}
+					fmt.Printf("   Partition %s: start %d, size %d, type %s %s\n", node, p.Start, p.Size, p.Type, p.Label)
+				}
 			}
 		}
 		return err
@@ -130,9 +163,41 @@ var copyCmd = &cobra.Command{
 
 func init() {
 	copyCmd.Flags().StringVar(&bmapFile, "bmap", "", "path to .bmap file")
+	copyCmd.Flags().StringVar(&checksumFile, "checksum-file", "", "SHA256SUMS, SHA512SUMS, .sha256 or .sha512 file listing the image (default: found next to it)")
+	copyCmd.Flags().StringVar(&imageEntry, "entry", "", "image to flash from an archive (default: see pvflasher archive ls)")
 	copyCmd.Flags().BoolVar(&force, "force", false, "allow writing to mounted devices")
 	copyCmd.Flags().BoolVar(&noVerify, "no-verify", false, "skip verification after flash")
 	copyCmd.Flags().BoolVar(&noEject, "no-eject", false, "don't eject device after flash")
+	copyCmd.Flags().BoolVar(&lazyUnmount, "lazy-unmount", false, "lazily detach busy mounts instead of failing (Linux)")
+	copyCmd.Flags().DurationVar(&partitionTimeout, "partition-timeout", 10*time.Second, "with --no-eject, how long to wait for the new partitions to appear")
+	copyCmd.Flags().BoolVar(&requireSignature, "require-signature", false, "refuse bmaps without a signature from a trusted key")
+	copyCmd.Flags().StringVar(&keyringDir, "keyring", "", "directory of trusted public keys (default ~/.pvflasher/keys)")
+	copyCmd.Flags().StringVar(&baseBmap, "base", "", "bmap of the image on the device; only ranges that changed are written")
+	copyCmd.Flags().BoolVar(&trustBase, "trust-base", false, "with --base, skip unchanged ranges without reading them back from the device")
+	copyCmd.Flags().BoolVar(&skipIdentical, "skip-identical", false, "read the device first and only write data that differs")
 	copyCmd.Flags().BoolVar(&jsonOutput, "json", false, "output progress in JSON format")
+	addDecodeFlags(copyCmd)
 	rootCmd.AddCommand(copyCmd)
 }
+
+// discoverBmap returns the bmap next to imagePath, named either
+// image.wic.zst.bmap or image.wic.bmap, or "" if there is none.
+func discoverBmap(imagePath string) string {
+	candidates := []string{
+		imagePath + ".bmap",
+	}
+
+	// If image has an extension like .gz, .bz2, etc, try removing it
+	ext := filepath.Ext(imagePath)
+	if image.HasCompressionExt(imagePath) || strings.EqualFold(ext, ".zip") {
+		base := strings.TrimSuffix(imagePath, ext)
+		candidates = append(candidates, base+".bmap")
+	}
+
+	for _, c := range candidates {
+		if _, err := os.Stat(c); err == nil {
+			return c
+		}
+	}
+	return ""
+}
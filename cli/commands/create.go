@@ -1,34 +1,101 @@
 package commands
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"os"
 
+	"github.com/schollz/progressbar/v3"
 	"github.com/spf13/cobra"
 
+	"pvflasher/internal/archive"
 	"pvflasher/internal/bmap"
+	"pvflasher/internal/fsmap"
+	"pvflasher/internal/image"
 )
 
 var outputBmap string
 var blockSize int
+var checksumType string
+var fsAware bool
+var createWorkers int
 
 var createCmd = &cobra.Command{
 	Use:   "create [image]",
 	Short: "Create a bmap file from an image",
-	Args:  cobra.ExactArgs(1),
+	Long: `Create a bmap file from an image.
+
+Raw images are scanned for holes. Compressed images (.gz, .bz2, .xz, .zst,
+.lz4, .lzma, .lz, .br) and tar archives are decompressed on the fly instead,
+and blocks that are all zeros are left out of the bmap.
+
+By default the bmap is written next to the input, named the way pvflasher
+copy and bmaptool look for it: image.wic.bmap for image.wic or image.wic.zst,
+and release.tar.gz.bmap for an archive.
+
+With --fs-aware, the partition table and the allocation bitmaps of ext2/3/4
+and FAT filesystems are read, and blocks a filesystem marks as free are left
+out even if they hold stale data. Partitions with other filesystems are
+mapped as usual.
+
+Zero detection and hashing run on all CPUs (see --workers); the bmap is the
+same whatever the number of workers.`,
+	Args: cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		imagePath := args[0]
-		
+
 		if outputBmap == "" {
-			outputBmap = imagePath + ".bmap"
+			outputBmap = defaultBmapPath(imagePath)
 		}
 
 		fmt.Printf("Creating bmap for %s...\n", imagePath)
-		
-		bm, err := bmap.Create(imagePath, bmap.CreateOptions{
-			BlockSize: blockSize,
-		})
-		if err != nil {
-			return err
+
+		opts := bmap.CreateOptions{
+			BlockSize:    blockSize,
+			ChecksumType: checksumType,
+			Workers:      createWorkers,
+		}
+		// Created on first use so it comes after the --fs-aware summary.
+		var bar *progressbar.ProgressBar
+		opts.Progress = func(read, total int64) {
+			if bar == nil {
+				bar = progressbar.DefaultBytes(-1, "reading")
+			}
+			if total > 0 && bar.GetMax64() != total {
+				bar.ChangeMax64(total)
+			}
+			bar.Set64(read)
+		}
+		var bm *bmap.Bmap
+		if archive.IsArchive(imagePath) || image.IsCompressed(imagePath) || image.IsSimgFile(imagePath) || image.IsVirtualDiskFile(imagePath) {
+			if fsAware {
+				return fmt.Errorf("--fs-aware needs a raw image to read the filesystems from; decompress %s first", imagePath)
+			}
+			src, err := openImageStream(imagePath)
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+			bm, err = bmap.CreateFromReader(src, opts)
+			if err != nil {
+				return err
+			}
+		} else {
+			var err error
+			if fsAware {
+				if opts.FreeRanges, err = scanFreeSpace(imagePath); err != nil {
+					return err
+				}
+			}
+			bm, err = bmap.Create(imagePath, opts)
+			if err != nil {
+				return err
+			}
+		}
+
+		if bar != nil {
+			bar.Finish()
 		}
 
 		if err := bm.Save(outputBmap); err != nil {
@@ -40,8 +107,133 @@ var createCmd = &cobra.Command{
 	},
 }
 
+// defaultBmapPath names the bmap for imagePath. Compressed images get the
+// name of the decompressed image plus .bmap; archives and raw images just
+// get .bmap appended.
+func defaultBmapPath(imagePath string) string {
+	if archive.IsArchive(imagePath) {
+		return imagePath + ".bmap"
+	}
+	return image.TrimCompressionExt(imagePath) + ".bmap"
+}
+
+// scanFreeSpace reads the free space of the filesystems in a raw image and
+// reports what it found for each partition.
+func scanFreeSpace(imagePath string) ([]image.ByteRange, error) {
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	filesystems, err := fsmap.Scan(f, fi.Size())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read partition table: %w", err)
+	}
+	for _, fs := range filesystems {
+		name := "filesystem"
+		if fs.Partition > 0 {
+			name = fmt.Sprintf("partition %d", fs.Partition)
+		}
+		switch {
+		case fs.Err != nil && fs.Type != "":
+			fmt.Printf("  %s (%s): %v, mapping all blocks\n", name, fs.Type, fs.Err)
+		case fs.Err != nil:
+			fmt.Printf("  %s: %v, mapping all blocks\n", name, fs.Err)
+		default:
+			fmt.Printf("  %s (%s): skipping %s of free space\n", name, fs.Type, formatSize(fs.FreeBytes()))
+		}
+	}
+	return fsmap.FreeRanges(filesystems), nil
+}
+
+// streamCloser closes the layers under a decompressed stream.
+type streamCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (s *streamCloser) Close() error {
+	var firstErr error
+	for _, c := range s.closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// openVirtualDisk returns the virtual disk in f, or nil if f is none.
+func openVirtualDisk(f *os.File) (*image.VirtualDisk, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	vd, err := image.DetectVirtualDisk(f, fi.Size())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read virtual disk: %w", err)
+	}
+	return vd, nil
+}
+
+// openImageStream returns the decompressed image data of a compressed image,
+// or of the image inside a tar archive. Android sparse images and virtual
+// disks are expanded.
+func openImageStream(path string) (io.ReadCloser, error) {
+	var raw io.ReadCloser
+	name := path
+	if archive.IsArchive(path) {
+		pair, err := archive.GetArchivePair(context.Background(), path, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to find image in archive: %w", err)
+		}
+		fmt.Printf("Using archive entry %s\n", pair.ImageEntry)
+		raw, _, err = archive.OpenArchiveImage(context.Background(), path, pair.ImageEntry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open archive entry %s: %w", pair.ImageEntry, err)
+		}
+		name = pair.ImageEntry
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		if !image.IsCompressed(path) {
+			if vd, err := openVirtualDisk(f); vd != nil || err != nil {
+				if err != nil {
+					f.Close()
+					return nil, err
+				}
+				return &streamCloser{Reader: vd, closers: []io.Closer{f}}, nil
+			}
+		}
+		raw = f
+	}
+
+	r, err := image.Decompressor(context.Background(), name, raw)
+	if err != nil {
+		raw.Close()
+		return nil, fmt.Errorf("failed to create decompressor: %w", err)
+	}
+	closers := []io.Closer{r, raw}
+	_, expanded, err := image.DetectSimg(r)
+	if err != nil {
+		(&streamCloser{closers: closers}).Close()
+		return nil, err
+	}
+	return &streamCloser{Reader: expanded, closers: closers}, nil
+}
+
 func init() {
-	createCmd.Flags().StringVarP(&outputBmap, "output", "o", "", "output bmap file (default image.bmap)")
+	createCmd.Flags().StringVarP(&outputBmap, "output", "o", "", "output bmap file (default next to the image, see above)")
 	createCmd.Flags().IntVarP(&blockSize, "block-size", "b", 4096, "block size in bytes")
+	createCmd.Flags().BoolVar(&fsAware, "fs-aware", false, "leave out blocks that ext2/3/4 and FAT filesystems mark as free")
+	createCmd.Flags().IntVarP(&createWorkers, "workers", "j", 0, "number of hashing workers (default: number of CPUs)")
+	createCmd.Flags().StringVar(&checksumType, "checksum", "sha256", "range and file checksum: sha1, sha256 or sha512")
+	addDecodeFlags(createCmd)
 	rootCmd.AddCommand(createCmd)
 }
@@ -0,0 +1,85 @@
+package commands
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+
+	"pvflasher/internal/bmap"
+)
+
+func TestDefaultBmapPath(t *testing.T) {
+	tests := map[string]string{
+		"image.wic":        "image.wic.bmap",
+		"image.wic.zst":    "image.wic.bmap",
+		"image.img.XZ":     "image.img.bmap",
+		"release.tar.gz":   "release.tar.gz.bmap",
+		"release.tgz":      "release.tgz.bmap",
+		"dir/image.img.gz": "dir/image.img.bmap",
+	}
+	for in, want := range tests {
+		if got := defaultBmapPath(in); got != want {
+			t.Errorf("defaultBmapPath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestOpenImageStream(t *testing.T) {
+	dir := t.TempDir()
+	img := append(bytes.Repeat([]byte{7}, 4096), make([]byte, 3*4096)...)
+	img = append(img, bytes.Repeat([]byte{9}, 4096)...)
+	rawPath := filepath.Join(dir, "image.wic")
+	if err := os.WriteFile(rawPath, img, 0644); err != nil {
+		t.Fatal(err)
+	}
+	want, err := bmap.Create(rawPath, bmap.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// image.wic.zst
+	var zst bytes.Buffer
+	enc, _ := zstd.NewWriter(&zst)
+	enc.Write(img)
+	enc.Close()
+	zstPath := filepath.Join(dir, "image.wic.zst")
+	if err := os.WriteFile(zstPath, zst.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// release.tar.gz holding image.wic
+	var tgz bytes.Buffer
+	gz := gzip.NewWriter(&tgz)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "image.wic", Mode: 0644, Size: int64(len(img))})
+	tw.Write(img)
+	tw.Close()
+	gz.Close()
+	tgzPath := filepath.Join(dir, "release.tar.gz")
+	if err := os.WriteFile(tgzPath, tgz.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{zstPath, tgzPath} {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			src, err := openImageStream(path)
+			if err != nil {
+				t.Fatalf("openImageStream failed: %v", err)
+			}
+			defer src.Close()
+			got, err := bmap.CreateFromReader(src, bmap.CreateOptions{})
+			if err != nil {
+				t.Fatalf("CreateFromReader failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("bmap = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
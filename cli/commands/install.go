@@ -303,6 +303,7 @@ func init() {
 	installCmd.Flags().BoolVar(&force, "force", false, "allow writing to mounted devices")
 	installCmd.Flags().BoolVar(&noVerify, "no-verify", false, "skip verification after flash")
 	installCmd.Flags().BoolVar(&noEject, "no-eject", false, "don't eject device after flash")
+	addDecodeFlags(installCmd)
 
 	rootCmd.AddCommand(installCmd)
 }
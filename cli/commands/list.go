@@ -1,45 +1,183 @@
 package commands
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"strconv"
 	"strings"
+	"text/tabwriter"
 
 	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
 
 	"pvflasher/internal/device"
 )
 
+var (
+	listOutput    string
+	listJSON      bool
+	listRemovable bool
+	listMinSize   string
+	listMaxSize   string
+	listTransport string
+)
+
 var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List available devices",
+	Long: `List available devices and their partitions.
+
+Sizes for --min-size and --max-size accept an optional K, M, G or T suffix
+(powers of 1024), e.g. --min-size 4G.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		format := listOutput
+		if listJSON {
+			format = "json"
+		}
+
+		filter := device.Filter{
+			Removable: listRemovable,
+			Transport: listTransport,
+		}
+		var err error
+		if filter.MinSize, err = parseSize(listMinSize); err != nil {
+			return fmt.Errorf("invalid --min-size: %w", err)
+		}
+		if filter.MaxSize, err = parseSize(listMaxSize); err != nil {
+			return fmt.Errorf("invalid --max-size: %w", err)
+		}
+
 		mgr := device.NewManager()
 		devs, err := mgr.List()
 		if err != nil {
 			return err
 		}
+		devs = filter.Apply(devs)
 
-		if len(devs) == 0 {
-			fmt.Println("No devices found.")
-			return nil
-		}
-
-		fmt.Println("Available devices:")
-		for _, d := range devs {
-			removable := ""
-			if d.Removable {
-				removable = "(Removable)"
+		switch format {
+		case "table":
+			return writeDeviceTable(os.Stdout, devs)
+		case "json":
+			if devs == nil {
+				devs = []device.Device{}
 			}
-			mounted := ""
-			if len(d.MountPoints) > 0 {
-				mounted = fmt.Sprintf("[Mounted: %s]", strings.Join(d.MountPoints, ", "))
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(devs)
+		case "yaml":
+			if devs == nil {
+				devs = []device.Device{}
 			}
-			fmt.Printf("- %s: %s %s %s %s [%d bytes]\n", d.Name, d.Vendor, d.Model, removable, mounted, d.Size)
+			enc := yaml.NewEncoder(os.Stdout)
+			enc.SetIndent(2)
+			defer enc.Close()
+			return enc.Encode(devs)
+		default:
+			return fmt.Errorf("unknown output format %q (want table, json or yaml)", format)
 		}
-		return nil
 	},
 }
 
+// writeDeviceTable prints devices lsblk-style, with each device's partitions
+// listed underneath it.
+func writeDeviceTable(out io.Writer, devs []device.Device) error {
+	if len(devs) == 0 {
+		_, err := fmt.Fprintln(out, "No devices found.")
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSIZE\tTYPE\tMODEL/LABEL\tMOUNTPOINT\tFLAGS")
+	for _, d := range devs {
+		var flags []string
+		if d.Removable {
+			flags = append(flags, "removable")
+		}
+		if d.ReadOnly {
+			flags = append(flags, "write-protected")
+		}
+		if len(d.MountPoints) > 0 {
+			flags = append(flags, "mounted")
+		}
+		model := strings.TrimSpace(d.Vendor + " " + d.Model)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t\t%s\n",
+			d.Name, formatSize(d.Size), orDash(d.Transport), orDash(model), strings.Join(flags, ","))
+
+		for i, p := range d.Partitions {
+			branch := "├─"
+			if i == len(d.Partitions)-1 {
+				branch = "└─"
+			}
+			fmt.Fprintf(w, "%s%s\t%s\t%s\t%s\t%s\t\n",
+				branch, p.Name, formatSize(p.Size), orDash(p.FSType), p.Label, p.MountPoint)
+		}
+	}
+	return w.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// formatSize renders a byte count with a binary unit, e.g. "14.9G".
+func formatSize(size int64) string {
+	const units = "KMGTP"
+	if size < 1024 {
+		return fmt.Sprintf("%dB", size)
+	}
+	value := float64(size)
+	unit := -1
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f%c", value, units[unit])
+}
+
+// parseSize parses a byte count with an optional K/M/G/T suffix (powers of
+// 1024, an optional trailing "B" or "iB" is ignored). An empty string is 0.
+func parseSize(arg string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(arg))
+	if s == "" {
+		return 0, nil
+	}
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+
+	shift := 0
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			shift = 10
+		case 'M':
+			shift = 20
+		case 'G':
+			shift = 30
+		case 'T':
+			shift = 40
+		}
+		if shift > 0 {
+			s = s[:n-1]
+		}
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("%q is not a size", arg)
+	}
+	return int64(value * float64(int64(1)<<shift)), nil
+}
+
 func init() {
+	listCmd.Flags().StringVarP(&listOutput, "output", "o", "table", "output format: table, json or yaml")
+	listCmd.Flags().BoolVar(&listJSON, "json", false, "output JSON (same as --output json)")
+	listCmd.Flags().BoolVar(&listRemovable, "removable", false, "only list removable devices")
+	listCmd.Flags().StringVar(&listMinSize, "min-size", "", "only list devices of at least this size")
+	listCmd.Flags().StringVar(&listMaxSize, "max-size", "", "only list devices of at most this size")
+	listCmd.Flags().StringVar(&listTransport, "transport", "", "only list devices on this bus (usb, mmc, sata, nvme, ...)")
 	rootCmd.AddCommand(listCmd)
 }
@@ -0,0 +1,102 @@
+package commands
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"pvflasher/internal/device"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"", 0},
+		{"4096", 4096},
+		{"512K", 512 << 10},
+		{"8m", 8 << 20},
+		{"4G", 4 << 30},
+		{"4GB", 4 << 30},
+		{"4GiB", 4 << 30},
+		{"1.5G", 3 << 29},
+		{"2T", 2 << 40},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.in)
+		if err != nil {
+			t.Errorf("parseSize(%q) error: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseSize(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"G", "abc", "-1G"} {
+		if _, err := parseSize(bad); err == nil {
+			t.Errorf("parseSize(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := map[int64]string{
+		512:       "512B",
+		1536:      "1.5K",
+		256 << 20: "256.0M",
+		16 * 1e9:  "14.9G",
+		3 << 40:   "3.0T",
+	}
+	for in, want := range tests {
+		if got := formatSize(in); got != want {
+			t.Errorf("formatSize(%d) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestWriteDeviceTable(t *testing.T) {
+	devs := []device.Device{{
+		Name:        "/dev/sdb",
+		Size:        16 << 30,
+		Vendor:      "SanDisk",
+		Model:       "Ultra",
+		Transport:   "usb",
+		Removable:   true,
+		MountPoints: []string{"/media/user/boot"},
+		Partitions: []device.Partition{
+			{Name: "/dev/sdb1", Size: 256 << 20, FSType: "vfat", Label: "boot", MountPoint: "/media/user/boot"},
+			{Name: "/dev/sdb2", Size: 4 << 30, FSType: "ext4", Label: "root"},
+		},
+	}}
+
+	var buf bytes.Buffer
+	if err := writeDeviceTable(&buf, devs); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("got %d lines, want 4:\n%s", len(lines), buf.String())
+	}
+	for i, want := range [][]string{
+		{"NAME", "SIZE", "TYPE", "MOUNTPOINT"},
+		{"/dev/sdb", "16.0G", "usb", "SanDisk Ultra", "removable,mounted"},
+		{"├─/dev/sdb1", "256.0M", "vfat", "boot", "/media/user/boot"},
+		{"└─/dev/sdb2", "4.0G", "ext4", "root"},
+	} {
+		for _, field := range want {
+			if !strings.Contains(lines[i], field) {
+				t.Errorf("line %d = %q, missing %q", i, lines[i], field)
+			}
+		}
+	}
+
+	buf.Reset()
+	if err := writeDeviceTable(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != "No devices found.\n" {
+		t.Errorf("empty table = %q", got)
+	}
+}
@@ -0,0 +1,272 @@
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/schollz/progressbar/v3"
+	"github.com/spf13/cobra"
+
+	"pvflasher/internal/archive"
+	"pvflasher/internal/bmap"
+	"pvflasher/internal/image"
+)
+
+var packOutput string
+var packCompression string
+var packLevel int
+var packFrameSize string
+var packSums bool
+
+// packExts are the extensions pack gives its output.
+var packExts = map[string]string{
+	"zstd": ".zst",
+	"xz":   ".xz",
+	"gz":   ".gz",
+}
+
+// sumsFile is the name of the checksum file pack --sha256sums writes.
+const sumsFile = "SHA256SUMS"
+
+var packCmd = &cobra.Command{
+	Use:   "pack [image]",
+	Short: "Compress a raw image for random access and create its bmap",
+	Long: `Compress a raw image for random access and create its bmap.
+
+The image is read once: the compressed image and the bmap, and with
+--sha256sums the checksums of both, are made in the same pass.
+
+The image is compressed in frames that decode on their own (4 MiB by
+default, see --frame-size), so pvflasher copy can jump straight to each range
+of the bmap instead of decompressing the gaps between them:
+
+  zstd  the zstd seekable format: zstd frames followed by a seek table
+  xz    one xz block per frame, found through the xz index
+  gz    a gzip file with a sync flush after every frame, and an index of
+        the frames in image.gz.zran next to it
+
+Every zstd, xz and gzip decoder still reads the output as a stream.
+
+The output is named after the image with the compression extension, like
+image.wic.zst, and the bmap after the image, like image.wic.bmap, which is
+where pvflasher copy and bmaptool look for it. The bmap maps the same blocks
+as pvflasher create would.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		imagePath := args[0]
+		if archive.IsArchive(imagePath) || image.IsCompressed(imagePath) || image.IsSimgFile(imagePath) || image.IsVirtualDiskFile(imagePath) {
+			return fmt.Errorf("%s isn't a raw image; decompress it first", imagePath)
+		}
+		ext, ok := packExts[packCompression]
+		if !ok {
+			return fmt.Errorf("unknown compression %q; use zstd, xz or gz", packCompression)
+		}
+		frameSize, err := parseSize(packFrameSize)
+		if err != nil {
+			return fmt.Errorf("invalid --frame-size: %w", err)
+		}
+		if packOutput == "" {
+			packOutput = imagePath + ext
+		}
+
+		opts := packOptions{
+			output:      packOutput,
+			bmapPath:    image.TrimCompressionExt(packOutput) + ".bmap",
+			compression: packCompression,
+			level:       packLevel,
+			frameSize:   int(frameSize),
+			bmap: bmap.CreateOptions{
+				BlockSize:    blockSize,
+				ChecksumType: checksumType,
+				Workers:      createWorkers,
+			},
+		}
+		if fsAware {
+			if opts.bmap.FreeRanges, err = scanFreeSpace(imagePath); err != nil {
+				return err
+			}
+		}
+
+		fi, err := os.Stat(imagePath)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Packing %s...\n", imagePath)
+		var bar *progressbar.ProgressBar
+		opts.bmap.Progress = func(read, total int64) {
+			if bar == nil {
+				bar = progressbar.DefaultBytes(fi.Size(), "packing")
+			}
+			bar.Set64(read)
+		}
+		files, err := packImage(imagePath, opts)
+		if bar != nil {
+			bar.Finish()
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Seekable image created: %s\n", opts.output)
+		if opts.compression == "gz" {
+			fmt.Printf("Index created: %s\n", opts.output+image.ZranExt)
+		}
+		fmt.Printf("Bmap file created: %s\n", opts.bmapPath)
+
+		if packSums {
+			sumsPath := filepath.Join(filepath.Dir(opts.output), sumsFile)
+			if err := updateSums(sumsPath, files); err != nil {
+				return fmt.Errorf("failed to write %s: %w", sumsPath, err)
+			}
+			fmt.Printf("Checksums written: %s\n", sumsPath)
+		}
+		return nil
+	},
+}
+
+func init() {
+	packCmd.Flags().StringVarP(&packOutput, "output", "o", "", "output image (default: the image with the compression extension)")
+	packCmd.Flags().StringVarP(&packCompression, "compression", "c", "zstd", "compression: zstd, xz or gz")
+	packCmd.Flags().IntVarP(&packLevel, "level", "l", 0, "compression level: 1-22 for zstd, 1-9 for xz and gz (default 3 for zstd, 6 for xz and gz)")
+	packCmd.Flags().StringVar(&packFrameSize, "frame-size", "4M", "amount of data in each independently decodable frame")
+	packCmd.Flags().BoolVar(&packSums, "sha256sums", false, "also add the checksums of the outputs to SHA256SUMS next to them")
+	packCmd.Flags().IntVarP(&blockSize, "block-size", "b", 4096, "bmap block size in bytes")
+	packCmd.Flags().StringVar(&checksumType, "checksum", "sha256", "bmap range and file checksum: sha1, sha256 or sha512")
+	packCmd.Flags().BoolVar(&fsAware, "fs-aware", false, "leave blocks that ext2/3/4 and FAT filesystems mark as free out of the bmap")
+	packCmd.Flags().IntVarP(&createWorkers, "workers", "j", 0, "goroutines scanning for zero blocks and hashing ranges (default: number of CPUs)")
+	rootCmd.AddCommand(packCmd)
+}
+
+// packOptions says what packImage writes.
+type packOptions struct {
+	output      string
+	bmapPath    string
+	compression string // zstd, xz or gz
+	level       int    // 0 for the default of the compression
+	frameSize   int
+	bmap        bmap.CreateOptions
+}
+
+// packedFile is a file packImage wrote, with its SHA-256.
+type packedFile struct {
+	path string
+	sum  [sha256.Size]byte
+}
+
+// packImage compresses the raw image at imagePath into opts.output in
+// frames, and writes the .zran index for gzip and the bmap, all while
+// reading the image once. It returns the files it wrote.
+func packImage(imagePath string, opts packOptions) ([]packedFile, error) {
+	in, err := os.Open(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	// The image is written under another name until it is complete, so a
+	// failure doesn't leave a truncated image or destroy an older one.
+	partial := opts.output + ".partial"
+	out, err := os.Create(partial)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(partial)
+	defer out.Close()
+	outSum := sha256.New()
+	w, err := image.NewSeekableWriter(io.MultiWriter(out, outSum), opts.compression, opts.frameSize, opts.level)
+	if err != nil {
+		return nil, err
+	}
+
+	// The bmap is built from what the compressor reads. It comes out as
+	// from bmap.Create, since holes read as zeros and zero blocks are left
+	// out either way.
+	bm, err := bmap.CreateFromReader(io.TeeReader(in, w), opts.bmap)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack %s: %w", imagePath, err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress %s: %w", imagePath, err)
+	}
+	if err := out.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(partial, opts.output); err != nil {
+		return nil, err
+	}
+	files := []packedFile{{path: opts.output}}
+	copy(files[0].sum[:], outSum.Sum(nil))
+
+	if opts.compression == "gz" {
+		var index bytes.Buffer
+		if err := w.WriteIndex(&index); err != nil {
+			return nil, err
+		}
+		f, err := writePacked(opts.output+image.ZranExt, index.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	data, err := bm.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	f, err := writePacked(opts.bmapPath, data)
+	if err != nil {
+		return nil, err
+	}
+	return append(files, f), nil
+}
+
+// writePacked writes data to path and returns it with its SHA-256.
+func writePacked(path string, data []byte) (packedFile, error) {
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return packedFile{}, err
+	}
+	return packedFile{path: path, sum: sha256.Sum256(data)}, nil
+}
+
+// updateSums adds the checksums of files to the SHA256SUMS file at path, in
+// the format of sha256sum, replacing the lines of files of the same name and
+// keeping the others. The files are named relative to path's directory.
+func updateSums(path string, files []packedFile) error {
+	dir := filepath.Dir(path)
+	names := make(map[string]bool)
+	var lines []string
+	for _, f := range files {
+		name, err := filepath.Rel(dir, f.path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		names[name] = true
+		lines = append(lines, fmt.Sprintf("%x  %s", f.sum, name))
+	}
+
+	var kept []string
+	if old, err := os.Open(path); err == nil {
+		sc := bufio.NewScanner(old)
+		for sc.Scan() {
+			// "<sum>  <name>", or "<sum> *<name>" in binary mode
+			line := sc.Text()
+			if len(line) > 2*sha256.Size+2 && names[line[2*sha256.Size+2:]] {
+				continue
+			}
+			kept = append(kept, line)
+		}
+		old.Close()
+		if err := sc.Err(); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return os.WriteFile(path, []byte(strings.Join(append(kept, lines...), "\n")+"\n"), 0644)
+}
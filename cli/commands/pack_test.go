@@ -0,0 +1,122 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"pvflasher/internal/bmap"
+	"pvflasher/internal/image"
+)
+
+func TestPackImage(t *testing.T) {
+	dir := t.TempDir()
+	img := append(bytes.Repeat([]byte{7}, 100000), make([]byte, 200000)...)
+	img = append(img, bytes.Repeat([]byte{9}, 50000)...)
+	rawPath := filepath.Join(dir, "image.wic")
+	if err := os.WriteFile(rawPath, img, 0644); err != nil {
+		t.Fatal(err)
+	}
+	want, err := bmap.Create(rawPath, bmap.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantBmap, _ := want.Marshal()
+
+	for compression, ext := range packExts {
+		t.Run(compression, func(t *testing.T) {
+			opts := packOptions{
+				output:      filepath.Join(dir, "out", "image.wic"+ext),
+				bmapPath:    filepath.Join(dir, "out", "image.wic.bmap"),
+				compression: compression,
+				level:       1,
+				frameSize:   64 << 10,
+			}
+			os.MkdirAll(filepath.Dir(opts.output), 0755)
+			files, err := packImage(rawPath, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s, err := image.OpenSeekable(opts.output)
+			if err != nil || s == nil {
+				t.Fatalf("OpenSeekable = %v, %v", s, err)
+			}
+			defer s.Close()
+			if s.Frames() != 6 {
+				t.Errorf("%d frames, want 6", s.Frames())
+			}
+			got, err := io.ReadAll(s)
+			if err != nil || !bytes.Equal(got, img) {
+				t.Errorf("read back %d bytes, err %v", len(got), err)
+			}
+
+			// The bmap is the one bmap.Create makes.
+			if gotBmap, _ := os.ReadFile(opts.bmapPath); !bytes.Equal(gotBmap, wantBmap) {
+				t.Errorf("bmap differs from bmap.Create's:\n%s", gotBmap)
+			}
+
+			wantFiles := 2
+			if compression == "gz" {
+				wantFiles = 3
+			}
+			if len(files) != wantFiles {
+				t.Fatalf("packImage returned %d files, want %d", len(files), wantFiles)
+			}
+			for _, f := range files {
+				data, err := os.ReadFile(f.path)
+				if err != nil || sha256.Sum256(data) != f.sum {
+					t.Errorf("%s: wrong checksum (%v)", f.path, err)
+				}
+			}
+		})
+	}
+}
+
+func TestPackImage_InvalidLevel(t *testing.T) {
+	dir := t.TempDir()
+	rawPath := filepath.Join(dir, "image.wic")
+	if err := os.WriteFile(rawPath, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := packImage(rawPath, packOptions{
+		output:      rawPath + ".gz",
+		bmapPath:    rawPath + ".bmap",
+		compression: "gz",
+		level:       10,
+	})
+	if err == nil || !strings.Contains(err.Error(), "level") {
+		t.Errorf("err = %v, want an invalid level error", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d files in the output directory, want only the image", len(entries))
+	}
+}
+
+func TestUpdateSums(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, sumsFile)
+	old := fmt.Sprintf("%x  other.img.zst\n%x *image.wic.zst\n", sha256.Sum256([]byte("other")), sha256.Sum256([]byte("old")))
+	if err := os.WriteFile(path, []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []packedFile{
+		{path: filepath.Join(dir, "image.wic.zst"), sum: sha256.Sum256([]byte("new"))},
+		{path: filepath.Join(dir, "image.wic.bmap"), sum: sha256.Sum256([]byte("bmap"))},
+	}
+	if err := updateSums(path, files); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(path)
+	want := fmt.Sprintf("%x  other.img.zst\n%x  image.wic.zst\n%x  image.wic.bmap\n",
+		sha256.Sum256([]byte("other")), sha256.Sum256([]byte("new")), sha256.Sum256([]byte("bmap")))
+	if string(got) != want {
+		t.Errorf("SHA256SUMS =\n%s\nwant\n%s", got, want)
+	}
+}
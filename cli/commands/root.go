@@ -5,6 +5,7 @@ import (
 	"os"
 
 	"github.com/spf13/cobra"
+	"pvflasher/internal/image"
 	"pvflasher/internal/version"
 )
 
@@ -24,8 +25,8 @@ func RootCmd() *cobra.Command {
 }
 
 // RegisterCommands adds all pvflasher subcommands (copy, list, verify,
-// create, install) to a parent cobra command. This is the recommended
-// way for external tools to integrate pvflasher capabilities.
+// create, pack, bmap, archive, install) to a parent cobra command. This is the
+// recommended way for external tools to integrate pvflasher capabilities.
 //
 // Example:
 //
@@ -38,6 +39,9 @@ func RegisterCommands(parent *cobra.Command) {
 	parent.AddCommand(listCmd)
 	parent.AddCommand(verifyCmd)
 	parent.AddCommand(createCmd)
+	parent.AddCommand(packCmd)
+	parent.AddCommand(bmapCmd)
+	parent.AddCommand(archiveCmd)
 	parent.AddCommand(installCmd)
 	parent.AddCommand(downloadCmd)
 }
@@ -51,3 +55,8 @@ func Execute() {
 		os.Exit(1)
 	}
 }
+
+// addDecodeFlags adds the flags of commands that decompress images to cmd.
+func addDecodeFlags(cmd *cobra.Command) {
+	cmd.Flags().IntVar(&image.DecodeWorkers, "decode-workers", 0, "number of goroutines decoding xz and zstd images (default: number of CPUs, at most 8)")
+}
@@ -41,5 +41,6 @@ var verifyCmd = &cobra.Command{
 }
 
 func init() {
+	addDecodeFlags(verifyCmd)
 	rootCmd.AddCommand(verifyCmd)
 }
@@ -16,6 +16,9 @@ import (
 	"pvflasher/gui/pantavisor"
 	"pvflasher/gui/screens"
 	"pvflasher/gui/util"
+	"pvflasher/internal/archive"
+	"pvflasher/internal/checksum"
+	"pvflasher/internal/image"
 	"pvflasher/pkg/flash"
 
 	"fyne.io/fyne/v2"
@@ -43,11 +46,15 @@ type App struct {
 
 	// User selections
 	selectedImage  string
+	imageEntry     string // Image to flash from an archive, "" for the default
 	selectedDevice string
 	bmapPath       string
+	checksumPath   string // SHA256SUMS or the like listing selectedImage
 	forceChecked   bool
 	verifyChecked  bool
 	ejectChecked   bool
+	requireSigned  bool
+	skipIdentical  bool
 
 	// Screen state
 	mainContent     fyne.CanvasObject
@@ -183,8 +190,12 @@ func (a *App) buildMainView() {
 	a.imageCard = cards.NewImageCard(a.window, cards.ImageCardCallbacks{
 		OnLocalImageSelected: func(path string) {
 			a.SetSelectedImage(path)
+			a.SetImageEntry("")
 			a.selectedRel = nil // Clear any Pantavisor selection
 			a.updateFlashButtonState()
+			if archive.IsArchive(path) {
+				go a.loadArchiveEntries(path)
+			}
 		},
 		OnPantavisorSelected: func(rel *pantavisor.DeviceRelease) {
 			a.mu.Lock()
@@ -193,7 +204,8 @@ func (a *App) buildMainView() {
 			a.mu.Unlock()
 			a.updateFlashButtonState()
 		},
-		CheckBmapStatus: a.checkBmapStatus,
+		CheckBmapStatus:        a.checkBmapStatus,
+		OnArchiveEntrySelected: a.SetImageEntry,
 	})
 	imageCardUI := a.imageCard.Build()
 
@@ -215,7 +227,14 @@ func (a *App) buildMainView() {
 		OnForceChanged:  func(b bool) { a.SetForceChecked(b) },
 		OnVerifyChanged: func(b bool) { a.SetVerifyChecked(b) },
 		OnEjectChanged:  func(b bool) { a.SetEjectChecked(b) },
-		OnStartFlash:    func() { a.startFlash() },
+		OnRequireSignatureChanged: func(b bool) {
+			a.SetRequireSignature(b)
+			if b {
+				a.optionsCard.VerifyCheck.SetChecked(true)
+			}
+		},
+		OnSkipIdenticalChanged: func(b bool) { a.SetSkipIdentical(b) },
+		OnStartFlash:           func() { a.startFlash() },
 	})
 	optionsCardUI := a.optionsCard.Build()
 
@@ -390,8 +409,10 @@ func (a *App) updateFlashButtonState() {
 func (a *App) resetToMainView() {
 	a.mu.Lock()
 	a.selectedImage = ""
+	a.imageEntry = ""
 	a.selectedDevice = ""
 	a.bmapPath = ""
+	a.checksumPath = ""
 	a.selectedRel = nil
 	a.mu.Unlock()
 
@@ -413,6 +434,7 @@ func (a *App) resetToMainView() {
 func (a *App) rebuildAllViews() {
 	// Store current state
 	selectedImage := a.selectedImage
+	imageEntry := a.imageEntry
 	selectedDevice := a.selectedDevice
 	bmapPath := a.bmapPath
 
@@ -424,12 +446,16 @@ func (a *App) rebuildAllViews() {
 
 	// Restore state
 	a.selectedImage = selectedImage
+	a.imageEntry = imageEntry
 	a.selectedDevice = selectedDevice
 	a.bmapPath = bmapPath
 
 	// Update UI labels if needed
 	if selectedImage != "" && a.imageCard != nil {
 		a.imageCard.SelectedImageLabel.SetText(fmt.Sprintf("📁 %s", filepath.Base(selectedImage)))
+		if archive.IsArchive(selectedImage) {
+			go a.loadArchiveEntries(selectedImage)
+		}
 	}
 	if selectedDevice != "" && a.deviceCard != nil {
 		a.deviceCard.SelectedDeviceLabel.SetText(selectedDevice)
@@ -470,12 +496,42 @@ func (a *App) showErrorScreen() {
 
 // checkBmapStatus checks for bmap file and returns status string
 func (a *App) checkBmapStatus(imagePath string) string {
-	bmapPath := a.CheckBmap(imagePath)
-	if bmapPath != "" {
+	status := "💡 No bmap file found (will use full image)"
+	if bmapPath := a.CheckBmap(imagePath); bmapPath != "" {
 		a.SetBmapPath(bmapPath)
-		return fmt.Sprintf("✅ Found: %s", filepath.Base(bmapPath))
+		status = fmt.Sprintf("✅ Found: %s", filepath.Base(bmapPath))
 	}
-	return "💡 No bmap file found (will use full image)"
+	if sums := checksum.Find(imagePath); sums != "" {
+		status += fmt.Sprintf("\n🔒 Checksum in %s", filepath.Base(sums))
+	}
+	return status
+}
+
+// loadArchiveEntries lists the images of the archive at path and offers
+// them in the image card, picking the one selected before or else the one
+// the flasher would pick.
+func (a *App) loadArchiveEntries(path string) {
+	images, err := archive.ListImages(context.Background(), path)
+	if err != nil || len(images) == 0 {
+		return
+	}
+	entries := make([]string, len(images))
+	for i, img := range images {
+		entries[i] = img.Name
+	}
+
+	fyne.Do(func() {
+		a.mu.Lock()
+		current, selected := a.selectedImage, a.imageEntry
+		a.mu.Unlock()
+		if current != path {
+			return // Another image was selected meanwhile
+		}
+		if selected == "" {
+			selected = entries[0]
+		}
+		a.imageCard.SetArchiveEntries(entries, selected)
+	})
 }
 
 // CheckBmap returns the path of the auto-discovered bmap file
@@ -485,11 +541,11 @@ func (a *App) CheckBmap(imagePath string) string {
 	}
 
 	ext := filepath.Ext(imagePath)
-	switch strings.ToLower(ext) {
-	case ".gz", ".bz2", ".xz", ".zst", ".zstd", ".zip":
+	switch {
+	case image.HasCompressionExt(imagePath) || strings.EqualFold(ext, ".zip"):
 		base := strings.TrimSuffix(imagePath, ext)
 		candidates = append(candidates, base+".bmap")
-	case ".tar":
+	case strings.EqualFold(ext, ".tar"):
 		candidates = append(candidates, imagePath+".bmap")
 	}
 
@@ -560,6 +616,12 @@ func (a *App) SetSelectedImage(path string) {
 	a.selectedImage = path
 }
 
+func (a *App) SetImageEntry(entry string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.imageEntry = entry
+}
+
 func (a *App) SetSelectedDevice(path string) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
@@ -589,3 +651,15 @@ func (a *App) SetEjectChecked(checked bool) {
 	defer a.mu.Unlock()
 	a.ejectChecked = checked
 }
+
+func (a *App) SetRequireSignature(checked bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.requireSigned = checked
+}
+
+func (a *App) SetSkipIdentical(checked bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.skipIdentical = checked
+}
@@ -120,6 +120,9 @@ func (c *DeviceCard) RefreshDeviceList() {
 		if len(d.MountPoints) > 0 {
 			warning = " ⚠️ MOUNTED"
 		}
+		if d.ReadOnly {
+			warning += " 🔒 WRITE-PROTECTED"
+		}
 
 		sizeStr := fmt.Sprintf("%.0f GB", float64(d.Size)/1e9)
 		options = append(options, fmt.Sprintf("%s (%s - %s)%s", d.Name, d.Vendor, sizeStr, warning))
@@ -21,6 +21,9 @@ type ImageCardCallbacks struct {
 	OnLocalImageSelected func(path string)
 	OnPantavisorSelected func(rel *pantavisor.DeviceRelease)
 	CheckBmapStatus      func(path string) string
+	// OnArchiveEntrySelected is called when an image is picked from the
+	// images of an archive, see SetArchiveEntries.
+	OnArchiveEntrySelected func(entry string)
 }
 
 // ImageCard represents the image selection card
@@ -31,6 +34,8 @@ type ImageCard struct {
 	// Widgets
 	SelectedImageLabel *util.ColoredLabel
 	bmapStatusLabel    *util.ColoredLabel
+	archiveSelect      *widget.Select
+	archiveBox         *fyne.Container
 	ChannelSelect      *widget.Select
 	VersionSelect      *widget.Select
 	DeviceSelect       *widget.Select
@@ -59,12 +64,25 @@ func (c *ImageCard) Build() fyne.CanvasObject {
 	// --- Tab 1: Local File ---
 	c.SelectedImageLabel = util.NewThemedLabelBold("No image selected")
 	c.bmapStatusLabel = util.NewColoredLabel("", util.CurrentSecondaryTextColor())
+	c.archiveSelect = widget.NewSelect([]string{}, func(entry string) {
+		if entry != "" && c.callbacks.OnArchiveEntrySelected != nil {
+			c.callbacks.OnArchiveEntrySelected(entry)
+		}
+	})
+	c.archiveBox = container.NewVBox(
+		util.SectionSpacer(12),
+		util.InstructionLabel("Image in archive:"),
+		util.SectionSpacer(4),
+		util.TallSelect(c.archiveSelect),
+	)
+	c.archiveBox.Hide()
 
 	selectButton := util.PrimaryActionButton("Browse Local File", func() {
 		fileDialog := dialog.NewFileOpen(func(uri fyne.URIReadCloser, err error) {
 			if err == nil && uri != nil {
 				path := uri.URI().Path()
 				c.SelectedImageLabel.SetText(fmt.Sprintf("📁 %s", filepath.Base(path)))
+				c.SetArchiveEntries(nil, "")
 				if c.callbacks.CheckBmapStatus != nil {
 					c.bmapStatusLabel.SetText(c.callbacks.CheckBmapStatus(path))
 				}
@@ -74,7 +92,7 @@ func (c *ImageCard) Build() fyne.CanvasObject {
 				uri.Close()
 			}
 		}, c.window)
-		fileDialog.SetFilter(storage.NewExtensionFileFilter([]string{".img", ".iso", ".wic", ".gz", ".bz2", ".xz", ".zst", ".zip", ".tar", ".tgz"}))
+		fileDialog.SetFilter(storage.NewExtensionFileFilter([]string{".img", ".iso", ".wic", ".simg", ".qcow2", ".vhd", ".vmdk", ".gz", ".bz2", ".xz", ".zst", ".lz4", ".lzma", ".lz", ".br", ".zip", ".tar", ".tgz"}))
 		fileDialog.Resize(fyne.NewSize(1200, 700))
 		fileDialog.Show()
 	})
@@ -85,6 +103,7 @@ func (c *ImageCard) Build() fyne.CanvasObject {
 		util.SectionSpacer(12),
 		c.SelectedImageLabel,
 		c.bmapStatusLabel,
+		c.archiveBox,
 	)
 
 	// --- Tab 2: Pantavisor Download ---
@@ -297,10 +316,25 @@ func (c *ImageCard) onDeviceSelected(deviceName string) {
 	}
 }
 
+// SetArchiveEntries offers to pick one of entries, the images of the
+// archive selected, with selected picked. It shows the picker only when
+// there is a choice.
+func (c *ImageCard) SetArchiveEntries(entries []string, selected string) {
+	c.archiveSelect.Options = entries
+	c.archiveSelect.ClearSelected()
+	c.archiveSelect.SetSelected(selected)
+	if len(entries) > 1 {
+		c.archiveBox.Show()
+	} else {
+		c.archiveBox.Hide()
+	}
+}
+
 // Reset clears the card state
 func (c *ImageCard) Reset() {
 	c.SelectedImageLabel.SetText("No image selected")
 	c.bmapStatusLabel.SetText("")
+	c.SetArchiveEntries(nil, "")
 
 	c.mu.Lock()
 	c.SelectedRel = nil
@@ -13,7 +13,11 @@ type OptionsCardCallbacks struct {
 	OnForceChanged  func(checked bool)
 	OnVerifyChanged func(checked bool)
 	OnEjectChanged  func(checked bool)
-	OnStartFlash    func()
+	// OnRequireSignatureChanged is called when the signed bmap option changes
+	OnRequireSignatureChanged func(checked bool)
+	// OnSkipIdenticalChanged is called when the skip identical writes option changes
+	OnSkipIdenticalChanged func(checked bool)
+	OnStartFlash           func()
 }
 
 // OptionsCard represents the flash options card
@@ -24,7 +28,10 @@ type OptionsCard struct {
 	ForceCheck  *widget.Check
 	VerifyCheck *widget.Check
 	EjectCheck  *widget.Check
-	FlashButton *widget.Button
+	SignedCheck *widget.Check
+	// SkipIdenticalCheck only writes what differs from the device
+	SkipIdenticalCheck *widget.Check
+	FlashButton        *widget.Button
 }
 
 // NewOptionsCard creates a new flash options card
@@ -60,6 +67,18 @@ func (c *OptionsCard) Build() fyne.CanvasObject {
 	})
 	c.EjectCheck.SetChecked(true)
 
+	c.SignedCheck = widget.NewCheck("Require signed bmap", func(b bool) {
+		if c.callbacks.OnRequireSignatureChanged != nil {
+			c.callbacks.OnRequireSignatureChanged(b)
+		}
+	})
+
+	c.SkipIdenticalCheck = widget.NewCheck("Only write blocks that changed", func(b bool) {
+		if c.callbacks.OnSkipIdenticalChanged != nil {
+			c.callbacks.OnSkipIdenticalChanged(b)
+		}
+	})
+
 	c.FlashButton = util.PrimaryActionButton("Start Flash", func() {
 		if c.callbacks.OnStartFlash != nil {
 			c.callbacks.OnStartFlash()
@@ -82,6 +101,10 @@ func (c *OptionsCard) Build() fyne.CanvasObject {
 		c.VerifyCheck,
 		util.SectionSpacer(12),
 		c.EjectCheck,
+		util.SectionSpacer(12),
+		c.SignedCheck,
+		util.SectionSpacer(12),
+		c.SkipIdenticalCheck,
 	)
 
 	// Use border to place button at bottom with full width
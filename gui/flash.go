@@ -14,9 +14,11 @@ import (
 
 	"pvflasher/gui/pantavisor"
 	"pvflasher/gui/util"
+	"pvflasher/internal/checksum"
 	"pvflasher/internal/device"
 	"pvflasher/pkg/flash"
 	"pvflasher/internal/platform"
+	"pvflasher/internal/signature"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/dialog"
@@ -92,6 +94,7 @@ func (a *App) proceedWithFlash() {
 		if a.bmapPath == "" {
 			a.bmapPath = a.CheckBmap(a.selectedImage)
 		}
+		a.checksumPath = checksum.Find(a.selectedImage)
 		a.mu.Unlock()
 
 		if platform.IsRoot() {
@@ -152,6 +155,7 @@ func (a *App) downloadThenFlash(rel *pantavisor.DeviceRelease) {
 	a.mu.Lock()
 	a.selectedImage = cachedPath
 	a.bmapPath = a.CheckBmap(cachedPath)
+	a.checksumPath = "" // Checked against the release while downloading
 	a.mu.Unlock()
 
 	// Reset progress for flash phase
@@ -177,11 +181,16 @@ func (a *App) runInProcessFlash() {
 
 	opts := flash.Options{
 		ImagePath:  a.selectedImage,
+		ImageEntry: a.imageEntry,
 		DevicePath: a.selectedDevice,
 		BmapPath:   a.bmapPath,
 		Force:      a.forceChecked,
 		NoVerify:   !a.verifyChecked,
 		NoEject:    !a.ejectChecked,
+		// Signature checks use the user's keyring, see buildFlashArgs
+		RequireSignature: a.requireSigned,
+		SkipIdentical:    a.skipIdentical,
+		ChecksumPath:     a.checksumPath,
 		ProgressCb: func(p flash.Progress) {
 			a.updateProgressUI(p)
 		},
@@ -203,6 +212,12 @@ func (a *App) buildFlashArgs() []string {
 	if a.bmapPath != "" {
 		args = append(args, "--bmap", a.bmapPath)
 	}
+	if a.imageEntry != "" {
+		args = append(args, "--entry", a.imageEntry)
+	}
+	if a.checksumPath != "" {
+		args = append(args, "--checksum-file", a.checksumPath)
+	}
 	if a.forceChecked {
 		args = append(args, "--force")
 	}
@@ -212,6 +227,17 @@ func (a *App) buildFlashArgs() []string {
 	if !a.ejectChecked {
 		args = append(args, "--no-eject")
 	}
+	// The elevated child runs as root, so point it at the user's keyring
+	// rather than root's.
+	if dir := signature.DefaultKeyringDir(); dir != "" {
+		args = append(args, "--keyring", dir)
+	}
+	if a.requireSigned {
+		args = append(args, "--require-signature")
+	}
+	if a.skipIdentical {
+		args = append(args, "--skip-identical")
+	}
 	return args
 }
 
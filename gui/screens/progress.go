@@ -95,11 +95,12 @@ func (s *ProgressScreen) Build() fyne.CanvasObject {
 
 // indeterminatePhase reports the trailing, byte-less phases where a determinate
 // bar/speed would sit static (syncing flushes the page cache to the device in
-// one blocking call; ejecting is instant). These get the animated bar. The
-// writing/verifying phases have a known total and keep the normal bar.
+// one blocking call; rescanning waits for the new partitions; ejecting is
+// instant). These get the animated bar. The writing/verifying phases have a
+// known total and keep the normal bar.
 func indeterminatePhase(phase string) bool {
 	switch phase {
-	case "syncing", "ejecting":
+	case "syncing", "rescanning", "ejecting":
 		return true
 	}
 	return false
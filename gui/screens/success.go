@@ -149,6 +149,12 @@ func (s *SuccessScreen) UpdateStats(result *flash.FlashResult) {
 		}
 		s.statsGrid.Add(s.createStatCard("Verification", verification))
 
+		// Row 4, when some data was already on the device
+		if skipped := result.BytesSkipped + result.BytesIdentical; skipped > 0 {
+			s.statsGrid.Add(s.createStatCard("Already on Device", util.FormatBytes(skipped)))
+			s.statsGrid.Add(s.createStatCard("Writes Saved", fmt.Sprintf("%.0f%%", float64(skipped)/float64(skipped+result.BytesWritten)*100)))
+		}
+
 		s.statsGrid.Refresh()
 	})
 }
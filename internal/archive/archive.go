@@ -1,156 +1,190 @@
 package archive
 
 import (
-	"archive/tar"
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"pvflasher/internal/bmap"
 	"pvflasher/internal/image"
+	"pvflasher/internal/signature"
 )
 
-// IsArchive checks if the path has a tar archive extension
+// IsArchive reports whether the file at path is a tar archive, compressed
+// or not, or a zip archive, going by its content. If the file can't be read,
+// it goes by the extension: .tar, .tgz, .zip, or .tar followed by a
+// compression extension, like .tar.gz or .tar.zst.
 func IsArchive(path string) bool {
-	ext := strings.ToLower(filepath.Ext(path))
-	if ext == ".tar" || ext == ".tgz" {
-		return true
+	if format, err := image.Detect(path); err == nil {
+		return format.Kind == "tar" || format.Kind == "zip"
 	}
-	if ext == ".gz" {
-		// Check if it is .tar.gz
-		if strings.HasSuffix(strings.ToLower(path), ".tar.gz") {
-			return true
-		}
+	lower := strings.ToLower(path)
+	ext := filepath.Ext(lower)
+	if ext == ".tar" || ext == ".tgz" || ext == ".zip" {
+		return true
 	}
-	return false
+	return image.HasCompressionExt(lower) && filepath.Ext(image.TrimCompressionExt(lower)) == ".tar"
 }
 
 // ArchivePair contains the found image entry and its optional bmap
 type ArchivePair struct {
-	ImageEntry string
-	BmapEntry  string
-	Bmap       *bmap.Bmap
+	ImageEntry       string
+	BmapEntry        string
+	Bmap             *bmap.Bmap
+	SignatureEntries []string // Detached signatures of the bmap, e.g. image.wic.bmap.asc
+	// Candidates are all the images in the archive, as ListImages returns
+	// them. The image picked is the first, unless an entry was asked for.
+	Candidates []Candidate
 }
 
-// GetArchivePair scans the archive for a compatible image and bmap pair
-func GetArchivePair(path string) (*ArchivePair, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
+// Candidate is an image in an archive: a *.img, *.wic or *.iso entry,
+// possibly compressed, like image.wic.zst.
+type Candidate struct {
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`           // Size in the archive; compressed for a compressed image
+	BmapEntry string `json:"bmap,omitempty"` // Its bmap, if the archive has one
+}
 
-	r, err := image.Decompressor(path, f)
-	if err != nil {
-		return nil, err
-	}
+// archiveIndex is what scanArchive finds in an archive.
+type archiveIndex struct {
+	candidates []Candidate
+	sizes      map[string]int64     // Size of every regular file, by entry name
+	bmaps      map[string]bmapEntry // By the name of the image they are for, without directory
+}
 
-	if c, ok := r.(io.Closer); ok {
-		defer c.Close()
-	}
+type bmapEntry struct {
+	name string
+	bm   *bmap.Bmap
+}
 
-	tr := tar.NewReader(r)
+// bmapFor returns the bmap of the image entry name: image.wic.bmap for
+// image.wic and image.wic.zst, anywhere in the archive.
+func (idx *archiveIndex) bmapFor(name string) (bmapEntry, bool) {
+	b, ok := idx.bmaps[image.TrimCompressionExt(filepath.Base(name))]
+	return b, ok
+}
 
-	type bmapInfo struct {
-		bm       *bmap.Bmap
-		filename string
+// isImageEntry reports whether name looks like an image: *.img, *.iso or
+// *.wic, possibly with a compression extension.
+func isImageEntry(name string) bool {
+	switch strings.ToLower(filepath.Ext(image.TrimCompressionExt(filepath.Base(name)))) {
+	case ".img", ".iso", ".wic":
+		return true
 	}
+	return false
+}
 
-	bmaps := make(map[string]bmapInfo)
-	images := make(map[string]string)
+// scanArchive reads the entries of the archive at path, parsing its bmaps.
+func scanArchive(ctx context.Context, path string) (*archiveIndex, error) {
+	w, err := openWalker(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
 
+	idx := &archiveIndex{sizes: make(map[string]int64), bmaps: make(map[string]bmapEntry)}
 	for {
-		header, err := tr.Next()
+		name, size, err := w.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
 			return nil, err
 		}
+		idx.sizes[name] = size
 
-		if header.Typeflag != tar.TypeReg {
-			continue
-		}
-
-		name := header.Name
 		baseName := filepath.Base(name)
-		lowerBase := strings.ToLower(baseName)
-
-		if strings.HasSuffix(lowerBase, ".bmap") {
-			// Read bmap content
-			buf := new(bytes.Buffer)
-			if _, err := io.Copy(buf, tr); err != nil {
+		if strings.HasSuffix(strings.ToLower(baseName), ".bmap") {
+			// image.wic.bmap -> image.wic. The first bmap of a name is kept.
+			key := strings.TrimSuffix(baseName, filepath.Ext(baseName))
+			if _, ok := idx.bmaps[key]; ok {
 				continue
 			}
-			bm, err := bmap.Parse(buf)
-			if err == nil {
-				// image.wic.bmap -> image.wic
-				key := strings.TrimSuffix(baseName, ".bmap")
-				bmaps[key] = bmapInfo{bm: bm, filename: name}
-			}
-		} else {
-			// Check for valid image patterns: *.img, *.iso, or *.wic (possibly with compression)
-			ext := filepath.Ext(baseName)
-			lowerExt := strings.ToLower(ext)
-
-			var key string
-			matched := false
-
-			// Supported compression extensions
-			isComp := lowerExt == ".gz" || lowerExt == ".bz2" || lowerExt == ".xz" || lowerExt == ".zst" || lowerExt == ".zstd"
-
-			if isComp {
-				withoutComp := strings.TrimSuffix(baseName, ext)
-				subExt := filepath.Ext(withoutComp)
-				lowerSubExt := strings.ToLower(subExt)
-				if lowerSubExt == ".img" || lowerSubExt == ".wic" || lowerSubExt == ".iso" {
-					matched = true
-					key = withoutComp
+			buf := new(bytes.Buffer)
+			if _, err := io.Copy(buf, w); err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
 				}
-			} else if lowerExt == ".img" || lowerExt == ".wic" || lowerExt == ".iso" {
-				matched = true
-				key = baseName
+				continue
 			}
-
-			if matched {
-				images[key] = name
+			if bm, err := bmap.Parse(buf); err == nil {
+				idx.bmaps[key] = bmapEntry{name: name, bm: bm}
 			}
+		} else if isImageEntry(name) {
+			idx.candidates = append(idx.candidates, Candidate{Name: name, Size: size})
 		}
 	}
 
-	// Find match
-	for key, imgEntry := range images {
-		if info, ok := bmaps[key]; ok {
-			return &ArchivePair{
-				ImageEntry: imgEntry,
-				BmapEntry:  info.filename,
-				Bmap:       info.bm,
-			}, nil
+	for i, c := range idx.candidates {
+		if b, ok := idx.bmapFor(c.Name); ok {
+			idx.candidates[i].BmapEntry = b.name
 		}
 	}
+	// Images with a bmap first, then in archive order.
+	sort.SliceStable(idx.candidates, func(i, j int) bool {
+		return idx.candidates[i].BmapEntry != "" && idx.candidates[j].BmapEntry == ""
+	})
+	return idx, nil
+}
 
-	// Fallback: Return first image found if no bmap pair
-	for _, imgEntry := range images {
-		return &ArchivePair{
-			ImageEntry: imgEntry,
-			Bmap:       nil,
-		}, nil
+// ListImages returns the images in the archive at path, in the order they
+// are preferred: images with a bmap first, then in archive order.
+func ListImages(ctx context.Context, path string) ([]Candidate, error) {
+	idx, err := scanArchive(ctx, path)
+	if err != nil {
+		return nil, err
 	}
-
-	return nil, errors.New("no suitable image found in archive")
+	return idx.candidates, nil
 }
 
-// Extract extracts the image and bmap (if present) from the archive to a temporary directory.
-// Returns the paths to the extracted image and bmap, a cleanup function, and any error.
-func Extract(archivePath string) (imagePath string, bmapPath string, cleanup func(), err error) {
-	pair, err := GetArchivePair(archivePath)
+// GetArchivePair finds the image to flash in the archive at path, with its
+// bmap if the archive has one. It is entry if not empty, which may be any
+// file in the archive, or else the first image ListImages returns.
+func GetArchivePair(ctx context.Context, path, entry string) (*ArchivePair, error) {
+	idx, err := scanArchive(ctx, path)
 	if err != nil {
-		return "", "", nil, err
+		return nil, err
+	}
+
+	if entry == "" {
+		if len(idx.candidates) == 0 {
+			return nil, errors.New("no suitable image found in archive")
+		}
+		entry = idx.candidates[0].Name
+	} else if _, ok := idx.sizes[entry]; !ok {
+		names := make([]string, len(idx.candidates))
+		for i, c := range idx.candidates {
+			names[i] = c.Name
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("archive has no entry %s", entry)
+		}
+		return nil, fmt.Errorf("archive has no entry %s; its images are %s", entry, strings.Join(names, ", "))
 	}
 
+	pair := &ArchivePair{ImageEntry: entry, Candidates: idx.candidates}
+	if b, ok := idx.bmapFor(entry); ok {
+		pair.BmapEntry, pair.Bmap = b.name, b.bm
+		for _, ext := range signature.SignatureExtensions {
+			if _, ok := idx.sizes[b.name+ext]; ok {
+				pair.SignatureEntries = append(pair.SignatureEntries, b.name+ext)
+			}
+		}
+	}
+	return pair, nil
+}
+
+// Extract extracts the image and bmap (if present) of pair, along with the
+// bmap's detached signatures, from the archive to a temporary directory.
+// Returns the paths to the extracted image and bmap, a cleanup function, and any error.
+// Extraction stops with the error of ctx once it is done.
+func Extract(ctx context.Context, archivePath string, pair *ArchivePair) (imagePath string, bmapPath string, cleanup func(), err error) {
 	tempDir, err := os.MkdirTemp("", "pvflasher-extract-*")
 	if err != nil {
 		return "", "", nil, err
@@ -158,29 +192,25 @@ func Extract(archivePath string) (imagePath string, bmapPath string, cleanup fun
 	cleanup = func() { os.RemoveAll(tempDir) }
 
 	// Re-open archive for extraction
-	f, err := os.Open(archivePath)
+	w, err := openWalker(ctx, archivePath)
 	if err != nil {
 		cleanup()
 		return "", "", nil, err
 	}
-	defer f.Close()
-
-	r, err := image.Decompressor(archivePath, f)
-	if err != nil {
-		cleanup()
-		return "", "", nil, err
-	}
-	if c, ok := r.(io.Closer); ok {
-		defer c.Close()
+	defer w.Close()
+
+	// Entries to extract next to the image, keyed by archive name.
+	wanted := map[string]bool{}
+	if pair.BmapEntry != "" {
+		wanted[pair.BmapEntry] = true
+		for _, sig := range pair.SignatureEntries {
+			wanted[sig] = true
+		}
 	}
-
-	tr := tar.NewReader(r)
-
 	foundImage := false
-	foundBmap := false
 
 	for {
-		header, err := tr.Next()
+		name, _, err := w.Next()
 		if err == io.EOF {
 			break
 		}
@@ -189,39 +219,34 @@ func Extract(archivePath string) (imagePath string, bmapPath string, cleanup fun
 			return "", "", nil, err
 		}
 
-		if header.Name == pair.ImageEntry {
-			destPath := filepath.Join(tempDir, filepath.Base(header.Name))
-			outFile, err := os.Create(destPath)
-			if err != nil {
-				cleanup()
-				return "", "", nil, err
-			}
-			if _, err := io.Copy(outFile, tr); err != nil {
-				outFile.Close()
-				cleanup()
-				return "", "", nil, err
-			}
+		if name != pair.ImageEntry && !wanted[name] {
+			continue
+		}
+
+		destPath := filepath.Join(tempDir, filepath.Base(name))
+		outFile, err := os.Create(destPath)
+		if err != nil {
+			cleanup()
+			return "", "", nil, err
+		}
+		if _, err := io.Copy(outFile, w); err != nil {
 			outFile.Close()
+			cleanup()
+			return "", "", nil, err
+		}
+		outFile.Close()
+
+		if name == pair.ImageEntry {
 			imagePath = destPath
 			foundImage = true
-		} else if pair.BmapEntry != "" && header.Name == pair.BmapEntry {
-			destPath := filepath.Join(tempDir, filepath.Base(header.Name))
-			outFile, err := os.Create(destPath)
-			if err != nil {
-				cleanup()
-				return "", "", nil, err
-			}
-			if _, err := io.Copy(outFile, tr); err != nil {
-				outFile.Close()
-				cleanup()
-				return "", "", nil, err
+		} else {
+			if name == pair.BmapEntry {
+				bmapPath = destPath
 			}
-			outFile.Close()
-			bmapPath = destPath
-			foundBmap = true
+			delete(wanted, name)
 		}
 
-		if foundImage && (pair.BmapEntry == "" || foundBmap) {
+		if foundImage && len(wanted) == 0 {
 			break
 		}
 	}
@@ -249,50 +274,29 @@ func (r *readCloserWrapper) Close() error {
 	return firstErr
 }
 
-// OpenArchiveImage returns a reader for the specific entry in the archive
-func OpenArchiveImage(archivePath, entryName string) (io.ReadCloser, int64, error) {
-	f, err := os.Open(archivePath)
-	if err != nil {
-		return nil, 0, err
-	}
-
-	outerR, err := image.Decompressor(archivePath, f)
+// OpenArchiveImage returns a reader for the specific entry in the archive.
+// Once ctx is done, reads fail with its error.
+func OpenArchiveImage(ctx context.Context, archivePath, entryName string) (io.ReadCloser, int64, error) {
+	w, err := openWalker(ctx, archivePath)
 	if err != nil {
-		f.Close()
 		return nil, 0, err
 	}
 
-	tr := tar.NewReader(outerR)
-
 	for {
-		header, err := tr.Next()
+		name, size, err := w.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			f.Close()
-			if c, ok := outerR.(io.Closer); ok {
-				c.Close()
-			}
+			w.Close()
 			return nil, 0, err
 		}
 
-		if header.Name == entryName {
-			closers := []io.Closer{f}
-			if c, ok := outerR.(io.Closer); ok {
-				closers = append([]io.Closer{c}, closers...)
-			}
-
-			return &readCloserWrapper{
-				Reader: tr,
-				closers: closers,
-			}, header.Size, nil
+		if name == entryName {
+			return w, size, nil
 		}
 	}
 
-	f.Close()
-	if c, ok := outerR.(io.Closer); ok {
-		c.Close()
-	}
+	w.Close()
 	return nil, 0, os.ErrNotExist
 }
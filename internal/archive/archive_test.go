@@ -2,9 +2,12 @@ package archive
 
 import (
 	"archive/tar"
+	"archive/zip"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -25,10 +28,15 @@ func TestIsArchive(t *testing.T) {
 		{"image.Tar.Gz", true},
 		{"image.img", false},
 		{"image.iso", false},
-		{"image.zip", false},
+		{"image.zip", true},
 		{"image.txt", false},
-		{"image.gz", false},        // Just .gz, not .tar.gz
-		{"archive.tar.bz2", false}, // Not supported
+		{"image.gz", false}, // Just .gz, not .tar.gz
+		{"archive.tar.bz2", true},
+		{"archive.tar.zst", true},
+		{"archive.tar.lz4", true},
+		{"archive.TAR.LZ", true},
+		{"image.lz4", false},
+		{"image.img.br", false},
 	}
 
 	for _, tt := range tests {
@@ -81,7 +89,7 @@ func TestGetArchivePair_ImageOnly(t *testing.T) {
 	}
 	archivePath := createTestTarGz(t, files)
 
-	pair, err := GetArchivePair(archivePath)
+	pair, err := GetArchivePair(context.Background(), archivePath, "")
 	if err != nil {
 		t.Fatalf("GetArchivePair failed: %v", err)
 	}
@@ -125,7 +133,7 @@ func TestGetArchivePair_WithBmap(t *testing.T) {
 	}
 	archivePath := createTestTarGz(t, files)
 
-	pair, err := GetArchivePair(archivePath)
+	pair, err := GetArchivePair(context.Background(), archivePath, "")
 	if err != nil {
 		t.Fatalf("GetArchivePair failed: %v", err)
 	}
@@ -147,7 +155,7 @@ func TestGetArchivePair_CompressedImage(t *testing.T) {
 	}
 	archivePath := createTestTarGz(t, files)
 
-	pair, err := GetArchivePair(archivePath)
+	pair, err := GetArchivePair(context.Background(), archivePath, "")
 	if err != nil {
 		t.Fatalf("GetArchivePair failed: %v", err)
 	}
@@ -157,22 +165,124 @@ func TestGetArchivePair_CompressedImage(t *testing.T) {
 	}
 }
 
+// createTestTar writes a tar archive of entries, name and content, in order.
+func createTestTar(t *testing.T, entries ...[2]string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: e[0], Mode: 0644, Size: int64(len(e[1]))}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(e[1]))
+	}
+	tw.Close()
+	path := filepath.Join(t.TempDir(), "test.tar")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testBmap returns a valid bmap of a one block image.
+func testBmap() string {
+	template := `<?xml version="1.0" ?>
+<bmap version="2.0">
+	<ImageSize> 4096 </ImageSize>
+	<BlockSize> 4096 </BlockSize>
+	<BlocksCount> 1 </BlocksCount>
+	<MappedBlocksCount> 1 </MappedBlocksCount>
+	<ChecksumType> sha256 </ChecksumType>
+	<BmapFileChecksum> PLACEHOLDER </BmapFileChecksum>
+	<BlockMap>
+		<Range chksum="abc"> 0 </Range>
+	</BlockMap>
+</bmap>`
+	sum := sha256.Sum256([]byte(strings.Replace(template, "PLACEHOLDER", strings.Repeat("0", 64), 1)))
+	return strings.Replace(template, "PLACEHOLDER", fmt.Sprintf("%x", sum), 1)
+}
+
 func TestGetArchivePair_MultipleImages(t *testing.T) {
-	// When multiple images exist, it should return the first one with a bmap
-	files := map[string]string{
-		"image1.img": "image1 content",
-		"image2.img": "image2 content",
+	tests := []struct {
+		name    string
+		entries [][2]string
+		want    string
+	}{
+		{"archive order", [][2]string{{"b.img", "b"}, {"a.img", "a"}}, "b.img"},
+		{"bmap first", [][2]string{{"a.img", "a"}, {"b.wic.zst", "b"}, {"b.wic.bmap", testBmap()}}, "b.wic.zst"},
+		{"bmap before image", [][2]string{{"b.wic.bmap", testBmap()}, {"a.img", "a"}, {"sub/b.wic", "b"}}, "sub/b.wic"},
 	}
-	archivePath := createTestTarGz(t, files)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := createTestTar(t, tt.entries...)
+			// The same image every time
+			for i := 0; i < 3; i++ {
+				pair, err := GetArchivePair(context.Background(), path, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if pair.ImageEntry != tt.want {
+					t.Fatalf("ImageEntry = %q, want %q", pair.ImageEntry, tt.want)
+				}
+				if len(pair.Candidates) != 2 {
+					t.Errorf("%d candidates, want 2", len(pair.Candidates))
+				}
+			}
+		})
+	}
+}
 
-	pair, err := GetArchivePair(archivePath)
+func TestGetArchivePair_Entry(t *testing.T) {
+	path := createTestTar(t,
+		[2]string{"a.img", "a"},
+		[2]string{"b.wic", "b"},
+		[2]string{"b.wic.bmap", testBmap()},
+		[2]string{"b.wic.bmap.asc", "signature"},
+		[2]string{"firmware.bin", "firmware"},
+	)
+
+	pair, err := GetArchivePair(context.Background(), path, "a.img")
 	if err != nil {
-		t.Fatalf("GetArchivePair failed: %v", err)
+		t.Fatal(err)
+	}
+	if pair.ImageEntry != "a.img" || pair.Bmap != nil || pair.SignatureEntries != nil {
+		t.Errorf("pair = %+v, want a.img without a bmap", pair)
+	}
+
+	// Any entry can be asked for, and gets its bmap and signatures.
+	if pair, err = GetArchivePair(context.Background(), path, "b.wic"); err != nil {
+		t.Fatal(err)
+	}
+	if pair.BmapEntry != "b.wic.bmap" || len(pair.SignatureEntries) != 1 {
+		t.Errorf("pair = %+v, want b.wic with its bmap and signature", pair)
+	}
+	if pair, err = GetArchivePair(context.Background(), path, "firmware.bin"); err != nil || pair.ImageEntry != "firmware.bin" {
+		t.Errorf("GetArchivePair(firmware.bin) = %+v, %v", pair, err)
 	}
 
-	// Should return the first image found
-	if pair.ImageEntry == "" {
-		t.Error("ImageEntry should not be empty")
+	_, err = GetArchivePair(context.Background(), path, "c.img")
+	if err == nil || !strings.Contains(err.Error(), "b.wic, a.img") {
+		t.Errorf("err = %v, want one listing the images", err)
+	}
+}
+
+func TestListImages(t *testing.T) {
+	path := createTestTar(t,
+		[2]string{"readme.txt", "read me"},
+		[2]string{"a.img.xz", "compressed"},
+		[2]string{"b.iso", "iso"},
+		[2]string{"b.iso.bmap", testBmap()},
+	)
+	got, err := ListImages(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Candidate{
+		{Name: "b.iso", Size: 3, BmapEntry: "b.iso.bmap"},
+		{Name: "a.img.xz", Size: 10},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("ListImages = %+v, want %+v", got, want)
 	}
 }
 
@@ -182,14 +292,14 @@ func TestGetArchivePair_NoImage(t *testing.T) {
 	}
 	archivePath := createTestTarGz(t, files)
 
-	_, err := GetArchivePair(archivePath)
+	_, err := GetArchivePair(context.Background(), archivePath, "")
 	if err == nil {
 		t.Error("Expected error for archive without image")
 	}
 }
 
 func TestGetArchivePair_NonExistentFile(t *testing.T) {
-	_, err := GetArchivePair("/nonexistent/path/to/archive.tar.gz")
+	_, err := GetArchivePair(context.Background(), "/nonexistent/path/to/archive.tar.gz", "")
 	if err == nil {
 		t.Error("Expected error for non-existent file")
 	}
@@ -201,7 +311,7 @@ func TestGetArchivePair_ISOImage(t *testing.T) {
 	}
 	archivePath := createTestTarGz(t, files)
 
-	pair, err := GetArchivePair(archivePath)
+	pair, err := GetArchivePair(context.Background(), archivePath, "")
 	if err != nil {
 		t.Fatalf("GetArchivePair failed: %v", err)
 	}
@@ -216,8 +326,12 @@ func TestExtract(t *testing.T) {
 		"image.img": "this is image content for extraction",
 	}
 	archivePath := createTestTarGz(t, files)
+	pair, err := GetArchivePair(context.Background(), archivePath, "")
+	if err != nil {
+		t.Fatalf("GetArchivePair failed: %v", err)
+	}
 
-	imagePath, bmapPath, cleanup, err := Extract(archivePath)
+	imagePath, bmapPath, cleanup, err := Extract(context.Background(), archivePath, pair)
 	if err != nil {
 		t.Fatalf("Extract failed: %v", err)
 	}
@@ -266,12 +380,22 @@ func TestExtract_WithBmap(t *testing.T) {
 	bmapContent := strings.Replace(templateBmap, "PLACEHOLDER", validChecksum, 1)
 
 	files := map[string]string{
-		"image.wic":      "this is wic content",
-		"image.wic.bmap": bmapContent,
+		"image.wic":          "this is wic content",
+		"image.wic.bmap":     bmapContent,
+		"image.wic.bmap.asc": "signature",
+		"other.bmap.asc":     "unrelated signature",
 	}
 	archivePath := createTestTarGz(t, files)
 
-	imagePath, bmapPath, cleanup, err := Extract(archivePath)
+	pair, err := GetArchivePair(context.Background(), archivePath, "")
+	if err != nil {
+		t.Fatalf("GetArchivePair failed: %v", err)
+	}
+	if len(pair.SignatureEntries) != 1 || pair.SignatureEntries[0] != "image.wic.bmap.asc" {
+		t.Errorf("SignatureEntries = %v, want [image.wic.bmap.asc]", pair.SignatureEntries)
+	}
+
+	imagePath, bmapPath, cleanup, err := Extract(context.Background(), archivePath, pair)
 	if err != nil {
 		t.Fatalf("Extract failed: %v", err)
 	}
@@ -293,15 +417,30 @@ func TestExtract_WithBmap(t *testing.T) {
 	if string(content) != bmapContent {
 		t.Errorf("Bmap content mismatch")
 	}
+
+	// The bmap's signature lands next to it, where the flasher looks for it
+	if sig, err := os.ReadFile(bmapPath + ".asc"); err != nil || string(sig) != "signature" {
+		t.Errorf("signature not extracted next to the bmap: %q, %v", sig, err)
+	}
 }
 
 func TestExtract_InvalidArchive(t *testing.T) {
-	_, _, _, err := Extract("/nonexistent/archive.tar.gz")
+	_, _, _, err := Extract(context.Background(), "/nonexistent/archive.tar.gz", &ArchivePair{ImageEntry: "image.img"})
 	if err == nil {
 		t.Error("Expected error for invalid archive")
 	}
 }
 
+func TestExtract_Cancelled(t *testing.T) {
+	archivePath := createTestTarGz(t, map[string]string{"image.img": "image content"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, _, _, err := Extract(ctx, archivePath, &ArchivePair{ImageEntry: "image.img"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Extract error = %v, want context.Canceled", err)
+	}
+}
+
 func TestReadCloserWrapper(t *testing.T) {
 	// Create mock closers
 	var closed []string
@@ -355,7 +494,7 @@ func TestOpenArchiveImage(t *testing.T) {
 	}
 	archivePath := createTestTarGz(t, files)
 
-	reader, size, err := OpenArchiveImage(archivePath, "image.img")
+	reader, size, err := OpenArchiveImage(context.Background(), archivePath, "image.img")
 	if err != nil {
 		t.Fatalf("OpenArchiveImage failed: %v", err)
 	}
@@ -383,15 +522,76 @@ func TestOpenArchiveImage_NotFound(t *testing.T) {
 	}
 	archivePath := createTestTarGz(t, files)
 
-	_, _, err := OpenArchiveImage(archivePath, "nonexistent.img")
+	_, _, err := OpenArchiveImage(context.Background(), archivePath, "nonexistent.img")
 	if err == nil {
 		t.Error("Expected error for non-existent entry")
 	}
 }
 
 func TestOpenArchiveImage_InvalidArchive(t *testing.T) {
-	_, _, err := OpenArchiveImage("/nonexistent/archive.tar.gz", "image.img")
+	_, _, err := OpenArchiveImage(context.Background(), "/nonexistent/archive.tar.gz", "image.img")
 	if err == nil {
 		t.Error("Expected error for invalid archive")
 	}
 }
+
+func TestIsArchive_ByContent(t *testing.T) {
+	dir := t.TempDir()
+	tarGz := createTestTarGz(t, map[string]string{"image.img": "image content"})
+	data, err := os.ReadFile(tarGz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	misnamed := filepath.Join(dir, "release.bin")
+	if err := os.WriteFile(misnamed, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	notArchive := filepath.Join(dir, "image.tar")
+	if err := os.WriteFile(notArchive, []byte("raw image data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsArchive(misnamed) {
+		t.Errorf("IsArchive(%q) = false for a tar.gz", misnamed)
+	}
+	if IsArchive(notArchive) {
+		t.Errorf("IsArchive(%q) = true for raw data", notArchive)
+	}
+	pair, err := GetArchivePair(context.Background(), misnamed, "")
+	if err != nil || pair.ImageEntry != "image.img" {
+		t.Errorf("GetArchivePair = %+v, %v, want image.img", pair, err)
+	}
+}
+
+func TestZipArchive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "release.zip")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	zw.Create("docs/")
+	for name, content := range map[string]string{"docs/README": "read me", "image.wic": "zipped image content"} {
+		w, _ := zw.Create(name)
+		w.Write([]byte(content))
+	}
+	zw.Close()
+	f.Close()
+
+	if !IsArchive(path) {
+		t.Fatal("IsArchive = false for a zip archive")
+	}
+	pair, err := GetArchivePair(context.Background(), path, "")
+	if err != nil || pair.ImageEntry != "image.wic" {
+		t.Fatalf("GetArchivePair = %+v, %v, want image.wic", pair, err)
+	}
+	r, size, err := OpenArchiveImage(context.Background(), path, "image.wic")
+	if err != nil {
+		t.Fatalf("OpenArchiveImage failed: %v", err)
+	}
+	defer r.Close()
+	content, err := io.ReadAll(r)
+	if err != nil || string(content) != "zipped image content" || size != int64(len(content)) {
+		t.Errorf("entry = %q (size %d, err %v), want the image content", content, size, err)
+	}
+}
@@ -0,0 +1,127 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"pvflasher/internal/image"
+)
+
+// walker steps through the regular files of a tar or zip archive in the
+// order they are stored.
+type walker interface {
+	// Next moves to the next regular file and returns its name and size. At
+	// the end of the archive it returns io.EOF.
+	Next() (name string, size int64, err error)
+	// Read reads the data of the current file.
+	Read(p []byte) (int, error)
+	Close() error
+}
+
+// openWalker opens the archive at path, which may be a tar archive in any
+// compression image.Decompressor reads, or a zip archive. Once ctx is done,
+// reads fail with its error.
+func openWalker(ctx context.Context, path string) (walker, error) {
+	format, err := image.Detect(path)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case format.Kind == "tar":
+		return openTar(ctx, path)
+	case format.Kind == "zip" && format.Compression == "":
+		return openZip(ctx, path)
+	case format.Kind == "zip":
+		return nil, fmt.Errorf("%s is a %s-compressed zip archive; decompress it first", path, format.Compression)
+	default:
+		return nil, fmt.Errorf("%s is not a tar or zip archive (found %s)", path, format)
+	}
+}
+
+type tarWalker struct {
+	tr *tar.Reader
+	readCloserWrapper
+}
+
+func openTar(ctx context.Context, path string) (*tarWalker, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := image.Decompressor(ctx, path, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	tr := tar.NewReader(r)
+	return &tarWalker{tr: tr, readCloserWrapper: readCloserWrapper{Reader: tr, closers: []io.Closer{r, f}}}, nil
+}
+
+func (w *tarWalker) Next() (string, int64, error) {
+	for {
+		header, err := w.tr.Next()
+		if err != nil {
+			return "", 0, err
+		}
+		if header.Typeflag == tar.TypeReg {
+			return header.Name, header.Size, nil
+		}
+	}
+}
+
+type zipWalker struct {
+	ctx  context.Context
+	zr   *zip.ReadCloser
+	next int           // Index of the next file in zr.File
+	cur  io.ReadCloser // Data of the current file
+}
+
+func openZip(ctx context.Context, path string) (*zipWalker, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	return &zipWalker{ctx: ctx, zr: zr}, nil
+}
+
+func (w *zipWalker) Next() (string, int64, error) {
+	if w.cur != nil {
+		w.cur.Close()
+		w.cur = nil
+	}
+	for w.next < len(w.zr.File) {
+		f := w.zr.File[w.next]
+		w.next++
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to open %s: %w", f.Name, err)
+		}
+		w.cur = rc
+		return f.Name, int64(f.UncompressedSize64), nil
+	}
+	return "", 0, io.EOF
+}
+
+func (w *zipWalker) Read(p []byte) (int, error) {
+	if w.cur == nil {
+		return 0, io.EOF
+	}
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.cur.Read(p)
+}
+
+func (w *zipWalker) Close() error {
+	if w.cur != nil {
+		w.cur.Close()
+	}
+	return w.zr.Close()
+}
@@ -1,19 +1,61 @@
 package bmap
 
 import (
-	"crypto/sha256"
-	"encoding/xml"
 	"fmt"
 	"io"
 	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
 
 	"pvflasher/internal/image"
 )
 
+// createChunkSize is how much image data is read at a time. It is rounded up
+// to a multiple of the block size.
+const createChunkSize = 4 * 1024 * 1024
+
 // CreateOptions configures the bmap generation
 type CreateOptions struct {
-	ImageSize int64
-	BlockSize int
+	ImageSize    int64
+	BlockSize    int
+	ChecksumType string // sha1, sha256 (default) or sha512
+	// FreeRanges are byte ranges known to hold no data, e.g. blocks a
+	// filesystem marks as free (see package fsmap). Blocks entirely inside
+	// them are left unmapped even if they aren't zero. Sorted, not overlapping.
+	FreeRanges []image.ByteRange
+	// Workers is the number of goroutines looking for zero blocks and
+	// hashing ranges (default runtime.NumCPU()). The bmap doesn't depend on it.
+	Workers int
+	// Progress, if set, is called with the bytes of image data read so far
+	// and the total to read, or -1 if that isn't known (streams).
+	Progress func(read, total int64)
+}
+
+func (opts *CreateOptions) setDefaults() error {
+	if opts.BlockSize == 0 {
+		opts.BlockSize = 4096 // Default 4KB
+	}
+	if opts.BlockSize < 0 {
+		return fmt.Errorf("invalid block size %d", opts.BlockSize)
+	}
+	if opts.ChecksumType == "" {
+		opts.ChecksumType = "sha256"
+	}
+	if _, err := GetHasher(opts.ChecksumType); err != nil {
+		return err
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+	return nil
+}
+
+// inFreeRange reports whether [start, end) lies entirely in one of ranges.
+func inFreeRange(ranges []image.ByteRange, start, end int64) bool {
+	i := sort.Search(len(ranges), func(i int) bool { return ranges[i].End > start })
+	return i < len(ranges) && ranges[i].Start <= start && end <= ranges[i].End
 }
 
 // Create generates a Bmap struct from an image file
@@ -24,16 +66,18 @@ func Create(imagePath string, opts CreateOptions) (*Bmap, error) {
 	}
 	defer f.Close()
 
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
 	if opts.ImageSize == 0 {
-		fi, err := f.Stat()
-		if err != nil {
-			return nil, err
-		}
 		opts.ImageSize = fi.Size()
 	}
-
-	if opts.BlockSize == 0 {
-		opts.BlockSize = 4096 // Default 4KB
+	if fi.Mode().IsRegular() && fi.Size() < opts.ImageSize {
+		return nil, fmt.Errorf("image ends at byte %d, before its size %d: %w", fi.Size(), opts.ImageSize, io.ErrUnexpectedEOF)
+	}
+	if err := opts.setDefaults(); err != nil {
+		return nil, err
 	}
 
 	// Get mapped ranges (sparse detection)
@@ -42,72 +86,278 @@ func Create(imagePath string, opts CreateOptions) (*Bmap, error) {
 		return nil, fmt.Errorf("failed to detect mapped ranges: %w", err)
 	}
 
-	blocksCount := opts.ImageSize / int64(opts.BlockSize)
-	if opts.ImageSize%int64(opts.BlockSize) != 0 {
-		blocksCount++
+	bs := int64(opts.BlockSize)
+	blocksCount := (opts.ImageSize + bs - 1) / bs
+	extents := blockExtents(ranges, bs, blocksCount)
+	var total int64
+	for _, e := range extents {
+		total += min(e.end*bs, opts.ImageSize) - e.start*bs
 	}
 
-	bm := &Bmap{
-		Version:      "2.0",
-		ImageSize:    opts.ImageSize,
-		BlockSize:    opts.BlockSize,
-		BlocksCount:  blocksCount,
-		ChecksumType: "sha256",
-		BlockMap:     make([]Range, 0),
+	var read int64
+	bm, err := scan(opts, func(buf []byte, emit func(offset int64, data []byte) []byte) error {
+		for _, e := range extents {
+			off := e.start * bs
+			end := min(e.end*bs, opts.ImageSize)
+			for off < end {
+				n := min(int64(len(buf)), end-off)
+				got, err := f.ReadAt(buf[:n], off)
+				if err != nil && err != io.EOF {
+					return fmt.Errorf("failed to read image at offset %d: %w", off, err)
+				}
+				if got == 0 {
+					return fmt.Errorf("image ends at byte %d, before its size %d: %w", off, opts.ImageSize, io.ErrUnexpectedEOF)
+				}
+				buf = emit(off, buf[:got])
+				off += int64(got)
+				read += int64(got)
+				if opts.Progress != nil {
+					opts.Progress(read, total)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	bm.ImageSize = opts.ImageSize
+	bm.BlocksCount = blocksCount
+	return bm, nil
+}
 
-	var mappedBlocksCount int64
-	buf := make([]byte, opts.BlockSize)
-
-	for _, byteRange := range ranges {
-		firstBlock := byteRange.Start / int64(opts.BlockSize)
-		lastBlock := (byteRange.End - 1) / int64(opts.BlockSize)
+// CreateFromReader generates a Bmap from a stream of image data, e.g. the
+// output of image.Decompressor. A stream has no holes to find, so every block
+// is read and the ones that are all zeros are left unmapped. opts.ImageSize is
+// ignored; the image size is the length of the stream.
+func CreateFromReader(r io.Reader, opts CreateOptions) (*Bmap, error) {
+	if err := opts.setDefaults(); err != nil {
+		return nil, err
+	}
 
-		if lastBlock >= blocksCount {
-			lastBlock = blocksCount - 1
+	var size int64
+	bm, err := scan(opts, func(buf []byte, emit func(offset int64, data []byte) []byte) error {
+		for {
+			n, err := io.ReadFull(r, buf)
+			if n > 0 {
+				off := size
+				size += int64(n)
+				buf = emit(off, buf[:n])
+				if opts.Progress != nil {
+					opts.Progress(size, -1)
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read image at offset %d: %w", size, err)
+			}
 		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	bs := int64(opts.BlockSize)
+	bm.ImageSize = size
+	bm.BlocksCount = (size + bs - 1) / bs
+	return bm, nil
+}
 
-		var currentRangeStart int64 = -1
-		hasher := sha256.New()
+// blockRange is the half-open block range [start, end).
+type blockRange struct {
+	start, end int64
+}
 
-		_, err = f.Seek(firstBlock*int64(opts.BlockSize), io.SeekStart)
-		if err != nil {
-			return nil, err
+// blockExtents converts the data regions of a file to block ranges, merging
+// regions that share a block so no block is read twice.
+func blockExtents(ranges []image.ByteRange, bs, blocksCount int64) []blockRange {
+	var out []blockRange
+	for _, r := range ranges {
+		e := blockRange{start: r.Start / bs, end: min((r.End+bs-1)/bs, blocksCount)}
+		if e.start >= e.end {
+			continue
 		}
+		if n := len(out); n > 0 && e.start < out[n-1].end {
+			out[n-1].end = max(out[n-1].end, e.end)
+			continue
+		}
+		out = append(out, e)
+	}
+	return out
+}
 
-		for blk := firstBlock; blk <= lastBlock; blk++ {
-			n, err := io.ReadFull(f, buf)
-			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
-				return nil, err
-			}
-			if n == 0 {
-				break
-			}
+// chunk is a block-aligned piece of image data on its way through scan.
+type chunk struct {
+	offset int64
+	data   []byte
+	mapped []bool        // Per block: holds data. Set by a scan worker
+	ready  chan struct{} // Closed once mapped is filled in
+	refs   atomic.Int32  // Users of data; the buffer goes back to the pool at zero
+	pool   chan []byte
+}
 
-			// Check if block is all zeros (to skip even if mapped by FS)
-			if isAllZero(buf[:n]) {
-				if currentRangeStart != -1 {
-					bm.BlockMap = append(bm.BlockMap, createRangeFromHasher(currentRangeStart, blk-1, hasher))
-					currentRangeStart = -1
-					hasher.Reset()
+func (c *chunk) release() {
+	if c.refs.Add(-1) == 0 {
+		c.pool <- c.data[:cap(c.data)]
+	}
+}
+
+// piece is the part of a chunk that belongs to one range.
+type piece struct {
+	c    *chunk
+	data []byte
+}
+
+// scan builds a bmap from the image data produced by read, which fills the
+// buffer it is given and passes it to emit in ascending offset order; emit
+// returns the next buffer to fill. Reading, zero detection and hashing
+// overlap:
+//
+//   - opts.Workers goroutines find the zero and free blocks of each chunk;
+//   - the calling goroutine walks the chunks in order and cuts them into ranges;
+//   - every range is hashed by its own goroutine, at most opts.Workers at once.
+//
+// Each range is numbered and hashed on its own, so the bmap doesn't depend on
+// the number of workers. Memory use is bounded by the buffer pool.
+func scan(opts CreateOptions, read func(buf []byte, emit func(offset int64, data []byte) []byte) error) (*Bmap, error) {
+	bs := int64(opts.BlockSize)
+	chunkSize := (createChunkSize + bs - 1) / bs * bs
+
+	// Enough buffers to keep every worker busy, plus some read-ahead.
+	pool := make(chan []byte, 2*opts.Workers+2)
+	for i := 0; i < cap(pool); i++ {
+		pool <- make([]byte, chunkSize)
+	}
+	toScan := make(chan *chunk, cap(pool))
+	ordered := make(chan *chunk, cap(pool))
+
+	var scanners sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		scanners.Add(1)
+		go func() {
+			defer scanners.Done()
+			for c := range toScan {
+				c.mapped = make([]bool, (int64(len(c.data))+bs-1)/bs)
+				for i := range c.mapped {
+					start := int64(i) * bs
+					end := min(start+bs, int64(len(c.data)))
+					c.mapped[i] = !isAllZero(c.data[start:end]) &&
+						!inFreeRange(opts.FreeRanges, c.offset+start, c.offset+end)
 				}
-				continue
+				close(c.ready)
 			}
+		}()
+	}
+
+	var readErr error
+	go func() {
+		defer close(ordered)
+		defer close(toScan)
+		emit := func(offset int64, data []byte) []byte {
+			c := &chunk{offset: offset, data: data, ready: make(chan struct{}), pool: pool}
+			c.refs.Store(1)
+			toScan <- c
+			ordered <- c
+			return <-pool
+		}
+		readErr = read(<-pool, emit)
+	}()
+
+	bm := assemble(opts, ordered)
+	scanners.Wait()
+	if readErr != nil {
+		return nil, readErr
+	}
+	return bm, nil
+}
 
-			mappedBlocksCount++
-			if currentRangeStart == -1 {
-				currentRangeStart = blk
+// assemble consumes scanned chunks in image order, groups consecutive mapped
+// blocks into ranges and hands the data of each range to a hashing goroutine.
+// ImageSize and BlocksCount are left to the caller.
+func assemble(opts CreateOptions, ordered <-chan *chunk) *Bmap {
+	bs := int64(opts.BlockSize)
+	bm := &Bmap{
+		Version:      "2.0",
+		BlockSize:    opts.BlockSize,
+		ChecksumType: opts.ChecksumType,
+		BlockMap:     make([]Range, 0),
+	}
+
+	var hashers sync.WaitGroup
+	slots := make(chan struct{}, opts.Workers)
+	var results []*Range
+	var pieces chan piece // Data of the open range, nil if there is none
+
+	openRange := func(start int64) {
+		result := &Range{}
+		results = append(results, result)
+		ch := make(chan piece, 16)
+		pieces = ch
+		slots <- struct{}{}
+		hashers.Add(1)
+		go func() {
+			defer hashers.Done()
+			hasher, _ := GetHasher(opts.ChecksumType)
+			end := start
+			for p := range ch {
+				hasher.Write(p.data)
+				end += (int64(len(p.data)) + bs - 1) / bs
+				p.c.release()
 			}
-			hasher.Write(buf[:n])
+			*result = createRangeFromHasher(start, end-1, hasher)
+			<-slots
+		}()
+	}
+	closeRange := func() {
+		if pieces != nil {
+			close(pieces)
+			pieces = nil
+		}
+	}
+
+	var nextBlock int64
+	for c := range ordered {
+		<-c.ready
+		first := c.offset / bs
+		if first != nextBlock {
+			closeRange() // Hole between two extents of the file
 		}
 
-		if currentRangeStart != -1 {
-			bm.BlockMap = append(bm.BlockMap, createRangeFromHasher(currentRangeStart, lastBlock, hasher))
+		pieceStart := -1
+		flush := func(to int) {
+			if pieceStart < 0 {
+				return
+			}
+			c.refs.Add(1)
+			pieces <- piece{c: c, data: c.data[int64(pieceStart)*bs : min(int64(to)*bs, int64(len(c.data)))]}
+			pieceStart = -1
+		}
+		for i, mapped := range c.mapped {
+			if !mapped {
+				flush(i)
+				closeRange()
+				continue
+			}
+			bm.MappedBlocksCount++
+			if pieces == nil {
+				openRange(first + int64(i))
+			}
+			if pieceStart < 0 {
+				pieceStart = i
+			}
 		}
+		flush(len(c.mapped))
+		nextBlock = first + int64(len(c.mapped))
+		c.release()
 	}
+	closeRange()
+	hashers.Wait()
 
-	bm.MappedBlocksCount = mappedBlocksCount
-	return bm, nil
+	for _, r := range results {
+		bm.BlockMap = append(bm.BlockMap, *r)
+	}
+	return bm
 }
 
 func isAllZero(b []byte) bool {
@@ -120,9 +370,14 @@ func isAllZero(b []byte) bool {
 }
 
 func createRangeFromHasher(start, end int64, h io.Writer) Range {
-	sum := fmt.Sprintf("%x", h.(interface{ Sum([]byte) []byte }).Sum(nil))
+	return NewRange(start, end, fmt.Sprintf("%x", h.(interface{ Sum([]byte) []byte }).Sum(nil)))
+}
+
+// NewRange returns the range of blocks start to end, inclusive, with the
+// given hex checksum.
+func NewRange(start, end int64, checksum string) Range {
 	r := Range{
-		Checksum: sum,
+		Checksum: checksum,
 	}
 	if start == end {
 		r.Text = fmt.Sprintf("%d", start)
@@ -134,23 +389,9 @@ func createRangeFromHasher(start, end int64, h io.Writer) Range {
 
 // Save writes the Bmap to a file
 func (b *Bmap) Save(path string) error {
-	f, err := os.Create(path)
+	data, err := b.Marshal()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-
-	// Write header
-	f.WriteString("<?xml version=\"1.0\" ?>\n")
-	
-	// Comment with human readable info like bmaptool
-	f.WriteString(fmt.Sprintf("<!-- Bmap for image %d bytes, mapped %d blocks -->\n", b.ImageSize, b.MappedBlocksCount))
-
-	enc := xml.NewEncoder(f)
-	enc.Indent("", "    ")
-	if err := enc.Encode(b); err != nil {
-		return err
-	}
-    f.WriteString("\n")
-	return nil
+	return os.WriteFile(path, data, 0644)
 }
@@ -1,10 +1,17 @@
 package bmap
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"hash"
+	"io"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -50,6 +57,9 @@ func TestCreate_Simple(t *testing.T) {
 	if b.MappedBlocksCount == 0 {
 		t.Error("MappedBlocksCount should be > 0")
 	}
+	if err := b.Validate(); err != nil {
+		t.Errorf("created bmap is invalid: %v", err)
+	}
 }
 
 func TestCreate_ZeroFile(t *testing.T) {
@@ -81,6 +91,16 @@ func TestCreate_ZeroFile(t *testing.T) {
 	}
 }
 
+func TestCreate_ShortFile(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "short.img")
+	os.WriteFile(imagePath, bytes.Repeat([]byte{0xAB}, 8192), 0644)
+
+	_, err := Create(imagePath, CreateOptions{ImageSize: 16384})
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Create of a file shorter than ImageSize = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
 func TestCreate_NonExistentFile(t *testing.T) {
 	opts := CreateOptions{}
 	_, err := Create("/nonexistent/path/to/image.img", opts)
@@ -336,3 +356,337 @@ func (t *testHasher) Reset() {
 
 // Import needed packages at the top
 func init() {}
+
+// writeFixtureImage writes the image the bmaptool fixtures in testdata were
+// made from: 11 blocks of 4096 bytes, the last one 1000 bytes short, with
+// data in blocks 0-2, 6 and 10 and holes elsewhere.
+func writeFixtureImage(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fixture.img")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	const size = 10*4096 + 1000
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	for _, blk := range []int64{0, 1, 2, 6} {
+		if _, err := f.WriteAt(bytes.Repeat([]byte{byte(blk + 1)}, 4096), blk*4096); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := f.WriteAt(bytes.Repeat([]byte{0xaa}, 1000), 10*4096); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSave_MatchesBmaptool(t *testing.T) {
+	imagePath := writeFixtureImage(t)
+
+	for _, algo := range []string{"sha256", "sha1"} {
+		t.Run(algo, func(t *testing.T) {
+			want, err := os.ReadFile(filepath.Join("testdata", "bmaptool-"+algo+".bmap"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := Create(imagePath, CreateOptions{ChecksumType: algo})
+			if err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+			path := filepath.Join(t.TempDir(), "fixture.img.bmap")
+			if err := b.Save(path); err != nil {
+				t.Fatalf("Save failed: %v", err)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("saved bmap differs from bmaptool's:\n--- got\n%s\n--- want\n%s", got, want)
+			}
+
+			// The fixture's self-checksum is bmaptool's, so this also checks
+			// verifyIntegrity against it.
+			parsed, err := Parse(bytes.NewReader(want))
+			if err != nil {
+				t.Fatalf("Parse of bmaptool fixture failed: %v", err)
+			}
+			if parsed.BmapFileChecksum == "" {
+				t.Error("fixture has no BmapFileChecksum")
+			}
+		})
+	}
+}
+
+func TestSave_SelfChecksum(t *testing.T) {
+	imagePath := writeFixtureImage(t)
+
+	for _, algo := range []string{"sha1", "sha256", "sha512"} {
+		t.Run(algo, func(t *testing.T) {
+			b, err := Create(imagePath, CreateOptions{ChecksumType: algo})
+			if err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+			data, err := b.Marshal()
+			if err != nil {
+				t.Fatalf("Marshal failed: %v", err)
+			}
+			parsed, err := Parse(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			h, _ := GetHasher(algo)
+			if len(parsed.BmapFileChecksum) != h.Size()*2 {
+				t.Errorf("BmapFileChecksum = %q, want a %s digest", parsed.BmapFileChecksum, algo)
+			}
+			if err := parsed.Validate(); err != nil {
+				t.Errorf("saved bmap is invalid: %v", err)
+			}
+
+			// Any change to the file must break the checksum.
+			tampered := bytes.Replace(data, []byte("<BlockSize> 4096"), []byte("<BlockSize> 8192"), 1)
+			if _, err := Parse(bytes.NewReader(tampered)); err == nil {
+				t.Error("Parse accepted a modified bmap")
+			}
+		})
+	}
+}
+
+func TestCreate_UnknownChecksum(t *testing.T) {
+	if _, err := Create(writeFixtureImage(t), CreateOptions{ChecksumType: "md5"}); err == nil {
+		t.Error("Create accepted an unsupported checksum type")
+	}
+}
+
+func TestHumanSize(t *testing.T) {
+	tests := map[int64]string{
+		1:           "1 byte",
+		511:         "511 bytes",
+		512:         "0.5 KiB",
+		41960:       "41.0 KiB",
+		4 << 30:     "4.0 GiB",
+		3 << 40 / 2: "1.5 TiB",
+	}
+	for size, want := range tests {
+		if got := humanSize(size); got != want {
+			t.Errorf("humanSize(%d) = %q, want %q", size, got, want)
+		}
+	}
+}
+
+func TestCreateFromReader_MatchesCreate(t *testing.T) {
+	imagePath := writeFixtureImage(t)
+	want, err := Create(imagePath, CreateOptions{})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	f, err := os.Open(imagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// Hide the *os.File so nothing can seek for holes.
+	got, err := CreateFromReader(struct{ io.Reader }{f}, CreateOptions{})
+	if err != nil {
+		t.Fatalf("CreateFromReader failed: %v", err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CreateFromReader = %+v, want %+v", got, want)
+	}
+}
+
+func TestCreateFromReader_ZeroBlocks(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       []byte
+		wantBlocks int64
+		wantRanges []string
+	}{
+		{"empty", nil, 0, []string{}},
+		{"all zeros", make([]byte, 3*4096), 3, []string{}},
+		{"trailing partial zero block", append(bytes.Repeat([]byte{1}, 4096), make([]byte, 100)...), 2, []string{"0"}},
+		{"zeros between data", append(append(bytes.Repeat([]byte{1}, 2*4096), make([]byte, 4096)...), 2), 4, []string{"0-1", "3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := CreateFromReader(bytes.NewReader(tt.data), CreateOptions{})
+			if err != nil {
+				t.Fatalf("CreateFromReader failed: %v", err)
+			}
+			if b.ImageSize != int64(len(tt.data)) || b.BlocksCount != tt.wantBlocks {
+				t.Errorf("ImageSize = %d, BlocksCount = %d, want %d, %d", b.ImageSize, b.BlocksCount, len(tt.data), tt.wantBlocks)
+			}
+			ranges := []string{}
+			for _, r := range b.BlockMap {
+				ranges = append(ranges, r.Text)
+			}
+			if !reflect.DeepEqual(ranges, tt.wantRanges) {
+				t.Errorf("ranges = %v, want %v", ranges, tt.wantRanges)
+			}
+			if err := b.Validate(); err != nil {
+				t.Errorf("bmap is invalid: %v", err)
+			}
+		})
+	}
+}
+
+// writeLargeImage writes an image spanning several read chunks, with ranges
+// that cross chunk boundaries, zero blocks inside chunks and a hole.
+func writeLargeImage(t testing.TB, size int64) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "large.img")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	block := make([]byte, 4096)
+	for blk := int64(0); blk*4096 < size; blk++ {
+		if blk%97 == 13 || (blk >= 2000 && blk < 3000) {
+			continue // Zero block or hole
+		}
+		for i := range block {
+			block[i] = byte(blk*31 + int64(i))
+		}
+		if _, err := f.WriteAt(block, blk*4096); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestCreate_WorkersDeterministic(t *testing.T) {
+	imagePath := writeLargeImage(t, 5*createChunkSize+1234)
+
+	serial, err := Create(imagePath, CreateOptions{Workers: 1})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	want, err := serial.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial.MappedBlocksCount == 0 || len(serial.BlockMap) < 2 {
+		t.Fatalf("unexpected bmap: %d mapped blocks in %d ranges", serial.MappedBlocksCount, len(serial.BlockMap))
+	}
+
+	// Check one range that crosses a chunk boundary against a plain hash.
+	data, err := os.ReadFile(imagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range serial.BlockMap {
+		br, err := r.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		start, end := br.Start, br.End
+		if start*4096 < createChunkSize && (end+1)*4096 > createChunkSize {
+			sum := sha256.Sum256(data[start*4096 : (end+1)*4096])
+			if got := r.Checksum; got != hex.EncodeToString(sum[:]) {
+				t.Errorf("range %s checksum = %s, want %x", r.Text, got, sum)
+			}
+		}
+	}
+
+	for _, workers := range []int{2, 8} {
+		b, err := Create(imagePath, CreateOptions{Workers: workers})
+		if err != nil {
+			t.Fatalf("Create with %d workers failed: %v", workers, err)
+		}
+		got, err := b.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("bmap with %d workers differs from a serial run", workers)
+		}
+
+		f, err := os.Open(imagePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		streamed, err := CreateFromReader(struct{ io.Reader }{f}, CreateOptions{Workers: workers})
+		f.Close()
+		if err != nil {
+			t.Fatalf("CreateFromReader with %d workers failed: %v", workers, err)
+		}
+		if got, _ := streamed.Marshal(); !bytes.Equal(got, want) {
+			t.Errorf("streamed bmap with %d workers differs from a serial run", workers)
+		}
+	}
+}
+
+func TestCreate_Progress(t *testing.T) {
+	imagePath := writeLargeImage(t, 2*createChunkSize)
+	var last, total int64
+	_, err := CreateFromReader(mustOpen(t, imagePath), CreateOptions{
+		Progress: func(read, tot int64) {
+			if read < last {
+				t.Errorf("progress went back from %d to %d", last, read)
+			}
+			last, total = read, tot
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateFromReader failed: %v", err)
+	}
+	if last != 2*createChunkSize || total != -1 {
+		t.Errorf("final progress = %d of %d, want %d of -1", last, total, 2*createChunkSize)
+	}
+}
+
+type failingReader struct{ n int }
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, errors.New("disk on fire")
+	}
+	n := min(len(p), r.n)
+	for i := range p[:n] {
+		p[i] = 1
+	}
+	r.n -= n
+	return n, nil
+}
+
+func TestCreateFromReader_ReadError(t *testing.T) {
+	_, err := CreateFromReader(&failingReader{n: 3 * createChunkSize}, CreateOptions{Workers: 4})
+	if err == nil || !strings.Contains(err.Error(), "disk on fire") {
+		t.Errorf("err = %v, want the read error", err)
+	}
+}
+
+func mustOpen(t testing.TB, path string) io.Reader {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func BenchmarkCreate(b *testing.B) {
+	const size = 64 << 20
+	imagePath := writeLargeImage(b, size)
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				if _, err := Create(imagePath, CreateOptions{Workers: workers}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package bmap
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Info summarises a bmap for display. See Inspect.
+type Info struct {
+	Version       string   `json:"version"`
+	ImageSize     int64    `json:"image_size"`
+	BlockSize     int      `json:"block_size"`
+	BlocksCount   int64    `json:"blocks_count"`
+	MappedBlocks  int64    `json:"mapped_blocks"` // As counted from the ranges
+	MappedBytes   int64    `json:"mapped_bytes"`
+	MappedPercent float64  `json:"mapped_percent"` // Of ImageSize
+	Ranges        int      `json:"ranges"`
+	ChecksumType  string   `json:"checksum_type"`
+	FileChecksum  string   `json:"file_checksum,omitempty"`
+	Integrity     string   `json:"integrity"`          // "ok", "none" or why the self-checksum check failed
+	Problems      []string `json:"problems,omitempty"` // Reported by Validate
+	LargestGaps   []Gap    `json:"largest_gaps"`
+}
+
+// Gap is a run of unmapped blocks from Start to End, inclusive.
+type Gap struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	Bytes int64 `json:"bytes"`
+}
+
+// Inspect parses a bmap like Parse, but reports a failed self-checksum or
+// a failed Validate in the returned Info instead of failing. Only XML that
+// can't be decoded is an error. At most maxGaps gaps are listed, largest
+// first.
+func Inspect(r io.Reader, maxGaps int) (*Bmap, *Info, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read bmap content: %w", err)
+	}
+	b, err := decode(content)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info := &Info{
+		Version:      b.Version,
+		ImageSize:    b.ImageSize,
+		BlockSize:    b.BlockSize,
+		BlocksCount:  b.BlocksCount,
+		Ranges:       len(b.BlockMap),
+		ChecksumType: b.ChecksumType,
+		FileChecksum: b.BmapFileChecksum,
+		Integrity:    "ok",
+		LargestGaps:  []Gap{},
+	}
+	if info.FileChecksum == "" {
+		info.FileChecksum = b.BmapFileSHA1
+	}
+	if info.FileChecksum == "" {
+		info.Integrity = "none"
+	} else if err := verifyIntegrity(b, content); err != nil {
+		info.Integrity = err.Error()
+	}
+	if err := b.Validate(); err != nil {
+		info.Problems = strings.Split(err.Error(), "\n")
+	}
+	if b.BlockSize <= 0 {
+		return b, info, nil
+	}
+
+	bs := int64(b.BlockSize)
+	bytesOf := func(start, end int64) int64 {
+		return max(0, min((end+1)*bs, b.ImageSize)-start*bs)
+	}
+	var gaps []Gap
+	next := int64(0)
+	for _, rng := range b.BlockMap {
+		r, err := rng.Parse()
+		if err != nil || r.Start < next {
+			continue // Reported in Problems
+		}
+		if r.Start > next {
+			gaps = append(gaps, Gap{Start: next, End: r.Start - 1, Bytes: bytesOf(next, r.Start-1)})
+		}
+		info.MappedBlocks += r.Count
+		info.MappedBytes += bytesOf(r.Start, r.End)
+		next = r.End + 1
+	}
+	if next < b.BlocksCount {
+		gaps = append(gaps, Gap{Start: next, End: b.BlocksCount - 1, Bytes: bytesOf(next, b.BlocksCount-1)})
+	}
+	if b.ImageSize > 0 {
+		info.MappedPercent = float64(info.MappedBytes) / float64(b.ImageSize) * 100
+	}
+
+	sort.SliceStable(gaps, func(i, j int) bool { return gaps[i].Bytes > gaps[j].Bytes })
+	if len(gaps) > maxGaps {
+		gaps = gaps[:maxGaps]
+	}
+	info.LargestGaps = append(info.LargestGaps, gaps...)
+	return b, info, nil
+}
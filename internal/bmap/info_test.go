@@ -0,0 +1,61 @@
+package bmap
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "bmaptool-sha256.bmap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, info, err := Inspect(bytes.NewReader(data), 1)
+	if err != nil {
+		t.Fatalf("Inspect failed: %v", err)
+	}
+	if info.Integrity != "ok" || len(info.Problems) != 0 {
+		t.Errorf("Integrity = %q, Problems = %v, want ok and none", info.Integrity, info.Problems)
+	}
+	if info.ImageSize != 41960 || info.BlocksCount != 11 || info.Ranges != 3 || info.ChecksumType != "sha256" {
+		t.Errorf("unexpected header: %+v", info)
+	}
+	if info.MappedBlocks != 5 || info.MappedBytes != 4*4096+1000 {
+		t.Errorf("mapped = %d blocks, %d bytes, want 5 blocks, %d bytes", info.MappedBlocks, info.MappedBytes, 4*4096+1000)
+	}
+	// Two gaps of 3 blocks; the first one wins the tie.
+	if want := []Gap{{Start: 3, End: 5, Bytes: 3 * 4096}}; !reflect.DeepEqual(info.LargestGaps, want) {
+		t.Errorf("LargestGaps = %+v, want %+v", info.LargestGaps, want)
+	}
+
+	t.Run("damaged", func(t *testing.T) {
+		tampered := bytes.Replace(data, []byte("<MappedBlocksCount> 5"), []byte("<MappedBlocksCount> 6"), 1)
+		if bytes.Equal(tampered, data) {
+			t.Fatal("fixture changed, tamper had no effect")
+		}
+		_, info, err := Inspect(bytes.NewReader(tampered), 5)
+		if err != nil {
+			t.Fatalf("Inspect failed: %v", err)
+		}
+		if !strings.Contains(info.Integrity, "mismatch") {
+			t.Errorf("Integrity = %q, want a checksum mismatch", info.Integrity)
+		}
+		if len(info.Problems) != 1 || !strings.Contains(info.Problems[0], "MappedBlocksCount") {
+			t.Errorf("Problems = %q, want the MappedBlocksCount mismatch", info.Problems)
+		}
+		if len(info.LargestGaps) != 2 {
+			t.Errorf("LargestGaps = %+v, want both gaps", info.LargestGaps)
+		}
+	})
+
+	t.Run("not xml", func(t *testing.T) {
+		if _, _, err := Inspect(strings.NewReader("not a bmap"), 5); err == nil {
+			t.Error("Inspect accepted garbage")
+		}
+	})
+}
@@ -0,0 +1,92 @@
+package bmap
+
+import (
+	"fmt"
+	"io"
+)
+
+// Mismatch is a range whose data in the image doesn't match its checksum.
+type Mismatch struct {
+	Range BlockRange
+	Got   string // Checksum of the image data
+}
+
+// Match hashes the mapped ranges of an image and compares them with the
+// range checksums of b, which must be sorted (see Validate). r is read from
+// its current position, taken as the start of the image; unmapped data is
+// seeked over if r is an io.Seeker and read otherwise. Every mismatching
+// range is returned. An image too short to hold a range is an error.
+//
+// progress, if not nil, is called with the bytes hashed so far and the
+// total.
+func Match(r io.Reader, b *Bmap, progress func(done, total int64)) ([]Mismatch, error) {
+	bs := int64(b.BlockSize)
+	ranges := make([]BlockRange, 0, len(b.BlockMap))
+	var total int64
+	for _, rng := range b.BlockMap {
+		br, err := rng.Parse()
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, br)
+		total += min((br.End+1)*bs, b.ImageSize) - br.Start*bs
+	}
+
+	seeker, _ := r.(io.Seeker)
+	var origin int64
+	if seeker != nil {
+		var err error
+		if origin, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			seeker = nil
+		}
+	}
+
+	var mismatches []Mismatch
+	var pos, done int64
+	buf := make([]byte, 4*1024*1024)
+	for _, br := range ranges {
+		start := br.Start * bs
+		end := min((br.End+1)*bs, b.ImageSize)
+		if start < pos {
+			return nil, fmt.Errorf("range %d-%d is not sorted", br.Start, br.End)
+		}
+		if seeker != nil {
+			if _, err := seeker.Seek(origin+start, io.SeekStart); err != nil {
+				return nil, fmt.Errorf("failed to seek to block %d: %w", br.Start, err)
+			}
+		} else if n, err := io.CopyN(io.Discard, r, start-pos); err != nil {
+			return nil, shortImage(err, br, pos+n)
+		}
+
+		hasher, err := GetHasher(b.ChecksumType)
+		if err != nil {
+			return nil, err
+		}
+		for off := start; off < end; {
+			n, err := io.ReadFull(r, buf[:min(int64(len(buf)), end-off)])
+			hasher.Write(buf[:n])
+			off += int64(n)
+			done += int64(n)
+			if err != nil {
+				return nil, shortImage(err, br, off)
+			}
+			if progress != nil {
+				progress(done, total)
+			}
+		}
+		pos = end
+
+		// Early 1.x bmaps may omit range checksums.
+		if got := fmt.Sprintf("%x", hasher.Sum(nil)); br.Checksum != "" && got != br.Checksum {
+			mismatches = append(mismatches, Mismatch{Range: br, Got: got})
+		}
+	}
+	return mismatches, nil
+}
+
+func shortImage(err error, br BlockRange, at int64) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("image ends at byte %d, inside or before range %d-%d", at, br.Start, br.End)
+	}
+	return fmt.Errorf("failed to read range %d-%d: %w", br.Start, br.End, err)
+}
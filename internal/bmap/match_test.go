@@ -0,0 +1,60 @@
+package bmap
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	imagePath := writeFixtureImage(t)
+	b, err := Create(imagePath, CreateOptions{})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	data, err := os.ReadFile(imagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, r := range map[string]io.Reader{
+		"seeker": bytes.NewReader(data),
+		"stream": struct{ io.Reader }{bytes.NewReader(data)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var done, total int64
+			mismatches, err := Match(r, b, func(d, tot int64) { done, total = d, tot })
+			if err != nil {
+				t.Fatalf("Match failed: %v", err)
+			}
+			if len(mismatches) != 0 {
+				t.Errorf("mismatches = %+v, want none", mismatches)
+			}
+			if done != 4*4096+1000 || total != done {
+				t.Errorf("progress = %d of %d, want %d of %d", done, total, 4*4096+1000, 4*4096+1000)
+			}
+		})
+	}
+
+	t.Run("changed block", func(t *testing.T) {
+		changed := bytes.Clone(data)
+		changed[6*4096+17] ^= 0xff
+		changed[8*4096] = 1 // Unmapped, so not noticed
+		mismatches, err := Match(bytes.NewReader(changed), b, nil)
+		if err != nil {
+			t.Fatalf("Match failed: %v", err)
+		}
+		if len(mismatches) != 1 || mismatches[0].Range.Start != 6 || mismatches[0].Got == mismatches[0].Range.Checksum {
+			t.Errorf("mismatches = %+v, want range 6", mismatches)
+		}
+	})
+
+	t.Run("short image", func(t *testing.T) {
+		_, err := Match(struct{ io.Reader }{bytes.NewReader(data[:7*4096-1])}, b, nil)
+		if err == nil || !strings.Contains(err.Error(), "image ends") {
+			t.Errorf("err = %v, want a short image error", err)
+		}
+	})
+}
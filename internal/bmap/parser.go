@@ -16,20 +16,69 @@ func Parse(r io.Reader) (*Bmap, error) {
 		return nil, fmt.Errorf("failed to read bmap content: %w", err)
 	}
 
+	b, err := decode(content)
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify integrity
+	if err := verifyIntegrity(b, content); err != nil {
+		return nil, fmt.Errorf("bmap integrity check failed: %w", err)
+	}
+
+	return b, nil
+}
+
+// decode unmarshals and normalizes a bmap without checking its integrity.
+func decode(content []byte) (*Bmap, error) {
 	var b Bmap
 	if err := xml.Unmarshal(content, &b); err != nil {
 		return nil, fmt.Errorf("failed to decode bmap xml: %w", err)
 	}
 	b.Trim()
 
-	// Verify integrity
-	if err := verifyIntegrity(&b, content); err != nil {
-		return nil, fmt.Errorf("bmap integrity check failed: %w", err)
+	if err := b.normalize(); err != nil {
+		return nil, err
 	}
-
 	return &b, nil
 }
 
+// MajorVersion returns the major number of the bmap format version.
+func (b *Bmap) MajorVersion() (int, error) {
+	major, _, _ := strings.Cut(b.Version, ".")
+	n, err := strconv.Atoi(major)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bmap format version %q", b.Version)
+	}
+	return n, nil
+}
+
+// normalize maps the older format onto the 2.x fields used by the rest of the
+// code. Format 1.x has no ChecksumType and stores SHA1 range hashes in a sha1
+// attribute; 2.x names the algorithm and uses chksum.
+func (b *Bmap) normalize() error {
+	major, err := b.MajorVersion()
+	if err != nil {
+		return err
+	}
+	switch major {
+	case 1:
+		if b.ChecksumType == "" {
+			b.ChecksumType = "sha1"
+		}
+		for i := range b.BlockMap {
+			if b.BlockMap[i].Checksum == "" {
+				b.BlockMap[i].Checksum = b.BlockMap[i].SHA1
+			}
+			b.BlockMap[i].SHA1 = ""
+		}
+	case 2:
+	default:
+		return fmt.Errorf("unsupported bmap format version %s (supported: 1.x, 2.x)", b.Version)
+	}
+	return nil
+}
+
 func verifyIntegrity(b *Bmap, content []byte) error {
 	var expectedChecksum string
 	var algo string
@@ -82,16 +131,17 @@ func (b *Bmap) Trim() {
 	b.BmapFileSHA1 = strings.TrimSpace(b.BmapFileSHA1)
 	for i := range b.BlockMap {
 		b.BlockMap[i].Checksum = strings.TrimSpace(b.BlockMap[i].Checksum)
+		b.BlockMap[i].SHA1 = strings.TrimSpace(b.BlockMap[i].SHA1)
 		b.BlockMap[i].Text = strings.TrimSpace(b.BlockMap[i].Text)
 	}
 }
 
 // BlockRange represents a parsed range of blocks
 type BlockRange struct {
-	Start    int64
-	End      int64 // Inclusive
-	Count    int64
-	Checksum string
+	Start    int64  `json:"start"`
+	End      int64  `json:"end"` // Inclusive
+	Count    int64  `json:"count"`
+	Checksum string `json:"checksum,omitempty"`
 }
 
 // Parse converts the XML Range text into a BlockRange
@@ -4,6 +4,8 @@ import (
 	"crypto/sha1"
 	"crypto/sha256"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -100,3 +102,122 @@ func TestSHA1Integrity(t *testing.T) {
         t.Errorf("unexpected SHA1: %s", b.BmapFileSHA1)
     }
 }
+
+// withSelfChecksum fills in PLACEHOLDER the way bmaptool computes the bmap
+// file checksum: over the file with the checksum field set to zeros.
+func withSelfChecksum(content, algo string) string {
+	if !strings.Contains(content, "PLACEHOLDER") {
+		return content
+	}
+	h, _ := GetHasher(algo)
+	zeroed := strings.Replace(content, "PLACEHOLDER", strings.Repeat("0", h.Size()*2), 1)
+	h.Write([]byte(zeroed))
+	return strings.Replace(content, "PLACEHOLDER", fmt.Sprintf("%x", h.Sum(nil)), 1)
+}
+
+func TestParseVersions(t *testing.T) {
+	sha1Range := strings.Repeat("a", 40)
+	sha256Range := strings.Repeat("b", 64)
+
+	tests := []struct {
+		version  string
+		header   string // version-specific elements
+		rangeTag string
+		algo     string
+		checksum string
+	}{
+		{"1.0", "", `sha1="` + sha1Range + `"`, "sha1", sha1Range},
+		{"1.2", "", `sha1="` + sha1Range + `"`, "sha1", sha1Range},
+		{"1.3", "<BmapFileSHA1> PLACEHOLDER </BmapFileSHA1>", `sha1="` + sha1Range + `"`, "sha1", sha1Range},
+		{"1.4", "<BmapFileSHA1> PLACEHOLDER </BmapFileSHA1>", `sha1="` + sha1Range + `"`, "sha1", sha1Range},
+		{"2.0", "<ChecksumType> sha256 </ChecksumType>\n    <BmapFileChecksum> PLACEHOLDER </BmapFileChecksum>", `chksum="` + sha256Range + `"`, "sha256", sha256Range},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			content := withSelfChecksum(fmt.Sprintf(`<?xml version="1.0" ?>
+<bmap version="%s">
+    <ImageSize> 16384 </ImageSize>
+    <BlockSize> 4096 </BlockSize>
+    <BlocksCount> 4 </BlocksCount>
+    <MappedBlocksCount> 3 </MappedBlocksCount>
+    %s
+    <BlockMap>
+        <Range %s> 0-1 </Range>
+        <Range %s> 3 </Range>
+    </BlockMap>
+</bmap>`, tt.version, tt.header, tt.rangeTag, tt.rangeTag), tt.algo)
+
+			b, err := Parse(strings.NewReader(content))
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			checkParsed := func(b *Bmap) {
+				t.Helper()
+				if b.Version != tt.version {
+					t.Errorf("Version = %q, want %q", b.Version, tt.version)
+				}
+				if b.ChecksumType != tt.algo {
+					t.Errorf("ChecksumType = %q, want %q", b.ChecksumType, tt.algo)
+				}
+				if len(b.BlockMap) != 2 {
+					t.Fatalf("got %d ranges, want 2", len(b.BlockMap))
+				}
+				for i, r := range b.BlockMap {
+					if r.Checksum != tt.checksum {
+						t.Errorf("range %d checksum = %q, want %q", i, r.Checksum, tt.checksum)
+					}
+					if r.SHA1 != "" {
+						t.Errorf("range %d SHA1 = %q, want it moved to Checksum", i, r.SHA1)
+					}
+				}
+			}
+			checkParsed(b)
+
+			// Round trip: Save must keep the version's layout.
+			path := filepath.Join(t.TempDir(), "image.bmap")
+			if err := b.Save(path); err != nil {
+				t.Fatalf("Save failed: %v", err)
+			}
+			saved, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(saved), tt.rangeTag) {
+				t.Errorf("saved bmap lacks %s:\n%s", tt.rangeTag, saved)
+			}
+			if strings.HasPrefix(tt.version, "1.") && strings.Contains(string(saved), "ChecksumType") {
+				t.Errorf("saved 1.x bmap has a ChecksumType:\n%s", saved)
+			}
+
+			b2, err := Parse(strings.NewReader(string(saved)))
+			if err != nil {
+				t.Fatalf("Parse of saved bmap failed: %v", err)
+			}
+			checkParsed(b2)
+		})
+	}
+}
+
+func TestParseRejectsUnknownVersion(t *testing.T) {
+	for _, version := range []string{"3.0", "0.9", "", "two"} {
+		content := fmt.Sprintf(`<?xml version="1.0" ?>
+<bmap version="%s">
+    <ImageSize> 4096 </ImageSize>
+    <BlockSize> 4096 </BlockSize>
+    <BlocksCount> 1 </BlocksCount>
+    <MappedBlocksCount> 1 </MappedBlocksCount>
+    <BlockMap>
+        <Range> 0 </Range>
+    </BlockMap>
+</bmap>`, version)
+		_, err := Parse(strings.NewReader(content))
+		if err == nil {
+			t.Errorf("Parse accepted version %q", version)
+			continue
+		}
+		if !strings.Contains(err.Error(), "version") {
+			t.Errorf("version %q: error %q does not mention the version", version, err)
+		}
+	}
+}
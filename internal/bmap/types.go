@@ -10,14 +10,15 @@ type Bmap struct {
 	BlockSize         int      `xml:"BlockSize"`
 	BlocksCount       int64    `xml:"BlocksCount"`
 	MappedBlocksCount int64    `xml:"MappedBlocksCount"`
-	ChecksumType      string   `xml:"ChecksumType"`
-	BmapFileChecksum  string   `xml:"BmapFileChecksum"`
-	BmapFileSHA1      string   `xml:"BmapFileSHA1"`
+	ChecksumType      string   `xml:"ChecksumType,omitempty"`     // 2.x only; Parse sets "sha1" for 1.x
+	BmapFileChecksum  string   `xml:"BmapFileChecksum,omitempty"` // 2.x
+	BmapFileSHA1      string   `xml:"BmapFileSHA1,omitempty"`     // 1.3 and 1.4
 	BlockMap          []Range  `xml:"BlockMap>Range"`
 }
 
 // Range represents a single range entry in the BlockMap
 type Range struct {
-	Checksum string `xml:"chksum,attr"`
+	Checksum string `xml:"chksum,attr,omitempty"`
+	SHA1     string `xml:"sha1,attr,omitempty"` // 1.x; Parse moves it to Checksum
 	Text     string `xml:",chardata"`
 }
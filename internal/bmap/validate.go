@@ -0,0 +1,123 @@
+package bmap
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// maxValidationErrors caps how many problems Validate reports, so a bmap
+// with thousands of bad ranges still produces a readable error.
+const maxValidationErrors = 20
+
+// Validate checks the bmap for semantic consistency: the header fields agree
+// with each other, ranges are sorted, don't overlap and fit in BlocksCount,
+// they add up to MappedBlocksCount, and checksums have the length of
+// ChecksumType. Parse only checks that the XML is well formed and intact, so
+// Validate should run before a bmap is used to drive a write.
+//
+// All problems found are joined into the returned error, one per line.
+func (b *Bmap) Validate() error {
+	var errs []error
+	add := func(format string, args ...any) bool {
+		errs = append(errs, fmt.Errorf(format, args...))
+		return len(errs) < maxValidationErrors
+	}
+
+	if b.BlockSize <= 0 {
+		add("BlockSize must be positive, got %d", b.BlockSize)
+		return errors.Join(errs...)
+	}
+	if b.ImageSize < 0 {
+		add("ImageSize must not be negative, got %d", b.ImageSize)
+	}
+	if want := (b.ImageSize + int64(b.BlockSize) - 1) / int64(b.BlockSize); b.BlocksCount != want {
+		add("BlocksCount is %d, but ImageSize %d with BlockSize %d needs %d blocks", b.BlocksCount, b.ImageSize, b.BlockSize, want)
+	}
+
+	major, _ := b.MajorVersion()
+	digits := 0
+	if hasher, err := GetHasher(b.ChecksumType); err == nil {
+		digits = hasher.Size() * 2
+	} else {
+		add("ChecksumType: %v", err)
+	}
+
+	var mapped int64
+	rangesOK := true
+	prev := BlockRange{Start: -1, End: -1}
+	for i, rng := range b.BlockMap {
+		r, err := rng.Parse()
+		if err != nil {
+			rangesOK = false
+			if !add("range %d: %v", i+1, err) {
+				break
+			}
+			continue
+		}
+
+		var problem string
+		switch {
+		case r.Start < 0:
+			problem = "starts before block 0"
+		case r.End < r.Start:
+			problem = "ends before it starts"
+		case r.End >= b.BlocksCount:
+			problem = fmt.Sprintf("ends past the last block %d", b.BlocksCount-1)
+		case r.Start < prev.Start:
+			problem = fmt.Sprintf("is not sorted after %d-%d", prev.Start, prev.End)
+		case r.Start <= prev.End:
+			problem = fmt.Sprintf("overlaps %d-%d", prev.Start, prev.End)
+		}
+		if problem != "" {
+			rangesOK = false
+			if !add("range %d (%s) %s", i+1, rng.Text, problem) {
+				break
+			}
+			continue
+		}
+
+		switch {
+		case r.Checksum == "" && major >= 2:
+			problem = "has no checksum"
+		case r.Checksum == "" || digits == 0:
+		case len(r.Checksum) != digits:
+			problem = fmt.Sprintf("has a %d-digit checksum, %s needs %d", len(r.Checksum), b.ChecksumType, digits)
+		default:
+			if _, err := hex.DecodeString(r.Checksum); err != nil {
+				problem = fmt.Sprintf("has a checksum that is not hex: %q", r.Checksum)
+			}
+		}
+		if problem != "" && !add("range %d (%s) %s", i+1, rng.Text, problem) {
+			break
+		}
+
+		mapped += r.Count
+		prev = r
+	}
+
+	// The block count is only meaningful if every range could be counted.
+	if rangesOK && mapped != b.MappedBlocksCount {
+		add("MappedBlocksCount is %d, but the ranges cover %d blocks", b.MappedBlocksCount, mapped)
+	}
+	return errors.Join(errs...)
+}
+
+// ParseFile reads, parses and validates the bmap at path.
+func ParseFile(path string) (*Bmap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b, err := Parse(f)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid bmap %s:\n%w", path, err)
+	}
+	return b, nil
+}
@@ -0,0 +1,114 @@
+package bmap
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func validBmap() *Bmap {
+	return &Bmap{
+		Version:           "2.0",
+		ImageSize:         10*4096 - 100,
+		BlockSize:         4096,
+		BlocksCount:       10,
+		MappedBlocksCount: 6,
+		ChecksumType:      "sha256",
+		BlockMap: []Range{
+			{Text: "0-2", Checksum: strings.Repeat("a", 64)},
+			{Text: "5", Checksum: strings.Repeat("b", 64)},
+			{Text: "8-9", Checksum: strings.Repeat("c", 64)},
+		},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := validBmap().Validate(); err != nil {
+		t.Fatalf("Validate() on a valid bmap = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(b *Bmap)
+		want   string
+	}{
+		{"zero block size", func(b *Bmap) { b.BlockSize = 0 }, "BlockSize must be positive"},
+		{"blocks count", func(b *Bmap) { b.BlocksCount = 11 }, "BlocksCount is 11, but ImageSize 40860 with BlockSize 4096 needs 10 blocks"},
+		{"mapped count", func(b *Bmap) { b.MappedBlocksCount = 7 }, "MappedBlocksCount is 7, but the ranges cover 6 blocks"},
+		{"unsorted", func(b *Bmap) { b.BlockMap[0], b.BlockMap[1] = b.BlockMap[1], b.BlockMap[0] }, "range 2 (0-2) is not sorted after 5-5"},
+		{"overlap", func(b *Bmap) { b.BlockMap[1].Text = "2-5" }, "range 2 (2-5) overlaps 0-2"},
+		{"past end", func(b *Bmap) { b.BlockMap[2].Text = "8-10" }, "range 3 (8-10) ends past the last block 9"},
+		{"reversed", func(b *Bmap) { b.BlockMap[2].Text = "9-8" }, "range 3 (9-8) ends before it starts"},
+		{"bad syntax", func(b *Bmap) { b.BlockMap[0].Text = "x-2" }, "range 1: invalid range start 'x'"},
+		{"checksum length", func(b *Bmap) { b.BlockMap[1].Checksum = strings.Repeat("b", 40) }, "range 2 (5) has a 40-digit checksum, sha256 needs 64"},
+		{"checksum hex", func(b *Bmap) { b.BlockMap[1].Checksum = strings.Repeat("z", 64) }, "range 2 (5) has a checksum that is not hex"},
+		{"missing checksum", func(b *Bmap) { b.BlockMap[1].Checksum = "" }, "range 2 (5) has no checksum"},
+		{"checksum type", func(b *Bmap) { b.ChecksumType = "md5" }, "unsupported checksum algorithm: md5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := validBmap()
+			tt.modify(b)
+			err := b.Validate()
+			if err == nil {
+				t.Fatal("Validate() = nil, want error")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Validate() = %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateLegacyWithoutChecksums(t *testing.T) {
+	b := validBmap()
+	b.Version = "1.0"
+	b.ChecksumType = "sha1"
+	for i := range b.BlockMap {
+		b.BlockMap[i].Checksum = ""
+	}
+	if err := b.Validate(); err != nil {
+		t.Errorf("Validate() on 1.0 bmap without checksums = %v", err)
+	}
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	b := validBmap()
+	b.BlocksCount = 11
+	b.BlockMap[1].Text = "2-5"
+	b.BlockMap[2].Checksum = "abc"
+
+	err := b.Validate()
+	if err == nil {
+		t.Fatal("Validate() = nil, want error")
+	}
+	if lines := strings.Split(err.Error(), "\n"); len(lines) != 3 {
+		t.Errorf("got %d problems, want 3:\n%v", len(lines), err)
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "image.bmap")
+	if err := validBmap().Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseFile(path); err != nil {
+		t.Fatalf("ParseFile() on a valid bmap = %v", err)
+	}
+
+	b := validBmap()
+	b.BlockMap[1].Text = "2-5"
+	if err := b.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	_, err := ParseFile(path)
+	if err == nil || !strings.Contains(err.Error(), "overlaps") {
+		t.Errorf("ParseFile() on overlapping ranges = %v", err)
+	}
+
+	if _, err := ParseFile(filepath.Join(dir, "missing.bmap")); !os.IsNotExist(err) {
+		t.Errorf("ParseFile() on a missing file = %v, want not-exist", err)
+	}
+}
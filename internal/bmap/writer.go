@@ -0,0 +1,150 @@
+package bmap
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// headerComment is the explanation bmaptool puts at the top of every bmap.
+const headerComment = `<!-- This file contains the block map for an image file, which is basically
+     a list of useful (mapped) block numbers in the image file. In other words,
+     it lists only those blocks which contain data (boot sector, partition
+     table, file-system metadata, files, directories, extents, etc). These
+     blocks have to be copied to the target device. The other blocks do not
+     contain any useful data and do not have to be copied to the target
+     device.
+
+     The block map an optimization which allows to copy or flash the image to
+     the image quicker than copying of flashing the entire image. This is
+     because with bmap less data is copied: <MappedBlocksCount> blocks instead
+     of <BlocksCount> blocks.
+
+     Besides the machine-readable data, this file contains useful commentaries
+     which contain human-readable information like image size, percentage of
+     mapped data, etc.
+
+     The 'version' attribute is the block map file format version in the
+     'major.minor' format. The version major number is increased whenever an
+     incompatible block map format change is made. The minor number changes
+     in case of minor backward-compatible changes. -->
+`
+
+// Marshal encodes b the way bmaptool's BmapCreate writes it, comments and
+// column layout included, so files from either tool diff cleanly. The file
+// checksum is computed over the output with the checksum field zeroed and
+// then substituted in. Format 1.x gets sha1 range attributes, no
+// ChecksumType, and a BmapFileSHA1 from 1.3 on. A self-checksum carried over
+// from a parsed file is ignored since it would no longer match.
+func (b *Bmap) Marshal() ([]byte, error) {
+	major, err := b.MajorVersion()
+	if err != nil {
+		return nil, err
+	}
+	_, minorStr, _ := strings.Cut(b.Version, ".")
+	minor, _ := strconv.Atoi(minorStr)
+
+	// Algorithm and element name of the self-checksum, if the version has one.
+	selfAlgo, selfTag, rangeAttr := b.ChecksumType, "BmapFileChecksum", "chksum"
+	if major == 1 {
+		selfAlgo, selfTag, rangeAttr = "sha1", "BmapFileSHA1", "sha1"
+		if minor < 3 {
+			selfTag = ""
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("<?xml version=\"1.0\" ?>\n")
+	buf.WriteString(headerComment)
+	fmt.Fprintf(&buf, "\n<bmap version=\"%s\">\n", b.Version)
+
+	imageSize := humanSize(b.ImageSize)
+	fmt.Fprintf(&buf, "    <!-- Image size in bytes: %s -->\n", imageSize)
+	fmt.Fprintf(&buf, "    <ImageSize> %d </ImageSize>\n\n", b.ImageSize)
+	buf.WriteString("    <!-- Size of a block in bytes -->\n")
+	fmt.Fprintf(&buf, "    <BlockSize> %d </BlockSize>\n\n", b.BlockSize)
+	buf.WriteString("    <!-- Count of blocks in the image file -->\n")
+	fmt.Fprintf(&buf, "    <BlocksCount> %d </BlocksCount>\n\n", b.BlocksCount)
+
+	// bmaptool reserves these fields before it knows the mapped count and
+	// patches them in place afterwards, which leaves trailing padding.
+	var percent float64
+	if b.BlocksCount > 0 {
+		percent = float64(b.MappedBlocksCount) * 100 / float64(b.BlocksCount)
+	}
+	mapped := fmt.Sprintf("%s or %.1f%%", humanSize(b.MappedBlocksCount*int64(b.BlockSize)), percent)
+	fmt.Fprintf(&buf, "    <!-- Count of mapped blocks: %s-->\n",
+		overlay(strings.Repeat(" ", len(imageSize)+len(" or ")+len("100.0%"))+"   ", mapped))
+	fmt.Fprintf(&buf, "    <MappedBlocksCount> %s </MappedBlocksCount>\n\n",
+		overlay(strings.Repeat(" ", len(strconv.FormatInt(b.BlocksCount, 10))), strconv.FormatInt(b.MappedBlocksCount, 10)))
+
+	if major != 1 {
+		buf.WriteString("    <!-- Type of checksum used in this file -->\n")
+		fmt.Fprintf(&buf, "    <ChecksumType> %s </ChecksumType>\n\n", b.ChecksumType)
+	}
+
+	checksumPos := -1
+	checksumLen := 0
+	if selfTag != "" {
+		hasher, err := GetHasher(selfAlgo)
+		if err != nil {
+			return nil, err
+		}
+		checksumLen = hasher.Size() * 2
+		buf.WriteString("    <!-- The checksum of this bmap file. When it is calculated, the value of\n")
+		buf.WriteString("         the checksum has be zero (all ASCII \"0\" symbols).  -->\n")
+		fmt.Fprintf(&buf, "    <%s> ", selfTag)
+		checksumPos = buf.Len()
+		fmt.Fprintf(&buf, "%s </%s>\n\n", strings.Repeat("0", checksumLen), selfTag)
+	}
+
+	buf.WriteString("    <!-- The block map which consists of elements which may either be a\n")
+	buf.WriteString("         range of blocks or a single block. The 'chksum' attribute\n")
+	buf.WriteString("         (if present) is the checksum of this blocks range. -->\n")
+	buf.WriteString("    <BlockMap>\n")
+	for _, r := range b.BlockMap {
+		attr := ""
+		if r.Checksum != "" {
+			attr = fmt.Sprintf(" %s=\"%s\"", rangeAttr, r.Checksum)
+		}
+		fmt.Fprintf(&buf, "        <Range%s> %s </Range>\n", attr, strings.TrimSpace(r.Text))
+	}
+	buf.WriteString("    </BlockMap>\n")
+	buf.WriteString("</bmap>\n")
+
+	out := buf.Bytes()
+	if checksumPos >= 0 {
+		hasher, _ := GetHasher(selfAlgo)
+		hasher.Write(out)
+		copy(out[checksumPos:checksumPos+checksumLen], fmt.Sprintf("%x", hasher.Sum(nil)))
+	}
+	return out, nil
+}
+
+// overlay writes s over the start of field, like bmaptool seeking back into
+// its reserved space. A longer s pushes past the end of the field.
+func overlay(field, s string) string {
+	if len(s) >= len(field) {
+		return s
+	}
+	return s + field[len(s):]
+}
+
+// humanSize formats a byte count like bmaptool's human_size helper.
+func humanSize(size int64) string {
+	if size == 1 {
+		return "1 byte"
+	}
+	if size < 512 {
+		return fmt.Sprintf("%d bytes", size)
+	}
+	value := float64(size)
+	for _, unit := range []string{"KiB", "MiB", "GiB", "TiB", "PiB"} {
+		value /= 1024
+		if value < 1024 {
+			return fmt.Sprintf("%.1f %s", value, unit)
+		}
+	}
+	return fmt.Sprintf("%.1f EiB", value/1024)
+}
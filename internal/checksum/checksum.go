@@ -0,0 +1,154 @@
+// Package checksum reads the checksum files published next to images:
+// SHA256SUMS and SHA512SUMS, which list the checksums of several files as
+// sha256sum and sha512sum write them, and image.sha256 or image.sha512,
+// which hold the checksum of a single one.
+//
+// Lines are in the format of sha256sum ("<hex>  <name>", or "<hex> *<name>"
+// for binary mode) or of sha256sum --tag ("SHA256 (<name>) = <hex>"). A
+// single-file checksum file may also hold the bare checksum.
+package checksum
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// ErrNoEntry is returned when a checksum file has no checksum for a file.
+	ErrNoEntry = errors.New("no checksum listed")
+	// ErrMismatch is returned when a file doesn't have the checksum listed.
+	ErrMismatch = errors.New("checksum mismatch")
+)
+
+// Sum is the checksum a checksum file lists for a file.
+type Sum struct {
+	Algorithm string // "sha256" or "sha512"
+	Hex       string // In lower case
+}
+
+func (s Sum) String() string {
+	return s.Algorithm + ":" + s.Hex
+}
+
+// New returns a hash of the algorithm of s.
+func (s Sum) New() hash.Hash {
+	if s.Algorithm == "sha512" {
+		return sha512.New()
+	}
+	return sha256.New()
+}
+
+// Check compares got, the checksum of the file name, with s.
+func (s Sum) Check(got []byte, name string) error {
+	if hex.EncodeToString(got) != s.Hex {
+		return fmt.Errorf("%w: %s of %s is %x, want %s", ErrMismatch, s.Algorithm, name, got, s.Hex)
+	}
+	return nil
+}
+
+// CheckFile hashes the file at path and compares it with s.
+func (s Sum) CheckFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := s.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	return s.Check(h.Sum(nil), filepath.Base(path))
+}
+
+// Find returns the checksum file next to imagePath that lists it, trying
+// image.wic.zst.sha256, image.wic.zst.sha512, SHA256SUMS and SHA512SUMS for
+// image.wic.zst, or "" if there is none.
+func Find(imagePath string) string {
+	dir := filepath.Dir(imagePath)
+	candidates := []string{
+		imagePath + ".sha256",
+		imagePath + ".sha512",
+		filepath.Join(dir, "SHA256SUMS"),
+		filepath.Join(dir, "SHA512SUMS"),
+	}
+	for _, c := range candidates {
+		if _, err := Lookup(c, filepath.Base(imagePath)); err == nil {
+			return c
+		}
+	}
+	return ""
+}
+
+// Lookup returns the checksum the checksum file at path lists for the file
+// name, without directory. A bare checksum is taken to be name's only in a
+// single-file checksum file, named *.sha256 or *.sha512.
+func Lookup(path, name string) (Sum, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	singleFile := ext == ".sha256" || ext == ".sha512"
+
+	f, err := os.Open(path)
+	if err != nil {
+		return Sum{}, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sum, entry, ok := parseLine(line)
+		if !ok {
+			continue
+		}
+		entry = strings.TrimPrefix(filepath.ToSlash(entry), "./")
+		if entry == name || entry == "" && singleFile {
+			return sum, nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return Sum{}, err
+	}
+	return Sum{}, fmt.Errorf("%w for %s in %s", ErrNoEntry, name, path)
+}
+
+// parseLine splits a line of a checksum file into the checksum and the name
+// of the file, "" for a bare checksum.
+func parseLine(line string) (Sum, string, bool) {
+	var sumHex, name string
+	if tag, rest, ok := strings.Cut(line, " ("); ok && !strings.ContainsAny(tag, " \t") {
+		// SHA256 (name) = hex
+		i := strings.LastIndex(rest, ") = ")
+		if i < 0 {
+			return Sum{}, "", false
+		}
+		name, sumHex = rest[:i], rest[i+4:]
+	} else {
+		sumHex, name, _ = strings.Cut(line, " ")
+		name = strings.TrimPrefix(strings.TrimLeft(name, " "), "*")
+	}
+
+	sum := Sum{Hex: strings.ToLower(sumHex)}
+	switch len(sum.Hex) {
+	case 2 * sha256.Size:
+		sum.Algorithm = "sha256"
+	case 2 * sha512.Size:
+		sum.Algorithm = "sha512"
+	default:
+		return Sum{}, "", false // md5 and sha1 lists are of no use
+	}
+	if _, err := hex.DecodeString(sum.Hex); err != nil {
+		return Sum{}, "", false
+	}
+	return sum, name, true
+}
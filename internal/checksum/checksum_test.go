@@ -0,0 +1,96 @@
+package checksum
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	sum256 := fmt.Sprintf("%x", sha256.Sum256([]byte("image")))
+	sum512 := fmt.Sprintf("%x", sha512.Sum512([]byte("image")))
+	other := fmt.Sprintf("%x", sha256.Sum256([]byte("other")))
+
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    Sum
+	}{
+		{"text mode", "SHA256SUMS", other + "  other.img\n" + sum256 + "  image.wic.zst\n", Sum{"sha256", sum256}},
+		{"binary mode", "SHA256SUMS", sum256 + " *image.wic.zst\n", Sum{"sha256", sum256}},
+		{"relative", "SHA256SUMS", sum256 + "  ./image.wic.zst\n", Sum{"sha256", sum256}},
+		{"tag", "SHA512SUMS", "# release 1.0\nSHA512 (image.wic.zst) = " + sum512 + "\n", Sum{"sha512", sum512}},
+		{"bare", "image.wic.zst.sha256", sum256 + "\n", Sum{"sha256", sum256}},
+		{"bare sha512", "image.wic.zst.sha512", sum512 + "\n", Sum{"sha512", sum512}},
+		{"upper case", "image.wic.zst.sha256", fmt.Sprintf("%X  image.wic.zst\r\n", sha256.Sum256([]byte("image"))), Sum{"sha256", sum256}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := Lookup(path, "image.wic.zst")
+			if err != nil || got != tt.want {
+				t.Errorf("Lookup = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+
+	path := filepath.Join(t.TempDir(), "SHA256SUMS")
+	os.WriteFile(path, []byte(other+"  other.img\nd41d8cd98f00b204e9800998ecf8427e  image.wic.zst\n"), 0644)
+	if _, err := Lookup(path, "image.wic.zst"); !errors.Is(err, ErrNoEntry) {
+		t.Errorf("Lookup of a file listed with md5 only: err = %v, want ErrNoEntry", err)
+	}
+
+	// A bare checksum in a list of several files could be any file's.
+	os.WriteFile(path, []byte(other+"  other.img\n"+sum256+"\n"), 0644)
+	if _, err := Lookup(path, "image.wic.zst"); !errors.Is(err, ErrNoEntry) {
+		t.Errorf("Lookup of a bare checksum in SHA256SUMS: err = %v, want ErrNoEntry", err)
+	}
+}
+
+func TestFind(t *testing.T) {
+	dir := t.TempDir()
+	imagePath := filepath.Join(dir, "image.wic.zst")
+	line := fmt.Sprintf("%x  image.wic.zst\n", sha256.Sum256([]byte("image")))
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := Find(imagePath); got != "" {
+		t.Errorf("Find = %q with no checksum file", got)
+	}
+	// SHA256SUMS listing other files only is passed over.
+	write("SHA256SUMS", fmt.Sprintf("%x  other.img\n", sha256.Sum256(nil)))
+	write("SHA512SUMS", fmt.Sprintf("%x  image.wic.zst\n", sha512.Sum512(nil)))
+	if got := Find(imagePath); got != filepath.Join(dir, "SHA512SUMS") {
+		t.Errorf("Find = %q, want SHA512SUMS", got)
+	}
+	write("image.wic.zst.sha256", line)
+	if got := Find(imagePath); got != imagePath+".sha256" {
+		t.Errorf("Find = %q, want image.wic.zst.sha256", got)
+	}
+}
+
+func TestCheckFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "image.img")
+	if err := os.WriteFile(path, []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	good := Sum{"sha256", fmt.Sprintf("%x", sha256.Sum256([]byte("image")))}
+	if err := good.CheckFile(path); err != nil {
+		t.Errorf("CheckFile = %v", err)
+	}
+	bad := Sum{"sha512", fmt.Sprintf("%x", sha512.Sum512([]byte("other")))}
+	if err := bad.CheckFile(path); !errors.Is(err, ErrMismatch) {
+		t.Errorf("CheckFile = %v, want ErrMismatch", err)
+	}
+}
@@ -1,16 +1,67 @@
 package device
 
+import "strings"
+
 // Device represents a storage device
 type Device struct {
-	Name        string   `json:"name"`        // e.g. /dev/sda, PhysicalDrive1
-	Size        int64    `json:"size"`        // Size in bytes
-	Model       string   `json:"model"`       // Device model
-	Vendor      string   `json:"vendor"`      // Device vendor
-	Removable   bool     `json:"removable"`   // Is removable
-	MountPoints []string `json:"mountPoints"` // List of mount points
+	Name        string      `json:"name" yaml:"name"`               // e.g. /dev/sda, PhysicalDrive1
+	Size        int64       `json:"size" yaml:"size"`               // Size in bytes
+	Model       string      `json:"model" yaml:"model"`             // Device model
+	Vendor      string      `json:"vendor" yaml:"vendor"`           // Device vendor
+	Transport   string      `json:"transport" yaml:"transport"`     // Bus, e.g. usb, mmc, sata, nvme ("" if unknown)
+	Removable   bool        `json:"removable" yaml:"removable"`     // Is removable
+	ReadOnly    bool        `json:"readOnly" yaml:"readOnly"`       // Media is write-protected
+	MountPoints []string    `json:"mountPoints" yaml:"mountPoints"` // List of mount points
+	Partitions  []Partition `json:"partitions" yaml:"partitions"`   // Partitions on the device
+}
+
+// Partition represents a partition on a Device
+type Partition struct {
+	Name       string `json:"name" yaml:"name"`             // e.g. /dev/sda1, disk2s1
+	Size       int64  `json:"size" yaml:"size"`             // Size in bytes
+	FSType     string `json:"fsType" yaml:"fsType"`         // Filesystem type, e.g. vfat, ext4
+	Label      string `json:"label" yaml:"label"`           // Filesystem label
+	MountPoint string `json:"mountPoint" yaml:"mountPoint"` // Mount point, empty if not mounted
 }
 
 // Manager defines the interface for device enumeration
 type Manager interface {
 	List() ([]Device, error)
 }
+
+// Filter selects devices by their properties. The zero value matches all
+// devices.
+type Filter struct {
+	Removable bool   // Only removable devices
+	MinSize   int64  // Minimum size in bytes, 0 for no limit
+	MaxSize   int64  // Maximum size in bytes, 0 for no limit
+	Transport string // Bus to match, case-insensitive
+}
+
+// Match reports whether d passes the filter.
+func (f Filter) Match(d Device) bool {
+	if f.Removable && !d.Removable {
+		return false
+	}
+	if f.MinSize > 0 && d.Size < f.MinSize {
+		return false
+	}
+	if f.MaxSize > 0 && d.Size > f.MaxSize {
+		return false
+	}
+	if f.Transport != "" && !strings.EqualFold(f.Transport, d.Transport) {
+		return false
+	}
+	return true
+}
+
+// Apply returns the devices that pass the filter, in their original order.
+func (f Filter) Apply(devs []Device) []Device {
+	var out []Device
+	for _, d := range devs {
+		if f.Match(d) {
+			out = append(out, d)
+		}
+	}
+	return out
+}
@@ -1,6 +1,7 @@
 package device
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -12,6 +13,7 @@ func TestDevice_Struct(t *testing.T) {
 		Vendor:      "Samsung",
 		Removable:   true,
 		MountPoints: []string{"/mnt/usb"},
+		ReadOnly:    true,
 	}
 
 	if d.Name != "/dev/sda" {
@@ -32,6 +34,9 @@ func TestDevice_Struct(t *testing.T) {
 	if len(d.MountPoints) != 1 || d.MountPoints[0] != "/mnt/usb" {
 		t.Errorf("MountPoints = %v, want [/mnt/usb]", d.MountPoints)
 	}
+	if !d.ReadOnly {
+		t.Error("ReadOnly = false, want true")
+	}
 }
 
 func TestDevice_Empty(t *testing.T) {
@@ -207,3 +212,41 @@ func TestNewManager(t *testing.T) {
 		t.Error("NewManager() returned nil")
 	}
 }
+
+func TestFilter(t *testing.T) {
+	devs := []Device{
+		{Name: "/dev/sda", Size: 512 << 30, Transport: "sata"},
+		{Name: "/dev/sdb", Size: 16 << 30, Transport: "usb", Removable: true},
+		{Name: "/dev/mmcblk0", Size: 32 << 30, Transport: "mmc", Removable: true},
+		{Name: "/dev/sdc", Size: 2 << 30, Transport: "usb", Removable: true},
+	}
+
+	names := func(devs []Device) string {
+		var out []string
+		for _, d := range devs {
+			out = append(out, d.Name)
+		}
+		return strings.Join(out, ",")
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   string
+	}{
+		{"zero value", Filter{}, "/dev/sda,/dev/sdb,/dev/mmcblk0,/dev/sdc"},
+		{"removable", Filter{Removable: true}, "/dev/sdb,/dev/mmcblk0,/dev/sdc"},
+		{"transport", Filter{Transport: "USB"}, "/dev/sdb,/dev/sdc"},
+		{"min size", Filter{MinSize: 16 << 30}, "/dev/sda,/dev/sdb,/dev/mmcblk0"},
+		{"max size", Filter{MaxSize: 16 << 30}, "/dev/sdb,/dev/sdc"},
+		{"combined", Filter{Removable: true, MinSize: 4 << 30, MaxSize: 64 << 30, Transport: "usb"}, "/dev/sdb"},
+		{"no match", Filter{Transport: "nvme"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := names(tt.filter.Apply(devs)); got != tt.want {
+				t.Errorf("Apply() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"strings"
 
 	"howett.net/plist"
+
+	"pvflasher/internal/platform"
 )
 
 func newPlatformManager() Manager {
@@ -18,7 +20,19 @@ func newPlatformManager() Manager {
 type DarwinManager struct{}
 
 type diskUtilList struct {
-	AllDisks []string `plist:"AllDisks"`
+	AllDisks              []string `plist:"AllDisks"`
+	AllDisksAndPartitions []struct {
+		DeviceIdentifier string              `plist:"DeviceIdentifier"`
+		Partitions       []diskUtilPartition `plist:"Partitions"`
+	} `plist:"AllDisksAndPartitions"`
+}
+
+type diskUtilPartition struct {
+	DeviceIdentifier string `plist:"DeviceIdentifier"`
+	Size             int64  `plist:"Size"`
+	Content          string `plist:"Content"` // Partition type, e.g. DOS_FAT_32, Linux
+	VolumeName       string `plist:"VolumeName"`
+	MountPoint       string `plist:"MountPoint"`
 }
 
 type diskUtilInfo struct {
@@ -29,11 +43,8 @@ type diskUtilInfo struct {
 	VirtualOrPhysical string `plist:"VirtualOrPhysical"`
 	Model             string `plist:"Model"`
 	Vendor            string `plist:"Vendor"`
+	WritableMedia     *bool  `plist:"WritableMedia"`
 	MountPoint        string `plist:"MountPoint"`
-	Partitions        []struct {
-		DeviceIdentifier string `plist:"DeviceIdentifier"`
-		MountPoint       string `plist:"MountPoint"`
-	} `plist:"Partitions"`
 }
 
 func (m *DarwinManager) List() ([]Device, error) {
@@ -49,6 +60,11 @@ func (m *DarwinManager) List() ([]Device, error) {
 		return nil, fmt.Errorf("failed to parse diskutil list plist: %w", err)
 	}
 
+	partitions := make(map[string][]diskUtilPartition)
+	for _, disk := range list.AllDisksAndPartitions {
+		partitions[disk.DeviceIdentifier] = disk.Partitions
+	}
+
 	var devices []Device
 	for _, devID := range list.AllDisks {
 		// Only look at whole disks, e.g., disk0, disk1, not partitions like disk0s1
@@ -76,17 +92,26 @@ func (m *DarwinManager) List() ([]Device, error) {
 			Size:      info.Size,
 			Model:     info.Model,
 			Vendor:    info.Vendor,
+			Transport: platform.Transport(devID),
 			Removable: info.Removable,
+			ReadOnly:  info.WritableMedia != nil && !*info.WritableMedia,
 		}
 
 		if info.MountPoint != "" {
 			d.MountPoints = append(d.MountPoints, info.MountPoint)
 		}
 
-		for _, p := range info.Partitions {
+		for _, p := range partitions[devID] {
 			if p.MountPoint != "" {
 				d.MountPoints = append(d.MountPoints, p.MountPoint)
 			}
+			d.Partitions = append(d.Partitions, Partition{
+				Name:       "/dev/" + p.DeviceIdentifier,
+				Size:       p.Size,
+				FSType:     p.Content,
+				Label:      p.VolumeName,
+				MountPoint: p.MountPoint,
+			})
 		}
 
 		devices = append(devices, d)
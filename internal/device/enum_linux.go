@@ -9,6 +9,8 @@ import (
 	"strings"
 
 	"github.com/jaypipes/ghw"
+
+	"pvflasher/internal/platform"
 )
 
 func newPlatformManager() Manager {
@@ -53,21 +55,33 @@ func (m *LinuxManager) List() ([]Device, error) {
 			}
 		}
 
+		readOnly, _ := platform.WriteProtection(devName)
+
 		d := Device{
 			Name:        devName,
 			Size:        int64(disk.SizeBytes),
 			Model:       model,
 			Vendor:      vendor,
+			Transport:   platform.Transport(devName),
 			Removable:   disk.IsRemovable,
+			ReadOnly:    readOnly,
 			MountPoints: mounts[devName],
 		}
 
 		// Also check partitions for mounts
 		for _, part := range disk.Partitions {
 			partName := "/dev/" + part.Name
+			p := Partition{
+				Name:   partName,
+				Size:   int64(part.SizeBytes),
+				FSType: knownValue(part.Type),
+				Label:  knownValue(part.FilesystemLabel),
+			}
 			if partMounts, ok := mounts[partName]; ok {
 				d.MountPoints = append(d.MountPoints, partMounts...)
+				p.MountPoint = partMounts[0]
 			}
+			d.Partitions = append(d.Partitions, p)
 		}
 
 		devices = append(devices, d)
@@ -75,6 +89,14 @@ func (m *LinuxManager) List() ([]Device, error) {
 	return devices, nil
 }
 
+// knownValue maps ghw's "unknown" placeholder to an empty string.
+func knownValue(s string) string {
+	if s == "unknown" {
+		return ""
+	}
+	return s
+}
+
 // readSysfsAttr reads a sysfs attribute for a block device.
 func readSysfsAttr(diskName, attr string) string {
 	path := "/sys/block/" + diskName + "/" + attr
@@ -5,6 +5,8 @@ package device
 import (
 	"fmt"
 	"github.com/jaypipes/ghw"
+
+	"pvflasher/internal/platform"
 )
 
 func newPlatformManager() Manager {
@@ -26,14 +28,26 @@ func (m *WindowsManager) List() ([]Device, error) {
 			Size:      int64(disk.SizeBytes),
 			Model:     disk.Model,
 			Vendor:    disk.Vendor,
+			Transport: platform.Transport(disk.Name),
 			Removable: disk.IsRemovable,
 		}
+		d.ReadOnly, _ = platform.WriteProtection(disk.Name)
 		
 		// For Windows, ghw should handle basic mount point detection via partitions
 		for _, part := range disk.Partitions {
 			if part.MountPoint != "" {
 				d.MountPoints = append(d.MountPoints, part.MountPoint)
 			}
+			// ghw only reports partitions that carry a volume: Name is the
+			// volume label, MountPoint the drive letter and Type the
+			// Win32_DiskPartition type (e.g. "GPT: Basic Data").
+			d.Partitions = append(d.Partitions, Partition{
+				Name:       part.MountPoint,
+				Size:       int64(part.SizeBytes),
+				FSType:     part.Type,
+				Label:      part.Name,
+				MountPoint: part.MountPoint,
+			})
 		}
 		
 		devices = append(devices, d)
@@ -0,0 +1,157 @@
+package fsmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"pvflasher/internal/image"
+)
+
+const (
+	extSuperblockOffset = 1024
+	extMagic            = 0xef53
+
+	extCompatHasJournal = 0x4
+
+	extIncompatRecover    = 0x4
+	extIncompatJournalDev = 0x8
+	extIncompatMetaBG     = 0x10
+	extIncompatExtents    = 0x40
+	extIncompat64Bit      = 0x80
+	extIncompatFlexBG     = 0x200
+
+	extROCompatHugeFile     = 0x8
+	extROCompatGDTCsum      = 0x10
+	extROCompatBigalloc     = 0x200
+	extROCompatMetadataCsum = 0x400
+
+	extBGBlockUninit = 0x2
+)
+
+// extSuperblock holds the fields of an ext2/3/4 superblock needed to find
+// the block bitmaps.
+type extSuperblock struct {
+	blocksCount     int64
+	firstDataBlock  int64
+	blockSize       int64
+	blocksPerGroup  int64
+	descSize        int64
+	featureCompat   uint32
+	featureIncompat uint32
+	featureROCompat uint32
+}
+
+func readExtSuperblock(r io.ReaderAt) (*extSuperblock, error) {
+	sb := make([]byte, 1024)
+	if _, err := r.ReadAt(sb, extSuperblockOffset); err != nil {
+		return nil, ErrUnknownFilesystem
+	}
+	if binary.LittleEndian.Uint16(sb[0x38:]) != extMagic {
+		return nil, ErrUnknownFilesystem
+	}
+
+	logBlockSize := binary.LittleEndian.Uint32(sb[0x18:])
+	if logBlockSize > 6 {
+		return nil, fmt.Errorf("ext: invalid block size 2^%d KiB", logBlockSize)
+	}
+	s := &extSuperblock{
+		blocksCount:     int64(binary.LittleEndian.Uint32(sb[0x04:])),
+		firstDataBlock:  int64(binary.LittleEndian.Uint32(sb[0x14:])),
+		blockSize:       1024 << logBlockSize,
+		blocksPerGroup:  int64(binary.LittleEndian.Uint32(sb[0x20:])),
+		descSize:        32,
+		featureCompat:   binary.LittleEndian.Uint32(sb[0x5c:]),
+		featureIncompat: binary.LittleEndian.Uint32(sb[0x60:]),
+		featureROCompat: binary.LittleEndian.Uint32(sb[0x64:]),
+	}
+	if s.featureIncompat&extIncompat64Bit != 0 {
+		s.blocksCount |= int64(binary.LittleEndian.Uint32(sb[0x150:])) << 32
+		s.descSize = int64(binary.LittleEndian.Uint16(sb[0xfe:]))
+		if s.descSize < 64 {
+			return nil, fmt.Errorf("ext: invalid group descriptor size %d", s.descSize)
+		}
+	}
+	if s.blocksPerGroup == 0 || s.blocksPerGroup > s.blockSize*8 {
+		return nil, fmt.Errorf("ext: invalid blocks per group %d", s.blocksPerGroup)
+	}
+	if s.firstDataBlock >= s.blocksCount {
+		return nil, fmt.Errorf("ext: first data block %d past the end", s.firstDataBlock)
+	}
+	return s, nil
+}
+
+// probeExt returns the ext flavour of the filesystem in r, named the way
+// blkid does: ext4 if it uses any ext4-only feature, ext3 if it has a
+// journal, ext2 otherwise.
+func probeExt(r io.ReaderAt) (string, error) {
+	s, err := readExtSuperblock(r)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case s.featureIncompat&(extIncompatExtents|extIncompat64Bit|extIncompatFlexBG) != 0,
+		s.featureROCompat&(extROCompatHugeFile|extROCompatGDTCsum|extROCompatMetadataCsum) != 0:
+		return "ext4", nil
+	case s.featureCompat&extCompatHasJournal != 0:
+		return "ext3", nil
+	}
+	return "ext2", nil
+}
+
+// extFreeRanges reads the block bitmap of every block group. Groups whose
+// bitmap was never initialised (BLOCK_UNINIT) are treated as in use: their
+// bitmap block may hold garbage, and they can contain metadata of other
+// groups under flex_bg.
+func extFreeRanges(r io.ReaderAt, size int64) ([]image.ByteRange, error) {
+	s, err := readExtSuperblock(r)
+	if err != nil {
+		return nil, err
+	}
+	if s.blocksCount > size/s.blockSize {
+		return nil, fmt.Errorf("ext: %d blocks of %d bytes don't fit in %d bytes", s.blocksCount, s.blockSize, size)
+	}
+	switch {
+	case s.featureIncompat&extIncompatRecover != 0:
+		return nil, fmt.Errorf("ext: %w: journal needs recovery", ErrUnsupported)
+	case s.featureIncompat&extIncompatJournalDev != 0:
+		return nil, fmt.Errorf("ext: %w: external journal device", ErrUnsupported)
+	case s.featureIncompat&extIncompatMetaBG != 0:
+		return nil, fmt.Errorf("ext: %w: meta_bg", ErrUnsupported)
+	case s.featureROCompat&extROCompatBigalloc != 0:
+		return nil, fmt.Errorf("ext: %w: bigalloc", ErrUnsupported)
+	}
+
+	groups := (s.blocksCount - s.firstDataBlock + s.blocksPerGroup - 1) / s.blocksPerGroup
+	descs := make([]byte, groups*s.descSize)
+	if _, err := r.ReadAt(descs, (s.firstDataBlock+1)*s.blockSize); err != nil {
+		return nil, fmt.Errorf("ext: failed to read group descriptors: %w", err)
+	}
+
+	var free []image.ByteRange
+	bitmap := make([]byte, s.blockSize)
+	for g := int64(0); g < groups; g++ {
+		d := descs[g*s.descSize : (g+1)*s.descSize]
+		if binary.LittleEndian.Uint16(d[0x12:])&extBGBlockUninit != 0 {
+			continue
+		}
+		bitmapBlock := int64(binary.LittleEndian.Uint32(d[0x00:]))
+		if s.descSize >= 64 {
+			bitmapBlock |= int64(binary.LittleEndian.Uint32(d[0x20:])) << 32
+		}
+		if bitmapBlock == 0 || bitmapBlock >= s.blocksCount {
+			return nil, fmt.Errorf("ext: group %d has bitmap block %d outside the filesystem", g, bitmapBlock)
+		}
+		if _, err := r.ReadAt(bitmap, bitmapBlock*s.blockSize); err != nil {
+			return nil, fmt.Errorf("ext: failed to read bitmap of group %d: %w", g, err)
+		}
+
+		first := s.firstDataBlock + g*s.blocksPerGroup
+		bits := s.blocksPerGroup
+		if first+bits > s.blocksCount {
+			bits = s.blocksCount - first
+		}
+		free = bitmapFreeRanges(bitmap, bits, first, s.blockSize, free)
+	}
+	return free, nil
+}
@@ -0,0 +1,155 @@
+package fsmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"pvflasher/internal/image"
+)
+
+// fatBPB holds the BIOS parameter block fields needed to walk the FAT.
+type fatBPB struct {
+	bytesPerSector    int64
+	sectorsPerCluster int64
+	reservedSectors   int64
+	numFATs           int64
+	fatSectors        int64
+	totalSectors      int64
+	dataStart         int64 // First sector of cluster 2
+	clusters          int64
+	kind              string // fat12, fat16 or fat32
+}
+
+func isPowerOfTwo(n int64) bool {
+	return n > 0 && n&(n-1) == 0
+}
+
+// readFATBPB parses the boot sector at the start of r. Besides the field
+// checks, the "FAT" type string must be present so an MBR isn't taken for a
+// boot sector.
+func readFATBPB(r io.ReaderAt) (*fatBPB, error) {
+	bs := make([]byte, 512)
+	if _, err := r.ReadAt(bs, 0); err != nil {
+		return nil, ErrUnknownFilesystem
+	}
+	if bs[510] != 0x55 || bs[511] != 0xaa || (bs[0] != 0xeb && bs[0] != 0xe9) {
+		return nil, ErrUnknownFilesystem
+	}
+	if string(bs[0x36:0x39]) != "FAT" && string(bs[0x52:0x55]) != "FAT" {
+		return nil, ErrUnknownFilesystem
+	}
+
+	b := &fatBPB{
+		bytesPerSector:    int64(binary.LittleEndian.Uint16(bs[0x0b:])),
+		sectorsPerCluster: int64(bs[0x0d]),
+		reservedSectors:   int64(binary.LittleEndian.Uint16(bs[0x0e:])),
+		numFATs:           int64(bs[0x10]),
+		fatSectors:        int64(binary.LittleEndian.Uint16(bs[0x16:])),
+	}
+	rootEntries := int64(binary.LittleEndian.Uint16(bs[0x11:]))
+	b.totalSectors = int64(binary.LittleEndian.Uint16(bs[0x13:]))
+	if b.totalSectors == 0 {
+		b.totalSectors = int64(binary.LittleEndian.Uint32(bs[0x20:]))
+	}
+	if b.fatSectors == 0 {
+		b.fatSectors = int64(binary.LittleEndian.Uint32(bs[0x24:]))
+	}
+
+	if b.bytesPerSector < 512 || b.bytesPerSector > 4096 || !isPowerOfTwo(b.bytesPerSector) ||
+		!isPowerOfTwo(b.sectorsPerCluster) || b.reservedSectors == 0 || b.numFATs == 0 || b.fatSectors == 0 {
+		return nil, ErrUnknownFilesystem
+	}
+
+	rootSectors := (rootEntries*32 + b.bytesPerSector - 1) / b.bytesPerSector
+	b.dataStart = b.reservedSectors + b.numFATs*b.fatSectors + rootSectors
+	if b.totalSectors <= b.dataStart {
+		return nil, fmt.Errorf("fat: %d sectors leave no room for data", b.totalSectors)
+	}
+	b.clusters = (b.totalSectors - b.dataStart) / b.sectorsPerCluster
+
+	// The cluster count alone decides the FAT type (Microsoft FAT spec).
+	switch {
+	case b.clusters < 4085:
+		b.kind = "fat12"
+	case b.clusters < 65525:
+		b.kind = "fat16"
+	default:
+		b.kind = "fat32"
+	}
+	return b, nil
+}
+
+func probeFAT(r io.ReaderAt) (string, error) {
+	b, err := readFATBPB(r)
+	if err != nil {
+		return "", err
+	}
+	return b.kind, nil
+}
+
+// fatFreeRanges reads the first FAT and returns the clusters marked free.
+// The reserved area, the FATs and the FAT12/16 root directory always count
+// as used.
+func fatFreeRanges(r io.ReaderAt, size int64) ([]image.ByteRange, error) {
+	b, err := readFATBPB(r)
+	if err != nil {
+		return nil, err
+	}
+	// The FATs lie inside the volume, so this also bounds the table read.
+	if b.totalSectors > size/b.bytesPerSector {
+		return nil, fmt.Errorf("fat: %d sectors of %d bytes don't fit in %d bytes", b.totalSectors, b.bytesPerSector, size)
+	}
+
+	fat := make([]byte, b.fatSectors*b.bytesPerSector)
+	if _, err := r.ReadAt(fat, b.reservedSectors*b.bytesPerSector); err != nil {
+		return nil, fmt.Errorf("fat: failed to read the allocation table: %w", err)
+	}
+
+	var entryBits int64
+	switch b.kind {
+	case "fat12":
+		entryBits = 12
+	case "fat16":
+		entryBits = 16
+	default:
+		entryBits = 32
+	}
+	if (b.clusters+2)*entryBits > int64(len(fat))*8 {
+		return nil, fmt.Errorf("fat: table of %d bytes is too small for %d clusters", len(fat), b.clusters)
+	}
+
+	entry := func(n int64) uint32 {
+		switch b.kind {
+		case "fat12":
+			v := binary.LittleEndian.Uint16(fat[n*3/2:])
+			if n%2 == 1 {
+				return uint32(v >> 4)
+			}
+			return uint32(v & 0xfff)
+		case "fat16":
+			return uint32(binary.LittleEndian.Uint16(fat[n*2:]))
+		default:
+			return binary.LittleEndian.Uint32(fat[n*4:]) & 0x0fffffff
+		}
+	}
+
+	clusterSize := b.sectorsPerCluster * b.bytesPerSector
+	dataStart := b.dataStart * b.bytesPerSector
+	var free []image.ByteRange
+	runStart := int64(-1)
+	for n := int64(2); n <= b.clusters+2; n++ {
+		isFree := n < b.clusters+2 && entry(n) == 0
+		switch {
+		case isFree && runStart < 0:
+			runStart = n
+		case !isFree && runStart >= 0:
+			free = append(free, image.ByteRange{
+				Start: dataStart + (runStart-2)*clusterSize,
+				End:   dataStart + (n-2)*clusterSize,
+			})
+			runStart = -1
+		}
+	}
+	return free, nil
+}
@@ -0,0 +1,157 @@
+// Package fsmap finds the blocks a filesystem considers free by reading its
+// allocation bitmaps, so bmap creation can leave out stale data in them.
+//
+// ext2/3/4 and FAT12/16/32 are understood. Other filesystems are reported
+// with ErrUnknownFilesystem and their space is treated as in use.
+package fsmap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"pvflasher/internal/image"
+	"pvflasher/internal/partition"
+)
+
+var (
+	// ErrUnknownFilesystem is returned for regions without a filesystem this
+	// package can read.
+	ErrUnknownFilesystem = errors.New("unknown filesystem")
+	// ErrUnsupported is returned for a known filesystem using a feature whose
+	// allocation data isn't parsed (e.g. ext4 bigalloc).
+	ErrUnsupported = errors.New("unsupported filesystem feature")
+)
+
+// Filesystem is the result of scanning one partition, or the whole image if
+// it has no partition table.
+type Filesystem struct {
+	Partition int               // Partition number, 0 for a bare filesystem
+	Start     int64             // Offset of the partition in bytes
+	Size      int64             // Size of the partition in bytes
+	Type      string            // ext2, ext3, ext4, fat12, fat16 or fat32; "" if unknown
+	Free      []image.ByteRange // Free space, as offsets into the image
+	Err       error             // Why Free is empty, e.g. ErrUnknownFilesystem
+}
+
+// FreeBytes returns the total size of the free ranges.
+func (fs Filesystem) FreeBytes() int64 {
+	var n int64
+	for _, r := range fs.Free {
+		n += r.End - r.Start
+	}
+	return n
+}
+
+// Scan reads the partition table of an image of the given size and the
+// allocation bitmaps of every partition in it. An image without a partition
+// table is scanned as a single filesystem. Problems with one partition are
+// recorded in its Err and don't stop the scan.
+func Scan(r io.ReaderAt, size int64) ([]Filesystem, error) {
+	// A FAT boot sector carries the same 0x55aa signature as an MBR, so
+	// superfloppy images are recognised before the partition table is read.
+	whole := io.NewSectionReader(r, 0, size)
+	if _, err := probeFAT(whole); err == nil {
+		return []Filesystem{scanOne(r, 0, 0, size)}, nil
+	}
+
+	table, err := partition.Read(r)
+	if errors.Is(err, partition.ErrNoTable) {
+		return []Filesystem{scanOne(r, 0, 0, size)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var out []Filesystem
+	for _, p := range table.Partitions {
+		if p.IsExtended() {
+			continue
+		}
+		out = append(out, scanOne(r, p.Number, p.Start, p.Size))
+	}
+	return out, nil
+}
+
+// FreeRanges merges the free space of all filesystems into sorted,
+// non-overlapping ranges.
+func FreeRanges(filesystems []Filesystem) []image.ByteRange {
+	var all []image.ByteRange
+	for _, fs := range filesystems {
+		all = append(all, fs.Free...)
+	}
+	return mergeRanges(all)
+}
+
+func scanOne(r io.ReaderAt, number int, start, size int64) Filesystem {
+	fs := Filesystem{Partition: number, Start: start, Size: size}
+	section := io.NewSectionReader(r, start, size)
+
+	var free []image.ByteRange
+	fsType, err := probeExt(section)
+	if err == nil {
+		fs.Type = fsType
+		free, err = extFreeRanges(section, size)
+	} else if errors.Is(err, ErrUnknownFilesystem) {
+		if fsType, err = probeFAT(section); err == nil {
+			fs.Type = fsType
+			free, err = fatFreeRanges(section, size)
+		}
+	}
+	if err != nil {
+		fs.Err = err
+		return fs
+	}
+
+	for _, f := range free {
+		// Never trust a bitmap pointing outside its own partition.
+		if f.End > size {
+			fs.Err = fmt.Errorf("%s: free range %d-%d is past the end of the partition", fs.Type, f.Start, f.End)
+			return fs
+		}
+		fs.Free = append(fs.Free, image.ByteRange{Start: start + f.Start, End: start + f.End})
+	}
+	fs.Free = mergeRanges(fs.Free)
+	return fs
+}
+
+// mergeRanges sorts ranges and joins the ones that touch or overlap.
+func mergeRanges(ranges []image.ByteRange) []image.ByteRange {
+	if len(ranges) == 0 {
+		return nil
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	out := []image.ByteRange{ranges[0]}
+	for _, r := range ranges[1:] {
+		last := &out[len(out)-1]
+		if r.Start <= last.End {
+			if r.End > last.End {
+				last.End = r.End
+			}
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// bitmapFreeRanges turns a run of allocation bits (1 = used, LSB first) into
+// byte ranges. Bit i covers unit first+i of unitSize bytes.
+func bitmapFreeRanges(bitmap []byte, bits int64, first, unitSize int64, out []image.ByteRange) []image.ByteRange {
+	runStart := int64(-1)
+	for i := int64(0); i <= bits; i++ {
+		free := i < bits && bitmap[i/8]&(1<<(i%8)) == 0
+		switch {
+		case free && runStart < 0:
+			runStart = i
+		case !free && runStart >= 0:
+			out = append(out, image.ByteRange{
+				Start: (first + runStart) * unitSize,
+				End:   (first + i) * unitSize,
+			})
+			runStart = -1
+		}
+	}
+	return out
+}
@@ -0,0 +1,311 @@
+package fsmap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"pvflasher/internal/bmap"
+	"pvflasher/internal/image"
+)
+
+// loadExt4 returns testdata/ext4.img.gz: a 4 MiB ext4 filesystem with 4 KiB
+// blocks, made with mke2fs -d from keep.bin (64 KiB of 0x33) and
+// garbage.bin (512 KiB of 0x5a), after which garbage.bin was removed with
+// debugfs. Its data is still in the now free blocks.
+func loadExt4(t *testing.T) []byte {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", "ext4.img.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(zr); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// blocks converts 4 KiB block ranges (inclusive, as dumpe2fs prints them)
+// to byte ranges starting at offset.
+func blocks(offset int64, ranges ...[2]int64) []image.ByteRange {
+	var out []image.ByteRange
+	for _, r := range ranges {
+		out = append(out, image.ByteRange{Start: offset + r[0]*4096, End: offset + (r[1]+1)*4096})
+	}
+	return out
+}
+
+// ext4Free is the free space of the fixture according to dumpe2fs.
+var ext4Free = [][2]int64{{8, 17}, {19, 33}, {99, 201}, {218, 1023}}
+
+func TestScanBareExt4(t *testing.T) {
+	img := loadExt4(t)
+	fss, err := Scan(bytes.NewReader(img), int64(len(img)))
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if len(fss) != 1 {
+		t.Fatalf("got %d filesystems, want 1", len(fss))
+	}
+	fs := fss[0]
+	if fs.Err != nil || fs.Type != "ext4" || fs.Partition != 0 {
+		t.Fatalf("got %+v, want a bare ext4", fs)
+	}
+	if want := blocks(0, ext4Free...); !reflect.DeepEqual(fs.Free, want) {
+		t.Errorf("Free = %v, want %v", fs.Free, want)
+	}
+	if fs.FreeBytes() != 934*4096 {
+		t.Errorf("FreeBytes = %d, want %d", fs.FreeBytes(), 934*4096)
+	}
+}
+
+func putMBREntry(disk []byte, idx int, typ byte, first, count uint32) {
+	e := disk[446+idx*16:]
+	e[4] = typ
+	binary.LittleEndian.PutUint32(e[8:], first)
+	binary.LittleEndian.PutUint32(e[12:], count)
+}
+
+func TestScanPartitionedDisk(t *testing.T) {
+	ext4 := loadExt4(t)
+	const mib = 1 << 20
+
+	// p1: the ext4 fixture at 1 MiB, p2: 1 MiB of data in no known format.
+	disk := make([]byte, 1*mib+int64(len(ext4))+mib)
+	disk[510], disk[511] = 0x55, 0xaa
+	putMBREntry(disk, 0, 0x83, mib/512, uint32(len(ext4)/512))
+	putMBREntry(disk, 1, 0x83, uint32((mib+len(ext4))/512), mib/512)
+	copy(disk[mib:], ext4)
+	for i := mib + len(ext4); i < len(disk); i++ {
+		disk[i] = byte(i)
+	}
+
+	fss, err := Scan(bytes.NewReader(disk), int64(len(disk)))
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if len(fss) != 2 {
+		t.Fatalf("got %d filesystems, want 2", len(fss))
+	}
+	if fss[0].Type != "ext4" || fss[0].Err != nil {
+		t.Errorf("p1 = %s, %v, want ext4", fss[0].Type, fss[0].Err)
+	}
+	if want := blocks(mib, ext4Free...); !reflect.DeepEqual(fss[0].Free, want) {
+		t.Errorf("p1 Free = %v, want %v", fss[0].Free, want)
+	}
+	if !errors.Is(fss[1].Err, ErrUnknownFilesystem) || fss[1].Free != nil {
+		t.Errorf("p2 = %+v, want ErrUnknownFilesystem and no free space", fss[1])
+	}
+	if got := FreeRanges(fss); !reflect.DeepEqual(got, fss[0].Free) {
+		t.Errorf("FreeRanges = %v, want p1's", got)
+	}
+}
+
+func TestCreateSkipsFreeExt4Blocks(t *testing.T) {
+	img := loadExt4(t)
+	path := filepath.Join(t.TempDir(), "ext4.img")
+	if err := os.WriteFile(path, img, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	plain, err := bmap.Create(path, bmap.CreateOptions{})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	fss, err := Scan(bytes.NewReader(img), int64(len(img)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aware, err := bmap.Create(path, bmap.CreateOptions{FreeRanges: FreeRanges(fss)})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if err := aware.Validate(); err != nil {
+		t.Errorf("bmap is invalid: %v", err)
+	}
+
+	// The deleted file's 128 blocks are non-zero, so only the
+	// filesystem-aware bmap leaves them out.
+	if plain.MappedBlocksCount-aware.MappedBlocksCount < 128 {
+		t.Errorf("MappedBlocksCount = %d with free space, %d without; want at least 128 fewer",
+			aware.MappedBlocksCount, plain.MappedBlocksCount)
+	}
+	for _, r := range aware.BlockMap {
+		br, _ := r.Parse()
+		for blk := br.Start; blk <= br.End; blk++ {
+			if bytes.Equal(img[blk*4096:(blk+1)*4096], bytes.Repeat([]byte{0x5a}, 4096)) {
+				t.Fatalf("block %d of the deleted file is mapped", blk)
+			}
+		}
+	}
+	mapped := func(blk int64) bool {
+		for _, r := range aware.BlockMap {
+			br, _ := r.Parse()
+			if br.Start <= blk && blk <= br.End {
+				return true
+			}
+		}
+		return false
+	}
+	// keep.bin lives in blocks 202-217.
+	for blk := int64(202); blk <= 217; blk++ {
+		if !mapped(blk) {
+			t.Errorf("block %d of keep.bin is not mapped", blk)
+		}
+	}
+}
+
+// fatImage builds a FAT boot sector and first FAT. entries holds the FAT
+// entries from cluster 0 on; clusters past it are free.
+func fatImage(fatType string, totalSectors, fatSectors uint32, entries []uint32) []byte {
+	const bps = 512
+	reserved := uint32(1)
+	rootEntries := uint16(16)
+	if fatType == "FAT32" {
+		reserved, rootEntries = 32, 0
+	}
+	img := make([]byte, (reserved+2*fatSectors+1)*bps)
+	bs := img[:512]
+	bs[0] = 0xeb
+	binary.LittleEndian.PutUint16(bs[0x0b:], bps)
+	bs[0x0d] = 1 // sectors per cluster
+	binary.LittleEndian.PutUint16(bs[0x0e:], uint16(reserved))
+	bs[0x10] = 2 // FATs
+	binary.LittleEndian.PutUint16(bs[0x11:], rootEntries)
+	binary.LittleEndian.PutUint32(bs[0x20:], totalSectors)
+	if fatType == "FAT32" {
+		binary.LittleEndian.PutUint32(bs[0x24:], fatSectors)
+		copy(bs[0x52:], "FAT32   ")
+	} else {
+		binary.LittleEndian.PutUint16(bs[0x16:], uint16(fatSectors))
+		copy(bs[0x36:], fatType+"   ")
+	}
+	bs[510], bs[511] = 0x55, 0xaa
+
+	fat := img[reserved*bps:]
+	for n, v := range entries {
+		switch fatType {
+		case "FAT12":
+			off := n * 3 / 2
+			cur := binary.LittleEndian.Uint16(fat[off:])
+			if n%2 == 1 {
+				cur = cur&0x000f | uint16(v)<<4
+			} else {
+				cur = cur&0xf000 | uint16(v)&0x0fff
+			}
+			binary.LittleEndian.PutUint16(fat[off:], cur)
+		case "FAT16":
+			binary.LittleEndian.PutUint16(fat[n*2:], uint16(v))
+		default:
+			binary.LittleEndian.PutUint32(fat[n*4:], v)
+		}
+	}
+	return img
+}
+
+func TestScanFAT(t *testing.T) {
+	tests := []struct {
+		fatType      string
+		totalSectors uint32
+		fatSectors   uint32
+		entries      []uint32
+		wantType     string
+		dataStart    int64 // in sectors
+		clusters     int64
+		freeClusters [][2]int64 // inclusive
+	}{
+		{
+			// 1 reserved + 2 FATs + 1 root directory sector
+			fatType: "FAT12", totalSectors: 100, fatSectors: 1,
+			entries:  []uint32{0xff8, 0xfff, 0xfff, 0x005, 0x000, 0xfff, 0x000, 0xfff},
+			wantType: "fat12", dataStart: 4, clusters: 96,
+			freeClusters: [][2]int64{{4, 4}, {6, 6}, {8, 97}},
+		},
+		{
+			fatType: "FAT16", totalSectors: 5000, fatSectors: 20,
+			entries:  []uint32{0xfff8, 0xffff, 0xffff, 0x0000, 0xffff},
+			wantType: "fat16", dataStart: 42, clusters: 4958,
+			freeClusters: [][2]int64{{3, 3}, {5, 4959}},
+		},
+		{
+			// The top 4 bits of a FAT32 entry are reserved and ignored.
+			fatType: "FAT32", totalSectors: 70000, fatSectors: 540,
+			entries:  []uint32{0x0ffffff8, 0x0fffffff, 0x0fffffff, 0xf0000000, 0x0fffffff},
+			wantType: "fat32", dataStart: 32 + 2*540, clusters: 70000 - (32 + 2*540),
+			freeClusters: [][2]int64{{3, 3}, {5, 70000 - (32 + 2*540) + 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fatType, func(t *testing.T) {
+			img := fatImage(tt.fatType, tt.totalSectors, tt.fatSectors, tt.entries)
+			size := int64(tt.totalSectors) * 512
+			// Only the boot sector and FAT are read, so the image can stop there.
+			fss, err := Scan(bytes.NewReader(img), size)
+			if err != nil {
+				t.Fatalf("Scan failed: %v", err)
+			}
+			if len(fss) != 1 || fss[0].Err != nil || fss[0].Type != tt.wantType {
+				t.Fatalf("got %+v, want one %s", fss, tt.wantType)
+			}
+			var want []image.ByteRange
+			for _, c := range tt.freeClusters {
+				want = append(want, image.ByteRange{
+					Start: (tt.dataStart + c[0] - 2) * 512,
+					End:   (tt.dataStart + c[1] - 1) * 512,
+				})
+			}
+			if !reflect.DeepEqual(fss[0].Free, want) {
+				t.Errorf("Free = %v, want %v", fss[0].Free, want)
+			}
+			if last := fss[0].Free[len(fss[0].Free)-1].End; last != (tt.dataStart+tt.clusters)*512 {
+				t.Errorf("free space ends at %d, want the end of the last cluster %d", last, (tt.dataStart+tt.clusters)*512)
+			}
+		})
+	}
+}
+
+func TestScanFATLargerThanPartition(t *testing.T) {
+	// A FAT32 boot sector claiming a 1 TiB table on a 35 MiB partition.
+	img := fatImage("FAT32", 70000, 540, nil)
+	binary.LittleEndian.PutUint32(img[0x20:], 0xffffffff)
+	binary.LittleEndian.PutUint32(img[0x24:], 0x7fff0000)
+	fss, err := Scan(bytes.NewReader(img), 70000*512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fss) != 1 || fss[0].Type != "fat32" || fss[0].Err == nil || fss[0].Free != nil {
+		t.Errorf("got %+v, want fat32 with an error", fss)
+	}
+}
+
+func TestScanUnsupportedExt4(t *testing.T) {
+	img := loadExt4(t)
+	// Pretend the journal needs replaying; the bitmaps can't be trusted then.
+	binary.LittleEndian.PutUint32(img[1024+0x60:], binary.LittleEndian.Uint32(img[1024+0x60:])|extIncompatRecover)
+	fss, err := Scan(bytes.NewReader(img), int64(len(img)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fss[0].Type != "ext4" || !errors.Is(fss[0].Err, ErrUnsupported) || fss[0].Free != nil {
+		t.Errorf("got %+v, want ext4 with ErrUnsupported", fss[0])
+	}
+}
+
+func TestMergeRanges(t *testing.T) {
+	got := mergeRanges([]image.ByteRange{{Start: 10, End: 20}, {Start: 0, End: 5}, {Start: 5, End: 8}, {Start: 15, End: 30}})
+	want := []image.ByteRange{{Start: 0, End: 8}, {Start: 10, End: 30}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeRanges = %v, want %v", got, want)
+	}
+}
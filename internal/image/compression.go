@@ -3,42 +3,98 @@ package image
 import (
 	"bufio"
 	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"path/filepath"
+	"runtime"
 	"strings"
 
+	"github.com/andybalholm/brotli"
 	"github.com/cosnicolaou/pbzip2"
 	"github.com/klauspost/compress/gzip"
 	"github.com/klauspost/compress/zstd"
-	"github.com/ulikunitz/xz"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz/lzma"
 )
 
-// IsCompressed returns true if the file path has a known compression extension
+// DecodeWorkers is the number of goroutines decoding xz and zstd data
+// (default runtime.NumCPU(), at most maxDecodeWorkers). With 1, they are
+// decoded sequentially.
+var DecodeWorkers int
+
+// maxDecodeWorkers caps the default: a few workers already decode faster
+// than flash media can be written, and every one holds a block in memory.
+const maxDecodeWorkers = 8
+
+func decodeWorkers() int {
+	if DecodeWorkers <= 0 {
+		return min(runtime.NumCPU(), maxDecodeWorkers)
+	}
+	return DecodeWorkers
+}
+
+// compressionExts maps file extensions to the compression format they
+// suggest, named as detectMagic names them.
+var compressionExts = map[string]string{
+	".gz":   "gz",
+	".bz2":  "bz2",
+	".xz":   "xz",
+	".zst":  "zstd",
+	".zstd": "zstd",
+	".lz4":  "lz4",
+	".lzma": "lzma",
+	".lz":   "lzip",
+	".br":   "brotli",
+}
+
+// IsCompressed reports whether the file at path is compressed, going by its
+// content. If the file can't be read, it falls back to the extension.
 func IsCompressed(path string) bool {
-	ext := strings.ToLower(filepath.Ext(path))
-	switch ext {
-	case ".gz", ".bz2", ".xz", ".zst", ".zstd":
-		return true
-	default:
-		return false
+	format, err := Detect(path)
+	if err != nil {
+		return HasCompressionExt(path)
+	}
+	return format.Compression != ""
+}
+
+// HasCompressionExt returns true if the name has a known compression
+// extension. It is for names of files that can't be read, like archive
+// entries or files still to be written.
+func HasCompressionExt(name string) bool {
+	_, ok := compressionExts[strings.ToLower(filepath.Ext(name))]
+	return ok
+}
+
+// TrimCompressionExt strips a compression extension from path, e.g.
+// image.wic.zst becomes image.wic. Other paths are returned unchanged.
+func TrimCompressionExt(path string) string {
+	if !HasCompressionExt(path) {
+		return path
 	}
+	return strings.TrimSuffix(path, filepath.Ext(path))
 }
 
 // Magic byte signatures for compression formats.
 var (
-	magicGzip = []byte{0x1f, 0x8b}
-	magicXZ   = []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}
-	magicBZ2  = []byte{0x42, 0x5a}                   // "BZ"
-	magicZstd = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicGzip      = []byte{0x1f, 0x8b}
+	magicXZ        = []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}
+	magicBZ2       = []byte{0x42, 0x5a, 0x68} // "BZh", then the block size 1-9
+	magicZstd      = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicLZ4       = []byte{0x04, 0x22, 0x4d, 0x18}
+	magicLZ4Legacy = []byte{0x02, 0x21, 0x4c, 0x18} // lz4 -l, as Yocto writes it
+	magicLzip      = []byte{'L', 'Z', 'I', 'P', 0x01}
 )
 
 // detectMagic peeks at the first bytes of r and returns the detected
-// compression format ("gz", "xz", "bz2", "zstd") or "" if unrecognised.
-// The returned reader replays the peeked bytes transparently.
+// compression format ("gz", "xz", "bz2", "zstd", "lz4", "lzip") or "" if
+// unrecognised. Brotli and lzma streams have no magic and are never detected
+// here; see extOnlyCompression. The returned reader replays the peeked bytes
+// transparently, and can peek at the 13 bytes of an lzma header.
 func detectMagic(r io.Reader) (format string, buffered *bufio.Reader) {
-	br := bufio.NewReaderSize(r, 8)
-	peek, _ := br.Peek(6) // 6 bytes covers the longest magic (xz)
+	br := bufio.NewReaderSize(r, 16)
+	peek, _ := br.Peek(6) // 6 bytes covers the longest signature (xz)
 
 	switch {
 	case len(peek) >= 2 && peek[0] == magicGzip[0] && peek[1] == magicGzip[1]:
@@ -47,13 +103,36 @@ func detectMagic(r io.Reader) (format string, buffered *bufio.Reader) {
 		return "xz", br
 	case len(peek) >= 4 && matchBytes(peek, magicZstd):
 		return "zstd", br
-	case len(peek) >= 2 && peek[0] == magicBZ2[0] && peek[1] == magicBZ2[1]:
+	case matchBytes(peek, magicLZ4) || matchBytes(peek, magicLZ4Legacy):
+		return "lz4", br
+	case matchBytes(peek, magicLzip):
+		return "lzip", br
+	case matchBytes(peek, magicBZ2) && len(peek) > 3 && peek[3] >= '1' && peek[3] <= '9':
 		return "bz2", br
 	default:
 		return "", br
 	}
 }
 
+// isLzmaHeader reports whether h starts like a legacy .lzma file. The format
+// has no magic, so this checks for what lzma and xz --format=lzma write: the
+// default properties, a dictionary size of 2^n or 3*2^n bytes and an unknown
+// or plausible uncompressed size.
+func isLzmaHeader(h []byte) bool {
+	if len(h) < 13 || h[0] != 0x5d {
+		return false
+	}
+	dict := binary.LittleEndian.Uint32(h[1:])
+	if dict%3 == 0 {
+		dict /= 3
+	}
+	if dict < 1<<10 || dict&(dict-1) != 0 {
+		return false
+	}
+	size := binary.LittleEndian.Uint64(h[5:])
+	return size == math.MaxUint64 || size < 1<<48
+}
+
 func matchBytes(data, magic []byte) bool {
 	if len(data) < len(magic) {
 		return false
@@ -69,49 +148,68 @@ func matchBytes(data, magic []byte) bool {
 // Decompressor returns a reader that decompresses the source if needed.
 //
 // Detection strategy:
-//  1. The file extension is checked first as a hint.
-//  2. The first few bytes (magic signature) are inspected to confirm.
-//  3. If the extension says compressed but the magic doesn't match, we
-//     trust the magic and return an appropriate decompressor (or the raw
-//     reader if the content is uncompressed). A warning is logged.
-func Decompressor(path string, r io.Reader) (io.Reader, error) {
+//  1. The first few bytes (magic signature) are inspected, whatever the
+//     file is called, so a compressed image.bin is decompressed too.
+//  2. Brotli has no magic and lzma only a heuristic one, so when the magic
+//     gives nothing, a .br extension decides, and so does a .lzma one if the
+//     header looks like lzma. Other files are never taken for lzma, so a
+//     raw image that happens to start like it is left alone.
+//  3. If the extension says another compression than the magic, or says
+//     compressed when the content is not, we trust the magic. A warning is
+//     logged.
+//
+// Once ctx is done, reads fail with its error and the decode goroutines of
+// pbzip2 and xz stop. Close releases the goroutines of any decoder, and
+// doesn't close r.
+func Decompressor(ctx context.Context, path string, r io.Reader) (io.ReadCloser, error) {
 	ext := strings.ToLower(filepath.Ext(path))
-
-	// For extensions that don't suggest compression, return as-is.
-	switch ext {
-	case ".gz", ".bz2", ".xz", ".zst", ".zstd":
-		// Fall through to magic-byte detection below.
-	default:
-		return r, nil
-	}
+	extName := compressionExts[ext]
 
 	magic, br := detectMagic(r)
-
-	// Strip leading dot for comparison: ".gz" → "gz", ".zstd" → "zstd".
-	extName := strings.TrimPrefix(ext, ".")
-
-	// Extension and magic agree — use the matching decompressor.
-	if magic == extName || (extName == "zst" && magic == "zstd") || (extName == "zstd" && magic == "zstd") {
-		return newDecompressor(magic, br)
+	if magic == "" {
+		magic = extOnlyCompression(path, br)
 	}
 
 	// Magic detected a DIFFERENT compression than the extension claims.
-	if magic != "" {
+	if magic != "" && extName != "" && magic != extName {
 		fmt.Printf("WARNING: %s has %s extension but content is %s-compressed (detected by magic bytes); using %s decompressor\n",
 			filepath.Base(path), ext, magic, magic)
-		return newDecompressor(magic, br)
+	}
+	if magic != "" {
+		d, err := newDecompressor(ctx, magic, br, decodeWorkers())
+		if err != nil {
+			return nil, err
+		}
+		return &decompressReader{contextReader: contextReader{ctx: ctx, r: d}}, nil
 	}
 
 	// Extension says compressed but content has no recognisable magic.
 	// Likely an uncompressed file with a wrong extension.
 	// Treat as raw/uncompressed so the caller can handle it.
-	fmt.Printf("WARNING: %s has %s extension but content does not match any known compression format; treating as uncompressed\n",
-		filepath.Base(path), ext)
-	return br, nil
+	if extName != "" {
+		fmt.Printf("WARNING: %s has %s extension but content does not match any known compression format; treating as uncompressed\n",
+			filepath.Base(path), ext)
+	}
+	return &decompressReader{contextReader: contextReader{ctx: ctx, r: br}}, nil
+}
+
+// decompressReader is what Decompressor returns: a decoder whose reads
+// stop with ctx, and that Close closes.
+type decompressReader struct {
+	contextReader
 }
 
-// newDecompressor creates a decompressor reader for the given format.
-func newDecompressor(format string, r io.Reader) (io.Reader, error) {
+func (d *decompressReader) Close() error {
+	if c, ok := d.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// newDecompressor creates a decompressor reader for the given format. xz
+// and zstd are decoded by up to workers goroutines, and bz2 by as many as
+// there are CPUs; pbzip2 and xz stop decoding when ctx is done.
+func newDecompressor(ctx context.Context, format string, r io.Reader, workers int) (io.Reader, error) {
 	switch format {
 	case "gz":
 		return gzip.NewReader(r)
@@ -120,19 +218,39 @@ func newDecompressor(format string, r io.Reader) (io.Reader, error) {
 		// single-threaded and was the throughput cap (~9 MB/s vs ~20 MB/s device
 		// ceiling); pbzip2 decodes bz2 blocks across goroutines, like bmaptool's
 		// external pbzip2 but in-process and cgo-free (keeps Win/macOS portability).
-		// ponytail: context.Background() — on a mid-flash abort the decode workers
-		// leak until process exit (fine for the one-shot CLI). Thread ctx through
-		// Decompressor only if the long-lived GUI ever needs prompt cancellation.
-		return pbzip2.NewReader(context.Background(), r), nil
+		// Its workers only stop when ctx is done, so Close cancels it.
+		ctx, cancel := context.WithCancel(ctx)
+		return &bz2Reader{Reader: pbzip2.NewReader(ctx, r), cancel: cancel}, nil
 	case "xz":
-		return xz.NewReader(r)
+		return newXZReader(ctx, r, workers)
 	case "zstd":
-		d, err := zstd.NewReader(r)
+		// With more than one worker, blocks are decoded asynchronously, up
+		// to that many in flight.
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(workers))
 		if err != nil {
 			return nil, err
 		}
-		return d, nil
+		return d.IOReadCloser(), nil
+	case "lz4":
+		return lz4.NewReader(r), nil
+	case "lzma":
+		return lzma.NewReader(r)
+	case "lzip":
+		return newLzipReader(r), nil
+	case "brotli":
+		return brotli.NewReader(r), nil
 	default:
 		return nil, fmt.Errorf("unsupported compression format: %s", format)
 	}
 }
+
+// bz2Reader stops the pbzip2 workers on Close.
+type bz2Reader struct {
+	io.Reader
+	cancel context.CancelFunc
+}
+
+func (b *bz2Reader) Close() error {
+	b.cancel()
+	return nil
+}
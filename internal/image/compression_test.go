@@ -3,17 +3,27 @@ package image
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/andybalholm/brotli"
 	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
 	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
 )
 
 func TestDecompressor_NoCompression(t *testing.T) {
 	input := "Hello, World!"
-	r, err := Decompressor("test.txt", strings.NewReader(input))
+	r, err := Decompressor(context.Background(), "test.txt", strings.NewReader(input))
 	if err != nil {
 		t.Fatalf("Decompressor error: %v", err)
 	}
@@ -30,7 +40,7 @@ func TestDecompressor_NoCompression(t *testing.T) {
 
 func TestDecompressor_NoCompression_UppercaseExtension(t *testing.T) {
 	input := "Hello, World!"
-	r, err := Decompressor("test.TXT", strings.NewReader(input))
+	r, err := Decompressor(context.Background(), "test.TXT", strings.NewReader(input))
 	if err != nil {
 		t.Fatalf("Decompressor error: %v", err)
 	}
@@ -54,7 +64,7 @@ func TestDecompressor_Gzip(t *testing.T) {
 	gw.Write([]byte(input))
 	gw.Close()
 
-	r, err := Decompressor("test.gz", bytes.NewReader(compressed.Bytes()))
+	r, err := Decompressor(context.Background(), "test.gz", bytes.NewReader(compressed.Bytes()))
 	if err != nil {
 		t.Fatalf("Decompressor error: %v", err)
 	}
@@ -85,7 +95,7 @@ func TestDecompressor_Xz(t *testing.T) {
 	xw.Write([]byte(input))
 	xw.Close()
 
-	r, err := Decompressor("test.xz", bytes.NewReader(compressed.Bytes()))
+	r, err := Decompressor(context.Background(), "test.xz", bytes.NewReader(compressed.Bytes()))
 	if err != nil {
 		t.Fatalf("Decompressor error: %v", err)
 	}
@@ -109,7 +119,7 @@ func TestDecompressor_Zstd(t *testing.T) {
 	zw.Write([]byte(input))
 	zw.Close()
 
-	r, err := Decompressor("test.zst", bytes.NewReader(compressed.Bytes()))
+	r, err := Decompressor(context.Background(), "test.zst", bytes.NewReader(compressed.Bytes()))
 	if err != nil {
 		t.Fatalf("Decompressor error: %v", err)
 	}
@@ -132,7 +142,7 @@ func TestDecompressor_ZstdAltExtension(t *testing.T) {
 	zw.Write([]byte(input))
 	zw.Close()
 
-	r, err := Decompressor("test.zstd", bytes.NewReader(compressed.Bytes()))
+	r, err := Decompressor(context.Background(), "test.zstd", bytes.NewReader(compressed.Bytes()))
 	if err != nil {
 		t.Fatalf("Decompressor error: %v", err)
 	}
@@ -153,7 +163,7 @@ func TestDecompressor_GzipInvalidData(t *testing.T) {
 	// of returning an error.
 	invalidData := []byte("This is not gzip data")
 
-	r, err := Decompressor("test.gz", bytes.NewReader(invalidData))
+	r, err := Decompressor(context.Background(), "test.gz", bytes.NewReader(invalidData))
 	if err != nil {
 		t.Fatalf("Expected fallback to raw reader, got error: %v", err)
 	}
@@ -176,7 +186,7 @@ func TestDecompressor_XzInvalidData(t *testing.T) {
 	// recognise it's not actually xz and fall back to raw reader.
 	invalidData := []byte("This is not xz data")
 
-	r, err := Decompressor("test.xz", bytes.NewReader(invalidData))
+	r, err := Decompressor(context.Background(), "test.xz", bytes.NewReader(invalidData))
 	if err != nil {
 		t.Fatalf("Expected fallback to raw reader, got error: %v", err)
 	}
@@ -196,7 +206,7 @@ func TestDecompressor_LargeData(t *testing.T) {
 	gw.Write(input)
 	gw.Close()
 
-	r, err := Decompressor("test.gz", bytes.NewReader(compressed.Bytes()))
+	r, err := Decompressor(context.Background(), "test.gz", bytes.NewReader(compressed.Bytes()))
 	if err != nil {
 		t.Fatalf("Decompressor error: %v", err)
 	}
@@ -233,7 +243,182 @@ func TestDecompressor_MixedCaseExtensions(t *testing.T) {
 
 			// For compressed extensions, we can't just pass plain text
 			// so we just verify the function doesn't panic
-			_, _ = Decompressor(tt.ext, reader)
+			_, _ = Decompressor(context.Background(), tt.ext, reader)
+		})
+	}
+}
+
+// encodeLzip returns data as an lzip file of the given members, each holding
+// an equal share of data.
+func encodeLzip(t *testing.T, data []byte, members int) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	share := len(data) / members
+	for i := 0; i < members; i++ {
+		part := data[i*share:]
+		if i < members-1 {
+			part = part[:share]
+		}
+		// The lzma package writes a classic header, which lzip replaces with
+		// its own; the end marker is required.
+		var stream bytes.Buffer
+		w, err := lzma.WriterConfig{DictCap: 1 << 16, EOSMarker: true, Size: -1}.NewWriter(&stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(part)
+		w.Close()
+		body := stream.Bytes()[lzma.HeaderLen:]
+
+		out.Write([]byte{'L', 'Z', 'I', 'P', 1, 16})
+		out.Write(body)
+		out.Write(binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE(part)))
+		out.Write(binary.LittleEndian.AppendUint64(nil, uint64(len(part))))
+		out.Write(binary.LittleEndian.AppendUint64(nil, uint64(lzipHeaderLen+len(body)+lzipTrailerLen)))
+	}
+	return out.Bytes()
+}
+
+func TestDecompressor_NewFormats(t *testing.T) {
+	input := bytes.Repeat([]byte("pvflasher compression test data "), 4096)
+
+	var lz4Frame, lz4Legacy, lzmaAlone, br bytes.Buffer
+	lw := lz4.NewWriter(&lz4Frame)
+	lw.Write(input)
+	lw.Close()
+	lw = lz4.NewWriter(&lz4Legacy)
+	lw.Apply(lz4.LegacyOption(true))
+	lw.Write(input)
+	lw.Close()
+	zw, _ := lzma.NewWriter(&lzmaAlone)
+	zw.Write(input)
+	zw.Close()
+	bw := brotli.NewWriter(&br)
+	bw.Write(input)
+	bw.Close()
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"image.img.lz4", lz4Frame.Bytes()},
+		{"image.img.lz4", lz4Legacy.Bytes()},
+		{"image.img.lzma", lzmaAlone.Bytes()},
+		{"image.img.lz", encodeLzip(t, input, 1)},
+		{"image.img.lz", encodeLzip(t, input, 3)},
+		{"image.img.br", br.Bytes()},
+		// Content wins over a wrong extension.
+		{"image.img.gz", lz4Frame.Bytes()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !HasCompressionExt(tt.name) {
+				t.Errorf("HasCompressionExt(%q) = false", tt.name)
+			}
+			r, err := Decompressor(context.Background(), tt.name, bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatalf("Decompressor error: %v", err)
+			}
+			content, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("Read error: %v", err)
+			}
+			if !bytes.Equal(content, input) {
+				t.Errorf("got %d bytes, want %d bytes of input", len(content), len(input))
+			}
+		})
+	}
+}
+
+func TestDecompressor_LzipCorrupt(t *testing.T) {
+	input := bytes.Repeat([]byte("lzip"), 10000)
+	good := encodeLzip(t, input, 2)
+
+	badCRC := bytes.Clone(good)
+	badCRC[len(badCRC)-lzipTrailerLen] ^= 0xff
+	badSize := bytes.Clone(good)
+	badSize[len(badSize)-lzipTrailerLen+4]++
+
+	tests := map[string][]byte{
+		"bad crc32":       badCRC,
+		"bad data size":   badSize,
+		"truncated":       good[:len(good)-10],
+		"truncated early": good[:len(good)/4],
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			r, err := Decompressor(context.Background(), "image.img.lz", bytes.NewReader(data))
+			if err == nil {
+				_, err = io.ReadAll(r)
+			}
+			if !errors.Is(err, ErrLzipCorrupt) {
+				t.Errorf("err = %v, want ErrLzipCorrupt", err)
+			}
+		})
+	}
+}
+
+func TestDetectMagic_LzmaHeuristic(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		want   bool
+	}{
+		{"8 MiB dict, unknown size", []byte{0x5d, 0, 0, 0x80, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, true},
+		{"3 MiB dict, known size", []byte{0x5d, 0, 0, 0x30, 0, 0x10, 0, 0, 0, 0, 0, 0, 0}, true},
+		{"odd dict", []byte{0x5d, 1, 2, 3, 4, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, false},
+		{"huge size", []byte{0x5d, 0, 0, 0x80, 0, 0, 0, 0, 0, 0, 0, 0x10, 0}, false},
+		{"other properties", []byte{0x5e, 0, 0, 0x80, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, false},
+	}
+	for _, tt := range tests {
+		if got := isLzmaHeader(tt.header); got != tt.want {
+			t.Errorf("%s: isLzmaHeader = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDecompressor_LzmaNeedsExtension(t *testing.T) {
+	// A raw image that happens to start like an lzma header.
+	raw := append([]byte{0x5d, 0, 0, 0x80, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, make([]byte, 4096)...)
+	path := filepath.Join(t.TempDir(), "image.img")
+	if err := os.WriteFile(path, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Decompressor(context.Background(), path, bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Decompressor error: %v", err)
+	}
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, raw) {
+		t.Errorf("ReadAll = %d bytes, %v, want the raw image", len(got), err)
+	}
+	if f, err := Detect(path); err != nil || f.Compression != "" {
+		t.Errorf("Detect = %+v, %v, want no compression", f, err)
+	}
+}
+
+// Decoding a multi-frame zstd image with one decoder goroutine and with
+// several. Before DecodeWorkers, the zstd package picked up to four.
+func BenchmarkDecompressZstd(b *testing.B) {
+	data := xzTestData(64 << 20)
+	enc, _ := zstd.NewWriter(nil)
+	var compressed []byte
+	for off := 0; off < len(data); off += 4 << 20 {
+		compressed = enc.EncodeAll(data[off:off+4<<20], compressed)
+	}
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				r, err := newDecompressor(context.Background(), "zstd", bytes.NewReader(compressed), workers)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, r); err != nil {
+					b.Fatal(err)
+				}
+				r.(io.Closer).Close()
+			}
 		})
 	}
 }
@@ -0,0 +1,137 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Format is what a file holds, as found by Detect.
+type Format struct {
+	// Compression is the compression format of the file, like "xz", or ""
+	// if it isn't compressed.
+	Compression string
+	// Kind is what the file, once decompressed, holds: "raw", "tar",
+	// "zip", "simg", "qcow2", "vhd", "vhdx" or "vmdk".
+	Kind string
+}
+
+// String returns the kind, followed by the compression if any, as in
+// "raw+xz" or "tar+zstd".
+func (f Format) String() string {
+	if f.Compression == "" {
+		return f.Kind
+	}
+	return f.Kind + "+" + f.Compression
+}
+
+// Detect reads the start of the file at path to find out what it holds. The
+// content decides; the extension only breaks ties the content can't, like
+// brotli, which has no magic.
+func Detect(path string) (Format, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Format{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return Format{}, err
+	}
+
+	// Virtual disks keep their footer or tables outside the first bytes,
+	// and are read in place, never compressed.
+	if kind := sniffVirtualDisk(f, fi.Size()); kind != "" {
+		return Format{Kind: kind}, nil
+	}
+
+	compression, br := detectMagic(f)
+	if compression == "" {
+		compression = extOnlyCompression(path, br)
+	}
+	if compression == "" {
+		return Format{Kind: sniffKind(bufio.NewReaderSize(br, sniffLen))}, nil
+	}
+	// One worker, as only the first bytes are read.
+	r, err := newDecompressor(context.Background(), compression, br, 1)
+	if err != nil {
+		return Format{}, err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	return Format{Compression: compression, Kind: sniffKind(bufio.NewReaderSize(r, sniffLen))}, nil
+}
+
+// tar archives in the ustar and GNU formats have a magic in their first
+// header.
+const tarMagicOffset = 257
+
+// sniffLen is how much of the start of a file sniffKind looks at.
+const sniffLen = tarMagicOffset + len("ustar")
+
+var (
+	tarMagic = []byte("ustar")
+	zipMagic = []byte("PK\x03\x04")
+	// Empty zip archive: just the end of central directory record
+	zipEmptyMagic = []byte("PK\x05\x06")
+)
+
+// sniffKind tells tar and zip archives and Android sparse images from raw
+// images by their first bytes.
+func sniffKind(br *bufio.Reader) string {
+	peek, _ := br.Peek(sniffLen)
+	switch {
+	case len(peek) == sniffLen && bytes.Equal(peek[tarMagicOffset:], tarMagic):
+		return "tar"
+	case matchBytes(peek, zipMagic) || matchBytes(peek, zipEmptyMagic):
+		return "zip"
+	case IsSimg(peek):
+		return "simg"
+	default:
+		return "raw"
+	}
+}
+
+// sniffVirtualDisk returns the kind of virtual disk r is, or "" if it's
+// none, without reading its tables.
+func sniffVirtualDisk(r io.ReaderAt, size int64) string {
+	var magic [8]byte
+	if n, _ := r.ReadAt(magic[:], 0); n < len(magic) {
+		return ""
+	}
+	switch {
+	case string(magic[:4]) == qcow2Magic:
+		return "qcow2"
+	case string(magic[:4]) == vmdkMagic:
+		return "vmdk"
+	case string(magic[:]) == "vhdxfile":
+		return "vhdx"
+	}
+	if _, ok := readVHDFooter(r, size-vhdFooterLen); ok {
+		return "vhd"
+	}
+	if _, ok := readVHDFooter(r, 0); ok {
+		return "vhd"
+	}
+	return ""
+}
+
+// extOnlyCompression returns the compression the extension of path names,
+// for formats without a reliable magic: brotli, and legacy lzma if br starts
+// with a plausible lzma header.
+func extOnlyCompression(path string, br *bufio.Reader) string {
+	switch c := compressionExts[strings.ToLower(filepath.Ext(path))]; c {
+	case "brotli":
+		return c
+	case "lzma":
+		if peek, _ := br.Peek(13); isLzmaHeader(peek) {
+			return c
+		}
+	}
+	return ""
+}
@@ -0,0 +1,98 @@
+package image
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/ulikunitz/xz"
+)
+
+func TestDetect(t *testing.T) {
+	raw := bytes.Repeat([]byte("raw image "), 1000)
+	compress := func(data []byte, newWriter func(*bytes.Buffer) io.WriteCloser) []byte {
+		var buf bytes.Buffer
+		w := newWriter(&buf)
+		w.Write(data)
+		w.Close()
+		return buf.Bytes()
+	}
+	gz := func(b *bytes.Buffer) io.WriteCloser {
+		return gzip.NewWriter(b)
+	}
+
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	tw.WriteHeader(&tar.Header{Name: "image.img", Mode: 0644, Size: int64(len(raw))})
+	tw.Write(raw)
+	tw.Close()
+
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	w, _ := zw.Create("image.img")
+	w.Write(raw)
+	zw.Close()
+
+	var xzBuf bytes.Buffer
+	xw, _ := xz.NewWriter(&xzBuf)
+	xw.Write(raw)
+	xw.Close()
+
+	simg, _ := buildSimg(testSimgChunks())
+	qcow2, _ := buildQcow2(t)
+
+	tests := []struct {
+		name string
+		data []byte
+		want Format
+	}{
+		{"image.img", raw, Format{Kind: "raw"}},
+		{"image.bin", xzBuf.Bytes(), Format{Compression: "xz", Kind: "raw"}},
+		{"image.img.gz", xzBuf.Bytes(), Format{Compression: "xz", Kind: "raw"}},
+		{"image.img.gz", raw, Format{Kind: "raw"}},
+		{"release", tarBuf.Bytes(), Format{Kind: "tar"}},
+		{"release.bin", compress(tarBuf.Bytes(), gz), Format{Compression: "gz", Kind: "tar"}},
+		{"release.img", zipBuf.Bytes(), Format{Kind: "zip"}},
+		{"system.img", simg, Format{Kind: "simg"}},
+		{"system.img", compress(simg, gz), Format{Compression: "gz", Kind: "simg"}},
+		{"disk.img", qcow2, Format{Kind: "qcow2"}},
+		// Brotli has no magic, so only the extension tells.
+		{"image.img.br", compress(raw, func(b *bytes.Buffer) io.WriteCloser {
+			return brotli.NewWriter(b)
+		}), Format{Compression: "brotli", Kind: "raw"}},
+	}
+	dir := t.TempDir()
+	for i, tt := range tests {
+		path := filepath.Join(dir, string(rune('a'+i)), tt.name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, tt.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := Detect(path)
+		if err != nil {
+			t.Errorf("%s (%d): Detect failed: %v", tt.name, i, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s (%d): Detect = %v, want %v", tt.name, i, got, tt.want)
+		}
+		if want := tt.want.Compression != ""; IsCompressed(path) != want {
+			t.Errorf("%s (%d): IsCompressed = %v, want %v", tt.name, i, !want, want)
+		}
+	}
+}
+
+func TestIsCompressed_MissingFile(t *testing.T) {
+	if !IsCompressed("/nonexistent/image.img.zst") {
+		t.Error("IsCompressed should fall back to the extension for missing files")
+	}
+	if IsCompressed("/nonexistent/image.img") {
+		t.Error("IsCompressed(image.img) = true for a missing file")
+	}
+}
@@ -0,0 +1,164 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// lzip format, as described in the lzip manual: members of a 6-byte header,
+// an LZMA stream with an end marker and a 20-byte trailer, back to back.
+const (
+	lzipHeaderLen  = 6
+	lzipTrailerLen = 20
+)
+
+// ErrLzipCorrupt is returned for an lzip member whose trailer doesn't match
+// its data.
+var ErrLzipCorrupt = errors.New("corrupt lzip data")
+
+// lzipReader decodes the members of an lzip file one after the other,
+// checking each against its trailer.
+type lzipReader struct {
+	br *bufio.Reader
+	// lzipStream for the current member, nil before the first one
+	member *lzipStream
+	dec    *lzma.Reader
+	crc    hash.Hash32
+	size   int64 // Data bytes of the current member
+	err    error
+}
+
+func newLzipReader(r io.Reader) *lzipReader {
+	return &lzipReader{br: bufio.NewReader(r), crc: crc32.NewIEEE()}
+}
+
+// lzipStream turns a member into a classic LZMA stream for the lzma
+// package: a synthesized header followed by the member's data. It reads
+// byte by byte from the bufio.Reader, so the decoder stops exactly at the
+// end marker and the trailer is left to read.
+type lzipStream struct {
+	header []byte
+	br     *bufio.Reader
+	n      int64 // Bytes read from br
+}
+
+func (s *lzipStream) Read(p []byte) (int, error) {
+	if len(s.header) > 0 {
+		n := copy(p, s.header)
+		s.header = s.header[n:]
+		return n, nil
+	}
+	n, err := s.br.Read(p)
+	s.n += int64(n)
+	return n, err
+}
+
+func (s *lzipStream) ReadByte() (byte, error) {
+	if len(s.header) > 0 {
+		c := s.header[0]
+		s.header = s.header[1:]
+		return c, nil
+	}
+	c, err := s.br.ReadByte()
+	if err == nil {
+		s.n++
+	}
+	return c, err
+}
+
+func (z *lzipReader) Read(p []byte) (int, error) {
+	for z.err == nil {
+		if z.dec == nil {
+			if z.err = z.nextMember(); z.err != nil {
+				break
+			}
+		}
+		n, err := z.dec.Read(p)
+		z.crc.Write(p[:n])
+		z.size += int64(n)
+		if err == io.EOF {
+			z.err = z.checkTrailer()
+			z.dec = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		if err != nil {
+			z.err = fmt.Errorf("%w: %v", ErrLzipCorrupt, err)
+			return n, z.err
+		}
+		return n, nil
+	}
+	return 0, z.err
+}
+
+// nextMember reads the header of the next member. After the first member,
+// the end of the file or data other than a member ends the stream, as lzip
+// ignores trailing data by default.
+func (z *lzipReader) nextMember() error {
+	header, err := z.br.Peek(lzipHeaderLen)
+	if z.member != nil && (len(header) < lzipHeaderLen || !bytes.Equal(header[:5], magicLzip)) {
+		return io.EOF
+	}
+	if err != nil {
+		return fmt.Errorf("%w: truncated header", ErrLzipCorrupt)
+	}
+	if !bytes.Equal(header[:4], magicLzip[:4]) {
+		return fmt.Errorf("%w: bad magic", ErrLzipCorrupt)
+	}
+	if header[4] != 1 {
+		return fmt.Errorf("unsupported lzip version %d", header[4])
+	}
+	// The dictionary size is a power of two, less up to 7 sixteenths of it.
+	base := uint32(1) << (header[5] & 0x1f)
+	dict := base - base/16*uint32(header[5]>>5)
+	if base < 1<<12 || base > 1<<29 || dict < 1<<12 {
+		return fmt.Errorf("%w: dictionary size %d", ErrLzipCorrupt, dict)
+	}
+	z.br.Discard(lzipHeaderLen)
+
+	// lc=3, lp=0, pb=2, unknown size: the stream ends with an end marker.
+	lzmaHeader := make([]byte, lzma.HeaderLen)
+	lzmaHeader[0] = 0x5d
+	binary.LittleEndian.PutUint32(lzmaHeader[1:], dict)
+	binary.LittleEndian.PutUint64(lzmaHeader[5:], math.MaxUint64)
+	z.member = &lzipStream{header: lzmaHeader, br: z.br}
+	z.dec, err = lzma.ReaderConfig{DictCap: int(dict)}.NewReader(z.member)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrLzipCorrupt, err)
+	}
+	z.crc.Reset()
+	z.size = 0
+	return nil
+}
+
+// checkTrailer reads the trailer of the current member and checks it against
+// the data decoded.
+func (z *lzipReader) checkTrailer() error {
+	var trailer [lzipTrailerLen]byte
+	if _, err := io.ReadFull(z.br, trailer[:]); err != nil {
+		return fmt.Errorf("%w: truncated trailer", ErrLzipCorrupt)
+	}
+	le := binary.LittleEndian
+	if crc := le.Uint32(trailer[0:]); crc != z.crc.Sum32() {
+		return fmt.Errorf("%w: crc32 %08x, trailer says %08x", ErrLzipCorrupt, z.crc.Sum32(), crc)
+	}
+	if size := int64(le.Uint64(trailer[4:])); size != z.size {
+		return fmt.Errorf("%w: %d bytes of data, trailer says %d", ErrLzipCorrupt, z.size, size)
+	}
+	memberSize := lzipHeaderLen + z.member.n + lzipTrailerLen
+	if size := int64(le.Uint64(trailer[12:])); size != memberSize {
+		return fmt.Errorf("%w: member of %d bytes, trailer says %d", ErrLzipCorrupt, memberSize, size)
+	}
+	return nil
+}
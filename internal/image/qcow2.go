@@ -0,0 +1,165 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/zstd"
+)
+
+// qcow2 format, as described in QEMU's docs/interop/qcow2.txt.
+const (
+	qcow2Magic = "QFI\xfb"
+
+	qcow2OffsetMask     = 0x00fffffffffffe00 // Host offset in L1 and L2 entries
+	qcow2Compressed     = 1 << 62            // L2 entry: cluster is compressed
+	qcow2ZeroCluster    = 1 << 0             // L2 entry (v3): cluster reads as zeros
+	qcow2Dirty          = 1 << 0             // Incompatible feature bits
+	qcow2CompressionExt = 1 << 3
+)
+
+// qcow2Layout maps clusters through the L1 and L2 tables.
+type qcow2Layout struct {
+	r           io.ReaderAt
+	fileSize    int64
+	clusterBits uint
+	l1          []uint64
+
+	// The last L2 table read
+	l2Off int64
+	l2    []uint64
+}
+
+// openQcow2 reads the header and L1 table of a qcow2 file. Images with a
+// backing file, encryption or an external data file are refused, as their
+// clusters aren't all in this file.
+func openQcow2(r io.ReaderAt, fileSize int64) (*VirtualDisk, error) {
+	hdr := make([]byte, 105)
+	n, err := r.ReadAt(hdr, 0)
+	if n < 72 {
+		if err == nil || err == io.EOF {
+			return nil, fmt.Errorf("%w: truncated qcow2 header", ErrVirtualDiskCorrupt)
+		}
+		return nil, err
+	}
+	be := binary.BigEndian
+	version := be.Uint32(hdr[4:])
+	if version != 2 && version != 3 {
+		return nil, fmt.Errorf("unsupported qcow2 version %d", version)
+	}
+	if be.Uint64(hdr[8:]) != 0 {
+		return nil, fmt.Errorf("qcow2 images with a backing file are not supported; flatten it with qemu-img convert first")
+	}
+	clusterBits := uint(be.Uint32(hdr[20:]))
+	if clusterBits < 9 || clusterBits > 21 {
+		return nil, fmt.Errorf("%w: qcow2 cluster bits %d", ErrVirtualDiskCorrupt, clusterBits)
+	}
+	if be.Uint32(hdr[32:]) != 0 {
+		return nil, fmt.Errorf("encrypted qcow2 images are not supported")
+	}
+
+	d := &VirtualDisk{
+		r:         r,
+		format:    "qcow2",
+		size:      int64(be.Uint64(hdr[24:])),
+		blockSize: 1 << clusterBits,
+		inflate:   inflateDeflate,
+	}
+	if err := checkDiskSize("qcow2", d.size); err != nil {
+		return nil, err
+	}
+	if version == 3 {
+		if n < 104 {
+			return nil, fmt.Errorf("%w: truncated qcow2 header", ErrVirtualDiskCorrupt)
+		}
+		features := be.Uint64(hdr[72:])
+		if unknown := features &^ (qcow2Dirty | qcow2CompressionExt); unknown != 0 {
+			return nil, fmt.Errorf("qcow2 image uses unsupported features (incompatible feature bits %#x)", unknown)
+		}
+		if features&qcow2CompressionExt != 0 {
+			if be.Uint32(hdr[100:]) <= 104 || n < 105 {
+				return nil, fmt.Errorf("%w: qcow2 header has no compression type", ErrVirtualDiskCorrupt)
+			}
+			switch hdr[104] {
+			case 0:
+			case 1:
+				d.inflate = inflateZstd
+			default:
+				return nil, fmt.Errorf("unsupported qcow2 compression type %d", hdr[104])
+			}
+		}
+	}
+
+	// Each L2 table fills one cluster with 8-byte entries.
+	l2Span := d.blockSize * (d.blockSize / 8)
+	l1Size := int64(be.Uint32(hdr[36:]))
+	if l1Size < (d.size+l2Span-1)/l2Span {
+		return nil, fmt.Errorf("%w: qcow2 L1 table of %d entries is too small for %d bytes", ErrVirtualDiskCorrupt, l1Size, d.size)
+	}
+	l1, err := readTable(r, fileSize, int64(be.Uint64(hdr[40:])), l1Size, 8, be)
+	if err != nil {
+		return nil, err
+	}
+	d.layout = &qcow2Layout{r: r, fileSize: fileSize, clusterBits: clusterBits, l1: l1}
+	return d, nil
+}
+
+func (q *qcow2Layout) locate(cluster int64) (blockLoc, error) {
+	l2Entries := int64(1) << (q.clusterBits - 3)
+	l2Off := int64(q.l1[cluster/l2Entries] & qcow2OffsetMask)
+	if l2Off == 0 {
+		return blockLoc{off: -1, unallocated: l2Entries - cluster%l2Entries}, nil
+	}
+	if l2Off != q.l2Off || q.l2 == nil {
+		l2, err := readTable(q.r, q.fileSize, l2Off, l2Entries, 8, binary.BigEndian)
+		if err != nil {
+			return blockLoc{}, err
+		}
+		q.l2, q.l2Off = l2, l2Off
+	}
+
+	entry := q.l2[cluster%l2Entries]
+	if entry&qcow2Compressed != 0 {
+		// Bits 0 to x-1 hold the offset, bits x to 61 the number of 512-byte
+		// sectors the data takes beyond the one the offset is in.
+		x := 62 - (q.clusterBits - 8)
+		off := int64(entry & (1<<x - 1))
+		sectors := int64(entry>>x) & (1<<(62-x) - 1)
+		length := (sectors+1)*512 - off%512
+		if off+length > q.fileSize+512 {
+			return blockLoc{}, fmt.Errorf("%w: compressed cluster %d is past the end of the file", ErrVirtualDiskCorrupt, cluster)
+		}
+		return blockLoc{off: off, compressed: length}, nil
+	}
+	off := int64(entry & qcow2OffsetMask)
+	if off == 0 || entry&qcow2ZeroCluster != 0 {
+		// Zero clusters are skipped like unallocated ones: qemu-img
+		// writes them for regions it found to be zeros.
+		return blockLoc{off: -1}, nil
+	}
+	return blockLoc{off: off}, nil
+}
+
+// inflateDeflate decodes a cluster compressed with raw deflate, qcow2's
+// default compression.
+func inflateDeflate(dst, src []byte) error {
+	fr := flate.NewReader(bytes.NewReader(src))
+	defer fr.Close()
+	_, err := io.ReadFull(fr, dst)
+	return err
+}
+
+// inflateZstd decodes a cluster compressed with zstd. The data is followed by
+// padding, so only as much as fills dst is decoded.
+func inflateZstd(dst, src []byte) error {
+	zr, err := zstd.NewReader(bytes.NewReader(src), zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	_, err = io.ReadFull(zr, dst)
+	return err
+}
@@ -1,31 +1,48 @@
 package image
 
 import (
+	"context"
 	"errors"
 	"io"
+	"sync/atomic"
 )
 
-// CountingReader wraps an io.Reader and counts the number of bytes read
+// CountingReader wraps an io.Reader and counts the number of bytes read.
+// Decoders may read it from their own goroutines, so Count is atomic.
 type CountingReader struct {
 	io.Reader
-	Count int64
+	Count atomic.Int64
 }
 
 func (r *CountingReader) Read(p []byte) (n int, err error) {
 	n, err = r.Reader.Read(p)
-	r.Count += int64(n)
+	r.Count.Add(int64(n))
 	return
 }
 
+// contextReader fails reads with the error of ctx once it is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
 // ForwardSeeker allows seeking forward only on a reader
 type ForwardSeeker struct {
-	r      io.Reader
+	r      contextReader
 	offset int64
 }
 
-// NewForwardSeeker creates a new ForwardSeeker
-func NewForwardSeeker(r io.Reader) *ForwardSeeker {
-	return &ForwardSeeker{r: r}
+// NewForwardSeeker creates a new ForwardSeeker. Once ctx is done, reads
+// and seeks fail with its error, also partway through skipping a gap.
+func NewForwardSeeker(ctx context.Context, r io.Reader) *ForwardSeeker {
+	return &ForwardSeeker{r: contextReader{ctx: ctx, r: r}}
 }
 
 func (s *ForwardSeeker) Read(p []byte) (n int, err error) {
@@ -56,7 +73,7 @@ func (s *ForwardSeeker) Seek(offset int64, whence int) (int64, error) {
 
 	delta := target - s.offset
 	// discard delta bytes
-	copied, err := io.CopyN(io.Discard, s.r, delta)
+	copied, err := io.CopyN(io.Discard, &s.r, delta)
 	s.offset += copied
 	if err != nil {
 		return s.offset, err
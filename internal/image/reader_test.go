@@ -1,6 +1,8 @@
 package image
 
 import (
+	"context"
+	"errors"
 	"io"
 	"strings"
 	"testing"
@@ -53,8 +55,8 @@ func TestCountingReader(t *testing.T) {
 				}
 			}
 
-			if r.Count != tt.wantCount {
-				t.Errorf("Count = %v, want %v", r.Count, tt.wantCount)
+			if r.Count.Load() != tt.wantCount {
+				t.Errorf("Count = %v, want %v", r.Count.Load(), tt.wantCount)
 			}
 		})
 	}
@@ -69,22 +71,22 @@ func TestCountingReader_MultipleReads(t *testing.T) {
 	// First read: 5 bytes
 	buf1 := make([]byte, 5)
 	n1, _ := r.Read(buf1)
-	if n1 != 5 || r.Count != 5 {
-		t.Errorf("After first read: n=%d, count=%d, want n=5, count=5", n1, r.Count)
+	if n1 != 5 || r.Count.Load() != 5 {
+		t.Errorf("After first read: n=%d, count=%d, want n=5, count=5", n1, r.Count.Load())
 	}
 
 	// Second read: 5 bytes
 	buf2 := make([]byte, 5)
 	n2, _ := r.Read(buf2)
-	if n2 != 5 || r.Count != 10 {
-		t.Errorf("After second read: n=%d, count=%d, want n=5, count=10", n2, r.Count)
+	if n2 != 5 || r.Count.Load() != 10 {
+		t.Errorf("After second read: n=%d, count=%d, want n=5, count=10", n2, r.Count.Load())
 	}
 
 	// Third read: remaining 3 bytes
 	buf3 := make([]byte, 5)
 	n3, _ := r.Read(buf3)
-	if n3 != 3 || r.Count != 13 {
-		t.Errorf("After third read: n=%d, count=%d, want n=3, count=13", n3, r.Count)
+	if n3 != 3 || r.Count.Load() != 13 {
+		t.Errorf("After third read: n=%d, count=%d, want n=3, count=13", n3, r.Count.Load())
 	}
 
 	// Fourth read: should get EOF
@@ -97,7 +99,7 @@ func TestCountingReader_MultipleReads(t *testing.T) {
 
 func TestForwardSeeker_New(t *testing.T) {
 	r := strings.NewReader("test data")
-	seeker := NewForwardSeeker(r)
+	seeker := NewForwardSeeker(context.Background(), r)
 
 	if seeker == nil {
 		t.Fatal("NewForwardSeeker returned nil")
@@ -110,7 +112,7 @@ func TestForwardSeeker_New(t *testing.T) {
 
 func TestForwardSeeker_Read(t *testing.T) {
 	input := "Hello, World!"
-	seeker := NewForwardSeeker(strings.NewReader(input))
+	seeker := NewForwardSeeker(context.Background(), strings.NewReader(input))
 
 	buf := make([]byte, 5)
 	n, err := seeker.Read(buf)
@@ -131,7 +133,7 @@ func TestForwardSeeker_Read(t *testing.T) {
 
 func TestForwardSeeker_SeekStart(t *testing.T) {
 	input := "Hello, World! This is a test message."
-	seeker := NewForwardSeeker(strings.NewReader(input))
+	seeker := NewForwardSeeker(context.Background(), strings.NewReader(input))
 
 	// Seek to position 7
 	pos, err := seeker.Seek(7, io.SeekStart)
@@ -155,7 +157,7 @@ func TestForwardSeeker_SeekStart(t *testing.T) {
 
 func TestForwardSeeker_SeekCurrent(t *testing.T) {
 	input := "Hello, World!"
-	seeker := NewForwardSeeker(strings.NewReader(input))
+	seeker := NewForwardSeeker(context.Background(), strings.NewReader(input))
 
 	// Read first 5 bytes
 	seeker.Read(make([]byte, 5))
@@ -182,7 +184,7 @@ func TestForwardSeeker_SeekCurrent(t *testing.T) {
 
 func TestForwardSeeker_SeekNoMovement(t *testing.T) {
 	input := "Hello, World!"
-	seeker := NewForwardSeeker(strings.NewReader(input))
+	seeker := NewForwardSeeker(context.Background(), strings.NewReader(input))
 
 	// Seek to same position
 	pos, err := seeker.Seek(0, io.SeekStart)
@@ -203,7 +205,7 @@ func TestForwardSeeker_SeekNoMovement(t *testing.T) {
 
 func TestForwardSeeker_SeekBackwardError(t *testing.T) {
 	input := "Hello, World!"
-	seeker := NewForwardSeeker(strings.NewReader(input))
+	seeker := NewForwardSeeker(context.Background(), strings.NewReader(input))
 
 	// Read some bytes first
 	seeker.Read(make([]byte, 10))
@@ -220,7 +222,7 @@ func TestForwardSeeker_SeekBackwardError(t *testing.T) {
 
 func TestForwardSeeker_SeekEndNotSupported(t *testing.T) {
 	input := "Hello, World!"
-	seeker := NewForwardSeeker(strings.NewReader(input))
+	seeker := NewForwardSeeker(context.Background(), strings.NewReader(input))
 
 	// SeekEnd should not be supported
 	_, err := seeker.Seek(0, io.SeekEnd)
@@ -231,7 +233,7 @@ func TestForwardSeeker_SeekEndNotSupported(t *testing.T) {
 
 func TestForwardSeeker_ReadAll(t *testing.T) {
 	input := "Hello, World!"
-	seeker := NewForwardSeeker(strings.NewReader(input))
+	seeker := NewForwardSeeker(context.Background(), strings.NewReader(input))
 
 	// Use io.ReadAll to read entire content
 	content, err := io.ReadAll(seeker)
@@ -248,6 +250,36 @@ func TestForwardSeeker_ReadAll(t *testing.T) {
 	}
 }
 
+// cancellingReader is an endless stream that cancels its context on the
+// first read.
+type cancellingReader struct {
+	cancel context.CancelFunc
+	reads  int
+}
+
+func (r *cancellingReader) Read(p []byte) (int, error) {
+	r.reads++
+	r.cancel()
+	return len(p), nil
+}
+
+func TestForwardSeeker_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &cancellingReader{cancel: cancel}
+	seeker := NewForwardSeeker(ctx, r)
+
+	// Skipping a 1 TiB gap stops right after the context is cancelled.
+	if _, err := seeker.Seek(1<<40, io.SeekStart); !errors.Is(err, context.Canceled) {
+		t.Errorf("Seek error = %v, want context.Canceled", err)
+	}
+	if r.reads != 1 {
+		t.Errorf("Seek read %d times after cancel, want 1", r.reads)
+	}
+	if _, err := seeker.Read(make([]byte, 10)); !errors.Is(err, context.Canceled) {
+		t.Errorf("Read error = %v, want context.Canceled", err)
+	}
+}
+
 func TestForwardSeeker_LargeSeek(t *testing.T) {
 	// Skip this test as it may fail on some systems due to ReadAll behavior
 	t.Skip("Large seek test - may have implementation-specific behavior")
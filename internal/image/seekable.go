@@ -0,0 +1,452 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// ErrSeekableCorrupt is returned for a seek table or index that doesn't
+// match the compressed data.
+var ErrSeekableCorrupt = errors.New("corrupt seek table")
+
+// seekFrame is a part of the decompressed data that can be decoded on its
+// own.
+type seekFrame struct {
+	off, size int64 // In the decompressed data
+}
+
+// SeekableReader reads compressed images at random: they are made of frames
+// that decode on their own, so a seek only decompresses from the start of
+// the frame it lands in. Forward seeks within a frame decompress and discard
+// what they skip, like ForwardSeeker.
+type SeekableReader struct {
+	f      *os.File
+	frames []seekFrame
+	size   int64
+	// open returns a decoder for frame i.
+	open  func(i int) (io.Reader, error)
+	close func()
+
+	pos    int64
+	frame  int       // Frame dec decodes
+	dec    io.Reader // nil until the first read and after a seek to another frame
+	decPos int64     // Offset of the next byte dec returns
+}
+
+// OpenSeekable opens the image at path for random access if it is a zstd
+// image in the seekable format, an xz image of more than one block or a gzip
+// image with a .zran index next to it. It returns nil if the image is none.
+func OpenSeekable(path string) (*SeekableReader, error) {
+	format, err := Detect(path)
+	if err != nil || format.Kind != "raw" {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	s := &SeekableReader{f: f}
+	switch format.Compression {
+	case "zstd":
+		err = s.initZstd(fi.Size())
+	case "xz":
+		err = s.initXZ(fi.Size())
+	case "gz":
+		err = s.initGzip(path, fi.Size())
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(s.frames) < 2 {
+		// A single frame is read like any stream.
+		s.Close()
+		return nil, nil
+	}
+	last := s.frames[len(s.frames)-1]
+	s.size = last.off + last.size
+	return s, nil
+}
+
+// Size returns the size of the decompressed data.
+func (s *SeekableReader) Size() int64 { return s.size }
+
+// Frames returns the number of frames the image is made of.
+func (s *SeekableReader) Frames() int { return len(s.frames) }
+
+func (s *SeekableReader) Read(p []byte) (int, error) {
+	if s.pos >= s.size {
+		return 0, io.EOF
+	}
+	if s.dec == nil || s.decPos != s.pos {
+		if err := s.position(); err != nil {
+			return 0, err
+		}
+	}
+	fr := s.frames[s.frame]
+	if left := fr.off + fr.size - s.pos; int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := s.dec.Read(p)
+	s.pos += int64(n)
+	s.decPos = s.pos
+	if s.pos == fr.off+fr.size {
+		s.dec = nil // The next read opens the next frame
+	} else if err == io.EOF {
+		return n, fmt.Errorf("%w: frame %d ends %d bytes early", ErrSeekableCorrupt, s.frame, fr.off+fr.size-s.pos)
+	} else if err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// position makes dec return the byte at pos next.
+func (s *SeekableReader) position() error {
+	fr := s.frames[s.frame]
+	if s.dec == nil || s.pos < s.decPos || s.pos >= fr.off+fr.size {
+		s.frame = sort.Search(len(s.frames), func(i int) bool {
+			return s.frames[i].off+s.frames[i].size > s.pos
+		})
+		dec, err := s.open(s.frame)
+		if err != nil {
+			s.dec = nil
+			return fmt.Errorf("frame %d: %w", s.frame, err)
+		}
+		s.dec, s.decPos = dec, s.frames[s.frame].off
+	}
+	if s.pos < s.decPos {
+		s.dec = nil
+		return fmt.Errorf("%w: frame %d starts at %d, after %d", ErrSeekableCorrupt, s.frame, s.decPos, s.pos)
+	}
+	if _, err := io.CopyN(io.Discard, s.dec, s.pos-s.decPos); err != nil {
+		s.dec = nil
+		return fmt.Errorf("frame %d: %w", s.frame, err)
+	}
+	s.decPos = s.pos
+	return nil
+}
+
+// Seek implements io.Seeker. Seeks are free until the next read.
+func (s *SeekableReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return s.pos, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return s.pos, errors.New("negative position")
+	}
+	s.pos = offset
+	return s.pos, nil
+}
+
+func (s *SeekableReader) Close() error {
+	if s.close != nil {
+		s.close()
+	}
+	return s.f.Close()
+}
+
+// zstd seekable format, as described in the zstd repository's
+// contrib/seekable_format: the frames are followed by a skippable frame
+// holding a seek table of their sizes, ending in a 9-byte footer.
+const (
+	zstdSkippableMagic = 0x184d2a5e
+	zstdSeekableMagic  = 0x8f92eab1
+	zstdSeekFooterLen  = 9
+)
+
+func (s *SeekableReader) initZstd(size int64) error {
+	le := binary.LittleEndian
+	var footer [zstdSeekFooterLen]byte
+	if size < 8+zstdSeekFooterLen {
+		return nil
+	}
+	if _, err := s.f.ReadAt(footer[:], size-zstdSeekFooterLen); err != nil {
+		return err
+	}
+	if le.Uint32(footer[5:]) != zstdSeekableMagic {
+		return nil // A plain zstd image
+	}
+	count := int64(le.Uint32(footer[0:]))
+	descriptor := footer[4]
+	if descriptor&0x7c != 0 {
+		return fmt.Errorf("%w: reserved seek table bits set", ErrSeekableCorrupt)
+	}
+	entryLen := int64(8)
+	if descriptor&0x80 != 0 {
+		entryLen = 12 // With the checksum of each frame
+	}
+	tableLen := count*entryLen + zstdSeekFooterLen
+	tableOff := size - tableLen - 8
+	if tableOff < 0 {
+		return fmt.Errorf("%w: seek table of %d frames doesn't fit", ErrSeekableCorrupt, count)
+	}
+	table := make([]byte, tableLen+8)
+	if _, err := s.f.ReadAt(table, tableOff); err != nil {
+		return err
+	}
+	if le.Uint32(table[0:]) != zstdSkippableMagic || int64(le.Uint32(table[4:])) != tableLen {
+		return fmt.Errorf("%w: seek table frame header", ErrSeekableCorrupt)
+	}
+
+	var offsets []int64 // Compressed offset of each frame
+	var off, uoff int64
+	for i := int64(0); i < count; i++ {
+		e := table[8+i*entryLen:]
+		csize, usize := int64(le.Uint32(e[0:])), int64(le.Uint32(e[4:]))
+		if usize > 0 {
+			offsets = append(offsets, off)
+			s.frames = append(s.frames, seekFrame{uoff, usize})
+		}
+		off += csize
+		uoff += usize
+	}
+	if off != tableOff {
+		return fmt.Errorf("%w: frames add up to %d bytes, seek table is at %d", ErrSeekableCorrupt, off, tableOff)
+	}
+
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return err
+	}
+	s.close = dec.Close
+	s.open = func(i int) (io.Reader, error) {
+		end := tableOff
+		if i+1 < len(offsets) {
+			end = offsets[i+1]
+		}
+		if err := dec.Reset(io.NewSectionReader(s.f, offsets[i], end-offsets[i])); err != nil {
+			return nil, err
+		}
+		return dec, nil
+	}
+	return nil
+}
+
+// xzBlockLoc is where a block is in an xz file.
+type xzBlockLoc struct {
+	off      int64 // Of its header
+	unpadded int64 // Header, compressed data and check
+	checkLen int
+}
+
+func (s *SeekableReader) initXZ(size int64) error {
+	// The streams are found from the end, by the index before each footer.
+	var blocks []xzBlockLoc
+	var records []xzRecord
+	for end := size; end > 0; {
+		var buf [xzFooterLen]byte
+		// Stream padding
+		for end >= 4 {
+			if _, err := s.f.ReadAt(buf[:4], end-4); err != nil {
+				return err
+			}
+			if !bytes.Equal(buf[:4], []byte{0, 0, 0, 0}) {
+				break
+			}
+			end -= 4
+		}
+		if end < xzHeaderLen+xzFooterLen {
+			return fmt.Errorf("%w: truncated stream", ErrXZCorrupt)
+		}
+		if _, err := s.f.ReadAt(buf[:], end-xzFooterLen); err != nil {
+			return err
+		}
+		indexLen, flags, err := parseXZFooter(buf[:])
+		if err != nil {
+			return err
+		}
+		flags = bytes.Clone(flags) // buf is reused for the header
+		checkLen, ok := xzCheckLen(flags)
+		if !ok {
+			return fmt.Errorf("xz: unsupported stream flags %#x", flags)
+		}
+		indexOff := end - xzFooterLen - indexLen
+		if indexOff < xzHeaderLen {
+			return fmt.Errorf("%w: index doesn't fit", ErrXZCorrupt)
+		}
+		index, n, err := readXZIndex(bufio.NewReader(io.NewSectionReader(s.f, indexOff, indexLen)))
+		if err != nil {
+			return err
+		}
+		if n != indexLen {
+			return fmt.Errorf("%w: index size in footer doesn't match the index", ErrXZCorrupt)
+		}
+
+		var blocksLen int64
+		for _, rec := range index {
+			blocksLen += (rec.unpadded + 3) &^ 3
+		}
+		start := indexOff - blocksLen - xzHeaderLen
+		if start < 0 {
+			return fmt.Errorf("%w: blocks don't fit before the index", ErrXZCorrupt)
+		}
+		if _, err := s.f.ReadAt(buf[:xzHeaderLen], start); err != nil {
+			return err
+		}
+		headerFlags, err := parseXZStreamHeader(buf[:xzHeaderLen])
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(headerFlags, flags) {
+			return fmt.Errorf("%w: stream footer flags don't match the header", ErrXZCorrupt)
+		}
+
+		var streamBlocks []xzBlockLoc
+		off := start + xzHeaderLen
+		for _, rec := range index {
+			streamBlocks = append(streamBlocks, xzBlockLoc{off, rec.unpadded, checkLen})
+			off += (rec.unpadded + 3) &^ 3
+		}
+		blocks = append(streamBlocks, blocks...)
+		records = append(index, records...)
+		end = start
+	}
+
+	var uoff int64
+	var locs []xzBlockLoc
+	for i, rec := range records {
+		if rec.uncompressed > 0 {
+			s.frames = append(s.frames, seekFrame{uoff, rec.uncompressed})
+			locs = append(locs, blocks[i])
+		}
+		uoff += rec.uncompressed
+	}
+	s.open = func(i int) (io.Reader, error) {
+		b := locs[i]
+		var size [1]byte
+		if _, err := s.f.ReadAt(size[:], b.off); err != nil {
+			return nil, err
+		}
+		raw := make([]byte, (int(size[0])+1)*4)
+		if _, err := s.f.ReadAt(raw, b.off); err != nil {
+			return nil, err
+		}
+		h, err := parseXZBlockHeader(raw)
+		if err != nil {
+			return nil, err
+		}
+		compressed := b.unpadded - int64(len(raw)) - int64(b.checkLen)
+		if compressed <= 0 || (h.compressed >= 0 && h.compressed != compressed) {
+			return nil, fmt.Errorf("%w: block size doesn't match the index", ErrXZCorrupt)
+		}
+		src := bufio.NewReader(io.NewSectionReader(s.f, b.off+int64(len(raw)), compressed))
+		return lzma.Reader2Config{DictCap: h.dictCap}.NewReader2(src)
+	}
+	return nil
+}
+
+// gzip index sidecar, written by pvflasher pack as image.gz.zran: points
+// in a single gzip member where deflate is byte-aligned, as after a sync
+// flush, each with the 32 KiB of data before it that later back-references
+// may reach. All integers are little-endian.
+//
+//	magic             "PVFZRAN\x01"
+//	compressed size   uint64, of the gzip file the index is for
+//	points            uint32
+//	per point:
+//	  compressed offset    uint64, of the deflate data
+//	  decompressed offset  uint64
+//	  window length        uint32, then the window
+//	decompressed size uint64
+const zranMagic = "PVFZRAN\x01"
+
+// ZranExt is the extension of gzip index sidecars.
+const ZranExt = ".zran"
+
+// zranPoint is a point of a gzip index.
+type zranPoint struct {
+	off, uoff int64
+	window    []byte
+}
+
+func (s *SeekableReader) initGzip(path string, size int64) error {
+	data, err := os.ReadFile(path + ZranExt)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	points, usize, err := parseZran(data, size)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path+ZranExt, err)
+	}
+	for i, p := range points {
+		end := usize
+		if i+1 < len(points) {
+			end = points[i+1].uoff
+		}
+		s.frames = append(s.frames, seekFrame{p.uoff, end - p.uoff})
+	}
+	s.open = func(i int) (io.Reader, error) {
+		// The deflate data runs on to the end of the member, so the
+		// decoder never sees it cut short at the next point.
+		p := points[i]
+		return flate.NewReaderDict(io.NewSectionReader(s.f, p.off, size-p.off), p.window), nil
+	}
+	return nil
+}
+
+// parseZran parses a gzip index for a gzip file of size bytes and returns
+// its points and the decompressed size.
+func parseZran(data []byte, size int64) ([]zranPoint, int64, error) {
+	le := binary.LittleEndian
+	if len(data) < len(zranMagic)+12 || string(data[:len(zranMagic)]) != zranMagic {
+		return nil, 0, fmt.Errorf("%w: not a gzip index", ErrSeekableCorrupt)
+	}
+	data = data[len(zranMagic):]
+	if int64(le.Uint64(data)) != size {
+		return nil, 0, fmt.Errorf("%w: index is for a gzip file of %d bytes, not %d", ErrSeekableCorrupt, le.Uint64(data), size)
+	}
+	count := le.Uint32(data[8:])
+	data = data[12:]
+	var points []zranPoint
+	for i := uint32(0); i < count; i++ {
+		if len(data) < 20 {
+			return nil, 0, fmt.Errorf("%w: truncated gzip index", ErrSeekableCorrupt)
+		}
+		p := zranPoint{off: int64(le.Uint64(data)), uoff: int64(le.Uint64(data[8:]))}
+		n := le.Uint32(data[16:])
+		data = data[20:]
+		if n > 32<<10 || int(n) > len(data) {
+			return nil, 0, fmt.Errorf("%w: bad window at point %d", ErrSeekableCorrupt, i)
+		}
+		p.window, data = data[:n], data[n:]
+		if i == 0 && (p.uoff != 0 || p.off < 0) {
+			return nil, 0, fmt.Errorf("%w: first point is at decompressed offset %d, not 0", ErrSeekableCorrupt, p.uoff)
+		}
+		if i > 0 && (p.off <= points[i-1].off || p.uoff <= points[i-1].uoff) || p.off >= size {
+			return nil, 0, fmt.Errorf("%w: points out of order at %d", ErrSeekableCorrupt, i)
+		}
+		points = append(points, p)
+	}
+	if len(data) != 8 {
+		return nil, 0, fmt.Errorf("%w: bad gzip index trailer", ErrSeekableCorrupt)
+	}
+	usize := int64(le.Uint64(data))
+	if len(points) > 0 && usize <= points[len(points)-1].uoff {
+		return nil, 0, fmt.Errorf("%w: decompressed size %d", ErrSeekableCorrupt, usize)
+	}
+	return points, usize, nil
+}
@@ -0,0 +1,179 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// writeSeekable packs data into dir/name with compression, in frames of
+// frameSize bytes, with a .zran index for gzip.
+func writeSeekable(t *testing.T, dir, name, compression string, data []byte, frameSize int) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	var out bytes.Buffer
+	w, err := NewSeekableWriter(&out, compression, frameSize, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Odd write sizes, so frames don't line up with writes.
+	for rest := data; len(rest) > 0; {
+		n := min(len(rest), 12345)
+		if _, err := w.Write(rest[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, out.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if compression == "gz" {
+		var index bytes.Buffer
+		if err := w.WriteIndex(&index); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path+ZranExt, index.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestSeekable(t *testing.T) {
+	data := xzTestData(1<<20 + 777)
+	dir := t.TempDir()
+	for _, tt := range []struct{ name, compression string }{
+		{"image.img.zst", "zstd"},
+		{"image.img.xz", "xz"},
+		{"image.img.gz", "gz"},
+	} {
+		t.Run(tt.compression, func(t *testing.T) {
+			path := writeSeekable(t, dir, tt.name, tt.compression, data, 100000)
+
+			// Any decoder reads it as a stream.
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			r, err := Decompressor(context.Background(), path, f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("stream: %d bytes, err %v", len(got), err)
+			}
+
+			s, err := OpenSeekable(path)
+			if err != nil || s == nil {
+				t.Fatalf("OpenSeekable = %v, %v", s, err)
+			}
+			defer s.Close()
+			if s.Size() != int64(len(data)) || s.Frames() != 11 {
+				t.Errorf("size %d in %d frames, want %d in 11", s.Size(), s.Frames(), len(data))
+			}
+			// Forward and backward, within a frame, across frames and up
+			// to the end.
+			for _, off := range []int64{500000, 0, 99999, 100000, 100010, 250000, 1<<20 - 10, int64(len(data)) - 5} {
+				if _, err := s.Seek(off, io.SeekStart); err != nil {
+					t.Fatal(err)
+				}
+				want := data[off:min(off+150000, int64(len(data)))]
+				got := make([]byte, len(want))
+				if _, err := io.ReadFull(s, got); err != nil {
+					t.Fatalf("read at %d: %v", off, err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("data at %d differs", off)
+				}
+			}
+			if n, err := s.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+				t.Errorf("read at the end = %d, %v", n, err)
+			}
+		})
+	}
+}
+
+func TestOpenSeekable_NotSeekable(t *testing.T) {
+	data := xzTestData(300000)
+	dir := t.TempDir()
+
+	enc, _ := zstd.NewWriter(nil)
+	plainZstd := filepath.Join(dir, "plain.img.zst")
+	os.WriteFile(plainZstd, enc.EncodeAll(data, nil), 0644)
+	raw := filepath.Join(dir, "raw.img")
+	os.WriteFile(raw, data, 0644)
+	oneFrame := writeSeekable(t, dir, "one.img.zst", "zstd", data, len(data))
+	noIndex := writeSeekable(t, dir, "noindex.img.gz", "gz", data, 100000)
+	os.Remove(noIndex + ZranExt)
+
+	for _, path := range []string{plainZstd, raw, oneFrame, noIndex} {
+		s, err := OpenSeekable(path)
+		if s != nil || err != nil {
+			t.Errorf("OpenSeekable(%s) = %v, %v, want nil", filepath.Base(path), s, err)
+		}
+	}
+}
+
+func TestOpenSeekable_StaleIndex(t *testing.T) {
+	data := xzTestData(300000)
+	dir := t.TempDir()
+	path := writeSeekable(t, dir, "image.img.gz", "gz", data, 100000)
+	index, _ := os.ReadFile(path + ZranExt)
+	// The index of another image
+	other := writeSeekable(t, dir, "other.img.gz", "gz", data[:200000], 100000)
+	os.Rename(other+ZranExt, path+ZranExt)
+
+	if _, err := OpenSeekable(path); !errors.Is(err, ErrSeekableCorrupt) {
+		t.Errorf("err = %v, want ErrSeekableCorrupt", err)
+	}
+	os.WriteFile(path+ZranExt, index[:len(index)-3], 0644)
+	if _, err := OpenSeekable(path); !errors.Is(err, ErrSeekableCorrupt) {
+		t.Errorf("truncated index: err = %v, want ErrSeekableCorrupt", err)
+	}
+
+	// Without its first point, the index would map the start of the data
+	// to the second.
+	fi, _ := os.Stat(path)
+	points, usize, err := parseZran(index, fi.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	le := binary.LittleEndian
+	cut := le.AppendUint64([]byte(zranMagic), uint64(fi.Size()))
+	cut = le.AppendUint32(cut, uint32(len(points)-1))
+	for _, p := range points[1:] {
+		cut = le.AppendUint64(cut, uint64(p.off))
+		cut = le.AppendUint64(cut, uint64(p.uoff))
+		cut = le.AppendUint32(cut, uint32(len(p.window)))
+		cut = append(cut, p.window...)
+	}
+	cut = le.AppendUint64(cut, uint64(usize))
+	os.WriteFile(path+ZranExt, cut, 0644)
+	if _, err := OpenSeekable(path); !errors.Is(err, ErrSeekableCorrupt) {
+		t.Errorf("index without its first point: err = %v, want ErrSeekableCorrupt", err)
+	}
+}
+
+func TestSeekable_FrameAfterPosition(t *testing.T) {
+	// A frame that starts after the position it is opened for is an error,
+	// not data read from the wrong offset.
+	s := &SeekableReader{
+		frames: []seekFrame{{off: 10, size: 10}},
+		size:   20,
+		open:   func(int) (io.Reader, error) { return bytes.NewReader(make([]byte, 10)), nil },
+	}
+	if _, err := s.Read(make([]byte, 5)); !errors.Is(err, ErrSeekableCorrupt) {
+		t.Errorf("err = %v, want ErrSeekableCorrupt", err)
+	}
+}
@@ -0,0 +1,269 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// DefaultFrameSize is the amount of data SeekableWriter puts in a frame.
+// A seek decompresses up to this much to reach its target.
+const DefaultFrameSize = 4 << 20
+
+// xzDictCaps are the dictionary sizes of xz's presets -1 to -9.
+var xzDictCaps = [...]int{1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+// SeekableWriter compresses an image in frames that decode on their own,
+// so that OpenSeekable can read it at random while any decoder still reads
+// it as a stream: zstd in the seekable format, xz with a block per frame
+// whose header records its sizes, or gzip with a sync flush after every
+// frame and an index for the .zran sidecar, written by WriteIndex.
+type SeekableWriter struct {
+	w           *countingWriter
+	compression string
+	frameSize   int
+	dictCap     int    // xz dictionary size
+	buf         []byte // Data of the frame being filled
+	size        int64  // Data written before buf
+
+	zstd      *zstd.Encoder
+	zstdTable []byte // Seek table entries
+
+	xzRecords []xzRecord
+
+	gzip   *gzip.Writer
+	points []zranPoint
+	window []byte // The last 32 KiB of data before buf
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// NewSeekableWriter returns a writer compressing to w with compression
+// "zstd", "xz" or "gz", in frames of frameSize bytes (DefaultFrameSize if 0).
+// level is the compression level, 1-22 for zstd and 1-9 for xz and gz, or 0
+// for the default of the zstd, xz and gzip tools: 3, 6 and 6. For xz it
+// sets the dictionary size, as xz's presets do, up to the frame size.
+func NewSeekableWriter(w io.Writer, compression string, frameSize, level int) (*SeekableWriter, error) {
+	if frameSize <= 0 {
+		frameSize = DefaultFrameSize
+	}
+	if frameSize > 1<<30 {
+		return nil, fmt.Errorf("frame size %d is too large", frameSize)
+	}
+	s := &SeekableWriter{
+		w:           &countingWriter{w: w},
+		compression: compression,
+		frameSize:   frameSize,
+		buf:         make([]byte, 0, frameSize),
+	}
+	var err error
+	switch compression {
+	case "zstd":
+		if level, err = checkLevel(compression, level, 3, 22); err == nil {
+			s.zstd, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+	case "xz":
+		if level, err = checkLevel(compression, level, 6, 9); err != nil {
+			return nil, err
+		}
+		s.dictCap = xzDictCaps[level-1]
+		header := append(append([]byte{}, magicXZ...), 0, 0x04) // CRC64 checks
+		header = binary.LittleEndian.AppendUint32(header, crc32.ChecksumIEEE(header[6:]))
+		_, err = s.w.Write(header)
+	case "gz":
+		if level, err = checkLevel(compression, level, 6, 9); err != nil {
+			return nil, err
+		}
+		if s.gzip, err = gzip.NewWriterLevel(s.w, level); err != nil {
+			return nil, err
+		}
+		// Writes the gzip header, so the first point is at the deflate data.
+		err = s.gzip.Flush()
+	default:
+		err = fmt.Errorf("can't write seekable %s images; use zstd, xz or gz", compression)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// checkLevel returns level, or def if level is 0.
+func checkLevel(compression string, level, def, max int) (int, error) {
+	if level == 0 {
+		return def, nil
+	}
+	if level < 1 || level > max {
+		return 0, fmt.Errorf("invalid %s compression level %d; use 1-%d", compression, level, max)
+	}
+	return level, nil
+}
+
+func (s *SeekableWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(s.buf[len(s.buf):cap(s.buf)], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+		if len(s.buf) == cap(s.buf) {
+			if err := s.flushFrame(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flushFrame compresses buf as a frame.
+func (s *SeekableWriter) flushFrame() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	var err error
+	switch s.compression {
+	case "zstd":
+		before := s.w.n
+		if _, err = s.w.Write(s.zstd.EncodeAll(s.buf, nil)); err == nil {
+			s.zstdTable = binary.LittleEndian.AppendUint32(s.zstdTable, uint32(s.w.n-before))
+			s.zstdTable = binary.LittleEndian.AppendUint32(s.zstdTable, uint32(len(s.buf)))
+		}
+	case "xz":
+		err = s.writeXZBlock()
+	case "gz":
+		s.points = append(s.points, zranPoint{off: s.w.n, uoff: s.size, window: bytes.Clone(s.window)})
+		if _, err = s.gzip.Write(s.buf); err == nil {
+			err = s.gzip.Flush()
+		}
+		s.window = append(s.window, s.buf[max(0, len(s.buf)-32<<10):]...)
+		s.window = s.window[max(0, len(s.window)-32<<10):]
+	}
+	s.size += int64(len(s.buf))
+	s.buf = s.buf[:0]
+	return err
+}
+
+// writeXZBlock writes buf as an xz block with its sizes in its header, as
+// xz -T does.
+func (s *SeekableWriter) writeXZBlock() error {
+	dictCap := min(max(len(s.buf), lzma.MinDictCap), s.dictCap)
+	var comp bytes.Buffer
+	enc, err := lzma.Writer2Config{DictCap: dictCap}.NewWriter2(&comp)
+	if err != nil {
+		return err
+	}
+	if _, err := enc.Write(s.buf); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+
+	le := binary.LittleEndian
+	h := []byte{0, 0xc0}
+	h = appendXZVarint(h, int64(comp.Len()))
+	h = appendXZVarint(h, int64(len(s.buf)))
+	h = append(h, 0x21, 1, lzma.EncodeDictCap(int64(dictCap)))
+	for len(h)%4 != 0 {
+		h = append(h, 0)
+	}
+	h[0] = byte(len(h) / 4) // Length with the CRC32, in 4 bytes, less one
+	h = le.AppendUint32(h, crc32.ChecksumIEEE(h))
+	check := le.AppendUint64(nil, crc64.Checksum(s.buf, crc64Table))
+	s.xzRecords = append(s.xzRecords, xzRecord{int64(len(h) + comp.Len() + len(check)), int64(len(s.buf))})
+	for comp.Len()%4 != 0 {
+		comp.WriteByte(0) // Block padding
+	}
+	for _, b := range [][]byte{h, comp.Bytes(), check} {
+		if _, err := s.w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendXZVarint appends v as an xz multibyte integer.
+func appendXZVarint(b []byte, v int64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// Close compresses the last frame and writes the seek table or index. It
+// doesn't close the underlying writer.
+func (s *SeekableWriter) Close() error {
+	if err := s.flushFrame(); err != nil {
+		return err
+	}
+	le := binary.LittleEndian
+	switch s.compression {
+	case "zstd":
+		s.zstd.Close()
+		table := le.AppendUint32(nil, zstdSkippableMagic)
+		table = le.AppendUint32(table, uint32(len(s.zstdTable)+zstdSeekFooterLen))
+		table = append(table, s.zstdTable...)
+		table = le.AppendUint32(table, uint32(len(s.zstdTable)/8))
+		table = append(table, 0) // No frame checksums
+		table = le.AppendUint32(table, zstdSeekableMagic)
+		_, err := s.w.Write(table)
+		return err
+	case "xz":
+		index := []byte{0}
+		index = appendXZVarint(index, int64(len(s.xzRecords)))
+		for _, rec := range s.xzRecords {
+			index = appendXZVarint(index, rec.unpadded)
+			index = appendXZVarint(index, rec.uncompressed)
+		}
+		for len(index)%4 != 0 {
+			index = append(index, 0)
+		}
+		index = le.AppendUint32(index, crc32.ChecksumIEEE(index))
+		footer := le.AppendUint32(nil, uint32(len(index)/4-1))
+		footer = append(footer, 0, 0x04)
+		footer = append(le.AppendUint32(nil, crc32.ChecksumIEEE(footer)), footer...)
+		footer = append(footer, 'Y', 'Z')
+		_, err := s.w.Write(append(index, footer...))
+		return err
+	default:
+		return s.gzip.Close()
+	}
+}
+
+// WriteIndex writes the .zran index of a gzip image to w, after Close.
+func (s *SeekableWriter) WriteIndex(w io.Writer) error {
+	if s.compression != "gz" {
+		return fmt.Errorf("%s images don't need an index", s.compression)
+	}
+	le := binary.LittleEndian
+	out := []byte(zranMagic)
+	out = le.AppendUint64(out, uint64(s.w.n))
+	out = le.AppendUint32(out, uint32(len(s.points)))
+	for _, p := range s.points {
+		out = le.AppendUint64(out, uint64(p.off))
+		out = le.AppendUint64(out, uint64(p.uoff))
+		out = le.AppendUint32(out, uint32(len(p.window)))
+		out = append(out, p.window...)
+	}
+	out = le.AppendUint64(out, uint64(s.size))
+	_, err := w.Write(out)
+	return err
+}
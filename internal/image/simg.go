@@ -0,0 +1,278 @@
+package image
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// Android sparse image format, as written by img2simg and read by fastboot
+// (system/core/libsparse/sparse_format.h).
+const (
+	simgMagic          = 0xed26ff3a
+	simgFileHeaderLen  = 28
+	simgChunkHeaderLen = 12
+
+	simgChunkRaw      = 0xcac1
+	simgChunkFill     = 0xcac2
+	simgChunkDontCare = 0xcac3
+	simgChunkCRC32    = 0xcac4
+
+	// simgMaxBlockSize is the largest block size accepted, as in libsparse.
+	// It keeps blocks*blockSize of 32-bit block counts well within int64.
+	simgMaxBlockSize = 64 << 20
+)
+
+// ErrSimgCorrupt is returned for a sparse image whose headers or checksums
+// are inconsistent.
+var ErrSimgCorrupt = errors.New("corrupt android sparse image")
+
+// IsSimg reports whether header starts with the Android sparse image magic.
+func IsSimg(header []byte) bool {
+	return len(header) >= 4 && binary.LittleEndian.Uint32(header) == simgMagic
+}
+
+// IsSimgFile reports whether the file at path is an Android sparse image.
+func IsSimgFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false
+	}
+	return IsSimg(header)
+}
+
+// DetectSimg peeks at r and returns a SimgReader if it holds an Android
+// sparse image. Otherwise it returns nil and a reader that replays the
+// peeked bytes.
+func DetectSimg(r io.Reader) (*SimgReader, io.Reader, error) {
+	br := bufio.NewReader(r)
+	peek, _ := br.Peek(4)
+	if !IsSimg(peek) {
+		return nil, br, nil
+	}
+	s, err := NewSimgReader(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, s, nil
+}
+
+// SimgReader expands an Android sparse image. Read returns the full image,
+// with DONT_CARE chunks as zeros. NextData instead skips DONT_CARE chunks, so
+// a caller can leave those regions of the target alone, as fastboot does.
+//
+// CRC32 chunks, and the image checksum if the header has one, are checked
+// against the expanded data; a mismatch is reported as ErrSimgCorrupt.
+type SimgReader struct {
+	r              io.Reader
+	blockSize      int64
+	totalBlocks    int64
+	totalChunks    int64
+	chunkHeaderLen int64
+	imageChecksum  uint32
+
+	chunks int64 // Chunk headers read so far
+	pos    int64 // Offset in the expanded image
+	crc    hash.Hash32
+
+	// The current chunk
+	kind   uint16
+	remain int64 // Expanded bytes left in it
+	fill   [4]byte
+}
+
+// NewSimgReader reads the file header of the sparse image in r.
+func NewSimgReader(r io.Reader) (*SimgReader, error) {
+	hdr := make([]byte, simgFileHeaderLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("failed to read sparse image header: %w", err)
+	}
+	if !IsSimg(hdr) {
+		return nil, fmt.Errorf("%w: bad magic", ErrSimgCorrupt)
+	}
+	if major := binary.LittleEndian.Uint16(hdr[4:]); major != 1 {
+		return nil, fmt.Errorf("unsupported android sparse image version %d", major)
+	}
+	fileHeaderLen := int64(binary.LittleEndian.Uint16(hdr[8:]))
+	s := &SimgReader{
+		r:              r,
+		chunkHeaderLen: int64(binary.LittleEndian.Uint16(hdr[10:])),
+		blockSize:      int64(binary.LittleEndian.Uint32(hdr[12:])),
+		totalBlocks:    int64(binary.LittleEndian.Uint32(hdr[16:])),
+		totalChunks:    int64(binary.LittleEndian.Uint32(hdr[20:])),
+		imageChecksum:  binary.LittleEndian.Uint32(hdr[24:]),
+		crc:            crc32.NewIEEE(),
+	}
+	if fileHeaderLen < simgFileHeaderLen || s.chunkHeaderLen < simgChunkHeaderLen {
+		return nil, fmt.Errorf("%w: header sizes %d and %d", ErrSimgCorrupt, fileHeaderLen, s.chunkHeaderLen)
+	}
+	if s.blockSize == 0 || s.blockSize%4 != 0 || s.blockSize > simgMaxBlockSize {
+		return nil, fmt.Errorf("%w: block size %d", ErrSimgCorrupt, s.blockSize)
+	}
+	if s.totalBlocks == 0 {
+		return nil, fmt.Errorf("%w: no blocks", ErrSimgCorrupt)
+	}
+	// Newer versions may append fields to the header.
+	if _, err := io.CopyN(io.Discard, r, fileHeaderLen-simgFileHeaderLen); err != nil {
+		return nil, fmt.Errorf("failed to read sparse image header: %w", err)
+	}
+	return s, nil
+}
+
+// Size returns the size of the expanded image.
+func (s *SimgReader) Size() int64 {
+	return s.totalBlocks * s.blockSize
+}
+
+// BlockSize returns the block size of the image. Chunks start and end on
+// block boundaries.
+func (s *SimgReader) BlockSize() int {
+	return int(s.blockSize)
+}
+
+// Read reads expanded image data.
+func (s *SimgReader) Read(p []byte) (int, error) {
+	for s.remain == 0 {
+		if err := s.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	return s.readChunk(p)
+}
+
+// NextData skips the rest of the current chunk and any DONT_CARE chunks,
+// and returns the offset and length of the next chunk that holds data. Its
+// data is then returned by Read. At the end of the image it returns io.EOF.
+func (s *SimgReader) NextData() (offset, length int64, err error) {
+	if s.remain > 0 {
+		scratch := make([]byte, min(s.remain, 64*1024))
+		for s.remain > 0 {
+			if _, err := s.readChunk(scratch); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	for {
+		if err := s.nextChunk(); err != nil {
+			return 0, 0, err
+		}
+		if s.kind != simgChunkDontCare {
+			return s.pos, s.remain, nil
+		}
+		// Keep the running CRC over the zeros the chunk stands for.
+		for s.remain > 0 {
+			n := min(s.remain, int64(len(zeroBlock)))
+			s.crc.Write(zeroBlock[:n])
+			s.remain -= n
+			s.pos += n
+		}
+	}
+}
+
+var zeroBlock = make([]byte, 64*1024)
+
+// readChunk returns data of the current chunk, which must have some left.
+func (s *SimgReader) readChunk(p []byte) (int, error) {
+	p = p[:min(int64(len(p)), s.remain)]
+	var n int
+	switch s.kind {
+	case simgChunkRaw:
+		var err error
+		n, err = io.ReadFull(s.r, p)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, fmt.Errorf("%w: truncated raw chunk at offset %d", ErrSimgCorrupt, s.pos+int64(n))
+		}
+		if err != nil {
+			return 0, err
+		}
+	case simgChunkFill:
+		// The pattern starts over at every block, and blocks are multiples
+		// of 4 bytes long, so the phase only depends on the offset.
+		for i := range p {
+			p[i] = s.fill[(s.pos+int64(i))%4]
+		}
+		n = len(p)
+	case simgChunkDontCare:
+		clear(p)
+		n = len(p)
+	}
+	s.crc.Write(p[:n])
+	s.pos += int64(n)
+	s.remain -= int64(n)
+	return n, nil
+}
+
+// nextChunk reads the next chunk header, checking CRC32 chunks on the way.
+// At the end of the image it checks the totals and returns io.EOF.
+func (s *SimgReader) nextChunk() error {
+	for {
+		if s.chunks == s.totalChunks {
+			if s.pos != s.Size() {
+				return fmt.Errorf("%w: chunks cover %d of %d bytes", ErrSimgCorrupt, s.pos, s.Size())
+			}
+			if s.imageChecksum != 0 && s.crc.Sum32() != s.imageChecksum {
+				return fmt.Errorf("%w: image checksum %08x, header says %08x", ErrSimgCorrupt, s.crc.Sum32(), s.imageChecksum)
+			}
+			return io.EOF
+		}
+
+		hdr := make([]byte, s.chunkHeaderLen)
+		if _, err := io.ReadFull(s.r, hdr); err != nil {
+			return fmt.Errorf("%w: truncated after %d of %d chunks", ErrSimgCorrupt, s.chunks, s.totalChunks)
+		}
+		s.chunks++
+		kind := binary.LittleEndian.Uint16(hdr[0:])
+		blocks := int64(binary.LittleEndian.Uint32(hdr[4:]))
+		total := int64(binary.LittleEndian.Uint32(hdr[8:]))
+		size := blocks * s.blockSize
+		if s.pos+size > s.Size() {
+			return fmt.Errorf("%w: chunk %d ends past the image size %d", ErrSimgCorrupt, s.chunks, s.Size())
+		}
+
+		var payload int64
+		switch kind {
+		case simgChunkRaw:
+			payload = size
+		case simgChunkFill, simgChunkCRC32:
+			payload = 4
+		case simgChunkDontCare:
+		default:
+			return fmt.Errorf("%w: chunk %d has unknown type %#x", ErrSimgCorrupt, s.chunks, kind)
+		}
+		if total != s.chunkHeaderLen+payload {
+			return fmt.Errorf("%w: chunk %d is %d bytes, want %d", ErrSimgCorrupt, s.chunks, total, s.chunkHeaderLen+payload)
+		}
+
+		switch kind {
+		case simgChunkFill:
+			if _, err := io.ReadFull(s.r, s.fill[:]); err != nil {
+				return fmt.Errorf("%w: truncated fill chunk", ErrSimgCorrupt)
+			}
+		case simgChunkCRC32:
+			var sum [4]byte
+			if _, err := io.ReadFull(s.r, sum[:]); err != nil {
+				return fmt.Errorf("%w: truncated crc32 chunk", ErrSimgCorrupt)
+			}
+			if want := binary.LittleEndian.Uint32(sum[:]); s.crc.Sum32() != want {
+				return fmt.Errorf("%w: crc32 %08x at offset %d, chunk says %08x", ErrSimgCorrupt, s.crc.Sum32(), s.pos, want)
+			}
+			continue
+		}
+		if size == 0 {
+			continue
+		}
+		s.kind = kind
+		s.remain = size
+		return nil
+	}
+}
@@ -0,0 +1,208 @@
+package image
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"testing"
+)
+
+// simgChunk describes one chunk for buildSimg. data is the raw payload, or
+// the 4-byte fill pattern; crc chunks get the checksum of what precedes them.
+type simgChunk struct {
+	kind   uint16
+	blocks uint32
+	data   []byte
+}
+
+// buildSimg encodes chunks as an Android sparse image with 4096-byte blocks,
+// the way img2simg does, and returns it along with the expanded image.
+func buildSimg(chunks []simgChunk) (simg, expanded []byte) {
+	const bs = 4096
+	var body bytes.Buffer
+	var total uint32
+	for _, c := range chunks {
+		payload := c.data
+		switch c.kind {
+		case simgChunkRaw:
+			expanded = append(expanded, c.data...)
+		case simgChunkFill:
+			for i := 0; i < int(c.blocks)*bs; i++ {
+				expanded = append(expanded, c.data[i%4])
+			}
+		case simgChunkDontCare:
+			expanded = append(expanded, make([]byte, int(c.blocks)*bs)...)
+		case simgChunkCRC32:
+			if payload == nil {
+				payload = binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE(expanded))
+			}
+		}
+		hdr := make([]byte, simgChunkHeaderLen)
+		binary.LittleEndian.PutUint16(hdr[0:], c.kind)
+		binary.LittleEndian.PutUint32(hdr[4:], c.blocks)
+		binary.LittleEndian.PutUint32(hdr[8:], uint32(simgChunkHeaderLen+len(payload)))
+		body.Write(hdr)
+		body.Write(payload)
+		total += c.blocks
+	}
+
+	hdr := make([]byte, simgFileHeaderLen)
+	binary.LittleEndian.PutUint32(hdr[0:], simgMagic)
+	binary.LittleEndian.PutUint16(hdr[4:], 1)
+	binary.LittleEndian.PutUint16(hdr[8:], simgFileHeaderLen)
+	binary.LittleEndian.PutUint16(hdr[10:], simgChunkHeaderLen)
+	binary.LittleEndian.PutUint32(hdr[12:], bs)
+	binary.LittleEndian.PutUint32(hdr[16:], total)
+	binary.LittleEndian.PutUint32(hdr[20:], uint32(len(chunks)))
+	return append(hdr, body.Bytes()...), expanded
+}
+
+func testSimgChunks() []simgChunk {
+	raw := make([]byte, 2*4096)
+	for i := range raw {
+		raw[i] = byte(i % 251)
+	}
+	return []simgChunk{
+		{kind: simgChunkRaw, blocks: 2, data: raw},
+		{kind: simgChunkDontCare, blocks: 3},
+		{kind: simgChunkFill, blocks: 1, data: []byte{0xde, 0xad, 0xbe, 0xef}},
+		{kind: simgChunkCRC32},
+		{kind: simgChunkDontCare, blocks: 1},
+		{kind: simgChunkRaw, blocks: 1, data: raw[:4096]},
+	}
+}
+
+func TestSimgReader_Expand(t *testing.T) {
+	simg, want := buildSimg(testSimgChunks())
+
+	s, r, err := DetectSimg(bytes.NewReader(simg))
+	if err != nil || s == nil {
+		t.Fatalf("DetectSimg = %v, %v, want a sparse reader", s, err)
+	}
+	if s.Size() != 8*4096 || s.BlockSize() != 4096 {
+		t.Errorf("Size = %d, BlockSize = %d, want %d, 4096", s.Size(), s.BlockSize(), 8*4096)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("expanded image differs")
+	}
+}
+
+func TestSimgReader_NextData(t *testing.T) {
+	simg, want := buildSimg(testSimgChunks())
+	s, err := NewSimgReader(bytes.NewReader(simg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type extent struct{ off, n int64 }
+	var got []extent
+	for {
+		off, n, err := s.NextData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("NextData failed: %v", err)
+		}
+		got = append(got, extent{off, n})
+		// Read part of the first chunk only; NextData skips the rest.
+		if len(got) == 1 {
+			n = 100
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(s, data); err != nil {
+			t.Fatalf("reading chunk at %d failed: %v", off, err)
+		}
+		if !bytes.Equal(data, want[off:off+n]) {
+			t.Errorf("data at %d differs", off)
+		}
+	}
+
+	wantExtents := []extent{{0, 2 * 4096}, {5 * 4096, 4096}, {7 * 4096, 4096}}
+	if len(got) != len(wantExtents) {
+		t.Fatalf("extents = %v, want %v", got, wantExtents)
+	}
+	for i := range got {
+		if got[i] != wantExtents[i] {
+			t.Errorf("extent %d = %v, want %v", i, got[i], wantExtents[i])
+		}
+	}
+}
+
+func TestSimgReader_Corrupt(t *testing.T) {
+	good, _ := buildSimg(testSimgChunks())
+
+	badCRC := testSimgChunks()
+	badCRC[3].data = []byte{1, 2, 3, 4}
+	crc, _ := buildSimg(badCRC)
+
+	// Block size and counts whose products overflow int64, for the image
+	// and a DONT_CARE chunk.
+	huge := append([]byte{}, good[:simgFileHeaderLen]...)
+	binary.LittleEndian.PutUint32(huge[12:], 0xfffffffc)
+	binary.LittleEndian.PutUint32(huge[16:], 0xffffffff)
+	binary.LittleEndian.PutUint32(huge[20:], 1)
+	huge = append(huge, 0xc3, 0xca, 0, 0, 0xff, 0xff, 0xff, 0xff, 12, 0, 0, 0)
+	empty := append([]byte{}, good[:simgFileHeaderLen]...)
+	binary.LittleEndian.PutUint32(empty[16:], 0)
+	binary.LittleEndian.PutUint32(empty[20:], 0)
+
+	tests := map[string][]byte{
+		"bad crc32":   crc,
+		"huge blocks": huge,
+		"no blocks":   empty,
+		"truncated":   good[:len(good)-100],
+		"short chunk": append(good[:simgFileHeaderLen:simgFileHeaderLen], 0xc1, 0xca, 0, 0, 2, 0, 0, 0, 12, 0, 0, 0),
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			s, err := NewSimgReader(bytes.NewReader(data))
+			if err == nil {
+				_, err = io.ReadAll(s)
+			}
+			if !errors.Is(err, ErrSimgCorrupt) {
+				t.Errorf("err = %v, want ErrSimgCorrupt", err)
+			}
+		})
+	}
+}
+
+func TestDetectSimg_Compressed(t *testing.T) {
+	simg, want := buildSimg(testSimgChunks())
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(simg)
+	w.Close()
+
+	dec, err := Decompressor(context.Background(), "system.simg.gz", &gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, r, err := DetectSimg(dec)
+	if err != nil || s == nil {
+		t.Fatalf("DetectSimg = %v, %v, want a sparse reader", s, err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("expanded image differs (err %v)", err)
+	}
+}
+
+func TestDetectSimg_Raw(t *testing.T) {
+	s, r, err := DetectSimg(bytes.NewReader([]byte("just a raw image")))
+	if err != nil || s != nil {
+		t.Fatalf("DetectSimg = %v, %v, want no sparse reader", s, err)
+	}
+	got, _ := io.ReadAll(r)
+	if string(got) != "just a raw image" {
+		t.Errorf("got %q, want the input back", got)
+	}
+}
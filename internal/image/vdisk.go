@@ -0,0 +1,290 @@
+package image
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// SparseSource is an image that knows which of its regions hold data, like
+// an Android sparse image or a virtual disk. Read returns the whole image,
+// with the regions that hold no data as zeros. NextData skips to the next
+// region with data, which Read then returns.
+type SparseSource interface {
+	io.Reader
+	NextData() (offset, length int64, err error)
+	Size() int64
+	BlockSize() int
+}
+
+// ErrVirtualDiskCorrupt is returned for a virtual disk whose headers or
+// tables point outside the file or contradict each other.
+var ErrVirtualDiskCorrupt = errors.New("corrupt virtual disk")
+
+// maxDiskSize bounds the disk size a header may claim. It is far above any
+// real disk, and keeps offsets computed from the size within int64.
+const maxDiskSize = 1 << 62
+
+// blockLoc is where a virtual disk file stores one block of the disk.
+type blockLoc struct {
+	off        int64 // File offset of the block's data, or -1 if unallocated
+	compressed int64 // Length of the compressed data at off, 0 if stored as is
+	// With off -1, the number of blocks from this one on that are known to
+	// be unallocated, such as those of a missing second-level table.
+	unallocated int64
+}
+
+// diskLayout maps the blocks of a virtual disk to the file. Blocks are
+// looked up in ascending order most of the time, so implementations cache
+// the last table they read.
+type diskLayout interface {
+	locate(block int64) (blockLoc, error)
+}
+
+// VirtualDisk reads the disk stored in a qcow2, VHD or VMDK file. Blocks the
+// file doesn't allocate read as zeros and are skipped by NextData.
+type VirtualDisk struct {
+	r         io.ReaderAt
+	format    string
+	size      int64
+	blockSize int64
+	layout    diskLayout
+	// inflate decodes a compressed block into dst, which is one block long.
+	inflate func(dst, src []byte) error
+	extents []ByteRange // Allocated regions of the disk, merged
+
+	pos  int64 // Offset of the next Read
+	next int   // Index of the extent the next NextData returns
+
+	// The last compressed block decoded
+	cached int64
+	cache  []byte
+}
+
+// DetectVirtualDisk returns a VirtualDisk if the file r of the given size is
+// a qcow2, VHD or monolithic sparse VMDK file, and nil if it's none of them.
+// Variants that can't be read on their own, like images with a backing
+// file, are reported as errors.
+func DetectVirtualDisk(r io.ReaderAt, size int64) (*VirtualDisk, error) {
+	var magic [8]byte
+	if n, _ := r.ReadAt(magic[:], 0); n < len(magic) {
+		return nil, nil
+	}
+	var d *VirtualDisk
+	var err error
+	switch {
+	case string(magic[:4]) == qcow2Magic:
+		d, err = openQcow2(r, size)
+	case string(magic[:4]) == vmdkMagic:
+		d, err = openVMDK(r, size)
+	case string(magic[:]) == "vhdxfile":
+		return nil, fmt.Errorf("VHDX images are not supported; convert to raw with qemu-img convert -O raw")
+	default:
+		d, err = openVHD(r, size)
+	}
+	if d == nil || err != nil {
+		return nil, err
+	}
+	if err := d.scan(size); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// IsVirtualDiskFile reports whether the file at path is a virtual disk
+// DetectVirtualDisk recognises.
+func IsVirtualDiskFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	d, err := DetectVirtualDisk(f, fi.Size())
+	return d != nil || err != nil
+}
+
+// checkDiskSize rejects a disk size from a header that is negative or
+// larger than maxDiskSize.
+func checkDiskSize(format string, size int64) error {
+	if size < 0 || size > maxDiskSize {
+		return fmt.Errorf("%w: %s disk size %d", ErrVirtualDiskCorrupt, format, size)
+	}
+	return nil
+}
+
+// scan finds the allocated extents of the disk in a file of fileSize bytes.
+// The tables of a file take at least 4 bytes for each block they map, so
+// scan gives up after fileSize/4 lookups: a small file whose tables all
+// point at the same one could otherwise make it loop for hours.
+func (d *VirtualDisk) scan(fileSize int64) error {
+	blocks := (d.size + d.blockSize - 1) / d.blockSize
+	for b, looked := int64(0), int64(0); b < blocks; b++ {
+		if looked++; looked > fileSize/4 {
+			return fmt.Errorf("%w: %s tables map more blocks than the file can hold", ErrVirtualDiskCorrupt, d.format)
+		}
+		loc, err := d.layout.locate(b)
+		if err != nil {
+			return err
+		}
+		if loc.off < 0 {
+			b += max(loc.unallocated, 1) - 1
+			continue
+		}
+		start, end := b*d.blockSize, min((b+1)*d.blockSize, d.size)
+		if n := len(d.extents); n > 0 && d.extents[n-1].End == start {
+			d.extents[n-1].End = end
+		} else {
+			d.extents = append(d.extents, ByteRange{Start: start, End: end})
+		}
+	}
+	return nil
+}
+
+// Format returns "qcow2", "vhd" or "vmdk".
+func (d *VirtualDisk) Format() string {
+	return d.format
+}
+
+// Size returns the size of the disk.
+func (d *VirtualDisk) Size() int64 {
+	return d.size
+}
+
+// BlockSize returns the allocation unit of the file: the qcow2 cluster, VHD
+// block or VMDK grain size.
+func (d *VirtualDisk) BlockSize() int {
+	return int(d.blockSize)
+}
+
+// Extents returns the allocated regions of the disk in ascending order.
+func (d *VirtualDisk) Extents() []ByteRange {
+	return d.extents
+}
+
+// AllocatedBytes returns the number of bytes the file allocates.
+func (d *VirtualDisk) AllocatedBytes() int64 {
+	var n int64
+	for _, e := range d.extents {
+		n += e.End - e.Start
+	}
+	return n
+}
+
+// Read reads the disk sequentially.
+func (d *VirtualDisk) Read(p []byte) (int, error) {
+	n, err := d.ReadAt(p, d.pos)
+	d.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// NextData moves to the next allocated extent after the current position
+// and returns its offset and length. At the end of the disk it returns
+// io.EOF.
+func (d *VirtualDisk) NextData() (offset, length int64, err error) {
+	for d.next < len(d.extents) && d.extents[d.next].End <= d.pos {
+		d.next++
+	}
+	if d.next == len(d.extents) {
+		return 0, 0, io.EOF
+	}
+	e := d.extents[d.next]
+	d.next++
+	d.pos = max(d.pos, e.Start)
+	return d.pos, e.End - d.pos, nil
+}
+
+// ReadAt reads the disk at off.
+func (d *VirtualDisk) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	for n < len(p) && off < d.size {
+		block, in := off/d.blockSize, off%d.blockSize
+		m := min(int64(len(p)-n), d.blockSize-in, d.size-off)
+		if err := d.readBlock(block, in, p[n:n+int(m)]); err != nil {
+			return n, err
+		}
+		n += int(m)
+		off += m
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readBlock reads len(p) bytes at offset in of block.
+func (d *VirtualDisk) readBlock(block, in int64, p []byte) error {
+	loc, err := d.layout.locate(block)
+	if err != nil {
+		return err
+	}
+	switch {
+	case loc.off < 0:
+		clear(p)
+	case loc.compressed == 0:
+		if err := d.readFile(p, loc.off+in); err != nil {
+			return fmt.Errorf("failed to read block %d: %w", block, err)
+		}
+	default:
+		if d.cache == nil || d.cached != block {
+			src := make([]byte, loc.compressed)
+			// Compressed data is padded to whole sectors, which the last
+			// block of the file may lack.
+			n, err := d.r.ReadAt(src, loc.off)
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("failed to read block %d: %w", block, err)
+			}
+			if d.cache == nil {
+				d.cache = make([]byte, d.blockSize)
+			}
+			if err := d.inflate(d.cache, src[:n]); err != nil {
+				d.cache = nil
+				return fmt.Errorf("%w: block %d: %v", ErrVirtualDiskCorrupt, block, err)
+			}
+			d.cached = block
+		}
+		copy(p, d.cache[in:])
+	}
+	return nil
+}
+
+// readFile fills p from the file at off.
+func (d *VirtualDisk) readFile(p []byte, off int64) error {
+	n, err := d.r.ReadAt(p, off)
+	if n == len(p) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		return fmt.Errorf("%w: data at %d is past the end of the file", ErrVirtualDiskCorrupt, off)
+	}
+	return err
+}
+
+// readTable reads a table of n integers of the given width (4 or 8 bytes)
+// at off in a file of fileSize bytes.
+func readTable(r io.ReaderAt, fileSize, off, n int64, width int, order binary.ByteOrder) ([]uint64, error) {
+	if off < 0 || n < 0 || off > fileSize || n > (fileSize-off)/int64(width) {
+		return nil, fmt.Errorf("%w: table at %d is past the end of the file", ErrVirtualDiskCorrupt, off)
+	}
+	buf := make([]byte, n*int64(width))
+	if _, err := r.ReadAt(buf, off); err != nil {
+		return nil, err
+	}
+	t := make([]uint64, n)
+	for i := range t {
+		if width == 8 {
+			t[i] = order.Uint64(buf[i*8:])
+		} else {
+			t[i] = uint64(order.Uint32(buf[i*4:]))
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,291 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/flate"
+)
+
+// testBlock returns a 4096-byte block filled with a pattern unique to seed.
+func testBlock(seed byte) []byte {
+	b := make([]byte, 4096)
+	for i := range b {
+		b[i] = seed ^ byte(i%251)
+	}
+	return b
+}
+
+// buildQcow2 returns a qcow2 v3 file with 4 KiB clusters for a 64 KiB disk:
+// clusters 0 and 1 stored as is, cluster 5 compressed, cluster 7 a zero
+// cluster and the rest unallocated. It also returns the disk contents.
+func buildQcow2(t *testing.T) (file, disk []byte) {
+	const cs = 4096
+	be := binary.BigEndian
+	disk = make([]byte, 16*cs)
+	copy(disk[0:], testBlock(1))
+	copy(disk[cs:], testBlock(2))
+	copy(disk[5*cs:], testBlock(3))
+
+	var comp bytes.Buffer
+	fw, _ := flate.NewWriter(&comp, flate.BestCompression)
+	fw.Write(testBlock(3))
+	fw.Close()
+
+	// Header, L1, L2, two data clusters, then the compressed cluster
+	file = make([]byte, 5*cs)
+	copy(file, qcow2Magic)
+	be.PutUint32(file[4:], 3)
+	be.PutUint32(file[20:], 12)
+	be.PutUint64(file[24:], uint64(len(disk)))
+	be.PutUint32(file[36:], 1)
+	be.PutUint64(file[40:], cs)
+	be.PutUint32(file[100:], 104)
+	be.PutUint64(file[cs:], 2*cs|1<<63)
+
+	l2 := file[2*cs:]
+	be.PutUint64(l2[0:], 3*cs|1<<63)
+	be.PutUint64(l2[8:], 4*cs|1<<63)
+	sectors := uint64(comp.Len()-1) / 512
+	be.PutUint64(l2[5*8:], qcow2Compressed|sectors<<58|5*cs)
+	be.PutUint64(l2[7*8:], qcow2ZeroCluster)
+	copy(file[3*cs:], disk[0:2*cs])
+	return append(file, comp.Bytes()...), disk
+}
+
+// buildDynamicVHD returns a dynamic VHD with 4 KiB blocks for a 16 KiB disk,
+// of which only block 1 is allocated.
+func buildDynamicVHD() (file, disk []byte) {
+	be := binary.BigEndian
+	disk = make([]byte, 4*4096)
+	copy(disk[4096:], testBlock(4))
+
+	footer := vhdFooter(len(disk), vhdDynamic, 512)
+	hdr := make([]byte, vhdDynamicHeaderLen)
+	copy(hdr, "cxsparse")
+	be.PutUint64(hdr[8:], 0xffffffffffffffff)
+	be.PutUint64(hdr[16:], 1536)
+	be.PutUint32(hdr[28:], 4)
+	be.PutUint32(hdr[32:], 4096)
+	be.PutUint32(hdr[36:], vhdChecksum(hdr, 36))
+	bat := make([]byte, 512)
+	for i, e := range []uint32{vhdUnallocated, 4, vhdUnallocated, vhdUnallocated} {
+		be.PutUint32(bat[i*4:], e)
+	}
+
+	file = append(file, footer...)
+	file = append(file, hdr...)
+	file = append(file, bat...)
+	file = append(file, make([]byte, 512)...) // Sector bitmap
+	file = append(file, disk[4096:8192]...)
+	return append(file, footer...), disk
+}
+
+func vhdFooter(size int, diskType uint32, dataOffset uint64) []byte {
+	be := binary.BigEndian
+	f := make([]byte, vhdFooterLen)
+	copy(f, "conectix")
+	be.PutUint64(f[16:], dataOffset)
+	be.PutUint64(f[40:], uint64(size))
+	be.PutUint64(f[48:], uint64(size))
+	be.PutUint32(f[60:], diskType)
+	be.PutUint32(f[64:], vhdChecksum(f, 64))
+	return f
+}
+
+// buildVMDK returns a monolithic sparse VMDK with 4 KiB grains for a 16 KiB
+// disk: grain 2 is allocated and grain 3 is a zero grain.
+func buildVMDK() (file, disk []byte) {
+	le := binary.LittleEndian
+	disk = make([]byte, 4*4096)
+	copy(disk[2*4096:], testBlock(5))
+
+	// Header, descriptor, grain directory, grain table (4 sectors), grain
+	file = make([]byte, 8*512)
+	copy(file, vmdkMagic)
+	le.PutUint32(file[4:], 1)
+	le.PutUint64(file[12:], 32)
+	le.PutUint64(file[20:], 8)
+	le.PutUint64(file[28:], 1)
+	le.PutUint64(file[36:], 1)
+	le.PutUint32(file[44:], 512)
+	le.PutUint64(file[56:], 2)
+	copy(file[512:], "# Disk DescriptorFile\nversion=1\nCID=12345678\nparentCID=ffffffff\ncreateType=\"monolithicSparse\"\n")
+	le.PutUint32(file[2*512:], 3)
+	le.PutUint32(file[3*512+2*4:], 8)
+	le.PutUint32(file[3*512+3*4:], vmdkZeroGrain)
+	return append(file, disk[2*4096:3*4096]...), disk
+}
+
+func TestVirtualDisk(t *testing.T) {
+	qcow2, qcow2Disk := buildQcow2(t)
+	dynamic, dynamicDisk := buildDynamicVHD()
+	fixedDisk := append(testBlock(6), testBlock(7)...)
+	fixed := append(append([]byte(nil), fixedDisk...), vhdFooter(len(fixedDisk), vhdFixed, 0xffffffffffffffff)...)
+	vmdk, vmdkDisk := buildVMDK()
+
+	tests := []struct {
+		name    string
+		file    []byte
+		disk    []byte
+		format  string
+		extents []ByteRange
+	}{
+		{"qcow2", qcow2, qcow2Disk, "qcow2", []ByteRange{{0, 2 * 4096}, {5 * 4096, 6 * 4096}}},
+		{"dynamic vhd", dynamic, dynamicDisk, "vhd", []ByteRange{{4096, 2 * 4096}}},
+		{"fixed vhd", fixed, fixedDisk, "vhd", []ByteRange{{0, 2 * 4096}}},
+		{"vmdk", vmdk, vmdkDisk, "vmdk", []ByteRange{{2 * 4096, 3 * 4096}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := DetectVirtualDisk(bytes.NewReader(tt.file), int64(len(tt.file)))
+			if err != nil || d == nil {
+				t.Fatalf("DetectVirtualDisk = %v, %v, want a virtual disk", d, err)
+			}
+			if d.Format() != tt.format || d.Size() != int64(len(tt.disk)) {
+				t.Errorf("format %s of %d bytes, want %s of %d", d.Format(), d.Size(), tt.format, len(tt.disk))
+			}
+			if got := d.Extents(); len(got) != len(tt.extents) || !equalRanges(got, tt.extents) {
+				t.Errorf("Extents = %v, want %v", got, tt.extents)
+			}
+
+			got, err := io.ReadAll(d)
+			if err != nil {
+				t.Fatalf("ReadAll failed: %v", err)
+			}
+			if !bytes.Equal(got, tt.disk) {
+				t.Error("disk contents differ")
+			}
+
+			// Read one byte into each extent and let NextData skip the rest.
+			d, _ = DetectVirtualDisk(bytes.NewReader(tt.file), int64(len(tt.file)))
+			for i := 0; ; i++ {
+				off, n, err := d.NextData()
+				if err == io.EOF {
+					if i != len(tt.extents) {
+						t.Errorf("NextData returned %d extents, want %d", i, len(tt.extents))
+					}
+					break
+				}
+				if err != nil {
+					t.Fatalf("NextData failed: %v", err)
+				}
+				if i < len(tt.extents) && (off != tt.extents[i].Start || off+n != tt.extents[i].End) {
+					t.Errorf("extent %d = [%d, %d), want %v", i, off, off+n, tt.extents[i])
+				}
+				var b [1]byte
+				if _, err := d.Read(b[:]); err != nil || b[0] != tt.disk[off] {
+					t.Errorf("byte at %d = %d (err %v), want %d", off, b[0], err, tt.disk[off])
+				}
+			}
+		})
+	}
+}
+
+func equalRanges(a, b []ByteRange) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDetectVirtualDisk_Raw(t *testing.T) {
+	raw := testBlock(8)
+	d, err := DetectVirtualDisk(bytes.NewReader(raw), int64(len(raw)))
+	if d != nil || err != nil {
+		t.Errorf("DetectVirtualDisk = %v, %v, want nil, nil for a raw image", d, err)
+	}
+}
+
+func TestDetectVirtualDisk_Unsupported(t *testing.T) {
+	backing, _ := buildQcow2(t)
+	binary.BigEndian.PutUint64(backing[8:], 4096)
+
+	truncated, _ := buildQcow2(t)
+	binary.BigEndian.PutUint64(truncated[40:], 1<<30)
+
+	differencing := append(testBlock(9), vhdFooter(4096, vhdDifferencing, 512)...)
+
+	parent, _ := buildVMDK()
+	copy(parent[512:], "# Disk DescriptorFile\nversion=1\nCID=12345678\nparentCID=87654321\n")
+
+	negative, _ := buildQcow2(t)
+	binary.BigEndian.PutUint64(negative[24:], 1<<63)
+
+	// The grain directory size, capacity/grainSize/gtSize entries of 4
+	// bytes, overflowed to 0 before.
+	capacity, _ := buildVMDK()
+	binary.LittleEndian.PutUint64(capacity[12:], 1<<62)
+	binary.LittleEndian.PutUint64(capacity[20:], 1)
+	binary.LittleEndian.PutUint32(capacity[44:], 1)
+
+	tests := []struct {
+		name    string
+		file    []byte
+		corrupt bool
+		msg     string
+	}{
+		{"qcow2 backing file", backing, false, "backing file"},
+		{"qcow2 L1 past end", truncated, true, "past the end"},
+		{"differencing vhd", differencing, false, "differencing"},
+		{"vmdk with parent", parent, false, "parent disk"},
+		{"qcow2 negative size", negative, true, "disk size"},
+		{"vmdk capacity overflow", capacity, true, "capacity"},
+		{"vhdx", []byte("vhdxfile" + strings.Repeat("\x00", 100)), false, "VHDX"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := DetectVirtualDisk(bytes.NewReader(tt.file), int64(len(tt.file)))
+			if d != nil || err == nil || !strings.Contains(err.Error(), tt.msg) {
+				t.Fatalf("DetectVirtualDisk = %v, %v, want an error about %q", d, err, tt.msg)
+			}
+			if errors.Is(err, ErrVirtualDiskCorrupt) != tt.corrupt {
+				t.Errorf("errors.Is(err, ErrVirtualDiskCorrupt) = %v, want %v", !tt.corrupt, tt.corrupt)
+			}
+		})
+	}
+}
+
+// hugeQcow2 returns a qcow2 file with 2 MiB clusters and an L1 table of l1
+// entries, the first used ones of which point at the same empty L2 table.
+func hugeQcow2(l1, used int) []byte {
+	const cs = 2 << 20
+	be := binary.BigEndian
+	file := make([]byte, 2*cs)
+	copy(file, qcow2Magic)
+	be.PutUint32(file[4:], 2)
+	be.PutUint32(file[20:], 21)
+	be.PutUint64(file[24:], uint64(l1)*cs*(cs/8))
+	be.PutUint32(file[36:], uint32(l1))
+	be.PutUint64(file[40:], 4096)
+	for i := range used {
+		be.PutUint64(file[4096+i*8:], cs|1<<63)
+	}
+	return file
+}
+
+func TestDetectVirtualDisk_Huge(t *testing.T) {
+	// 256 TiB with no L2 tables: the unallocated L2 spans are skipped.
+	empty := hugeQcow2(512, 0)
+	d, err := DetectVirtualDisk(bytes.NewReader(empty), int64(len(empty)))
+	if err != nil || d == nil || d.Size() != 1<<48 || len(d.Extents()) != 0 {
+		t.Fatalf("DetectVirtualDisk = %v, %v, want an empty 256 TiB disk", d, err)
+	}
+
+	// Every L1 entry pointing at the same L2 table would have scan look up
+	// 2^38 clusters.
+	repeated := hugeQcow2(1<<17, 1<<17)
+	if _, err := DetectVirtualDisk(bytes.NewReader(repeated), int64(len(repeated))); !errors.Is(err, ErrVirtualDiskCorrupt) {
+		t.Errorf("DetectVirtualDisk = %v, want ErrVirtualDiskCorrupt", err)
+	}
+
+	if _, err := readTable(bytes.NewReader(empty), int64(len(empty)), 8, 1<<62, 4, binary.BigEndian); !errors.Is(err, ErrVirtualDiskCorrupt) {
+		t.Errorf("readTable of 1<<62 entries = %v, want ErrVirtualDiskCorrupt", err)
+	}
+}
@@ -0,0 +1,137 @@
+package image
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// VHD format, as described in Microsoft's Virtual Hard Disk Image Format
+// Specification.
+const (
+	vhdFooterLen        = 512
+	vhdDynamicHeaderLen = 1024
+
+	vhdFixed        = 2
+	vhdDynamic      = 3
+	vhdDifferencing = 4
+
+	vhdUnallocated = 0xffffffff // BAT entry of a block not in the file
+)
+
+// vhdFixedLayout maps a fixed VHD, which is the raw disk followed by the
+// footer.
+type vhdFixedLayout struct{ blockSize int64 }
+
+func (l vhdFixedLayout) locate(block int64) (blockLoc, error) {
+	return blockLoc{off: block * l.blockSize}, nil
+}
+
+// vhdDynamicLayout maps blocks through the block allocation table. Each
+// block in the file starts with a sector bitmap, which is ignored: like
+// QEMU, all of an allocated block is read from the file.
+type vhdDynamicLayout struct {
+	bat        []uint64
+	bitmapSize int64
+}
+
+func (l vhdDynamicLayout) locate(block int64) (blockLoc, error) {
+	if block >= int64(len(l.bat)) || l.bat[block] == vhdUnallocated {
+		return blockLoc{off: -1}, nil
+	}
+	return blockLoc{off: int64(l.bat[block])*512 + l.bitmapSize}, nil
+}
+
+// readVHDFooter reads a footer at off and reports whether it is valid.
+func readVHDFooter(r io.ReaderAt, off int64) ([]byte, bool) {
+	footer := make([]byte, vhdFooterLen)
+	if off < 0 {
+		return nil, false
+	}
+	if n, _ := r.ReadAt(footer, off); n < vhdFooterLen || string(footer[:8]) != "conectix" {
+		return nil, false
+	}
+	return footer, vhdChecksum(footer, 64) == binary.BigEndian.Uint32(footer[64:])
+}
+
+// vhdChecksum is the one's complement of the byte sum of b, leaving out the
+// checksum field at off.
+func vhdChecksum(b []byte, off int) uint32 {
+	var sum uint32
+	for i, c := range b {
+		if i < off || i >= off+4 {
+			sum += uint32(c)
+		}
+	}
+	return ^sum
+}
+
+// openVHD reads the footer at the end of a VHD file, or its copy at the
+// start, which dynamic disks have. It returns nil for files without one.
+func openVHD(r io.ReaderAt, fileSize int64) (*VirtualDisk, error) {
+	footer, ok := readVHDFooter(r, fileSize-vhdFooterLen)
+	if !ok {
+		if start, startOK := readVHDFooter(r, 0); startOK {
+			footer, ok = start, true
+		}
+	}
+	if footer == nil {
+		return nil, nil
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: bad VHD footer checksum", ErrVirtualDiskCorrupt)
+	}
+
+	be := binary.BigEndian
+	d := &VirtualDisk{
+		r:      r,
+		format: "vhd",
+		size:   int64(be.Uint64(footer[48:])),
+	}
+	if err := checkDiskSize("vhd", d.size); err != nil {
+		return nil, err
+	}
+	switch diskType := be.Uint32(footer[60:]); diskType {
+	case vhdFixed:
+		if d.size > fileSize-vhdFooterLen {
+			return nil, fmt.Errorf("%w: fixed VHD of %d bytes in a %d byte file", ErrVirtualDiskCorrupt, d.size, fileSize)
+		}
+		d.blockSize = 4096
+		d.layout = vhdFixedLayout{blockSize: d.blockSize}
+	case vhdDynamic:
+		hdrOff := int64(be.Uint64(footer[16:]))
+		hdr := make([]byte, vhdDynamicHeaderLen)
+		if hdrOff < 0 || hdrOff+vhdDynamicHeaderLen > fileSize {
+			return nil, fmt.Errorf("%w: VHD dynamic header at %d is past the end of the file", ErrVirtualDiskCorrupt, hdrOff)
+		}
+		if _, err := r.ReadAt(hdr, hdrOff); err != nil {
+			return nil, err
+		}
+		if string(hdr[:8]) != "cxsparse" {
+			return nil, fmt.Errorf("%w: bad VHD dynamic header", ErrVirtualDiskCorrupt)
+		}
+		if vhdChecksum(hdr, 36) != be.Uint32(hdr[36:]) {
+			return nil, fmt.Errorf("%w: bad VHD dynamic header checksum", ErrVirtualDiskCorrupt)
+		}
+		d.blockSize = int64(be.Uint32(hdr[32:]))
+		if d.blockSize < 512 || d.blockSize%512 != 0 {
+			return nil, fmt.Errorf("%w: VHD block size %d", ErrVirtualDiskCorrupt, d.blockSize)
+		}
+		entries := int64(be.Uint32(hdr[28:]))
+		if entries < (d.size+d.blockSize-1)/d.blockSize {
+			return nil, fmt.Errorf("%w: VHD block table of %d entries is too small for %d bytes", ErrVirtualDiskCorrupt, entries, d.size)
+		}
+		bat, err := readTable(r, fileSize, int64(be.Uint64(hdr[16:])), entries, 4, be)
+		if err != nil {
+			return nil, err
+		}
+		// One bit per sector, padded to whole sectors
+		bitmapSize := (d.blockSize/512/8 + 511) / 512 * 512
+		d.layout = vhdDynamicLayout{bat: bat, bitmapSize: bitmapSize}
+	case vhdDifferencing:
+		return nil, fmt.Errorf("differencing VHD images are not supported; merge them with their parent first")
+	default:
+		return nil, fmt.Errorf("unsupported VHD disk type %d", diskType)
+	}
+	return d, nil
+}
@@ -0,0 +1,118 @@
+package image
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+// VMDK hosted sparse extent format, as described in VMware's Virtual Disk
+// Format 1.1 specification.
+const (
+	vmdkMagic     = "KDMV"
+	vmdkHeaderLen = 512
+
+	vmdkCompressed = 1 << 16            // Flag: grains are compressed (stream-optimized)
+	vmdkGDAtEnd    = 0xffffffffffffffff // Grain directory offset of stream-optimized files
+
+	// Grain table entries of grains not in the file: 0 is unallocated, 1 a
+	// grain of zeros.
+	vmdkZeroGrain = 1
+)
+
+var (
+	vmdkCreateType = regexp.MustCompile(`(?m)^\s*createType\s*=\s*"([^"]*)"`)
+	vmdkParentCID  = regexp.MustCompile(`(?m)^\s*parentCID\s*=\s*([0-9a-fA-F]+)`)
+)
+
+// vmdkLayout maps grains through the grain directory and grain tables.
+type vmdkLayout struct {
+	r        io.ReaderAt
+	fileSize int64
+	gd       []uint64
+	gtSize   int64 // Entries per grain table
+
+	// The last grain table read
+	gtOff int64
+	gt    []uint64
+}
+
+// openVMDK reads the header, descriptor and grain directory of a
+// monolithic sparse VMDK file. Other kinds of VMDK, which have their data in
+// further files, have compressed grains or a parent disk, are refused.
+func openVMDK(r io.ReaderAt, fileSize int64) (*VirtualDisk, error) {
+	hdr := make([]byte, vmdkHeaderLen)
+	if n, err := r.ReadAt(hdr, 0); n < vmdkHeaderLen {
+		if err == nil || err == io.EOF {
+			return nil, fmt.Errorf("%w: truncated VMDK header", ErrVirtualDiskCorrupt)
+		}
+		return nil, err
+	}
+	le := binary.LittleEndian
+	if version := le.Uint32(hdr[4:]); version < 1 || version > 3 {
+		return nil, fmt.Errorf("unsupported VMDK version %d", version)
+	}
+	gdOff := le.Uint64(hdr[56:])
+	if le.Uint32(hdr[8:])&vmdkCompressed != 0 || gdOff == vmdkGDAtEnd {
+		return nil, fmt.Errorf("stream-optimized VMDK images are not supported; convert to raw with qemu-img convert -O raw")
+	}
+
+	if descOff, descSize := int64(le.Uint64(hdr[28:])), int64(le.Uint64(hdr[36:])); descOff > 0 && descSize > 0 {
+		if descSize > 2048 || descOff > fileSize/512 || descOff*512+descSize*512 > fileSize {
+			return nil, fmt.Errorf("%w: VMDK descriptor is past the end of the file", ErrVirtualDiskCorrupt)
+		}
+		desc := make([]byte, descSize*512)
+		if _, err := r.ReadAt(desc, descOff*512); err != nil {
+			return nil, err
+		}
+		if m := vmdkCreateType.FindSubmatch(desc); m != nil && string(m[1]) != "monolithicSparse" {
+			return nil, fmt.Errorf("VMDK images of type %s are not supported, only monolithicSparse", m[1])
+		}
+		if m := vmdkParentCID.FindSubmatch(desc); m != nil && string(m[1]) != "ffffffff" {
+			return nil, fmt.Errorf("VMDK images with a parent disk are not supported")
+		}
+	}
+
+	capacity := int64(le.Uint64(hdr[12:]))
+	grainSize := int64(le.Uint64(hdr[20:]))
+	gtSize := int64(le.Uint32(hdr[44:]))
+	if grainSize == 0 || grainSize > 1<<16 || gtSize == 0 || gtSize > 1<<16 {
+		return nil, fmt.Errorf("%w: VMDK grain size %d and table size %d", ErrVirtualDiskCorrupt, grainSize, gtSize)
+	}
+	if capacity < 0 || capacity > maxDiskSize/512 {
+		return nil, fmt.Errorf("%w: VMDK capacity of %d sectors", ErrVirtualDiskCorrupt, capacity)
+	}
+	d := &VirtualDisk{
+		r:         r,
+		format:    "vmdk",
+		size:      capacity * 512,
+		blockSize: grainSize * 512,
+	}
+	grains := (capacity + grainSize - 1) / grainSize
+	gd, err := readTable(r, fileSize, int64(gdOff)*512, (grains+gtSize-1)/gtSize, 4, le)
+	if err != nil {
+		return nil, err
+	}
+	d.layout = &vmdkLayout{r: r, fileSize: fileSize, gd: gd, gtSize: gtSize}
+	return d, nil
+}
+
+func (v *vmdkLayout) locate(grain int64) (blockLoc, error) {
+	gtOff := int64(v.gd[grain/v.gtSize]) * 512
+	if gtOff == 0 {
+		return blockLoc{off: -1, unallocated: v.gtSize - grain%v.gtSize}, nil
+	}
+	if gtOff != v.gtOff || v.gt == nil {
+		gt, err := readTable(v.r, v.fileSize, gtOff, v.gtSize, 4, binary.LittleEndian)
+		if err != nil {
+			return blockLoc{}, err
+		}
+		v.gt, v.gtOff = gt, gtOff
+	}
+	entry := v.gt[grain%v.gtSize]
+	if entry == 0 || entry == vmdkZeroGrain {
+		return blockLoc{off: -1}, nil
+	}
+	return blockLoc{off: int64(entry) * 512}, nil
+}
@@ -0,0 +1,710 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// xz format, as described in the .xz file format specification: streams of a
+// 12-byte header, blocks, an index of the blocks and a 12-byte footer, with
+// zero padding between streams.
+const (
+	xzHeaderLen = 12
+	xzFooterLen = 12
+	// Blocks decoded in parallel are held in memory whole, so larger ones
+	// are refused. xz -T writes blocks of three times the dictionary size,
+	// 24 MiB at the default level and 192 MiB at -9. Larger blocks, and
+	// blocks whose headers don't record their sizes, are decoded as they
+	// are read, and handed on in pieces of xzPieceLen bytes.
+	xzMaxBlock = 256 << 20
+	xzPieceLen = 1 << 20
+)
+
+// xzMemory bounds the memory of the blocks split off but not yet read, both
+// their compressed bodies and their data, counted in pieces of xzPieceLen
+// bytes. It fits two of the largest blocks, so a -9 stream is still decoded
+// two blocks at a time.
+var xzMemory = 1 << 30
+
+// ErrXZCorrupt is returned by the parallel xz decoder for data that breaks
+// the xz format.
+var ErrXZCorrupt = errors.New("corrupt xz data")
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// newXZReader decodes xz data. Streams whose blocks record their sizes, as
+// xz -T and other multi-threaded encoders write them, are split into blocks
+// that up to workers goroutines decode at once. Data whose first block can't
+// be split, like the single block xz writes without -T, goes to the
+// sequential decoder; later blocks that can't be split are decoded in turn
+// by the splitter. Blocks stop being split off once ctx is done, as on
+// Close.
+func newXZReader(ctx context.Context, r io.Reader, workers int) (io.Reader, error) {
+	br := bufio.NewReaderSize(r, 64<<10)
+	if workers > 1 && xzSplittable(br) {
+		z := &xzReader{
+			blocks: make(chan *xzBlock, workers),
+			slots:  make(chan struct{}, workers),
+			budget: make(chan struct{}, max(xzMemory/xzPieceLen, 1)),
+			stop:   make(chan struct{}),
+			ctx:    ctx,
+		}
+		go z.split(br)
+		return z, nil
+	}
+	return xz.NewReader(br)
+}
+
+// xzSplittable peeks at the stream header and first block header in br and
+// reports whether the block can be decoded on its own.
+func xzSplittable(br *bufio.Reader) bool {
+	peek, _ := br.Peek(xzHeaderLen + 1)
+	if len(peek) < xzHeaderLen+1 || peek[xzHeaderLen] == 0 {
+		return false
+	}
+	headerLen := (int(peek[xzHeaderLen]) + 1) * 4
+	peek, _ = br.Peek(xzHeaderLen + headerLen)
+	if len(peek) < xzHeaderLen+headerLen {
+		return false
+	}
+	h, err := parseXZBlockHeader(peek[xzHeaderLen:])
+	return err == nil && h.splittable() == nil
+}
+
+// xzReader returns the data of the blocks split off by split, in stream
+// order, as the goroutines decoding them finish. A block keeps its slot and
+// its share of the budget until Read has returned all of its data.
+type xzReader struct {
+	blocks chan *xzBlock // Blocks in stream order, buffered up to the number of workers
+	slots  chan struct{} // Limits the blocks being decoded or read at once
+	budget chan struct{} // Limits their memory, one entry per xzPieceLen bytes
+	stop   chan struct{} // Closed by Close
+	ctx    context.Context
+	once   sync.Once
+	cur    *xzBlock
+	buf    []byte // Rest of the current block
+	err    error
+	end    error // Set by split before it closes blocks: why it stopped early
+
+	nblock int // Blocks split off so far, in all streams
+}
+
+// xzBlock is a block of the stream, decoded once ready is closed.
+type xzBlock struct {
+	ready chan struct{}
+	data  []byte
+	err   error
+	slot  bool // Holds an entry of slots
+	cost  int  // Entries of budget held
+}
+
+func (z *xzReader) Read(p []byte) (int, error) {
+	for len(z.buf) == 0 {
+		if z.cur != nil {
+			z.release(z.cur)
+			z.cur = nil
+		}
+		if z.err != nil {
+			return 0, z.err
+		}
+		b, ok := <-z.blocks
+		if !ok {
+			z.err = io.EOF
+			if z.end != nil {
+				z.err = z.end
+			}
+			continue
+		}
+		<-b.ready
+		z.cur = b
+		z.buf, z.err = b.data, b.err
+	}
+	n := copy(p, z.buf)
+	z.buf = z.buf[n:]
+	return n, nil
+}
+
+// Close stops splitting off blocks. Blocks already being decoded finish in
+// the background.
+func (z *xzReader) Close() error {
+	z.once.Do(func() { close(z.stop) })
+	return nil
+}
+
+// reserve takes n bytes of the budget, or reports false if the reader was
+// closed. A reservation larger than the whole budget waits for all of it.
+func (z *xzReader) reserve(n int64) (int, bool) {
+	cost := min(int((n+xzPieceLen-1)/xzPieceLen), cap(z.budget))
+	for i := 0; i < cost; i++ {
+		select {
+		case z.budget <- struct{}{}:
+		case <-z.stop:
+			return 0, false
+		case <-z.ctx.Done():
+			return 0, false
+		}
+	}
+	return cost, true
+}
+
+// release returns what b holds once it has been read.
+func (z *xzReader) release(b *xzBlock) {
+	for i := 0; i < b.cost; i++ {
+		<-z.budget
+	}
+	if b.slot {
+		<-z.slots
+	}
+}
+
+// queue hands b to the reader, or reports false if the reader was closed.
+func (z *xzReader) queue(b *xzBlock) bool {
+	select {
+	case z.blocks <- b:
+		return true
+	case <-z.stop:
+		return false
+	case <-z.ctx.Done():
+		return false
+	}
+}
+
+// fail queues err for the reader after the blocks before it.
+func (z *xzReader) fail(err error) {
+	z.queue(readyBlock(nil, err))
+}
+
+// readyBlock returns a block that needs no decoding.
+func readyBlock(data []byte, err error) *xzBlock {
+	b := &xzBlock{ready: make(chan struct{}), data: data, err: err}
+	close(b.ready)
+	return b
+}
+
+// split reads the streams from br block by block, starting a goroutine to
+// decode each, and checks every stream's index against its blocks.
+func (z *xzReader) split(br *bufio.Reader) {
+	defer func() {
+		// Once ctx is done, the blocks queued so far are followed by its
+		// error rather than the end of the data.
+		z.end = z.ctx.Err()
+		close(z.blocks)
+	}()
+	for first := true; ; first = false {
+		if !first {
+			// Stream padding, then another stream or the end.
+			for {
+				pad, _ := br.Peek(4)
+				if len(pad) == 0 {
+					return
+				}
+				if !bytes.Equal(pad, []byte{0, 0, 0, 0}) {
+					break
+				}
+				br.Discard(4)
+			}
+		}
+		if err := z.splitStream(br); err != nil {
+			z.fail(err)
+			return
+		}
+		select {
+		case <-z.stop:
+			return
+		case <-z.ctx.Done():
+			return
+		default:
+		}
+	}
+}
+
+// xzRecord is an index record: the size of a block without its padding,
+// and the size of its data.
+type xzRecord struct {
+	unpadded, uncompressed int64
+}
+
+func (z *xzReader) splitStream(br *bufio.Reader) error {
+	var header [xzHeaderLen]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return fmt.Errorf("%w: truncated stream header", ErrXZCorrupt)
+	}
+	flags, err := parseXZStreamHeader(header[:])
+	if err != nil {
+		return err
+	}
+	checkLen, ok := xzCheckLen(flags)
+	if !ok {
+		return fmt.Errorf("xz: unsupported stream flags %#x", flags)
+	}
+
+	var records []xzRecord
+	for {
+		peek, err := br.Peek(1)
+		if err != nil {
+			return fmt.Errorf("%w: truncated stream", ErrXZCorrupt)
+		}
+		if peek[0] == 0 {
+			break // Index indicator
+		}
+		headerLen := (int(peek[0]) + 1) * 4
+		raw := make([]byte, headerLen)
+		if _, err := io.ReadFull(br, raw); err != nil {
+			return fmt.Errorf("%w: truncated block header", ErrXZCorrupt)
+		}
+		h, err := parseXZBlockHeader(raw)
+		if err != nil {
+			return fmt.Errorf("xz block %d: %w", z.nblock, err)
+		}
+		var rec xzRecord
+		var ok bool
+		if h.splittable() == nil {
+			rec, ok, err = z.splitBlock(br, h, flags[1], checkLen)
+		} else {
+			rec, ok, err = z.decodeBlock(br, h, flags[1], checkLen)
+		}
+		if err != nil {
+			return fmt.Errorf("xz block %d: %w", z.nblock, err)
+		}
+		if !ok {
+			return nil
+		}
+		rec.unpadded += int64(headerLen)
+		records = append(records, rec)
+		z.nblock++
+	}
+
+	index, indexLen, err := readXZIndex(br)
+	if err != nil {
+		return err
+	}
+	if len(index) != len(records) {
+		return fmt.Errorf("%w: index lists %d blocks, stream has %d", ErrXZCorrupt, len(index), len(records))
+	}
+	for i, got := range index {
+		if got != records[i] {
+			return fmt.Errorf("%w: index record %d is %v, block is %v", ErrXZCorrupt, i, got, records[i])
+		}
+	}
+	var footer [xzFooterLen]byte
+	if _, err := io.ReadFull(br, footer[:]); err != nil {
+		return fmt.Errorf("%w: truncated stream footer", ErrXZCorrupt)
+	}
+	footerIndexLen, footerFlags, err := parseXZFooter(footer[:])
+	if err != nil {
+		return err
+	}
+	if footerIndexLen != indexLen {
+		return fmt.Errorf("%w: index size in footer doesn't match the index", ErrXZCorrupt)
+	}
+	if !bytes.Equal(footerFlags, flags) {
+		return fmt.Errorf("%w: stream footer flags don't match the header", ErrXZCorrupt)
+	}
+	return nil
+}
+
+// splitBlock reads the body of a block whose header records its sizes and
+// starts a goroutine to decode it, once the block fits in the budget and a
+// slot is free. It reports false if the reader was closed.
+func (z *xzReader) splitBlock(br *bufio.Reader, h xzBlockHeader, checkType byte, checkLen int) (xzRecord, bool, error) {
+	padded := (h.compressed + 3) &^ 3
+	cost, ok := z.reserve(padded + int64(checkLen) + h.uncompressed)
+	if !ok {
+		return xzRecord{}, false, nil
+	}
+	select {
+	case z.slots <- struct{}{}:
+	case <-z.stop:
+		return xzRecord{}, false, nil
+	case <-z.ctx.Done():
+		return xzRecord{}, false, nil
+	}
+	b := &xzBlock{ready: make(chan struct{}), slot: true, cost: cost}
+
+	body := make([]byte, padded+int64(checkLen))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return xzRecord{}, false, fmt.Errorf("%w: truncated block", ErrXZCorrupt)
+	}
+	i := z.nblock
+	go func() {
+		b.data, b.err = h.decode(body, checkType)
+		if b.err != nil {
+			b.err = fmt.Errorf("xz block %d: %w", i, b.err)
+		}
+		close(b.ready)
+	}()
+	if !z.queue(b) {
+		return xzRecord{}, false, nil
+	}
+	return xzRecord{h.compressed + int64(checkLen), h.uncompressed}, true, nil
+}
+
+// decodeBlock decodes a block that can't be split off as it reads it from
+// br, and queues its data in pieces after the blocks before it. It reports
+// false if the reader was closed.
+func (z *xzReader) decodeBlock(br *bufio.Reader, h xzBlockHeader, checkType byte, checkLen int) (xzRecord, bool, error) {
+	// The LZMA2 decoder reads exactly the chunks it decodes, so counting
+	// them gives the compressed size.
+	cr := &xzCountingReader{br: br}
+	dec, err := lzma.Reader2Config{DictCap: h.dictCap}.NewReader2(cr)
+	if err != nil {
+		return xzRecord{}, false, fmt.Errorf("%w: %v", ErrXZCorrupt, err)
+	}
+	check := newXZCheck(checkType)
+	var size int64
+	for eof := false; !eof; {
+		cost, ok := z.reserve(xzPieceLen)
+		if !ok {
+			return xzRecord{}, false, nil
+		}
+		data := make([]byte, xzPieceLen)
+		n := 0
+		for n < len(data) && !eof {
+			k, err := dec.Read(data[n:])
+			n += k
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return xzRecord{}, false, fmt.Errorf("%w: %v", ErrXZCorrupt, err)
+			}
+		}
+		if n == 0 {
+			z.release(&xzBlock{cost: cost})
+			break
+		}
+		check.Write(data[:n])
+		size += int64(n)
+		piece := readyBlock(data[:n], nil)
+		piece.cost = cost
+		if !z.queue(piece) {
+			return xzRecord{}, false, nil
+		}
+	}
+
+	if h.uncompressed >= 0 && size != h.uncompressed {
+		return xzRecord{}, false, fmt.Errorf("%w: uncompressed size doesn't match the block header", ErrXZCorrupt)
+	}
+	if h.compressed >= 0 && cr.n != h.compressed {
+		return xzRecord{}, false, fmt.Errorf("%w: compressed size doesn't match the block header", ErrXZCorrupt)
+	}
+	for n := cr.n; n%4 != 0; n++ {
+		if c, err := br.ReadByte(); err != nil || c != 0 {
+			return xzRecord{}, false, fmt.Errorf("%w: non-zero block padding", ErrXZCorrupt)
+		}
+	}
+	sum := make([]byte, checkLen)
+	if _, err := io.ReadFull(br, sum); err != nil {
+		return xzRecord{}, false, fmt.Errorf("%w: truncated block", ErrXZCorrupt)
+	}
+	if !bytes.Equal(check.sum(), sum) {
+		return xzRecord{}, false, fmt.Errorf("%w: block check mismatch", ErrXZCorrupt)
+	}
+	return xzRecord{cr.n + int64(checkLen), size}, true, nil
+}
+
+// xzCountingReader counts the bytes read from br.
+type xzCountingReader struct {
+	br *bufio.Reader
+	n  int64
+}
+
+func (r *xzCountingReader) Read(p []byte) (int, error) {
+	n, err := r.br.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *xzCountingReader) ReadByte() (byte, error) {
+	c, err := r.br.ReadByte()
+	if err == nil {
+		r.n++
+	}
+	return c, err
+}
+
+// parseXZStreamHeader checks a stream header and returns its flags.
+func parseXZStreamHeader(header []byte) ([]byte, error) {
+	if !bytes.Equal(header[:6], magicXZ) {
+		return nil, fmt.Errorf("%w: bad stream magic", ErrXZCorrupt)
+	}
+	flags := header[6:8]
+	if binary.LittleEndian.Uint32(header[8:]) != crc32.ChecksumIEEE(flags) {
+		return nil, fmt.Errorf("%w: stream header checksum mismatch", ErrXZCorrupt)
+	}
+	return flags, nil
+}
+
+// parseXZFooter checks a stream footer and returns the length of the index
+// before it and the stream flags.
+func parseXZFooter(footer []byte) (int64, []byte, error) {
+	le := binary.LittleEndian
+	if string(footer[10:]) != "YZ" {
+		return 0, nil, fmt.Errorf("%w: bad stream footer magic", ErrXZCorrupt)
+	}
+	if le.Uint32(footer[0:]) != crc32.ChecksumIEEE(footer[4:10]) {
+		return 0, nil, fmt.Errorf("%w: stream footer checksum mismatch", ErrXZCorrupt)
+	}
+	return (int64(le.Uint32(footer[4:])) + 1) * 4, footer[8:10], nil
+}
+
+// xzCheckLen returns the length of the check the stream flags call for, for
+// the checks the xz package supports too.
+func xzCheckLen(flags []byte) (int, bool) {
+	if flags[0] != 0 {
+		return 0, false
+	}
+	switch flags[1] {
+	case 0x00: // None
+		return 0, true
+	case 0x01: // CRC32
+		return 4, true
+	case 0x04: // CRC64
+		return 8, true
+	case 0x0a: // SHA-256
+		return 32, true
+	}
+	return 0, false
+}
+
+// xzBlockHeader is what the decoder needs from a block header.
+type xzBlockHeader struct {
+	compressed, uncompressed int64 // -1 if the header doesn't say
+	dictCap                  int
+}
+
+// parseXZBlockHeader parses a block header with just the LZMA2 filter, the
+// only one the xz package supports.
+func parseXZBlockHeader(raw []byte) (xzBlockHeader, error) {
+	var h xzBlockHeader
+	n := len(raw) - 4
+	if binary.LittleEndian.Uint32(raw[n:]) != crc32.ChecksumIEEE(raw[:n]) {
+		return h, fmt.Errorf("%w: block header checksum mismatch", ErrXZCorrupt)
+	}
+	flags := raw[1]
+	if flags&0x3c != 0 {
+		return h, fmt.Errorf("%w: reserved block flags set", ErrXZCorrupt)
+	}
+	if flags&0x03 != 0 {
+		return h, errors.New("filters other than LZMA2 aren't supported")
+	}
+	r := bytes.NewReader(raw[2:n])
+	h.compressed, h.uncompressed = -1, -1
+	var err error
+	if flags&0x40 != 0 {
+		if h.compressed, err = readXZVarint(r); err != nil || h.compressed == 0 {
+			return h, fmt.Errorf("%w: bad compressed size", ErrXZCorrupt)
+		}
+	}
+	if flags&0x80 != 0 {
+		if h.uncompressed, err = readXZVarint(r); err != nil {
+			return h, fmt.Errorf("%w: bad uncompressed size", ErrXZCorrupt)
+		}
+	}
+	id, err := readXZVarint(r)
+	if err != nil {
+		return h, fmt.Errorf("%w: bad filter flags", ErrXZCorrupt)
+	}
+	if id != 0x21 {
+		return h, fmt.Errorf("filter %#x isn't supported", id)
+	}
+	if size, err := readXZVarint(r); err != nil || size != 1 {
+		return h, fmt.Errorf("%w: bad LZMA2 properties", ErrXZCorrupt)
+	}
+	props, _ := r.ReadByte()
+	dictCap, err := lzma.DecodeDictCap(props)
+	if err != nil {
+		return h, fmt.Errorf("%w: %v", ErrXZCorrupt, err)
+	}
+	h.dictCap = int(dictCap)
+	if h.compressed >= 0 && h.uncompressed >= 0 && h.compressed > lzma2Bound(h.uncompressed) {
+		return h, fmt.Errorf("%w: %d compressed bytes for %d bytes of data", ErrXZCorrupt, h.compressed, h.uncompressed)
+	}
+	for r.Len() > 0 {
+		if c, _ := r.ReadByte(); c != 0 {
+			return h, fmt.Errorf("%w: non-zero block header padding", ErrXZCorrupt)
+		}
+	}
+	return h, nil
+}
+
+// splittable reports why the block can't be decoded in parallel, if it
+// can't: its size must be known up front and small enough to hold.
+func (h xzBlockHeader) splittable() error {
+	if h.compressed < 0 || h.uncompressed < 0 {
+		return errors.New("block header doesn't record its sizes")
+	}
+	if h.uncompressed > xzMaxBlock || h.compressed > xzMaxBlock {
+		return fmt.Errorf("block of %d bytes is too large", h.uncompressed)
+	}
+	return nil
+}
+
+// lzma2Bound returns the largest LZMA2 encoding of n bytes: incompressible
+// data is stored in chunks of up to 64 KiB with a 3-byte header, followed by
+// the end marker.
+func lzma2Bound(n int64) int64 {
+	if n > math.MaxInt64/2 {
+		return math.MaxInt64
+	}
+	return n + (n+1<<16-1)>>16*3 + 1
+}
+
+// decode decodes a block body: its compressed data, padding and check.
+func (h xzBlockHeader) decode(body []byte, checkType byte) ([]byte, error) {
+	padded := (h.compressed + 3) &^ 3
+	src := bytes.NewReader(body[:h.compressed])
+	dec, err := lzma.Reader2Config{DictCap: h.dictCap}.NewReader2(src)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrXZCorrupt, err)
+	}
+	data := make([]byte, h.uncompressed)
+	if _, err := io.ReadFull(dec, data); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrXZCorrupt, err)
+	}
+	if n, err := dec.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		return nil, fmt.Errorf("%w: more data than the block header says", ErrXZCorrupt)
+	}
+	if src.Len() != 0 {
+		return nil, fmt.Errorf("%w: compressed size doesn't match the block header", ErrXZCorrupt)
+	}
+	for _, c := range body[h.compressed:padded] {
+		if c != 0 {
+			return nil, fmt.Errorf("%w: non-zero block padding", ErrXZCorrupt)
+		}
+	}
+
+	check := newXZCheck(checkType)
+	check.Write(data)
+	if !bytes.Equal(check.sum(), body[padded:]) {
+		return nil, fmt.Errorf("%w: block check mismatch", ErrXZCorrupt)
+	}
+	return data, nil
+}
+
+// xzCheck computes the check of block data for the check type of a stream.
+type xzCheck struct {
+	checkType byte
+	h         hash.Hash
+}
+
+func newXZCheck(checkType byte) *xzCheck {
+	c := &xzCheck{checkType: checkType}
+	switch checkType {
+	case 0x01:
+		c.h = crc32.NewIEEE()
+	case 0x04:
+		c.h = crc64.New(crc64Table)
+	case 0x0a:
+		c.h = sha256.New()
+	}
+	return c
+}
+
+func (c *xzCheck) Write(p []byte) {
+	if c.h != nil {
+		c.h.Write(p)
+	}
+}
+
+// sum returns the check as the stream stores it: CRCs little-endian.
+func (c *xzCheck) sum() []byte {
+	switch c.checkType {
+	case 0x01:
+		return binary.LittleEndian.AppendUint32(nil, c.h.(hash.Hash32).Sum32())
+	case 0x04:
+		return binary.LittleEndian.AppendUint64(nil, c.h.(hash.Hash64).Sum64())
+	case 0x0a:
+		return c.h.Sum(nil)
+	}
+	return nil
+}
+
+// readXZIndex reads the index of a stream, from its indicator to its
+// checksum, and returns its records and length.
+func readXZIndex(br io.ByteReader) ([]xzRecord, int64, error) {
+	r := &xzHashReader{br: br, crc: crc32.NewIEEE()}
+	if c, err := r.ReadByte(); err != nil || c != 0 {
+		return nil, 0, fmt.Errorf("%w: missing index", ErrXZCorrupt)
+	}
+	count, err := readXZVarint(r)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: truncated index", ErrXZCorrupt)
+	}
+	var records []xzRecord
+	for i := int64(0); i < count; i++ {
+		var rec xzRecord
+		if rec.unpadded, err = readXZVarint(r); err == nil {
+			rec.uncompressed, err = readXZVarint(r)
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: truncated index", ErrXZCorrupt)
+		}
+		records = append(records, rec)
+	}
+	for r.n%4 != 0 {
+		if c, err := r.ReadByte(); err != nil || c != 0 {
+			return nil, 0, fmt.Errorf("%w: bad index padding", ErrXZCorrupt)
+		}
+	}
+	sum := r.crc.Sum32()
+	var crc [4]byte
+	for i := range crc {
+		if crc[i], err = br.ReadByte(); err != nil {
+			return nil, 0, fmt.Errorf("%w: truncated index", ErrXZCorrupt)
+		}
+	}
+	if binary.LittleEndian.Uint32(crc[:]) != sum {
+		return nil, 0, fmt.Errorf("%w: index checksum mismatch", ErrXZCorrupt)
+	}
+	return records, r.n + 4, nil
+}
+
+// xzHashReader reads bytes from br, adding them to crc.
+type xzHashReader struct {
+	br  io.ByteReader
+	crc hash.Hash32
+	n   int64
+}
+
+func (r *xzHashReader) ReadByte() (byte, error) {
+	c, err := r.br.ReadByte()
+	if err == nil {
+		r.crc.Write([]byte{c})
+		r.n++
+	}
+	return c, err
+}
+
+// readXZVarint reads a multibyte integer of up to 9 bytes, 7 bits each,
+// least significant first.
+func readXZVarint(r io.ByteReader) (int64, error) {
+	var v uint64
+	for i := 0; i < 9; i++ {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		v |= uint64(c&0x7f) << (7 * i)
+		if c&0x80 == 0 {
+			if c == 0 && i > 0 {
+				return 0, errors.New("non-minimal varint")
+			}
+			return int64(v), nil
+		}
+	}
+	return 0, errors.New("varint too long")
+}
@@ -0,0 +1,369 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// buildXZ encodes data as one xz stream of blocks of blockSize bytes whose
+// headers record their sizes, as xz -T writes them.
+func buildXZ(t testing.TB, data []byte, blockSize int, check byte) []byte {
+	t.Helper()
+	le := binary.LittleEndian
+	flags := []byte{0, check}
+	out := append([]byte{}, magicXZ...)
+	out = append(out, flags...)
+	out = le.AppendUint32(out, crc32.ChecksumIEEE(flags))
+
+	index := []byte{0}
+	var records []byte
+	count := 0
+	for off := 0; off < len(data); off += blockSize {
+		chunk := data[off:min(off+blockSize, len(data))]
+		var comp bytes.Buffer
+		w, err := lzma.Writer2Config{DictCap: 1 << 20}.NewWriter2(&comp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(chunk)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		h := []byte{0, 0xc0}
+		h = appendXZVarint(h, int64(comp.Len()))
+		h = appendXZVarint(h, int64(len(chunk)))
+		h = append(h, 0x21, 1, lzma.EncodeDictCap(1<<20))
+		for len(h)%4 != 0 {
+			h = append(h, 0)
+		}
+		h[0] = byte((len(h)+4)/4 - 1)
+		h = le.AppendUint32(h, crc32.ChecksumIEEE(h))
+
+		var sum []byte
+		switch check {
+		case 0x01:
+			sum = le.AppendUint32(nil, crc32.ChecksumIEEE(chunk))
+		case 0x04:
+			sum = le.AppendUint64(nil, crc64.Checksum(chunk, crc64.MakeTable(crc64.ECMA)))
+		case 0x0a:
+			s := sha256.Sum256(chunk)
+			sum = s[:]
+		}
+		records = appendXZVarint(records, int64(len(h)+comp.Len()+len(sum)))
+		records = appendXZVarint(records, int64(len(chunk)))
+		count++
+
+		out = append(out, h...)
+		out = append(out, comp.Bytes()...)
+		for len(out)%4 != 0 {
+			out = append(out, 0)
+		}
+		out = append(out, sum...)
+	}
+
+	index = appendXZVarint(index, int64(count))
+	index = append(index, records...)
+	for len(index)%4 != 0 {
+		index = append(index, 0)
+	}
+	index = le.AppendUint32(index, crc32.ChecksumIEEE(index))
+	out = append(out, index...)
+
+	footer := le.AppendUint32(nil, uint32(len(index)/4-1))
+	footer = append(footer, flags...)
+	out = le.AppendUint32(out, crc32.ChecksumIEEE(footer))
+	out = append(out, footer...)
+	return append(out, 'Y', 'Z')
+}
+
+// xzTestData returns n bytes that compress to about a third.
+func xzTestData(n int) []byte {
+	rng := rand.New(rand.NewSource(1))
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = "abcdefgh"[rng.Intn(8)]
+	}
+	return data
+}
+
+func TestXZReader_Parallel(t *testing.T) {
+	data := xzTestData(1 << 20)
+	twoStreams := append(buildXZ(t, data[:300000], 64<<10, 0x04), 0, 0, 0, 0)
+	twoStreams = append(twoStreams, buildXZ(t, data[300000:], 100000, 0x01)...)
+
+	tests := map[string][]byte{
+		"crc64":       buildXZ(t, data, 64<<10, 0x04),
+		"crc32":       buildXZ(t, data, 64<<10, 0x01),
+		"sha256":      buildXZ(t, data, 64<<10, 0x0a),
+		"no check":    buildXZ(t, data, 64<<10, 0x00),
+		"one block":   buildXZ(t, data, len(data), 0x04),
+		"two streams": twoStreams,
+	}
+	for name, compressed := range tests {
+		t.Run(name, func(t *testing.T) {
+			r, err := newXZReader(context.Background(), bytes.NewReader(compressed), 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := r.(*xzReader); !ok {
+				t.Fatalf("got %T, want the parallel decoder", r)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("decoded %d bytes that differ from the %d encoded", len(got), len(data))
+			}
+
+			// The sequential decoder agrees.
+			seq, err := newXZReader(context.Background(), bytes.NewReader(compressed), 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := io.ReadAll(seq); err != nil || !bytes.Equal(got, data) {
+				t.Errorf("sequential decoder: %d bytes, err %v", len(got), err)
+			}
+		})
+	}
+}
+
+func TestXZReader_SequentialFallback(t *testing.T) {
+	// The xz package, like xz without -T, doesn't record the block sizes.
+	data := xzTestData(100000)
+	var buf bytes.Buffer
+	w, _ := xz.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+
+	r, err := newXZReader(context.Background(), &buf, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.(*xzReader); ok {
+		t.Error("got the parallel decoder for blocks without sizes")
+	}
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("decoded %d bytes, err %v", len(got), err)
+	}
+}
+
+func TestXZReader_LaterBlocksSequential(t *testing.T) {
+	// A stream split into blocks, then one from the xz package, whose block
+	// header doesn't record its sizes, like xz -T then xz without it.
+	data := xzTestData(400000)
+	var plain bytes.Buffer
+	w, _ := xz.NewWriter(&plain)
+	w.Write(data[300000:])
+	w.Close()
+	compressed := append(buildXZ(t, data[:300000], 64<<10, 0x01), 0, 0, 0, 0)
+	compressed = append(compressed, plain.Bytes()...)
+
+	r, err := newXZReader(context.Background(), bytes.NewReader(compressed), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.(*xzReader); !ok {
+		t.Fatalf("got %T, want the parallel decoder", r)
+	}
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("decoded %d bytes, err %v", len(got), err)
+	}
+
+	// A bad check in the sequentially decoded block is still caught.
+	bad := bytes.Clone(compressed)
+	indexLen := int(binary.LittleEndian.Uint32(bad[len(bad)-8:])+1) * 4
+	bad[len(bad)-xzFooterLen-indexLen-1] ^= 0xff
+	r, err = newXZReader(context.Background(), bytes.NewReader(bad), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrXZCorrupt) {
+		t.Errorf("err = %v, want ErrXZCorrupt", err)
+	}
+}
+
+// setXZBlockSizes rewrites the sizes in the header of the first block of a
+// stream buildXZ made.
+func setXZBlockSizes(stream []byte, compressed, uncompressed int64) []byte {
+	le := binary.LittleEndian
+	h := []byte{0, 0xc0}
+	h = appendXZVarint(h, compressed)
+	h = appendXZVarint(h, uncompressed)
+	h = append(h, 0x21, 1, lzma.EncodeDictCap(1<<20))
+	for len(h)%4 != 0 {
+		h = append(h, 0)
+	}
+	h[0] = byte((len(h)+4)/4 - 1)
+	h = le.AppendUint32(h, crc32.ChecksumIEEE(h))
+	oldLen := (int(stream[xzHeaderLen]) + 1) * 4
+	out := append([]byte{}, stream[:xzHeaderLen]...)
+	out = append(out, h...)
+	return append(out, stream[xzHeaderLen+oldLen:]...)
+}
+
+func TestXZReader_Corrupt(t *testing.T) {
+	good := buildXZ(t, xzTestData(300000), 64<<10, 0x04)
+	blockData := xzHeaderLen + 16
+
+	badData := bytes.Clone(good)
+	badData[blockData+1000] ^= 0xff
+	badCheck := bytes.Clone(good)
+	// The last block's check sits right before the index.
+	indexLen := int(binary.LittleEndian.Uint32(good[len(good)-8:])+1) * 4
+	badCheck[len(good)-xzFooterLen-indexLen-1] ^= 0xff
+	badIndex := bytes.Clone(good)
+	badIndex[len(good)-xzFooterLen-indexLen+3] ^= 0x01
+	badFooter := bytes.Clone(good)
+	badFooter[len(good)-1] = 'X'
+
+	// Sizes no LZMA2 data has, in the sixth block, which the parallel
+	// decoder would allocate for.
+	hugeBlock := append(bytes.Clone(good), 0, 0, 0, 0)
+	hugeBlock = append(hugeBlock, setXZBlockSizes(buildXZ(t, xzTestData(1000), 1000, 0x04), 1<<62, 1000)...)
+
+	tests := map[string][]byte{
+		"huge block": hugeBlock,
+		"bad data":   badData,
+		"bad check":  badCheck,
+		"bad index":  badIndex,
+		"bad footer": badFooter,
+		"truncated":  good[:len(good)/2],
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			r, err := newXZReader(context.Background(), bytes.NewReader(data), 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = io.ReadAll(r)
+			if !errors.Is(err, ErrXZCorrupt) {
+				t.Errorf("err = %v, want ErrXZCorrupt", err)
+			}
+			// Blocks are numbered across streams.
+			if name == "huge block" && !strings.Contains(err.Error(), "xz block 5:") {
+				t.Errorf("err = %v, want it to name block 5", err)
+			}
+		})
+	}
+}
+
+func TestXZReader_Close(t *testing.T) {
+	// Closing before reading everything stops splitting off blocks.
+	compressed := buildXZ(t, xzTestData(1<<20), 16<<10, 0x04)
+	r, err := newXZReader(context.Background(), bytes.NewReader(compressed), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	z := r.(*xzReader)
+	z.Close()
+	for range z.blocks {
+	}
+}
+
+// xzSource counts the bytes the decoder has taken from r.
+type xzSource struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (s *xzSource) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.n.Add(int64(n))
+	return n, err
+}
+
+func TestXZReader_MemoryBound(t *testing.T) {
+	// With the reader stalled, blocks are split off only as far as the
+	// budget allows, however many workers there are: each block of
+	// incompressible data costs a piece of the budget.
+	defer func(m int) { xzMemory = m }(xzMemory)
+	xzMemory = 4 * xzPieceLen
+	data := make([]byte, 2<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	src := &xzSource{r: bytes.NewReader(buildXZ(t, data, 32<<10, 0x04))}
+	r, err := newXZReader(context.Background(), src, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(r, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the splitter to stop reading.
+	for last := int64(-1); src.n.Load() != last; time.Sleep(50 * time.Millisecond) {
+		last = src.n.Load()
+	}
+	// The blocks in the budget, plus what the splitter buffers.
+	if limit := int64(4*(32<<10+64) + 64<<10 + 4096); src.n.Load() > limit {
+		t.Errorf("read %d compressed bytes ahead of the reader, want at most %d", src.n.Load(), limit)
+	}
+
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rest, data[100:]) {
+		t.Error("data differs after stalling")
+	}
+}
+
+func TestXZReader_Cancel(t *testing.T) {
+	// Blocks stop being split off when ctx is done, and reads end with its
+	// error, not io.EOF, even without the contextReader of Decompressor.
+	compressed := buildXZ(t, xzTestData(1<<20), 16<<10, 0x04)
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := newXZReader(ctx, bytes.NewReader(compressed), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if got, err := io.ReadAll(r); !errors.Is(err, context.Canceled) {
+		t.Errorf("read %d more bytes, err %v, want context.Canceled", len(got), err)
+	}
+}
+
+// Decoding a multi-block xz image with the xz package, as with one worker,
+// and with the parallel decoder.
+func BenchmarkDecompressXZ(b *testing.B) {
+	data := xzTestData(16 << 20)
+	compressed := buildXZ(b, data, 1<<20, 0x04)
+	run := func(b *testing.B, newReader func(io.Reader) (io.Reader, error)) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			r, err := newReader(bytes.NewReader(compressed))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.Copy(io.Discard, r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			run(b, func(r io.Reader) (io.Reader, error) { return newXZReader(context.Background(), r, workers) })
+		})
+	}
+}
@@ -0,0 +1,231 @@
+// Package partition reads MBR and GPT partition tables from disks and images.
+package partition
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// Partition describes a single entry of a partition table. Start and Size are
+// in bytes from the beginning of the disk.
+type Partition struct {
+	Number int    `json:"number"`
+	Node   string `json:"node,omitempty"` // e.g. /dev/sdb1, filled in by platform code
+	Start  int64  `json:"start"`
+	Size   int64  `json:"size"`
+	Type   string `json:"type"`            // MBR type ("0x83") or GPT type GUID
+	Label  string `json:"label,omitempty"` // GPT partition name
+}
+
+// Table is a parsed partition table.
+type Table struct {
+	Scheme     string      `json:"scheme"` // "mbr" or "gpt"
+	SectorSize int64       `json:"sector_size"`
+	Partitions []Partition `json:"partitions"`
+}
+
+// ErrNoTable is returned when the disk has no recognisable partition table.
+var ErrNoTable = errors.New("no partition table found")
+
+const (
+	mbrSignatureOffset = 510
+	mbrEntriesOffset   = 446
+	mbrTypeProtective  = 0xee
+	maxLogical         = 128 // guards against EBR chains that loop
+)
+
+// Read parses the partition table of r. A protective MBR is followed to the
+// GPT, which is looked up with a 512-byte and then a 4096-byte logical sector
+// size, so images built for 4Kn media are handled too.
+func Read(r io.ReaderAt) (*Table, error) {
+	mbr := make([]byte, 512)
+	if _, err := r.ReadAt(mbr, 0); err != nil {
+		return nil, fmt.Errorf("failed to read MBR: %w", err)
+	}
+	if mbr[mbrSignatureOffset] != 0x55 || mbr[mbrSignatureOffset+1] != 0xaa {
+		return nil, ErrNoTable
+	}
+
+	for i := 0; i < 4; i++ {
+		if mbr[mbrEntriesOffset+i*16+4] == mbrTypeProtective {
+			for _, sectorSize := range []int64{512, 4096} {
+				t, err := readGPT(r, sectorSize)
+				if err == nil {
+					return t, nil
+				}
+				if !errors.Is(err, ErrNoTable) {
+					return nil, err
+				}
+			}
+			return nil, fmt.Errorf("protective MBR without a valid GPT header")
+		}
+	}
+	return readMBR(r, mbr)
+}
+
+func readMBR(r io.ReaderAt, mbr []byte) (*Table, error) {
+	t := &Table{Scheme: "mbr", SectorSize: 512}
+	for i := 0; i < 4; i++ {
+		e := mbr[mbrEntriesOffset+i*16 : mbrEntriesOffset+(i+1)*16]
+		typ := e[4]
+		first := int64(binary.LittleEndian.Uint32(e[8:12]))
+		count := int64(binary.LittleEndian.Uint32(e[12:16]))
+		if typ == 0 || count == 0 {
+			continue
+		}
+		t.Partitions = append(t.Partitions, Partition{
+			Number: i + 1,
+			Start:  first * 512,
+			Size:   count * 512,
+			Type:   fmt.Sprintf("0x%02x", typ),
+		})
+		if isExtended(typ) {
+			logical, err := readLogical(r, first)
+			if err != nil {
+				return nil, err
+			}
+			t.Partitions = append(t.Partitions, logical...)
+		}
+	}
+	return t, nil
+}
+
+// IsExtended reports whether p is an MBR extended partition container. The
+// kernel exposes these as tiny placeholder devices rather than at full size.
+func (p Partition) IsExtended() bool {
+	switch p.Type {
+	case "0x05", "0x0f", "0x85":
+		return true
+	}
+	return false
+}
+
+func isExtended(typ byte) bool {
+	return typ == 0x05 || typ == 0x0f || typ == 0x85
+}
+
+// readLogical walks the chain of extended boot records starting at LBA
+// extStart. Logical partitions are numbered from 5, as Linux does.
+func readLogical(r io.ReaderAt, extStart int64) ([]Partition, error) {
+	var parts []Partition
+	ebr := make([]byte, 512)
+	next := int64(0)
+	for n := 5; n < 5+maxLogical; n++ {
+		lba := extStart + next
+		if _, err := r.ReadAt(ebr, lba*512); err != nil {
+			return nil, fmt.Errorf("failed to read EBR at sector %d: %w", lba, err)
+		}
+		if ebr[mbrSignatureOffset] != 0x55 || ebr[mbrSignatureOffset+1] != 0xaa {
+			return parts, nil
+		}
+		e := ebr[mbrEntriesOffset : mbrEntriesOffset+16]
+		if count := int64(binary.LittleEndian.Uint32(e[12:16])); e[4] != 0 && count != 0 {
+			parts = append(parts, Partition{
+				Number: n,
+				Start:  (lba + int64(binary.LittleEndian.Uint32(e[8:12]))) * 512,
+				Size:   count * 512,
+				Type:   fmt.Sprintf("0x%02x", e[4]),
+			})
+		}
+		link := ebr[mbrEntriesOffset+16 : mbrEntriesOffset+32]
+		if link[4] == 0 {
+			return parts, nil
+		}
+		next = int64(binary.LittleEndian.Uint32(link[8:12]))
+	}
+	return nil, fmt.Errorf("too many logical partitions (EBR loop?)")
+}
+
+func readGPT(r io.ReaderAt, sectorSize int64) (*Table, error) {
+	// Whole sectors are read so raw disk handles that require aligned I/O work.
+	hdr := make([]byte, sectorSize)
+	if _, err := r.ReadAt(hdr, sectorSize); err != nil {
+		return nil, ErrNoTable
+	}
+	if !bytes.Equal(hdr[0:8], []byte("EFI PART")) {
+		return nil, ErrNoTable
+	}
+
+	hdrSize := binary.LittleEndian.Uint32(hdr[12:16])
+	if hdrSize < 92 || int64(hdrSize) > sectorSize {
+		return nil, fmt.Errorf("invalid GPT header size %d", hdrSize)
+	}
+	full := make([]byte, hdrSize)
+	copy(full, hdr)
+	wantCRC := binary.LittleEndian.Uint32(full[16:20])
+	binary.LittleEndian.PutUint32(full[16:20], 0)
+	if crc32.ChecksumIEEE(full) != wantCRC {
+		return nil, fmt.Errorf("GPT header checksum mismatch")
+	}
+
+	entriesLBA := int64(binary.LittleEndian.Uint64(hdr[72:80]))
+	numEntries := binary.LittleEndian.Uint32(hdr[80:84])
+	entrySize := binary.LittleEndian.Uint32(hdr[84:88])
+	if entrySize < 128 || numEntries > 4096 {
+		return nil, fmt.Errorf("invalid GPT entry array (%d entries of %d bytes)", numEntries, entrySize)
+	}
+
+	arraySize := int64(numEntries) * int64(entrySize)
+	buf := make([]byte, (arraySize+sectorSize-1)/sectorSize*sectorSize)
+	if _, err := r.ReadAt(buf, entriesLBA*sectorSize); err != nil {
+		return nil, fmt.Errorf("failed to read GPT entries: %w", err)
+	}
+	entries := buf[:arraySize]
+	if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(hdr[88:92]) {
+		return nil, fmt.Errorf("GPT partition entry checksum mismatch")
+	}
+
+	t := &Table{Scheme: "gpt", SectorSize: sectorSize}
+	for i := 0; i < int(numEntries); i++ {
+		e := entries[i*int(entrySize) : (i+1)*int(entrySize)]
+		if isZero(e[0:16]) {
+			continue
+		}
+		first := int64(binary.LittleEndian.Uint64(e[32:40]))
+		last := int64(binary.LittleEndian.Uint64(e[40:48]))
+		t.Partitions = append(t.Partitions, Partition{
+			Number: i + 1,
+			Start:  first * sectorSize,
+			Size:   (last - first + 1) * sectorSize,
+			Type:   formatGUID(e[0:16]),
+			Label:  decodeName(e[56:128]),
+		})
+	}
+	return t, nil
+}
+
+// formatGUID renders a GPT GUID, whose first three fields are little-endian.
+func formatGUID(b []byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(b[0:4]),
+		binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]),
+		b[8:10], b[10:16])
+}
+
+func decodeName(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return strings.TrimSpace(string(utf16.Decode(u)))
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
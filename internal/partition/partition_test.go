@@ -0,0 +1,128 @@
+package partition
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"testing"
+	"unicode/utf16"
+)
+
+func putMBREntry(sector []byte, idx int, typ byte, first, count uint32) {
+	e := sector[mbrEntriesOffset+idx*16:]
+	e[4] = typ
+	binary.LittleEndian.PutUint32(e[8:12], first)
+	binary.LittleEndian.PutUint32(e[12:16], count)
+	sector[510], sector[511] = 0x55, 0xaa
+}
+
+func TestReadMBR(t *testing.T) {
+	disk := make([]byte, 4096*512)
+	putMBREntry(disk, 0, 0x0c, 2048, 1024)
+	putMBREntry(disk, 1, 0x05, 3072, 1024) // extended
+
+	// First EBR: logical at +1 sector, link to the next EBR at +512.
+	ebr1 := disk[3072*512:]
+	putMBREntry(ebr1, 0, 0x83, 1, 100)
+	putMBREntry(ebr1, 1, 0x05, 512, 200)
+	ebr2 := disk[(3072+512)*512:]
+	putMBREntry(ebr2, 0, 0x82, 1, 50)
+
+	tbl, err := Read(bytes.NewReader(disk))
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if tbl.Scheme != "mbr" {
+		t.Errorf("Scheme = %q, want mbr", tbl.Scheme)
+	}
+
+	want := []Partition{
+		{Number: 1, Start: 2048 * 512, Size: 1024 * 512, Type: "0x0c"},
+		{Number: 2, Start: 3072 * 512, Size: 1024 * 512, Type: "0x05"},
+		{Number: 5, Start: 3073 * 512, Size: 100 * 512, Type: "0x83"},
+		{Number: 6, Start: (3072 + 512 + 1) * 512, Size: 50 * 512, Type: "0x82"},
+	}
+	if len(tbl.Partitions) != len(want) {
+		t.Fatalf("got %d partitions, want %d: %+v", len(tbl.Partitions), len(want), tbl.Partitions)
+	}
+	for i, p := range want {
+		if tbl.Partitions[i] != p {
+			t.Errorf("partition %d = %+v, want %+v", i, tbl.Partitions[i], p)
+		}
+	}
+}
+
+// buildGPT returns a disk image with a protective MBR and a GPT holding the
+// given (first LBA, last LBA, name) entries with the Linux filesystem type.
+func buildGPT(sectorSize int, parts [][3]any) []byte {
+	disk := make([]byte, 2048*sectorSize)
+	putMBREntry(disk, 0, mbrTypeProtective, 1, 0xffffffff)
+
+	linuxFS := []byte{0xaf, 0x3d, 0xc6, 0x0f, 0x83, 0x84, 0x72, 0x47, 0x8e, 0x79, 0x3d, 0x69, 0xd8, 0x47, 0x7d, 0xe4}
+	entries := make([]byte, 128*128)
+	for i, p := range parts {
+		e := entries[i*128:]
+		copy(e[0:16], linuxFS)
+		e[16] = byte(i + 1) // unique GUID
+		binary.LittleEndian.PutUint64(e[32:40], p[0].(uint64))
+		binary.LittleEndian.PutUint64(e[40:48], p[1].(uint64))
+		for j, c := range utf16.Encode([]rune(p[2].(string))) {
+			binary.LittleEndian.PutUint16(e[56+j*2:], c)
+		}
+	}
+	copy(disk[2*sectorSize:], entries)
+
+	hdr := disk[sectorSize : sectorSize+92]
+	copy(hdr[0:8], "EFI PART")
+	binary.LittleEndian.PutUint32(hdr[8:12], 0x00010000)
+	binary.LittleEndian.PutUint32(hdr[12:16], 92)
+	binary.LittleEndian.PutUint64(hdr[72:80], 2)
+	binary.LittleEndian.PutUint32(hdr[80:84], 128)
+	binary.LittleEndian.PutUint32(hdr[84:88], 128)
+	binary.LittleEndian.PutUint32(hdr[88:92], crc32.ChecksumIEEE(entries))
+	binary.LittleEndian.PutUint32(hdr[16:20], crc32.ChecksumIEEE(hdr))
+	return disk
+}
+
+func TestReadGPT(t *testing.T) {
+	for _, sectorSize := range []int{512, 4096} {
+		disk := buildGPT(sectorSize, [][3]any{
+			{uint64(40), uint64(139), "boot"},
+			{uint64(140), uint64(1000), "rootfs"},
+		})
+		tbl, err := Read(bytes.NewReader(disk))
+		if err != nil {
+			t.Fatalf("Read(%d) failed: %v", sectorSize, err)
+		}
+		if tbl.Scheme != "gpt" || tbl.SectorSize != int64(sectorSize) {
+			t.Errorf("got %s/%d, want gpt/%d", tbl.Scheme, tbl.SectorSize, sectorSize)
+		}
+		if len(tbl.Partitions) != 2 {
+			t.Fatalf("got %d partitions, want 2", len(tbl.Partitions))
+		}
+		p := tbl.Partitions[1]
+		ss := int64(sectorSize)
+		if p.Number != 2 || p.Start != 140*ss || p.Size != 861*ss || p.Label != "rootfs" {
+			t.Errorf("partition 2 = %+v", p)
+		}
+		if p.Type != "0FC63DAF-8483-4772-8E79-3D69D8477DE4" {
+			t.Errorf("Type = %s, want Linux filesystem GUID", p.Type)
+		}
+	}
+}
+
+func TestReadGPT_CorruptHeader(t *testing.T) {
+	disk := buildGPT(512, [][3]any{{uint64(40), uint64(100), "a"}})
+	disk[512+40] ^= 0xff // flip a byte covered by the header CRC
+	if _, err := Read(bytes.NewReader(disk)); err == nil {
+		t.Error("expected error for corrupted GPT header")
+	}
+}
+
+func TestRead_NoTable(t *testing.T) {
+	_, err := Read(bytes.NewReader(make([]byte, 4096)))
+	if !errors.Is(err, ErrNoTable) {
+		t.Errorf("err = %v, want ErrNoTable", err)
+	}
+}
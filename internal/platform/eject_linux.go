@@ -0,0 +1,122 @@
+//go:build linux
+
+package platform
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// SG_IO request and transfer direction from <scsi/sg.h>.
+const (
+	sgIO        = 0x2285
+	sgDxferNone = -1
+	sgInterface = 'S'
+)
+
+// sgIOHdr mirrors struct sg_io_hdr from <scsi/sg.h>.
+type sgIOHdr struct {
+	interfaceID    int32
+	dxferDirection int32
+	cmdLen         uint8
+	mxSbLen        uint8
+	iovecCount     uint16
+	dxferLen       uint32
+	dxferp         uintptr
+	cmdp           uintptr
+	sbp            uintptr
+	timeout        uint32
+	flags          uint32
+	packID         int32
+	usrPtr         uintptr
+	status         uint8
+	maskedStatus   uint8
+	msgStatus      uint8
+	sbLenWr        uint8
+	hostStatus     uint16
+	driverStatus   uint16
+	resid          int32
+	duration       uint32
+	info           uint32
+}
+
+// scsiStopUnit flushes the drive cache, allows medium removal and stops the
+// unit with the eject bit set, which is what eject(1) does for USB mass
+// storage. Devices that don't speak SCSI (e.g. mmcblk) return an error.
+func scsiStopUnit(fd int) error {
+	cmds := []struct {
+		name string
+		cdb  []byte
+	}{
+		{"SYNCHRONIZE CACHE", []byte{0x35, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+		{"ALLOW MEDIUM REMOVAL", []byte{0x1e, 0, 0, 0, 0, 0}},
+		{"START STOP UNIT", []byte{0x1b, 0, 0, 0, 0x02, 0}}, // LoEj=1, Start=0
+	}
+	for _, c := range cmds {
+		if err := scsiCommand(fd, c.cdb); err != nil {
+			return fmt.Errorf("%s failed: %w", c.name, err)
+		}
+	}
+	return nil
+}
+
+// scsiCommand issues a SCSI command without a data phase through SG_IO.
+func scsiCommand(fd int, cdb []byte) error {
+	sense := make([]byte, 32)
+	hdr := sgIOHdr{
+		interfaceID:    sgInterface,
+		dxferDirection: sgDxferNone,
+		cmdLen:         uint8(len(cdb)),
+		mxSbLen:        uint8(len(sense)),
+		cmdp:           uintptr(unsafe.Pointer(&cdb[0])),
+		sbp:            uintptr(unsafe.Pointer(&sense[0])),
+		timeout:        10000, // milliseconds
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), sgIO, uintptr(unsafe.Pointer(&hdr)))
+	runtime.KeepAlive(cdb)
+	runtime.KeepAlive(sense)
+	if errno != 0 {
+		return errno
+	}
+	if hdr.status != 0 || hdr.hostStatus != 0 || hdr.driverStatus != 0 {
+		return fmt.Errorf("status 0x%02x, host 0x%04x, driver 0x%04x", hdr.status, hdr.hostStatus, hdr.driverStatus)
+	}
+	return nil
+}
+
+// powerOffUSB detaches the USB device backing a block device by writing to
+// its sysfs "remove" attribute, the same way udisksctl power-off does.
+func powerOffUSB(path string) error {
+	devPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	sysDev, err := filepath.EvalSymlinks(filepath.Join("/sys/block", filepath.Base(devPath), "device"))
+	if err != nil {
+		return fmt.Errorf("no sysfs device for %s: %w", path, err)
+	}
+
+	// Walk up from the SCSI device to the USB device that owns it.
+	for dir := sysDev; dir != "/sys" && dir != "/"; dir = filepath.Dir(dir) {
+		if !fileExists(filepath.Join(dir, "idVendor")) {
+			continue
+		}
+		remove := filepath.Join(dir, "remove")
+		if !fileExists(remove) {
+			return fmt.Errorf("USB device %s cannot be powered off", filepath.Base(dir))
+		}
+		return os.WriteFile(remove, []byte("1"), 0200)
+	}
+	return errors.New("not a USB device")
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,88 @@
+//go:build linux
+
+package platform
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// findHolders scans /proc for processes with an open file descriptor, working
+// directory or root on the device node devBase (or one of its partitions) or
+// anywhere below mountPoint. Processes we can't inspect are skipped, so the
+// result is best effort when not running as root.
+func findHolders(devBase, mountPoint string) []Holder {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	matches := func(target string) bool {
+		if strings.HasPrefix(target, "/dev/") && strings.HasPrefix(filepath.Base(target), devBase) {
+			return true
+		}
+		if mountPoint == "" {
+			return false
+		}
+		return target == mountPoint || strings.HasPrefix(target, strings.TrimSuffix(mountPoint, "/")+"/")
+	}
+
+	var holders []Holder
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		procDir := filepath.Join("/proc", e.Name())
+		if processUses(procDir, matches) {
+			holders = append(holders, Holder{PID: pid, Command: processCommand(procDir)})
+		}
+	}
+	sort.Slice(holders, func(i, j int) bool { return holders[i].PID < holders[j].PID })
+	return holders
+}
+
+func processUses(procDir string, matches func(string) bool) bool {
+	for _, link := range []string{"cwd", "root"} {
+		if target, err := os.Readlink(filepath.Join(procDir, link)); err == nil && target != "/" && matches(target) {
+			return true
+		}
+	}
+	fds, err := os.ReadDir(filepath.Join(procDir, "fd"))
+	if err != nil {
+		return false
+	}
+	for _, fd := range fds {
+		if target, err := os.Readlink(filepath.Join(procDir, "fd", fd.Name())); err == nil && matches(target) {
+			return true
+		}
+	}
+	return false
+}
+
+// processCommand returns the short command name of a process.
+func processCommand(procDir string) string {
+	data, err := os.ReadFile(filepath.Join(procDir, "comm"))
+	if err != nil {
+		return "?"
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// nodeLockHolder guesses who holds the flock on a device node: the first
+// other process with the node open.
+func nodeLockHolder(path string) *Holder {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil
+	}
+	for _, h := range findHolders(filepath.Base(resolved), "") {
+		if h.PID != os.Getpid() {
+			return &h
+		}
+	}
+	return nil
+}
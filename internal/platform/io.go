@@ -1,7 +1,13 @@
 package platform
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"strings"
+	"time"
+
+	"pvflasher/internal/partition"
 )
 
 // DeviceWriter is an interface for writing to a block device
@@ -14,11 +20,94 @@ type DeviceWriter interface {
 	Fd() uintptr // Useful for ioctl if needed
 }
 
+// PrepareOptions controls how PrepareDevice releases a device before writing.
+type PrepareOptions struct {
+	// LazyUnmount detaches busy mount points (umount -l) instead of failing.
+	// Only honoured on Linux.
+	LazyUnmount bool
+}
+
+// EjectStep records the outcome of a single step of the eject sequence.
+type EjectStep struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func newEjectStep(name string, err error) EjectStep {
+	step := EjectStep{Name: name, OK: err == nil}
+	if err != nil {
+		step.Error = err.Error()
+	}
+	return step
+}
+
+// Holder identifies a process that keeps a device or one of its mount points open.
+type Holder struct {
+	PID     int    `json:"pid"`
+	Command string `json:"command"`
+}
+
+func (h Holder) String() string {
+	return fmt.Sprintf("%d (%s)", h.PID, h.Command)
+}
+
+// BusyError is returned when a mount point cannot be released because it is
+// still in use. Holders lists the processes found using it, if any.
+type BusyError struct {
+	MountPoint string
+	Holders    []Holder
+	Err        error
+}
+
+func (e *BusyError) Error() string {
+	msg := fmt.Sprintf("failed to unmount %s: %v", e.MountPoint, e.Err)
+	if len(e.Holders) > 0 {
+		names := make([]string, len(e.Holders))
+		for i, h := range e.Holders {
+			names[i] = h.String()
+		}
+		msg += "; in use by " + strings.Join(names, ", ")
+	}
+	return msg
+}
+
+func (e *BusyError) Unwrap() error {
+	return e.Err
+}
+
+// ErrWriteProtected is returned by CheckWritable for media that refuse writes,
+// such as SD cards with the lock switch on or eMMC boot areas with force_ro.
+var ErrWriteProtected = errors.New("device is write-protected")
+
+// WriteProtection reports whether the device is write-protected and, if so,
+// why. It needs no elevated privileges where the platform allows it, so it
+// can be used while listing devices.
+func WriteProtection(path string) (protected bool, reason string) {
+	return writeProtection(path)
+}
+
+// CheckWritable returns an error wrapping ErrWriteProtected if the device is
+// write-protected. Some readers let such media be opened read-write and only
+// fail with EIO/EROFS partway through the write, so this runs before flashing.
+func CheckWritable(path string) error {
+	if protected, reason := writeProtection(path); protected {
+		return fmt.Errorf("%w: %s (%s)", ErrWriteProtected, path, reason)
+	}
+	return nil
+}
+
+// Transport reports how the device is attached, e.g. "usb", "mmc", "sata",
+// "nvme" or "scsi". It returns "" if the bus can't be determined.
+func Transport(path string) string {
+	return transport(path)
+}
+
 // PrepareDevice prepares the device for raw writing by dismounting volumes.
-// On Windows, this dismounts all volumes on the physical device.
-// On Linux/macOS, this is a no-op as the device open handles exclusivity.
-func PrepareDevice(path string) error {
-	return prepareDevice(path)
+// On Windows, this is a no-op as openDevice locks and dismounts the volumes.
+// On Linux/macOS, all mounted partitions of the device are unmounted.
+func PrepareDevice(path string, opts PrepareOptions) error {
+	return prepareDevice(path, opts)
 }
 
 // OpenDevice opens a block device for writing with platform-specific optimizations
@@ -26,7 +115,17 @@ func OpenDevice(path string) (DeviceWriter, error) {
 	return openDevice(path)
 }
 
-// EjectDevice attempts to unmount and eject the device
-func EjectDevice(path string) error {
+// EjectDevice attempts to unmount and eject the device. The returned steps
+// report which parts of the platform's eject sequence succeeded, even when
+// the device as a whole could not be ejected.
+func EjectDevice(path string) ([]EjectStep, error) {
 	return ejectDevice(path)
 }
+
+// RereadPartitions makes the OS pick up the partition table that was just
+// written to the device, then waits up to timeout for the partition nodes
+// matching that table to appear. It returns the partitions of the new table,
+// with Node filled in where the platform exposes per-partition devices.
+func RereadPartitions(path string, timeout time.Duration) ([]partition.Partition, error) {
+	return rereadPartitions(path, timeout)
+}
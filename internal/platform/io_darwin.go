@@ -10,6 +10,7 @@ import (
 	"syscall"
 
 	"golang.org/x/sys/unix"
+	"howett.net/plist"
 )
 
 type DarwinDeviceWriter struct {
@@ -68,18 +69,19 @@ func (w *DarwinDeviceWriter) Fd() uintptr {
 }
 
 // prepareDevice unmounts the disk on macOS before raw writing.
-func prepareDevice(path string) error {
+func prepareDevice(path string, opts PrepareOptions) error {
 	// Use diskutil unmountDisk to unmount all volumes on the device
 	cmd := exec.Command("diskutil", "unmountDisk", diskutilPath(path))
 	return cmd.Run()
 }
 
-func ejectDevice(path string) error {
+func ejectDevice(path string) ([]EjectStep, error) {
 	// Use diskutil unmountDisk and then eject
 	path = diskutilPath(path)
-	exec.Command("diskutil", "unmountDisk", path).Run()
-	cmd := exec.Command("diskutil", "eject", path)
-	return cmd.Run()
+	steps := []EjectStep{newEjectStep("unmount", exec.Command("diskutil", "unmountDisk", path).Run())}
+	err := exec.Command("diskutil", "eject", path).Run()
+	steps = append(steps, newEjectStep("eject", err))
+	return steps, err
 }
 
 func rawDevicePath(path string) string {
@@ -95,3 +97,54 @@ func diskutilPath(path string) string {
 	}
 	return path
 }
+
+// writeProtection asks diskutil whether the media is writable, which works
+// without administrator rights unlike opening the raw device.
+func writeProtection(path string) (bool, string) {
+	out, err := exec.Command("diskutil", "info", "-plist", diskutilPath(path)).Output()
+	if err != nil {
+		return false, ""
+	}
+	var info struct {
+		WritableMedia *bool `plist:"WritableMedia"`
+	}
+	if _, err := plist.Unmarshal(out, &info); err != nil || info.WritableMedia == nil {
+		return false, ""
+	}
+	if !*info.WritableMedia {
+		return true, "media is read-only, check the lock switch"
+	}
+	return false, ""
+}
+
+// transport reads the BusProtocol reported by diskutil.
+func transport(path string) string {
+	out, err := exec.Command("diskutil", "info", "-plist", diskutilPath(path)).Output()
+	if err != nil {
+		return ""
+	}
+	var info struct {
+		BusProtocol string `plist:"BusProtocol"`
+	}
+	if _, err := plist.Unmarshal(out, &info); err != nil {
+		return ""
+	}
+	switch info.BusProtocol {
+	case "USB":
+		return "usb"
+	case "Secure Digital":
+		return "mmc"
+	case "SATA":
+		return "sata"
+	case "PCI-Express":
+		return "nvme"
+	case "":
+		return ""
+	}
+	return strings.ToLower(info.BusProtocol)
+}
+
+// nodeLockHolder is not implemented on macOS.
+func nodeLockHolder(path string) *Holder {
+	return nil
+}
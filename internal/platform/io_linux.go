@@ -4,12 +4,16 @@ package platform
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 type LinuxDeviceWriter struct {
@@ -53,63 +57,226 @@ func (w *LinuxDeviceWriter) Fd() uintptr {
 }
 
 // prepareDevice unmounts all partitions of the device on Linux before raw writing.
-func prepareDevice(path string) error {
-	// Find the base device name (e.g. "sda" from "/dev/sda")
-	devBase := filepath.Base(path)
+func prepareDevice(path string, opts PrepareOptions) error {
+	mountPoints, err := deviceMountPoints(path)
+	if err != nil {
+		return err
+	}
+	// Unmount in reverse mount order so nested mounts go before their parents.
+	for i := len(mountPoints) - 1; i >= 0; i-- {
+		if err := unmount(path, mountPoints[i], opts.LazyUnmount); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	// Read /proc/mounts to find mounted partitions
+// deviceMountPoints returns every mount point that belongs to the device or
+// one of its partitions, according to /proc/mounts.
+func deviceMountPoints(path string) ([]string, error) {
 	f, err := os.Open("/proc/mounts")
 	if err != nil {
-		return fmt.Errorf("failed to read /proc/mounts: %w", err)
+		return nil, fmt.Errorf("failed to read /proc/mounts: %w", err)
 	}
 	defer f.Close()
+	return parseDeviceMounts(f, filepath.Base(path)), nil
+}
 
-	// Collect mount points to unmount. We need to check both:
-	// 1. The device column (fields[0]) — normal case: /dev/sda1 mounted on /mnt
-	// 2. The mount point column (fields[1]) — reverse case: something mounted ON /dev/sda
-	//    This can happen when another filesystem shadows the block device node.
+// parseDeviceMounts collects the mount points for devBase (e.g. "sda") from a
+// /proc/mounts formatted reader. We need to check both:
+//  1. The device column (fields[0]) — normal case: /dev/sda1 mounted on /mnt
+//  2. The mount point column (fields[1]) — reverse case: something mounted ON /dev/sda
+//     This can happen when another filesystem shadows the block device node.
+func parseDeviceMounts(r io.Reader, devBase string) []string {
 	var mountPoints []string
-	scanner := bufio.NewScanner(f)
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		fields := strings.Fields(scanner.Text())
 		if len(fields) < 2 {
 			continue
 		}
 		dev := fields[0]
-		mountPoint := fields[1]
+		mountPoint := unescapeMountField(fields[1])
 
 		// Check if the device column matches (e.g. /dev/sda, /dev/sda1)
-		if strings.HasPrefix(dev, "/dev/") {
-			name := filepath.Base(dev)
-			if name == devBase || strings.HasPrefix(name, devBase) {
-				mountPoints = append(mountPoints, mountPoint)
-				continue
-			}
+		if strings.HasPrefix(dev, "/dev/") && strings.HasPrefix(filepath.Base(dev), devBase) {
+			mountPoints = append(mountPoints, mountPoint)
+			continue
 		}
 
 		// Check if something is mounted ON the device path or its partitions
 		// (e.g. /dev/vdc mounted on /dev/sda)
-		if strings.HasPrefix(mountPoint, "/dev/") {
-			name := filepath.Base(mountPoint)
-			if name == devBase || strings.HasPrefix(name, devBase) {
-				mountPoints = append(mountPoints, mountPoint)
+		if strings.HasPrefix(mountPoint, "/dev/") && strings.HasPrefix(filepath.Base(mountPoint), devBase) {
+			mountPoints = append(mountPoints, mountPoint)
+		}
+	}
+	return mountPoints
+}
+
+// unescapeMountField decodes the octal escapes (\040 for space, etc.) the
+// kernel uses for whitespace and backslashes in /proc/mounts.
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
 			}
 		}
+		b.WriteByte(s[i])
 	}
+	return b.String()
+}
 
-	// Unmount each mount point
-	for _, mp := range mountPoints {
-		cmd := exec.Command("umount", mp)
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to unmount %s: %w", mp, err)
+// unmount detaches a single mount point with umount2(2). A busy mount is
+// lazily detached when lazy is set; otherwise a *BusyError naming the
+// processes that hold the device or mount point open is returned.
+func unmount(devPath, mountPoint string, lazy bool) error {
+	err := unix.Unmount(mountPoint, 0)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, unix.EBUSY) {
+		return fmt.Errorf("failed to unmount %s: %w", mountPoint, err)
+	}
+	if lazy {
+		if err := unix.Unmount(mountPoint, unix.MNT_DETACH); err == nil {
+			return nil
 		}
 	}
+	return &BusyError{
+		MountPoint: mountPoint,
+		Holders:    findHolders(filepath.Base(devPath), mountPoint),
+		Err:        err,
+	}
+}
 
-	return nil
+// ejectDevice releases the device without shelling out to eject(1), which is
+// missing from AppImage and minimal container environments. The sequence
+// mirrors udisksctl power-off: unmount, flush the buffer cache, re-read the
+// partition table, stop the SCSI unit and finally detach the USB device.
+func ejectDevice(path string) ([]EjectStep, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode()&os.ModeDevice == 0 {
+		return nil, fmt.Errorf("%s is not a block device", path)
+	}
+
+	var steps []EjectStep
+
+	// Anything mounted after the flash (e.g. by a desktop automounter) must go first.
+	var unmountErr error
+	mountPoints, err := deviceMountPoints(path)
+	if err != nil {
+		unmountErr = err
+	}
+	for i := len(mountPoints) - 1; i >= 0; i-- {
+		if err := unmount(path, mountPoints[i], false); err != nil {
+			unmountErr = err
+			break
+		}
+	}
+	steps = append(steps, newEjectStep("unmount", unmountErr))
+	if unmountErr != nil {
+		return steps, unmountErr
+	}
+
+	f, err := os.OpenFile(path, os.O_RDONLY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return steps, fmt.Errorf("failed to open device: %w", err)
+	}
+	fd := int(f.Fd())
+	steps = append(steps, newEjectStep("flush-buffers", unix.IoctlSetInt(fd, unix.BLKFLSBUF, 0)))
+	steps = append(steps, newEjectStep("reread-partitions", unix.IoctlSetInt(fd, unix.BLKRRPART, 0)))
+	stopErr := scsiStopUnit(fd)
+	steps = append(steps, newEjectStep("stop-unit", stopErr))
+	f.Close()
+
+	powerErr := powerOffUSB(path)
+	steps = append(steps, newEjectStep("power-off", powerErr))
+
+	// Either stopping the unit or detaching the USB device is enough for the
+	// media to be safely removed.
+	if stopErr != nil && powerErr != nil {
+		return steps, fmt.Errorf("failed to eject %s: %v; %v", path, stopErr, powerErr)
+	}
+	return steps, nil
 }
 
-func ejectDevice(path string) error {
-	// Use the 'eject' command which handles unmounting and physical ejection
-	cmd := exec.Command("eject", path)
-	return cmd.Run()
+// writeProtection checks the sysfs ro and force_ro attributes, which are
+// readable without privileges, and then BLKROGET if the device can be opened.
+func writeProtection(path string) (bool, string) {
+	devPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false, ""
+	}
+	fi, err := os.Stat(devPath)
+	if err != nil || fi.Mode()&os.ModeDevice == 0 {
+		return false, ""
+	}
+
+	sysDir := filepath.Join("/sys/class/block", filepath.Base(devPath))
+	if readSysfsFlag(filepath.Join(sysDir, "force_ro")) {
+		return true, "force_ro is set"
+	}
+	if readSysfsFlag(filepath.Join(sysDir, "ro")) {
+		return true, "media is read-only, check the lock switch"
+	}
+
+	f, err := os.Open(devPath)
+	if err != nil {
+		return false, ""
+	}
+	defer f.Close()
+	if ro, err := unix.IoctlGetInt(int(f.Fd()), unix.BLKROGET); err == nil && ro != 0 {
+		return true, "block device is read-only"
+	}
+	return false, ""
+}
+
+func readSysfsFlag(path string) bool {
+	data, err := os.ReadFile(path)
+	return err == nil && strings.TrimSpace(string(data)) == "1"
+}
+
+// transport resolves the device's sysfs node, whose path runs through the
+// bus it hangs off (e.g. .../usb2/2-1/.../block/sdb).
+func transport(path string) string {
+	devPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return ""
+	}
+	sysPath, err := filepath.EvalSymlinks(filepath.Join("/sys/class/block", filepath.Base(devPath)))
+	if err != nil {
+		return ""
+	}
+	return transportFromSysfsPath(sysPath)
+}
+
+// transportFromSysfsPath maps a resolved sysfs block device path to a bus.
+// USB is checked first since USB card readers and SATA bridges also show up
+// as SCSI hosts further down the path.
+func transportFromSysfsPath(p string) string {
+	switch {
+	case strings.Contains(p, "/usb"):
+		return "usb"
+	case strings.Contains(p, "/mmc_host/"):
+		return "mmc"
+	case strings.Contains(p, "/nvme/"):
+		return "nvme"
+	case strings.Contains(p, "/virtio"):
+		return "virtio"
+	case strings.Contains(p, "/ata"):
+		return "sata"
+	case strings.Contains(p, "/host"):
+		return "scsi"
+	}
+	return ""
 }
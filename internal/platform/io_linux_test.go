@@ -0,0 +1,154 @@
+//go:build linux
+
+package platform
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParseDeviceMounts(t *testing.T) {
+	mounts := `/dev/sda2 / ext4 rw,relatime 0 0
+/dev/sdb1 /media/user/BOOT vfat rw 0 0
+/dev/sdb2 /media/user/root\040fs ext4 rw 0 0
+/dev/sdb2 /media/user/root\040fs/nested ext4 rw 0 0
+tmpfs /run tmpfs rw 0 0
+/dev/vdc /dev/sdb ext4 rw 0 0
+`
+	got := parseDeviceMounts(strings.NewReader(mounts), "sdb")
+	want := []string{
+		"/media/user/BOOT",
+		"/media/user/root fs",
+		"/media/user/root fs/nested",
+		"/dev/sdb",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("parseDeviceMounts() = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("mount %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestUnescapeMountField(t *testing.T) {
+	tests := map[string]string{
+		`/mnt/plain`:          "/mnt/plain",
+		`/mnt/with\040space`:  "/mnt/with space",
+		`/mnt/tab\011x`:       "/mnt/tab\tx",
+		`/mnt/back\134slash`:  `/mnt/back\slash`,
+		`/mnt/trailing\04`:    `/mnt/trailing\04`,
+		`/mnt/not\999escaped`: `/mnt/not\999escaped`,
+	}
+	for in, want := range tests {
+		if got := unescapeMountField(in); got != want {
+			t.Errorf("unescapeMountField(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestFindHolders(t *testing.T) {
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "held"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	holders := findHolders("pvflasher-no-such-device", dir)
+	for _, h := range holders {
+		if h.PID == os.Getpid() {
+			if h.Command == "" {
+				t.Error("holder has empty command")
+			}
+			return
+		}
+	}
+	t.Errorf("findHolders() = %v, want it to include this process (%d)", holders, os.Getpid())
+}
+
+func TestBusyError(t *testing.T) {
+	err := error(&BusyError{
+		MountPoint: "/media/user/BOOT",
+		Holders:    []Holder{{PID: 42, Command: "bash"}, {PID: 99, Command: "nautilus"}},
+		Err:        syscall.EBUSY,
+	})
+	if !errors.Is(err, syscall.EBUSY) {
+		t.Error("BusyError should unwrap to EBUSY")
+	}
+	want := "failed to unmount /media/user/BOOT: device or resource busy; in use by 42 (bash), 99 (nautilus)"
+	if err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+}
+
+func TestPartitionName(t *testing.T) {
+	tests := []struct {
+		disk string
+		n    int
+		want string
+	}{
+		{"sdb", 1, "sdb1"},
+		{"sdb", 12, "sdb12"},
+		{"mmcblk0", 2, "mmcblk0p2"},
+		{"nvme0n1", 1, "nvme0n1p1"},
+		{"loop3", 1, "loop3p1"},
+	}
+	for _, tt := range tests {
+		if got := partitionName(tt.disk, tt.n); got != tt.want {
+			t.Errorf("partitionName(%q, %d) = %q, want %q", tt.disk, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestCheckWritableRegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(path, make([]byte, 512), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckWritable(path); err != nil {
+		t.Errorf("CheckWritable(regular file) = %v, want nil", err)
+	}
+	if ro, reason := WriteProtection(path); ro || reason != "" {
+		t.Errorf("WriteProtection(regular file) = %v, %q", ro, reason)
+	}
+}
+
+func TestReadSysfsFlag(t *testing.T) {
+	dir := t.TempDir()
+	set := filepath.Join(dir, "ro")
+	unset := filepath.Join(dir, "force_ro")
+	os.WriteFile(set, []byte("1\n"), 0644)
+	os.WriteFile(unset, []byte("0\n"), 0644)
+
+	if !readSysfsFlag(set) {
+		t.Error("readSysfsFlag(1) = false, want true")
+	}
+	if readSysfsFlag(unset) {
+		t.Error("readSysfsFlag(0) = true, want false")
+	}
+	if readSysfsFlag(filepath.Join(dir, "missing")) {
+		t.Error("readSysfsFlag(missing) = true, want false")
+	}
+}
+
+func TestTransportFromSysfsPath(t *testing.T) {
+	tests := map[string]string{
+		"/sys/devices/pci0000:00/0000:00:14.0/usb2/2-1/2-1:1.0/host4/target4:0:0/4:0:0:0/block/sdb": "usb",
+		"/sys/devices/pci0000:00/0000:00:17.0/ata1/host0/target0:0:0/0:0:0:0/block/sda":             "sata",
+		"/sys/devices/platform/fe320000.mmc/mmc_host/mmc1/mmc1:aaaa/block/mmcblk1":                  "mmc",
+		"/sys/devices/pci0000:00/0000:00:1d.0/0000:3d:00.0/nvme/nvme0/nvme0n1":                      "nvme",
+		"/sys/devices/pci0000:00/0000:00:04.0/virtio1/block/vda":                                    "virtio",
+		"/sys/devices/virtual/block/loop0":                                                          "",
+	}
+	for path, want := range tests {
+		if got := transportFromSysfsPath(path); got != want {
+			t.Errorf("transportFromSysfsPath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
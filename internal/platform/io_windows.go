@@ -21,6 +21,8 @@ const (
 	IOCTL_STORAGE_GET_DEVICE_NUMBER = 0x002D1080
 	IOCTL_STORAGE_MEDIA_REMOVAL     = 0x002D4804
 	IOCTL_STORAGE_EJECT_MEDIA       = 0x002D4808
+	IOCTL_DISK_IS_WRITABLE          = 0x00070024
+	IOCTL_STORAGE_QUERY_PROPERTY    = 0x002D1400
 )
 
 // PREVENT_MEDIA_REMOVAL structure for IOCTL_STORAGE_MEDIA_REMOVAL
@@ -516,15 +518,15 @@ func ejectPhysicalDevice(path string) error {
 // prepareDevice is now a no-op on Windows.
 // Volume locking and dismounting is handled in openDevice to ensure
 // the locks are held throughout the entire write operation.
-func prepareDevice(path string) error {
+func prepareDevice(path string, opts PrepareOptions) error {
 	return nil
 }
 
-func ejectDevice(path string) error {
+func ejectDevice(path string) ([]EjectStep, error) {
 	// Parse device number from path
 	deviceNum, err := extractDeviceNumber(path)
 	if err != nil {
-		return fmt.Errorf("failed to parse device number: %w", err)
+		return nil, fmt.Errorf("failed to parse device number: %w", err)
 	}
 
 	// Get all volumes on this device
@@ -535,13 +537,119 @@ func ejectDevice(path string) error {
 	}
 
 	// Dismount all volumes
+	var dismountErr error
 	for _, vol := range volumes {
 		if err := dismountVolume(vol); err != nil {
 			// Log warning but continue - non-critical
 			fmt.Fprintf(os.Stderr, "Warning: failed to dismount volume %s: %v\n", vol, err)
+			if dismountErr == nil {
+				dismountErr = err
+			}
 		}
 	}
+	steps := []EjectStep{newEjectStep("dismount", dismountErr)}
 
 	// Eject the physical device
-	return ejectPhysicalDevice(path)
+	err = ejectPhysicalDevice(path)
+	steps = append(steps, newEjectStep("eject", err))
+	return steps, err
+}
+
+// writeProtection queries IOCTL_DISK_IS_WRITABLE, which fails with
+// ERROR_WRITE_PROTECT for locked media. The handle is opened without read or
+// write access so this works for non-administrators too.
+func writeProtection(path string) (bool, string) {
+	if strings.HasPrefix(strings.ToUpper(path), "PHYSICALDRIVE") {
+		path = `\\.\` + path
+	}
+	pathPtr, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return false, ""
+	}
+	handle, err := windows.CreateFile(
+		pathPtr,
+		0,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE,
+		nil,
+		windows.OPEN_EXISTING,
+		0,
+		0,
+	)
+	if err != nil {
+		return false, ""
+	}
+	defer windows.CloseHandle(handle)
+
+	var bytesReturned uint32
+	err = windows.DeviceIoControl(handle, IOCTL_DISK_IS_WRITABLE, nil, 0, nil, 0, &bytesReturned, nil)
+	if err == windows.ERROR_WRITE_PROTECT {
+		return true, "media is read-only, check the lock switch"
+	}
+	return false, ""
+}
+
+// STORAGE_PROPERTY_QUERY structure for IOCTL_STORAGE_QUERY_PROPERTY
+type storagePropertyQuery struct {
+	PropertyId           uint32
+	QueryType            uint32
+	AdditionalParameters [4]byte
+}
+
+// storageBusTypes maps STORAGE_BUS_TYPE values to transport names.
+var storageBusTypes = map[uint32]string{
+	0x01: "scsi",
+	0x02: "atapi",
+	0x03: "ata",
+	0x07: "usb",
+	0x0A: "sas",
+	0x0B: "sata",
+	0x0C: "mmc", // BusTypeSd
+	0x0D: "mmc",
+	0x0E: "virtual",
+	0x11: "nvme",
+}
+
+// transport queries the StorageDeviceProperty descriptor, whose BusType
+// field sits at offset 28 of STORAGE_DEVICE_DESCRIPTOR. Like
+// writeProtection it needs no access rights on the handle.
+func transport(path string) string {
+	if strings.HasPrefix(strings.ToUpper(path), "PHYSICALDRIVE") {
+		path = `\\.\` + path
+	}
+	pathPtr, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return ""
+	}
+	handle, err := windows.CreateFile(
+		pathPtr,
+		0,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE,
+		nil,
+		windows.OPEN_EXISTING,
+		0,
+		0,
+	)
+	if err != nil {
+		return ""
+	}
+	defer windows.CloseHandle(handle)
+
+	query := storagePropertyQuery{} // StorageDeviceProperty, PropertyStandardQuery
+	var desc [512]byte
+	var bytesReturned uint32
+	err = windows.DeviceIoControl(
+		handle,
+		IOCTL_STORAGE_QUERY_PROPERTY,
+		(*byte)(unsafe.Pointer(&query)),
+		uint32(unsafe.Sizeof(query)),
+		&desc[0],
+		uint32(len(desc)),
+		&bytesReturned,
+		nil,
+	)
+	if err != nil || bytesReturned < 32 {
+		return ""
+	}
+	busType := *(*uint32)(unsafe.Pointer(&desc[28]))
+	return storageBusTypes[busType]
 }
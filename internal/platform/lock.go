@@ -0,0 +1,128 @@
+package platform
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrDeviceLocked is wrapped by the error LockDevice returns when another
+// process holds the lock.
+var ErrDeviceLocked = errors.New("device is in use by another process")
+
+// LockedError reports a device lock held by another process. Holder is nil
+// if the holder couldn't be identified, e.g. when a non-pvflasher process
+// holds the flock on the device node.
+type LockedError struct {
+	Device string
+	Holder *Holder
+}
+
+func (e *LockedError) Error() string {
+	if e.Holder != nil {
+		return fmt.Sprintf("%s: %s is locked by %s", ErrDeviceLocked, e.Device, e.Holder)
+	}
+	return fmt.Sprintf("%s: %s is locked", ErrDeviceLocked, e.Device)
+}
+
+func (e *LockedError) Unwrap() error {
+	return ErrDeviceLocked
+}
+
+// DeviceLock is an advisory lock that keeps two pvflasher processes (for
+// example the elevated GUI child and a script) from writing the same device.
+// It combines a lock file in the runtime directory, keyed by device identity
+// so different paths to one device collide, with a lock on the device node
+// itself where the platform supports it.
+type DeviceLock struct {
+	file *os.File // lock file, holds our PID and command
+	node *os.File // device node, nil if it couldn't be locked
+}
+
+// LockDevice takes the advisory lock for the device at path without
+// blocking. If it is held elsewhere the error is a *LockedError.
+func LockDevice(path string) (*DeviceLock, error) {
+	key, err := deviceLockKey(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to identify device %s: %w", path, err)
+	}
+
+	f, err := openLockFile(filepath.Join(lockDir(), "pvflasher-"+key+".lock"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	if err := lockFile(f); err != nil {
+		holder := readLockHolder(f)
+		f.Close()
+		if errors.Is(err, errWouldBlock) {
+			return nil, &LockedError{Device: path, Holder: holder}
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+
+	// The file is never removed: unlinking it would let a process that
+	// opened the old inode and one that creates a new file both "own" it.
+	f.Truncate(0)
+	fmt.Fprintf(f, "%d\n%s\n", os.Getpid(), strings.Join(os.Args, " "))
+
+	node, err := lockDeviceNode(path)
+	if err != nil {
+		f.Truncate(0)
+		unlockFile(f)
+		f.Close()
+		return nil, err
+	}
+	return &DeviceLock{file: f, node: node}, nil
+}
+
+// openLockFile opens the lock file at path, creating it writable by all
+// users: root and unprivileged pvflasher processes lock the same devices.
+func openLockFile(path string) (*os.File, error) {
+	// An existing file is opened without O_CREATE, which protected_regular
+	// refuses for files of other users in sticky directories like /run/lock.
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if !os.IsNotExist(err) {
+		return f, err
+	}
+	if f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666); err != nil {
+		return nil, err
+	}
+	// The umask narrows the mode given at creation. Only the owner may
+	// change it, so this fails harmlessly if another process created it.
+	f.Chmod(0666)
+	return f, nil
+}
+
+// Unlock releases the lock. It is safe to call on a nil lock.
+func (l *DeviceLock) Unlock() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	if l.node != nil {
+		l.node.Close()
+		l.node = nil
+	}
+	l.file.Truncate(0)
+	err := unlockFile(l.file)
+	l.file.Close()
+	l.file = nil
+	return err
+}
+
+// readLockHolder parses the PID and command written by the lock owner.
+func readLockHolder(f *os.File) *Holder {
+	data := make([]byte, 4096)
+	n, _ := f.ReadAt(data, 0)
+	lines := strings.SplitN(string(data[:n]), "\n", 3)
+	if len(lines) < 2 {
+		return nil
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(lines[0]))
+	if err != nil {
+		return nil
+	}
+	return &Holder{PID: pid, Command: strings.TrimSpace(lines[1])}
+}
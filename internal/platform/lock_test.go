@@ -0,0 +1,120 @@
+package platform
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestLockDevice(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(path, make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err := LockDevice(path)
+	if err != nil {
+		t.Fatalf("LockDevice() error: %v", err)
+	}
+
+	_, err = LockDevice(path)
+	var locked *LockedError
+	if !errors.As(err, &locked) {
+		t.Fatalf("second LockDevice() = %v, want *LockedError", err)
+	}
+	if !errors.Is(err, ErrDeviceLocked) {
+		t.Error("LockedError does not wrap ErrDeviceLocked")
+	}
+	if locked.Holder == nil || locked.Holder.PID != os.Getpid() {
+		t.Fatalf("Holder = %+v, want PID %d", locked.Holder, os.Getpid())
+	}
+	if !strings.Contains(locked.Holder.Command, filepath.Base(os.Args[0])) {
+		t.Errorf("Holder.Command = %q, want it to contain %q", locked.Holder.Command, os.Args[0])
+	}
+	if !strings.Contains(err.Error(), path) {
+		t.Errorf("error %q does not name the device", err)
+	}
+
+	if err := lock.Unlock(); err != nil {
+		t.Fatalf("Unlock() error: %v", err)
+	}
+	lock, err = LockDevice(path)
+	if err != nil {
+		t.Fatalf("LockDevice() after Unlock error: %v", err)
+	}
+	lock.Unlock()
+
+	var nilLock *DeviceLock
+	if err := nilLock.Unlock(); err != nil {
+		t.Errorf("nil Unlock() = %v", err)
+	}
+}
+
+func TestLockDeviceSymlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need extra privileges on Windows")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "disk.img")
+	if err := os.WriteFile(path, make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "by-id")
+	if err := os.Symlink(path, link); err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err := LockDevice(path)
+	if err != nil {
+		t.Fatalf("LockDevice() error: %v", err)
+	}
+	defer lock.Unlock()
+
+	if _, err := LockDevice(link); !errors.Is(err, ErrDeviceLocked) {
+		t.Errorf("LockDevice(symlink) = %v, want ErrDeviceLocked", err)
+	}
+}
+
+func TestReadLockHolder(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if h := readLockHolder(f); h != nil {
+		t.Errorf("empty lock file holder = %+v, want nil", h)
+	}
+	f.WriteString("1234\npvflasher copy disk.img /dev/sdb\n")
+	h := readLockHolder(f)
+	if h == nil || h.PID != 1234 || h.Command != "pvflasher copy disk.img /dev/sdb" {
+		t.Errorf("holder = %+v", h)
+	}
+}
+
+func TestLockFileSharedBetweenUsers(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no file mode bits for other users")
+	}
+	path := filepath.Join(t.TempDir(), "pvflasher-test.lock")
+	f, err := openLockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0666 {
+		t.Errorf("lock file mode = %v, want -rw-rw-rw-", fi.Mode().Perm())
+	}
+	// An existing lock file is reused.
+	if f, err = openLockFile(path); err != nil {
+		t.Fatalf("reopening the lock file: %v", err)
+	}
+	f.Close()
+}
@@ -0,0 +1,96 @@
+//go:build !windows
+
+package platform
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var errWouldBlock = unix.EWOULDBLOCK
+
+// lockDirs are tried in order for the lock files; they are shared between
+// users, unlike $XDG_RUNTIME_DIR, so a sudo'd CLI and the elevated GUI child
+// see the same locks.
+var lockDirs = []string{"/run/lock", "/var/run"}
+
+func lockDir() string {
+	for _, dir := range lockDirs {
+		if unix.Access(dir, unix.W_OK) == nil {
+			return dir
+		}
+	}
+	return os.TempDir()
+}
+
+// deviceLockKey identifies the device by its device number, so symlinks such
+// as /dev/disk/by-id/... and the raw /dev/rdiskN alias on macOS map to the
+// same lock. Regular files (used in tests and for image targets) use their
+// inode.
+func deviceLockKey(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(resolved, "/dev/rdisk") {
+		resolved = strings.Replace(resolved, "/dev/rdisk", "/dev/disk", 1)
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(resolved, &st); err != nil {
+		return "", err
+	}
+	if st.Mode&unix.S_IFMT == unix.S_IFBLK || st.Mode&unix.S_IFMT == unix.S_IFCHR {
+		rdev := uint64(st.Rdev)
+		return fmt.Sprintf("dev-%d-%d", unix.Major(rdev), unix.Minor(rdev)), nil
+	}
+	return fmt.Sprintf("file-%d-%d", uint64(st.Dev), uint64(st.Ino)), nil
+}
+
+func lockFile(f *os.File) error {
+	return unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+}
+
+func unlockFile(f *os.File) error {
+	return unix.Flock(int(f.Fd()), unix.LOCK_UN)
+}
+
+// nodeLockWait bounds how long lockDeviceNode retries: udev takes a short
+// shared lock on the node while it probes a device.
+const nodeLockWait = 2 * time.Second
+
+// lockDeviceNode takes an exclusive flock on the device node, which is also
+// the convention udev and partitioning tools use; while it is held udev
+// holds off probing the half-written device. Nodes we can't open (e.g. when
+// not running as root) are skipped and only the lock file applies.
+func lockDeviceNode(path string) (*os.File, error) {
+	if strings.HasPrefix(path, "/dev/rdisk") {
+		path = strings.Replace(path, "/dev/rdisk", "/dev/disk", 1)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil
+	}
+
+	deadline := time.Now().Add(nodeLockWait)
+	for {
+		err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, unix.EWOULDBLOCK) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	f.Close()
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		return nil, &LockedError{Device: path, Holder: nodeLockHolder(path)}
+	}
+	return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+}
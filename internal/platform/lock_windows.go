@@ -0,0 +1,68 @@
+//go:build windows
+
+package platform
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/windows"
+)
+
+var errWouldBlock = windows.ERROR_LOCK_VIOLATION
+
+// lockDir is shared between users so an elevated process and a script run
+// from another account see the same locks.
+func lockDir() string {
+	if programData := os.Getenv("ProgramData"); programData != "" {
+		dir := filepath.Join(programData, "pvflasher", "locks")
+		if err := os.MkdirAll(dir, 0755); err == nil {
+			return dir
+		}
+	}
+	return os.TempDir()
+}
+
+// deviceLockKey uses the drive number for physical drives and the volume
+// serial and file index for regular files.
+func deviceLockKey(path string) (string, error) {
+	name := strings.ToLower(strings.TrimPrefix(path, `\\.\`))
+	if strings.HasPrefix(name, "physicaldrive") {
+		return name, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var info windows.ByHandleFileInformation
+	if err := windows.GetFileInformationByHandle(windows.Handle(f.Fd()), &info); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("file-%x-%x%08x", info.VolumeSerialNumber, info.FileIndexHigh, info.FileIndexLow), nil
+}
+
+// lockRangeOffset places the byte-range lock far past the end of the file:
+// Windows locks are mandatory, and the holder's PID and command at the start
+// of the file must stay readable.
+const lockRangeOffset = 0x7fffffff
+
+func lockFile(f *os.File) error {
+	ol := windows.Overlapped{OffsetHigh: lockRangeOffset}
+	return windows.LockFileEx(windows.Handle(f.Fd()),
+		windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &ol)
+}
+
+func unlockFile(f *os.File) error {
+	ol := windows.Overlapped{OffsetHigh: lockRangeOffset}
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, &ol)
+}
+
+// lockDeviceNode is a no-op on Windows; openDevice already locks and
+// dismounts the volumes, and physical drives have no flock equivalent.
+func lockDeviceNode(path string) (*os.File, error) {
+	return nil, nil
+}
@@ -0,0 +1,182 @@
+//go:build linux
+
+package platform
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"pvflasher/internal/partition"
+)
+
+func rereadPartitions(path string, timeout time.Duration) ([]partition.Partition, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open device: %w", err)
+	}
+	defer f.Close()
+
+	tbl, err := partition.Read(f)
+	if errors.Is(err, partition.ErrNoTable) {
+		tbl = &partition.Table{}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read partition table: %w", err)
+	}
+	parts := tbl.Partitions
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode()&os.ModeDevice == 0 {
+		// Flashing into an image file: there is no kernel view to refresh.
+		return parts, nil
+	}
+
+	devPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+	diskName := filepath.Base(devPath)
+
+	fd := int(f.Fd())
+	if err := unix.IoctlSetInt(fd, unix.BLKRRPART, 0); err != nil {
+		if !errors.Is(err, unix.EBUSY) {
+			return nil, fmt.Errorf("failed to re-read partition table: %w", err)
+		}
+		// A partition is still open (typically udev probing the old layout), so
+		// the kernel refuses to drop the whole table. Update it one partition
+		// at a time instead, as partx(8) does.
+		if err := updatePartitions(fd, diskName, parts); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range parts {
+		parts[i].Node = "/dev/" + partitionName(diskName, parts[i].Number)
+	}
+	return parts, waitForPartitions(diskName, parts, timeout)
+}
+
+// partitionName returns the kernel name of partition n of disk: sdb1, but
+// mmcblk0p1 and nvme0n1p1 for disks whose name ends in a digit.
+func partitionName(disk string, n int) string {
+	if r := rune(disk[len(disk)-1]); unicode.IsDigit(r) {
+		return fmt.Sprintf("%sp%d", disk, n)
+	}
+	return fmt.Sprintf("%s%d", disk, n)
+}
+
+// sysfsPartition returns the start and size in bytes the kernel currently
+// has for a partition, or ok=false if it doesn't know the partition.
+func sysfsPartition(name string) (start, size int64, ok bool) {
+	dir := filepath.Join("/sys/class/block", name)
+	read := func(attr string) (int64, bool) {
+		data, err := os.ReadFile(filepath.Join(dir, attr))
+		if err != nil {
+			return 0, false
+		}
+		v, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		return v * 512, err == nil // sysfs always counts 512-byte sectors
+	}
+	start, ok1 := read("start")
+	size, ok2 := read("size")
+	return start, size, ok1 && ok2
+}
+
+// updatePartitions brings the kernel's partition list in line with parts
+// using BLKPG, leaving partitions that are already correct untouched.
+func updatePartitions(fd int, disk string, parts []partition.Partition) error {
+	wanted := make(map[int]partition.Partition)
+	for _, p := range parts {
+		wanted[p.Number] = p
+	}
+
+	// Drop partitions the new table no longer has.
+	entries, _ := os.ReadDir(filepath.Join("/sys/block", disk))
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join("/sys/block", disk, e.Name(), "partition"))
+		if err != nil {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			continue
+		}
+		if _, ok := wanted[n]; !ok {
+			if err := blkpg(fd, unix.BLKPG_DEL_PARTITION, n, 0, 0); err != nil {
+				return fmt.Errorf("failed to remove stale partition %d: %w", n, err)
+			}
+		}
+	}
+
+	for _, p := range parts {
+		start, size, ok := sysfsPartition(partitionName(disk, p.Number))
+		if ok && start == p.Start && (size == p.Size || p.IsExtended()) {
+			continue
+		}
+		if ok {
+			if err := blkpg(fd, unix.BLKPG_DEL_PARTITION, p.Number, 0, 0); err != nil {
+				return fmt.Errorf("failed to remove partition %d: %w", p.Number, err)
+			}
+		}
+		length := p.Size
+		if p.IsExtended() {
+			length = 1024 // the kernel only maps the EBR area of an extended partition
+		}
+		if err := blkpg(fd, unix.BLKPG_ADD_PARTITION, p.Number, p.Start, length); err != nil {
+			return fmt.Errorf("failed to add partition %d: %w", p.Number, err)
+		}
+	}
+	return nil
+}
+
+func blkpg(fd int, op int32, pno int, start, length int64) error {
+	part := unix.BlkpgPartition{Start: start, Length: length, Pno: int32(pno)}
+	arg := unix.BlkpgIoctlArg{
+		Op:      op,
+		Datalen: int32(unsafe.Sizeof(part)),
+		Data:    (*byte)(unsafe.Pointer(&part)),
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.BLKPG, uintptr(unsafe.Pointer(&arg)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// waitForPartitions polls until every partition is known to the kernel with
+// the expected geometry and udev has created its device node.
+func waitForPartitions(disk string, parts []partition.Partition, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		missing := ""
+		for _, p := range parts {
+			start, size, ok := sysfsPartition(partitionName(disk, p.Number))
+			if !ok || start != p.Start || (size != p.Size && !p.IsExtended()) {
+				missing = p.Node
+				break
+			}
+			if fi, err := os.Stat(p.Node); err != nil || fi.Mode()&os.ModeDevice == 0 {
+				missing = p.Node
+				break
+			}
+		}
+		if missing == "" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %v waiting for partition %s", timeout, missing)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
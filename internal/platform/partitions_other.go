@@ -0,0 +1,36 @@
+//go:build !linux
+
+package platform
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"pvflasher/internal/partition"
+)
+
+// rereadPartitions only parses the new table on macOS and Windows: both
+// rescan the disk on their own once the write handle is closed, and don't
+// expose per-partition device nodes we could wait for.
+func rereadPartitions(path string, timeout time.Duration) ([]partition.Partition, error) {
+	if strings.HasPrefix(strings.ToUpper(path), "PHYSICALDRIVE") {
+		path = `\\.\` + path
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open device: %w", err)
+	}
+	defer f.Close()
+
+	tbl, err := partition.Read(f)
+	if errors.Is(err, partition.ErrNoTable) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read partition table: %w", err)
+	}
+	return tbl.Partitions, nil
+}
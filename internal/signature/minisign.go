@@ -0,0 +1,138 @@
+package signature
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// ed25519Key is a minisign public key or a bare Ed25519 key.
+type ed25519Key struct {
+	name string // key file name
+	id   uint64 // minisign key ID, 0 for bare keys
+	pub  ed25519.PublicKey
+}
+
+// parseEd25519Key reads a minisign public key file ("untrusted comment:"
+// line followed by the base64 key) or a bare Ed25519 key as 32 raw bytes,
+// hex or base64.
+func parseEd25519Key(name string, data []byte) (*ed25519Key, error) {
+	lines := textLines(data)
+	if len(lines) >= 2 && strings.HasPrefix(lines[0], "untrusted comment:") {
+		raw, err := base64.StdEncoding.DecodeString(lines[1])
+		if err != nil || len(raw) != 42 || string(raw[:2]) != "Ed" {
+			return nil, errors.New("invalid minisign public key")
+		}
+		return &ed25519Key{
+			name: name,
+			id:   binary.LittleEndian.Uint64(raw[2:10]),
+			pub:  ed25519.PublicKey(raw[10:]),
+		}, nil
+	}
+
+	raw := decodeBinary(data, ed25519.PublicKeySize)
+	if raw == nil {
+		return nil, errors.New("not an Ed25519 public key")
+	}
+	return &ed25519Key{name: name, pub: ed25519.PublicKey(raw)}, nil
+}
+
+// minisignSignature is a parsed .minisig file.
+type minisignSignature struct {
+	prehashed      bool // "ED": the signature is over BLAKE2b-512(data)
+	keyID          uint64
+	sig            []byte
+	trustedComment string
+	globalSig      []byte
+}
+
+func parseMinisign(data []byte) (*minisignSignature, error) {
+	lines := textLines(data)
+	if len(lines) < 4 || !strings.HasPrefix(lines[0], "untrusted comment:") {
+		return nil, errors.New("not a minisign signature")
+	}
+	raw, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(raw) != 74 {
+		return nil, errors.New("invalid minisign signature")
+	}
+	var ms minisignSignature
+	switch string(raw[:2]) {
+	case "Ed":
+	case "ED":
+		ms.prehashed = true
+	default:
+		return nil, fmt.Errorf("unsupported minisign algorithm %q", raw[:2])
+	}
+	ms.keyID = binary.LittleEndian.Uint64(raw[2:10])
+	ms.sig = raw[10:]
+
+	comment, ok := strings.CutPrefix(lines[2], "trusted comment: ")
+	if !ok {
+		return nil, errors.New("minisign signature has no trusted comment")
+	}
+	ms.trustedComment = comment
+	if ms.globalSig, err = base64.StdEncoding.DecodeString(lines[3]); err != nil || len(ms.globalSig) != ed25519.SignatureSize {
+		return nil, errors.New("invalid minisign global signature")
+	}
+	return &ms, nil
+}
+
+// verify checks both the file signature and the global signature, which
+// binds the trusted comment to it.
+func (ms *minisignSignature) verify(k *ed25519Key, data []byte) error {
+	msg := data
+	if ms.prehashed {
+		sum := blake2b.Sum512(data)
+		msg = sum[:]
+	}
+	if !ed25519.Verify(k.pub, msg, ms.sig) {
+		return errBadSignature
+	}
+	global := append(append([]byte{}, ms.sig...), ms.trustedComment...)
+	if !ed25519.Verify(k.pub, global, ms.globalSig) {
+		return errBadSignature
+	}
+	return nil
+}
+
+// parseRawEd25519Signature reads a bare Ed25519 signature as 64 raw bytes,
+// hex or base64.
+func parseRawEd25519Signature(data []byte) ([]byte, error) {
+	if raw := decodeBinary(data, ed25519.SignatureSize); raw != nil {
+		return raw, nil
+	}
+	return nil, errors.New("not an Ed25519 signature")
+}
+
+// decodeBinary returns data as exactly size bytes, accepting raw bytes or a
+// hex or base64 encoding of them.
+func decodeBinary(data []byte, size int) []byte {
+	if len(data) == size {
+		return data
+	}
+	text := string(bytes.TrimSpace(data))
+	if raw, err := hex.DecodeString(text); err == nil && len(raw) == size {
+		return raw
+	}
+	if raw, err := base64.StdEncoding.DecodeString(text); err == nil && len(raw) == size {
+		return raw
+	}
+	return nil
+}
+
+func textLines(data []byte) []string {
+	var lines []string
+	for _, l := range strings.Split(string(data), "\n") {
+		if l = strings.TrimRight(l, "\r"); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,133 @@
+package signature
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// OpenPGP signatures are checked with go-crypto. Trust comes from the key
+// being in the keyring directory, so certifications by other keys are not
+// evaluated, but subkey binding signatures, revocations and expiry are: a
+// subkey is only trusted if its primary key bound it, and a revoked or
+// expired key doesn't verify anything.
+
+// parsePGPKeys reads the certificates of an armored or binary key file.
+// A certificate with a subkey its primary key didn't bind is rejected.
+func parsePGPKeys(data []byte) (openpgp.EntityList, error) {
+	if isArmored(data) {
+		return openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(data))
+}
+
+// dearmorSignature returns the binary packets of an armored or binary
+// signature.
+func dearmorSignature(data []byte) ([]byte, error) {
+	if !isArmored(data) {
+		return data, nil
+	}
+	block, err := armor.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if block.Type != openpgp.SignatureType {
+		return nil, fmt.Errorf("expected a signature block, got %s", block.Type)
+	}
+	return io.ReadAll(block.Body)
+}
+
+// pgpIssuer returns the key ID of the first signature in sig made by a
+// signing key of keys, or of the first signature if none is.
+func pgpIssuer(keys openpgp.EntityList, sig []byte) (uint64, error) {
+	var first *uint64
+	packets := packet.NewReader(bytes.NewReader(sig))
+	for {
+		p, err := packets.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		s, ok := p.(*packet.Signature)
+		if !ok {
+			return 0, errors.New("not a signature packet")
+		}
+		if s.IssuerKeyId == nil {
+			return 0, errors.New("signature doesn't name its issuer")
+		}
+		if len(keys.KeysByIdUsage(*s.IssuerKeyId, packet.KeyFlagSign)) > 0 {
+			return *s.IssuerKeyId, nil
+		}
+		if first == nil {
+			first = s.IssuerKeyId
+		}
+	}
+	if first == nil {
+		return 0, errors.New("no signature packet")
+	}
+	return *first, nil
+}
+
+func (k *Keyring) verifyPGP(sig, data []byte) (*Result, error) {
+	sig, err := dearmorSignature(sig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OpenPGP signature: %w", err)
+	}
+	id, err := pgpIssuer(k.pgp, sig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OpenPGP signature: %w", err)
+	}
+	keys := k.pgp.KeysByIdUsage(id, packet.KeyFlagSign)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("OpenPGP key %s is not in the keyring", formatKeyID(id))
+	}
+
+	_, signer, err := openpgp.VerifyDetachedSignature(k.pgp, bytes.NewReader(data), bytes.NewReader(sig), nil)
+	switch {
+	case err == nil:
+		return &Result{Scheme: "openpgp", KeyID: formatKeyID(id), Signer: userID(signer)}, nil
+	case signer != nil:
+		// The signature matches, but the key was revoked or has expired.
+		return nil, fmt.Errorf("OpenPGP key %s: %w", formatKeyID(id), err)
+	case errors.As(err, new(pgperrors.SignatureError)):
+		return nil, &BadSignatureError{Signer: userID(keys[0].Entity), Err: errBadSignature}
+	default:
+		return nil, fmt.Errorf("invalid OpenPGP signature: %w", err)
+	}
+}
+
+// userID returns the primary user ID of a certificate.
+func userID(e *openpgp.Entity) string {
+	if id := e.PrimaryIdentity(); id != nil {
+		return id.Name
+	}
+	return formatKeyID(e.PrimaryKey.KeyId)
+}
+
+func isArmored(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN PGP "))
+}
+
+// isOpenPGP reports whether data looks like an OpenPGP signature rather than
+// a raw Ed25519 signature.
+func isOpenPGP(data []byte) bool {
+	if isArmored(data) {
+		return true
+	}
+	p, err := packet.Read(bytes.NewReader(data))
+	_, ok := p.(*packet.Signature)
+	return err == nil && ok
+}
+
+// formatKeyID renders a key ID the way gpg prints it.
+func formatKeyID(id uint64) string {
+	return fmt.Sprintf("%016X", id)
+}
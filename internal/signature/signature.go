@@ -0,0 +1,219 @@
+// Package signature verifies detached signatures of bmap files against a
+// directory of trusted public keys.
+//
+// Three signature formats are understood, matched by file extension next to
+// the signed file:
+//
+//   - .asc: ASCII-armored OpenPGP signature (gpg --armor --detach-sign)
+//   - .sig: binary OpenPGP signature, or a bare Ed25519 signature
+//   - .minisig: minisign signature
+//
+// The keyring directory holds OpenPGP public keys (*.asc, *.gpg, *.pgp, as
+// exported by gpg --export) and minisign or bare Ed25519 public keys (*.pub).
+package signature
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+var (
+	// ErrUnsigned is returned when a file has no detached signature.
+	ErrUnsigned = errors.New("no signature found")
+	// ErrUntrusted is returned when a file is signed, but by no key in the
+	// keyring.
+	ErrUntrusted = errors.New("signature is not from a trusted key")
+
+	errBadSignature = errors.New("signature does not match")
+)
+
+// BadSignatureError is returned when a signature was made by a trusted key
+// but does not match the file, i.e. the file or the signature was modified.
+type BadSignatureError struct {
+	SignatureFile string
+	Signer        string
+	Err           error
+}
+
+func (e *BadSignatureError) Error() string {
+	return fmt.Sprintf("%s: bad signature from %s: %v", e.SignatureFile, e.Signer, e.Err)
+}
+
+func (e *BadSignatureError) Unwrap() error {
+	return e.Err
+}
+
+// SignatureExtensions are the detached signature suffixes looked for next to
+// a signed file, in order of preference.
+var SignatureExtensions = []string{".asc", ".sig", ".minisig"}
+
+// Result describes a verified signature.
+type Result struct {
+	SignatureFile string `json:"signature_file"`
+	Scheme        string `json:"scheme"` // openpgp, minisign or ed25519
+	KeyID         string `json:"key_id,omitempty"`
+	Signer        string `json:"signer"` // OpenPGP user ID or key file name
+}
+
+// Keyring is a set of trusted public keys.
+type Keyring struct {
+	pgp     openpgp.EntityList
+	ed25519 []*ed25519Key
+}
+
+// DefaultKeyringDir returns ~/.pvflasher/keys, next to the image cache.
+func DefaultKeyringDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".pvflasher", "keys")
+}
+
+// LoadKeyring reads every key file in dir. A missing directory gives an empty
+// keyring; unreadable or malformed key files are errors so a typo doesn't
+// silently drop a trusted key.
+func LoadKeyring(dir string) (*Keyring, error) {
+	k := &Keyring{}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return k, nil
+		}
+		return nil, fmt.Errorf("failed to read keyring: %w", err)
+	}
+
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		switch strings.ToLower(filepath.Ext(e.Name())) {
+		case ".asc", ".gpg", ".pgp":
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			keys, err := parsePGPKeys(data)
+			if err != nil {
+				return nil, fmt.Errorf("invalid OpenPGP key %s: %w", path, err)
+			}
+			k.pgp = append(k.pgp, keys...)
+		case ".pub":
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			key, err := parseEd25519Key(e.Name(), data)
+			if err != nil {
+				return nil, fmt.Errorf("invalid public key %s: %w", path, err)
+			}
+			k.ed25519 = append(k.ed25519, key)
+		}
+	}
+	return k, nil
+}
+
+// Len returns the number of keys in the keyring.
+func (k *Keyring) Len() int {
+	return len(k.pgp) + len(k.ed25519)
+}
+
+// FindSignatures returns the detached signature files that exist for path.
+func FindSignatures(path string) []string {
+	var found []string
+	for _, ext := range SignatureExtensions {
+		if fi, err := os.Stat(path + ext); err == nil && fi.Mode().IsRegular() {
+			found = append(found, path+ext)
+		}
+	}
+	return found
+}
+
+// VerifyFile checks path against its detached signatures. It succeeds if any
+// signature verifies with a trusted key. Otherwise the error wraps
+// ErrUnsigned if there are no signatures, is a *BadSignatureError if a
+// trusted key's signature doesn't match, and wraps ErrUntrusted if no
+// signature is from a trusted key.
+func (k *Keyring) VerifyFile(path string) (*Result, error) {
+	sigs := FindSignatures(path)
+	if len(sigs) == 0 {
+		return nil, fmt.Errorf("%w for %s (looked for %s)", ErrUnsigned, path, strings.Join(SignatureExtensions, ", "))
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var badSig error
+	var problems []string
+	for _, sigPath := range sigs {
+		sigData, err := os.ReadFile(sigPath)
+		if err != nil {
+			return nil, err
+		}
+		res, err := k.Verify(data, sigData)
+		if err == nil {
+			res.SignatureFile = sigPath
+			return res, nil
+		}
+		var bad *BadSignatureError
+		if errors.As(err, &bad) {
+			bad.SignatureFile = sigPath
+			if badSig == nil {
+				badSig = bad
+			}
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("%s: %v", filepath.Base(sigPath), err))
+	}
+	if badSig != nil {
+		return nil, badSig
+	}
+	sort.Strings(problems)
+	return nil, fmt.Errorf("%w (%s)", ErrUntrusted, strings.Join(problems, "; "))
+}
+
+// Verify checks data against one detached signature in any supported format.
+func (k *Keyring) Verify(data, sig []byte) (*Result, error) {
+	if ms, err := parseMinisign(sig); err == nil {
+		return k.verifyMinisign(ms, data)
+	}
+	if isOpenPGP(sig) {
+		return k.verifyPGP(sig, data)
+	}
+	raw, err := parseRawEd25519Signature(sig)
+	if err != nil {
+		return nil, errors.New("unrecognized signature format")
+	}
+	return k.verifyRawEd25519(raw, data)
+}
+
+func (k *Keyring) verifyMinisign(ms *minisignSignature, data []byte) (*Result, error) {
+	for _, key := range k.ed25519 {
+		if key.id != ms.keyID {
+			continue
+		}
+		if err := ms.verify(key, data); err != nil {
+			return nil, &BadSignatureError{Signer: key.name, Err: err}
+		}
+		return &Result{Scheme: "minisign", KeyID: formatKeyID(key.id), Signer: key.name}, nil
+	}
+	return nil, fmt.Errorf("minisign key %s is not in the keyring", formatKeyID(ms.keyID))
+}
+
+func (k *Keyring) verifyRawEd25519(sig, data []byte) (*Result, error) {
+	for _, key := range k.ed25519 {
+		if ed25519.Verify(key.pub, data, sig) {
+			return &Result{Scheme: "ed25519", Signer: key.name}, nil
+		}
+	}
+	return nil, errors.New("no Ed25519 key in the keyring matches")
+}
@@ -0,0 +1,382 @@
+package signature
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"golang.org/x/crypto/blake2b"
+)
+
+// The testdata keys and signatures were made with gpg:
+//
+//	gpg --quick-gen-key "Release Signing (test) <release@example.com>" ed25519 sign
+//	gpg --quick-gen-key "RSA Signing (test) <rsa@example.com>" rsa2048 sign
+//	gpg --quick-gen-key "ECDSA Signing (test) <ecdsa@example.com>" nistp256 sign
+//	gpg --armor --detach-sign -u release@example.com ed25519.bmap
+//	gpg --detach-sign -u rsa@example.com rsa.bmap
+//
+// untrusted.bmap.asc is signed by a key that is not in testdata/keyring.
+
+func loadTestKeyring(t *testing.T) *Keyring {
+	t.Helper()
+	k, err := LoadKeyring("testdata/keyring")
+	if err != nil {
+		t.Fatalf("LoadKeyring() error: %v", err)
+	}
+	return k
+}
+
+// copyFixture copies a testdata bmap and its signatures into a temp dir.
+func copyFixture(t *testing.T, name string) string {
+	t.Helper()
+	dir := t.TempDir()
+	matches, _ := filepath.Glob(filepath.Join("testdata", name+"*"))
+	for _, m := range matches {
+		data, err := os.ReadFile(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, filepath.Base(m)), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, name)
+}
+
+func TestVerifyOpenPGP(t *testing.T) {
+	k := loadTestKeyring(t)
+	if k.Len() != 3 {
+		t.Fatalf("keyring has %d keys, want 3", k.Len())
+	}
+
+	tests := []struct {
+		file   string
+		sigExt string
+		keyID  string
+		signer string
+	}{
+		{"ed25519.bmap", ".asc", "3FB21C4094F3E8B1", "Release Signing (test) <release@example.com>"},
+		{"rsa.bmap", ".sig", "BD79F721EAACF9DD", "RSA Signing (test) <rsa@example.com>"},
+		{"ecdsa.bmap", ".asc", "57C2634B4FF98226", "ECDSA Signing (test) <ecdsa@example.com>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			path := filepath.Join("testdata", tt.file)
+			res, err := k.VerifyFile(path)
+			if err != nil {
+				t.Fatalf("VerifyFile() error: %v", err)
+			}
+			if res.Scheme != "openpgp" || res.KeyID != tt.keyID || res.Signer != tt.signer {
+				t.Errorf("result = %+v", res)
+			}
+			if res.SignatureFile != path+tt.sigExt {
+				t.Errorf("SignatureFile = %q, want %q", res.SignatureFile, path+tt.sigExt)
+			}
+
+			// Any change to the signed file must be caught.
+			tampered := copyFixture(t, tt.file)
+			data, _ := os.ReadFile(tampered)
+			os.WriteFile(tampered, []byte(strings.Replace(string(data), "<BlocksCount> 2", "<BlocksCount> 3", 1)), 0644)
+			_, err = k.VerifyFile(tampered)
+			var bad *BadSignatureError
+			if !errors.As(err, &bad) {
+				t.Fatalf("VerifyFile(tampered) = %v, want *BadSignatureError", err)
+			}
+			if bad.Signer != tt.signer {
+				t.Errorf("BadSignatureError.Signer = %q, want %q", bad.Signer, tt.signer)
+			}
+		})
+	}
+}
+
+func TestVerifyUntrustedAndUnsigned(t *testing.T) {
+	k := loadTestKeyring(t)
+
+	_, err := k.VerifyFile("testdata/untrusted.bmap")
+	if !errors.Is(err, ErrUntrusted) {
+		t.Errorf("VerifyFile(untrusted) = %v, want ErrUntrusted", err)
+	}
+	if err != nil && !strings.Contains(err.Error(), "E43C2A451D871F81") {
+		t.Errorf("error %q does not name the signing key", err)
+	}
+
+	unsigned := filepath.Join(t.TempDir(), "unsigned.bmap")
+	os.WriteFile(unsigned, []byte("<bmap/>"), 0644)
+	if _, err := k.VerifyFile(unsigned); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("VerifyFile(unsigned) = %v, want ErrUnsigned", err)
+	}
+
+	empty, err := LoadKeyring(filepath.Join(t.TempDir(), "missing"))
+	if err != nil || empty.Len() != 0 {
+		t.Fatalf("LoadKeyring(missing) = %v, %v", empty, err)
+	}
+	if _, err := empty.VerifyFile("testdata/ed25519.bmap"); !errors.Is(err, ErrUntrusted) {
+		t.Errorf("VerifyFile with empty keyring = %v, want ErrUntrusted", err)
+	}
+}
+
+func TestLoadKeyringRejectsMalformedKeys(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "broken.pub"), []byte("not a key"), 0644)
+	if _, err := LoadKeyring(dir); err == nil {
+		t.Error("LoadKeyring() accepted a malformed key")
+	}
+}
+
+// writePGPFixture writes the public key of trusted into a keyring directory
+// and data signed by signer next to it, and returns the keyring and the path
+// of the signed file.
+func writePGPFixture(t *testing.T, trusted, signer *openpgp.Entity, config *packet.Config) (*Keyring, string) {
+	t.Helper()
+	dir := t.TempDir()
+	var key bytes.Buffer
+	if err := trusted.Serialize(&key); err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(dir, "keys"), 0755)
+	os.WriteFile(filepath.Join(dir, "keys", "release.gpg"), key.Bytes(), 0644)
+
+	data := []byte("<bmap version=\"2.0\"></bmap>\n")
+	path := filepath.Join(dir, "image.bmap")
+	os.WriteFile(path, data, 0644)
+	var sig bytes.Buffer
+	if err := openpgp.DetachSign(&sig, signer, bytes.NewReader(data), config); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(path+".sig", sig.Bytes(), 0644)
+
+	k, err := LoadKeyring(filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatalf("LoadKeyring() error: %v", err)
+	}
+	return k, path
+}
+
+func TestVerifyOpenPGPKeyValidity(t *testing.T) {
+	newEntity := func(config *packet.Config) *openpgp.Entity {
+		e, err := openpgp.NewEntity("Release Signing", "test", "release@example.com", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+
+	t.Run("signing subkey", func(t *testing.T) {
+		e := newEntity(nil)
+		if err := e.AddSigningSubkey(nil); err != nil {
+			t.Fatal(err)
+		}
+		k, path := writePGPFixture(t, e, e, nil)
+		res, err := k.VerifyFile(path)
+		if err != nil {
+			t.Fatalf("VerifyFile() error: %v", err)
+		}
+		if want := formatKeyID(e.Subkeys[len(e.Subkeys)-1].PublicKey.KeyId); res.KeyID != want {
+			t.Errorf("KeyID = %s, want the subkey %s", res.KeyID, want)
+		}
+	})
+
+	t.Run("revoked", func(t *testing.T) {
+		e := newEntity(nil)
+		signer := *e // signed before the revocation
+		if err := e.RevokeKey(packet.KeySuperseded, "", nil); err != nil {
+			t.Fatal(err)
+		}
+		k, path := writePGPFixture(t, e, &signer, nil)
+		if _, err := k.VerifyFile(path); !errors.Is(err, ErrUntrusted) {
+			t.Errorf("VerifyFile() = %v, want ErrUntrusted", err)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		config := &packet.Config{
+			Time:            func() time.Time { return time.Now().Add(-48 * time.Hour) },
+			KeyLifetimeSecs: 24 * 60 * 60,
+		}
+		e := newEntity(config)
+		k, path := writePGPFixture(t, e, e, config)
+		if _, err := k.VerifyFile(path); !errors.Is(err, ErrUntrusted) {
+			t.Errorf("VerifyFile() = %v, want ErrUntrusted", err)
+		}
+	})
+
+	t.Run("unbound subkey", func(t *testing.T) {
+		// A signing subkey of another key, appended to a trusted key
+		// without a binding signature from it.
+		trusted, attacker := newEntity(nil), newEntity(nil)
+		if err := attacker.AddSigningSubkey(nil); err != nil {
+			t.Fatal(err)
+		}
+		trusted.Subkeys = append(trusted.Subkeys, attacker.Subkeys[len(attacker.Subkeys)-1])
+
+		dir := t.TempDir()
+		var key bytes.Buffer
+		trusted.Serialize(&key)
+		os.WriteFile(filepath.Join(dir, "release.gpg"), key.Bytes(), 0644)
+		if _, err := LoadKeyring(dir); err == nil {
+			t.Error("LoadKeyring() accepted a key with an unbound subkey")
+		}
+	})
+}
+
+// writeMinisign signs data the way minisign does and returns the .minisig
+// contents.
+func writeMinisign(priv ed25519.PrivateKey, keyID uint64, data []byte, prehash bool) string {
+	alg, msg := "Ed", data
+	if prehash {
+		sum := blake2b.Sum512(data)
+		alg, msg = "ED", sum[:]
+	}
+	sig := ed25519.Sign(priv, msg)
+	raw := append([]byte(alg), make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(raw[2:], keyID)
+	raw = append(raw, sig...)
+
+	comment := "timestamp:1700000000\tfile:image.bmap"
+	global := ed25519.Sign(priv, append(append([]byte{}, sig...), comment...))
+	return fmt.Sprintf("untrusted comment: signature from minisign secret key\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(raw), comment, base64.StdEncoding.EncodeToString(global))
+}
+
+func TestVerifyMinisign(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	const keyID = 0x1122334455667788
+
+	dir := t.TempDir()
+	keyRaw := append([]byte("Ed"), make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(keyRaw[2:], keyID)
+	keyRaw = append(keyRaw, pub...)
+	os.MkdirAll(filepath.Join(dir, "keys"), 0755)
+	os.WriteFile(filepath.Join(dir, "keys", "release.pub"), []byte(
+		"untrusted comment: minisign public key 1122334455667788\n"+base64.StdEncoding.EncodeToString(keyRaw)+"\n"), 0644)
+	k, err := LoadKeyring(filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("<bmap version=\"2.0\"></bmap>\n")
+	path := filepath.Join(dir, "image.bmap")
+	os.WriteFile(path, data, 0644)
+
+	for _, prehash := range []bool{false, true} {
+		os.WriteFile(path+".minisig", []byte(writeMinisign(priv, keyID, data, prehash)), 0644)
+		res, err := k.VerifyFile(path)
+		if err != nil {
+			t.Fatalf("prehash=%v: VerifyFile() error: %v", prehash, err)
+		}
+		if res.Scheme != "minisign" || res.KeyID != "1122334455667788" || res.Signer != "release.pub" {
+			t.Errorf("prehash=%v: result = %+v", prehash, res)
+		}
+	}
+
+	// A modified trusted comment breaks the global signature.
+	sig, _ := os.ReadFile(path + ".minisig")
+	os.WriteFile(path+".minisig", []byte(strings.Replace(string(sig), "file:image.bmap", "file:other.bmap", 1)), 0644)
+	var bad *BadSignatureError
+	if _, err := k.VerifyFile(path); !errors.As(err, &bad) {
+		t.Errorf("VerifyFile(modified comment) = %v, want *BadSignatureError", err)
+	}
+
+	// A signature from an unknown key ID is untrusted.
+	os.WriteFile(path+".minisig", []byte(writeMinisign(priv, 42, data, true)), 0644)
+	if _, err := k.VerifyFile(path); !errors.Is(err, ErrUntrusted) {
+		t.Errorf("VerifyFile(unknown key) = %v, want ErrUntrusted", err)
+	}
+}
+
+func TestVerifyBareEd25519(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "keys"), 0755)
+	os.WriteFile(filepath.Join(dir, "keys", "ci.pub"), []byte(hex.EncodeToString(pub)+"\n"), 0644)
+	k, err := LoadKeyring(filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("bmap contents")
+	path := filepath.Join(dir, "image.bmap")
+	os.WriteFile(path, data, 0644)
+
+	// Raw and base64 signatures in a .sig file.
+	sig := ed25519.Sign(priv, data)
+	for _, encoded := range [][]byte{sig, []byte(base64.StdEncoding.EncodeToString(sig) + "\n")} {
+		os.WriteFile(path+".sig", encoded, 0644)
+		res, err := k.VerifyFile(path)
+		if err != nil {
+			t.Fatalf("VerifyFile() error: %v", err)
+		}
+		if res.Scheme != "ed25519" || res.Signer != "ci.pub" {
+			t.Errorf("result = %+v", res)
+		}
+	}
+
+	os.WriteFile(path, []byte("other contents"), 0644)
+	if _, err := k.VerifyFile(path); !errors.Is(err, ErrUntrusted) {
+		t.Errorf("VerifyFile(modified) = %v, want ErrUntrusted", err)
+	}
+}
+
+func TestVerifyMalformedOpenPGP(t *testing.T) {
+	k := loadTestKeyring(t)
+	data, err := os.ReadFile("testdata/rsa.bmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := os.ReadFile("testdata/rsa.bmap.sig")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string][]byte{
+		"empty packet":      {0xc2, 0x00},
+		"version only":      {0xc2, 0x01, 0x04},
+		"old format, empty": {0x88, 0x00},
+	}
+	// Every truncation of a valid signature, packet length fixed up or not.
+	for n := 1; n < len(sig); n++ {
+		tests[fmt.Sprintf("truncated to %d", n)] = sig[:n]
+	}
+	for name, sig := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := k.Verify(data, sig); err == nil {
+				t.Error("Verify() accepted a malformed signature")
+			}
+		})
+	}
+}
+
+func FuzzVerify(f *testing.F) {
+	k, err := LoadKeyring("testdata/keyring")
+	if err != nil {
+		f.Fatal(err)
+	}
+	data, err := os.ReadFile("testdata/rsa.bmap")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, name := range []string{"rsa.bmap.sig", "ed25519.bmap.asc", "ecdsa.bmap.asc"} {
+		sig, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(sig)
+	}
+	f.Add([]byte{0xc2, 0x00})
+	f.Fuzz(func(t *testing.T, sig []byte) {
+		// Must not panic; the signature was made over other data.
+		k.Verify(data, sig)
+	})
+}
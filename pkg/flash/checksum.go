@@ -0,0 +1,38 @@
+package flash
+
+import (
+	"hash"
+	"io"
+	"os"
+	"sync"
+)
+
+// sourceHash hashes the image file as the flasher reads it. Decoders may
+// read it from their own goroutines, so reads are serialized.
+type sourceHash struct {
+	mu sync.Mutex
+	f  *os.File
+	h  hash.Hash
+	n  int64 // Bytes read and hashed
+}
+
+func (s *sourceHash) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, err := s.f.Read(p)
+	s.h.Write(p[:n])
+	s.n += int64(n)
+	return n, err
+}
+
+// sum returns the checksum of the file of size bytes, hashing what the
+// flasher didn't read: what follows the last range of a bmap, or all of an
+// image read at random.
+func (s *sourceHash) sum(size int64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := io.Copy(s.h, io.NewSectionReader(s.f, s.n, size-s.n)); err != nil {
+		return nil, err
+	}
+	return s.h.Sum(nil), nil
+}
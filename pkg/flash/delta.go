@@ -0,0 +1,111 @@
+package flash
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"pvflasher/internal/bmap"
+)
+
+// rangeKey identifies a range by its blocks, for matching ranges between
+// two bmaps.
+type rangeKey struct {
+	start, end int64
+}
+
+// unchangedRanges compares bm with the bmap of the image already on the
+// device and marks the ranges of bm that the base has with the same blocks
+// and checksum. Ranges that were split, merged or moved count as changed.
+func unchangedRanges(bm, base *bmap.Bmap) ([]bool, error) {
+	if base.BlockSize != bm.BlockSize {
+		return nil, fmt.Errorf("base bmap has block size %d, the image's bmap %d", base.BlockSize, bm.BlockSize)
+	}
+	if base.ChecksumType != bm.ChecksumType {
+		return nil, fmt.Errorf("base bmap uses %s checksums, the image's bmap %s", base.ChecksumType, bm.ChecksumType)
+	}
+
+	old := make(map[rangeKey]string, len(base.BlockMap))
+	for _, rng := range base.BlockMap {
+		r, err := rng.Parse()
+		if err != nil {
+			return nil, err
+		}
+		old[rangeKey{r.Start, r.End}] = r.Checksum
+	}
+
+	unchanged := make([]bool, len(bm.BlockMap))
+	for i, rng := range bm.BlockMap {
+		r, err := rng.Parse()
+		if err != nil {
+			return nil, err
+		}
+		// A partial last block is hashed up to ImageSize, so the range only
+		// matches if both images end in the same place.
+		if end := (r.End + 1) * int64(bm.BlockSize); end > bm.ImageSize && base.ImageSize != bm.ImageSize {
+			continue
+		}
+		sum, ok := old[rangeKey{r.Start, r.End}]
+		unchanged[i] = ok && r.Checksum != "" && sum == r.Checksum
+	}
+	return unchanged, nil
+}
+
+// confirmUnchanged hashes the ranges marked in unchanged on the device and
+// clears the ones whose data doesn't match bm, e.g. because the card was
+// mounted and written since the base image was flashed.
+func (f *Flasher) confirmUnchanged(ctx context.Context, dev io.ReadSeeker, bm *bmap.Bmap, unchanged []bool) error {
+	bs := int64(bm.BlockSize)
+	var total, done int64
+	for i, rng := range bm.BlockMap {
+		if unchanged[i] {
+			r, _ := rng.Parse()
+			total += min((r.End+1)*bs, bm.ImageSize) - r.Start*bs
+		}
+	}
+
+	buf := make([]byte, 4*1024*1024)
+	for i, rng := range bm.BlockMap {
+		if !unchanged[i] {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		r, _ := rng.Parse()
+		start := r.Start * bs
+		end := min((r.End+1)*bs, bm.ImageSize)
+		if _, err := dev.Seek(start, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek device to %d: %w", start, err)
+		}
+
+		hasher, err := bmap.GetHasher(bm.ChecksumType)
+		if err != nil {
+			return err
+		}
+		for off := start; off < end; {
+			n, err := io.ReadFull(dev, buf[:min(int64(len(buf)), end-off)])
+			if err != nil {
+				// A device too small to hold the range can't be unchanged;
+				// the write will report the real problem.
+				unchanged[i] = false
+				break
+			}
+			hasher.Write(buf[:n])
+			off += int64(n)
+			done += int64(n)
+			if f.opts.ProgressCb != nil {
+				f.opts.ProgressCb(Progress{
+					Phase:          "comparing",
+					BytesProcessed: done,
+					BytesTotal:     total,
+					Percentage:     float64(done) / float64(total) * 100,
+				})
+			}
+		}
+		if unchanged[i] && fmt.Sprintf("%x", hasher.Sum(nil)) != r.Checksum {
+			unchanged[i] = false
+		}
+	}
+	return nil
+}
@@ -2,19 +2,28 @@ package flash
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"pvflasher/internal/archive"
 	"pvflasher/internal/bmap"
+	"pvflasher/internal/checksum"
 	"pvflasher/internal/device"
 	"pvflasher/internal/image"
+	"pvflasher/internal/partition"
 	"pvflasher/internal/platform"
+	"pvflasher/internal/signature"
 )
 
+// defaultPartitionTimeout is how long Flash waits for the partition nodes of
+// the new table to appear when the device is not ejected.
+const defaultPartitionTimeout = 10 * time.Second
+
 type Flasher struct {
 	opts Options
 }
@@ -47,28 +56,47 @@ func (f *Flasher) Flash(ctx context.Context) (*FlashResult, error) {
 		}
 	}
 
-	// 1. Prepare and Open Device
-	// Dismount volumes before raw device access (critical on Windows)
-	if err := platform.PrepareDevice(f.opts.DevicePath); err != nil {
-		return nil, fmt.Errorf("failed to prepare device: %w", err)
-	}
-
-	// Open device for writing
-	dev, err := platform.OpenDevice(f.opts.DevicePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open device: %w", err)
-	}
-	defer dev.Close()
-
-	// 2. Open Image & 3. Load Bmap
+	// 1. Open Image & 2. Load Bmap
 	var imgReader io.Reader
 	var bm *bmap.Bmap
 	var sourceSize int64
 	var counter *image.CountingReader
 
-	if archive.IsArchive(f.opts.ImagePath) {
+	// What the image is goes by its content, not its name.
+	format, err := image.Detect(f.opts.ImagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image: %w", err)
+	}
+	formatName := format.String()
+	var imageEntry string // The image flashed from an archive
+
+	// The image file is checked against its checksum file as it is read, or
+	// an archive before it is extracted.
+	var wantSum *checksum.Sum
+	if f.opts.ChecksumPath != "" {
+		sum, err := checksum.Lookup(f.opts.ChecksumPath, filepath.Base(f.opts.ImagePath))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load checksum: %w", err)
+		}
+		wantSum = &sum
+	}
+
+	if format.Kind == "tar" || format.Kind == "zip" {
 		f.reportPhase("extracting")
-		extractedImage, extractedBmap, cleanExtract, err := archive.Extract(f.opts.ImagePath)
+		if wantSum != nil {
+			if err := wantSum.CheckFile(f.opts.ImagePath); err != nil {
+				return nil, err
+			}
+		}
+		pair, err := archive.GetArchivePair(ctx, f.opts.ImagePath, f.opts.ImageEntry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract archive: %w", err)
+		}
+		if f.opts.ImageEntry == "" && len(pair.Candidates) > 1 {
+			fmt.Fprintf(os.Stderr, "Warning: %s holds %d images; flashing %s\n", f.opts.ImagePath, len(pair.Candidates), pair.ImageEntry)
+		}
+		imageEntry = pair.ImageEntry
+		extractedImage, extractedBmap, cleanExtract, err := archive.Extract(ctx, f.opts.ImagePath, pair)
 		if err != nil {
 			return nil, fmt.Errorf("failed to extract archive: %w", err)
 		}
@@ -79,6 +107,11 @@ func (f *Flasher) Flash(ctx context.Context) (*FlashResult, error) {
 		if f.opts.BmapPath == "" && extractedBmap != "" {
 			f.opts.BmapPath = extractedBmap
 		}
+
+		if format, err = image.Detect(f.opts.ImagePath); err != nil {
+			return nil, fmt.Errorf("failed to open extracted image: %w", err)
+		}
+		formatName += "/" + format.String()
 	}
 
 	imgFile, err := os.Open(f.opts.ImagePath)
@@ -93,27 +126,131 @@ func (f *Flasher) Flash(ctx context.Context) (*FlashResult, error) {
 	}
 	sourceSize = fi.Size()
 	counter = &image.CountingReader{Reader: imgFile}
+	var srcHash *sourceHash
+	if wantSum != nil && imageEntry == "" {
+		srcHash = &sourceHash{f: imgFile, h: wantSum.New()}
+		counter.Reader = srcHash
+	}
 
-	imgReader, err = image.Decompressor(f.opts.ImagePath, counter)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create decompressor: %w", err)
+	// Android sparse images and virtual disks know which of their regions
+	// hold data. Without a bmap, only those regions are written.
+	var sparse image.SparseSource
+
+	// Virtual disks are read in place, as their tables can be anywhere in
+	// the file.
+	var vdisk *image.VirtualDisk
+	if format.Compression == "" {
+		vdisk, err = image.DetectVirtualDisk(imgFile, sourceSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read virtual disk: %w", err)
+		}
+	}
+	// With a bmap, compressed images made of independent frames are read at
+	// random, so the gaps between ranges aren't decompressed.
+	var seekable *image.SeekableReader
+	if vdisk == nil && f.opts.BmapPath != "" && format.Compression != "" && format.Kind == "raw" {
+		seekable, err = image.OpenSeekable(f.opts.ImagePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: reading %s as a stream: %v\n", f.opts.ImagePath, err)
+			seekable = nil
+		}
+	}
+	if vdisk != nil {
+		imgReader, sparse = vdisk, vdisk
+		// Reads bypass counter, so progress follows the bytes written.
+		sourceSize = 0
+	} else if seekable != nil {
+		defer seekable.Close()
+		imgReader = seekable
+		sourceSize = 0 // Likewise
+	} else {
+		dec, err := image.Decompressor(ctx, f.opts.ImagePath, counter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create decompressor: %w", err)
+		}
+		// Stops the decode goroutines of a stream that isn't read to the end.
+		defer dec.Close()
+		imgReader = dec
+
+		// Android sparse images are expanded on the fly.
+		var simg *image.SimgReader
+		simg, imgReader, err = image.DetectSimg(imgReader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read android sparse image: %w", err)
+		}
+		if simg != nil {
+			sparse = simg
+		}
 	}
 
-	// If BmapPath was explicitly provided, it overrides archive bmap
+	// If BmapPath was explicitly provided, it overrides archive bmap.
+	// It is validated here, before any device is touched, so a malformed
+	// bmap can't fail the write halfway through.
 	if f.opts.BmapPath != "" {
-		bmapFile, err := os.Open(f.opts.BmapPath)
+		bm, err = bmap.ParseFile(f.opts.BmapPath)
 		if err != nil {
-			return nil, fmt.Errorf("failed to open bmap: %w", err)
+			return nil, fmt.Errorf("failed to load bmap: %w", err)
 		}
-		defer bmapFile.Close()
-		bm, err = bmap.Parse(bmapFile)
+	}
+
+	sig, err := f.checkSignature(bm)
+	if err != nil {
+		return nil, err
+	}
+
+	// With a base bmap, ranges the device already holds are not rewritten.
+	var unchanged []bool
+	if f.opts.BasePath != "" {
+		if bm == nil {
+			return nil, fmt.Errorf("delta flashing needs a bmap for the image")
+		}
+		base, err := bmap.ParseFile(f.opts.BasePath)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse bmap: %w", err)
+			return nil, fmt.Errorf("failed to load base bmap: %w", err)
+		}
+		if unchanged, err = unchangedRanges(bm, base); err != nil {
+			return nil, fmt.Errorf("can't flash against base bmap %s: %w", f.opts.BasePath, err)
+		}
+	}
+
+	// Refuse write-protected media up front; some readers accept O_RDWR and
+	// only fail with EIO/EROFS partway through the write.
+	if err := platform.CheckWritable(f.opts.DevicePath); err != nil {
+		return nil, err
+	}
+
+	// Hold the device lock from unmounting through eject so another pvflasher
+	// process (e.g. the GUI and a script) can't write the device concurrently.
+	lock, err := platform.LockDevice(f.opts.DevicePath)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	// 3. Prepare and Open Device
+	// Dismount volumes before raw device access (critical on Windows)
+	if err := platform.PrepareDevice(f.opts.DevicePath, platform.PrepareOptions{LazyUnmount: f.opts.LazyUnmount}); err != nil {
+		return nil, fmt.Errorf("failed to prepare device: %w", err)
+	}
+
+	// Open device for writing
+	dev, err := platform.OpenDevice(f.opts.DevicePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open device: %w", err)
+	}
+	defer dev.Close()
+
+	if unchanged != nil && !f.opts.TrustBase {
+		if err := f.confirmUnchanged(ctx, dev, bm, unchanged); err != nil {
+			return nil, fmt.Errorf("failed to compare device with base bmap: %w", err)
 		}
 	}
 
 	// Wrap in ForwardSeeker
-	seeker := image.NewForwardSeeker(imgReader)
+	var seeker io.ReadSeeker = image.NewForwardSeeker(ctx, imgReader)
+	if seekable != nil {
+		seeker = seekable
+	}
 
 	// 4. Flash Loop
 	//
@@ -124,6 +261,9 @@ func (f *Flasher) Flash(ctx context.Context) (*FlashResult, error) {
 	startTime := time.Now()
 	var totalBytes int64
 	var writtenBytes int64
+	var identicalBytes int64 // Left alone with SkipIdentical since the device already held them
+	var skippedBytes, skippedBlocks int64
+	var sparseBmap *bmap.Bmap // Checksums of the regions of a sparse source written, for verification
 
 	bufSize := 4 * 1024 * 1024 // 4MB buffers — fewer syscalls, better throughput on USB/SD
 	const numBufs = 4          // ~16MB read-ahead so decompress runs ahead of writes
@@ -141,18 +281,29 @@ func (f *Flasher) Flash(ctx context.Context) (*FlashResult, error) {
 				break
 			}
 		}
+		for i, rng := range bm.BlockMap {
+			if unchanged != nil && unchanged[i] {
+				pr, _ := rng.Parse()
+				skippedBlocks += pr.Count
+				skippedBytes += min((pr.End+1)*int64(bm.BlockSize), bm.ImageSize) - pr.Start*int64(bm.BlockSize)
+			}
+		}
+		totalBytes -= skippedBytes
 
-		pipe := newDevicePipe(dev, numBufs, bufSize, func(written, sourceRead int64) {
+		pipe := newDevicePipe(dev, numBufs, bufSize, f.opts.SkipIdentical, func(written, sourceRead int64) {
 			f.reportProgress(written, totalBytes, sourceRead, sourceSize, startTime)
 		})
 
 		var readErr error
 	rangeLoop:
-		for _, rng := range bm.BlockMap {
+		for i, rng := range bm.BlockMap {
 			if ctx.Err() != nil {
 				readErr = ctx.Err()
 				break
 			}
+			if unchanged != nil && unchanged[i] {
+				continue // Already on the device; the stream skips it on the next seek
+			}
 
 			parsedRange, err := rng.Parse()
 			if err != nil {
@@ -169,7 +320,7 @@ func (f *Flasher) Flash(ctx context.Context) (*FlashResult, error) {
 			}
 
 			// Forward-seek the decompressed stream to the range start; gaps are
-			// decompressed and discarded (unavoidable for a non-seekable stream).
+			// decompressed and discarded, unless the image is seekable.
 			if _, err := seeker.Seek(startByte, io.SeekStart); err != nil {
 				readErr = fmt.Errorf("failed to seek to block %d: %w", parsedRange.Start, err)
 				break
@@ -199,7 +350,7 @@ func (f *Flasher) Flash(ctx context.Context) (*FlashResult, error) {
 					break rangeLoop
 				}
 
-				if !pipe.submit(off, buf[:n], counter.Count) {
+				if !pipe.submit(off, buf[:n], counter.Count.Load()) {
 					break rangeLoop
 				}
 				off += int64(n)
@@ -209,24 +360,105 @@ func (f *Flasher) Flash(ctx context.Context) (*FlashResult, error) {
 
 		var werr error
 		writtenBytes, werr = pipe.finish()
+		identicalBytes = pipe.skipped
 		if readErr != nil {
 			return nil, readErr
 		}
 		if werr != nil {
 			return nil, fmt.Errorf("write error: %w", werr)
 		}
+	} else if sparse != nil {
+		// Android sparse image or virtual disk: the regions with data are
+		// written and the rest, DONT_CARE chunks or unallocated clusters, are
+		// skipped like bmap gaps. The device is verified against the checksums
+		// of what was written, as the image has none per range.
+		// How much of a sparse image is data isn't known up front, so
+		// totalBytes stays 0 and progress follows the source read instead.
+		if vdisk != nil {
+			totalBytes = vdisk.AllocatedBytes()
+		}
+		var ranges *rangeBuilder
+		if !f.opts.NoVerify {
+			ranges = newRangeBuilder(sparse.BlockSize())
+		}
+
+		pipe := newDevicePipe(dev, numBufs, bufSize, f.opts.SkipIdentical, func(written, sourceRead int64) {
+			f.reportProgress(written, totalBytes, sourceRead, sourceSize, startTime)
+		})
+
+		var readErr error
+	chunkLoop:
+		for {
+			if ctx.Err() != nil {
+				readErr = ctx.Err()
+				break
+			}
+
+			off, remaining, err := sparse.NextData()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				readErr = fmt.Errorf("failed to read image: %w", err)
+				break
+			}
+			if ranges != nil {
+				ranges.extent(off, remaining)
+			}
+
+			for remaining > 0 {
+				if ctx.Err() != nil {
+					readErr = ctx.Err()
+					break chunkLoop
+				}
+
+				buf, ok := pipe.get()
+				if !ok {
+					break chunkLoop // consumer aborted; error reported by finish()
+				}
+
+				toRead := min(int64(len(buf)), remaining)
+				n, err := io.ReadFull(sparse, buf[:toRead])
+				if err != nil {
+					readErr = fmt.Errorf("failed to read image at offset %d: %w", off, err)
+					break chunkLoop
+				}
+				if ranges != nil {
+					ranges.Write(buf[:n])
+				}
+
+				if !pipe.submit(off, buf[:n], counter.Count.Load()) {
+					break chunkLoop
+				}
+				off += int64(n)
+				remaining -= int64(n)
+			}
+		}
+
+		var werr error
+		writtenBytes, werr = pipe.finish()
+		identicalBytes = pipe.skipped
+		if readErr != nil {
+			return nil, readErr
+		}
+		if werr != nil {
+			return nil, fmt.Errorf("write error: %w", werr)
+		}
+		if ranges != nil {
+			sparseBmap = ranges.finish(sparse.Size())
+		}
 	} else {
 		// Raw copy (Full image)
 		// For compressed images, sourceSize is the compressed size on disk, but
 		// writtenBytes will be the decompressed size, so progress is driven by
 		// compressed bytes read (counter) rather than written bytes.
-		if image.IsCompressed(f.opts.ImagePath) {
+		if format.Compression != "" {
 			totalBytes = 0
 		} else {
 			totalBytes = sourceSize
 		}
 
-		pipe := newDevicePipe(dev, numBufs, bufSize, func(written, sourceRead int64) {
+		pipe := newDevicePipe(dev, numBufs, bufSize, f.opts.SkipIdentical, func(written, sourceRead int64) {
 			f.reportProgress(written, totalBytes, sourceRead, sourceSize, startTime)
 		})
 
@@ -245,7 +477,7 @@ func (f *Flasher) Flash(ctx context.Context) (*FlashResult, error) {
 
 			n, err := seeker.Read(buf)
 			if n > 0 {
-				if !pipe.submit(off, buf[:n], counter.Count) {
+				if !pipe.submit(off, buf[:n], counter.Count.Load()) {
 					break
 				}
 				off += int64(n)
@@ -264,6 +496,7 @@ func (f *Flasher) Flash(ctx context.Context) (*FlashResult, error) {
 
 		var werr error
 		writtenBytes, werr = pipe.finish()
+		identicalBytes = pipe.skipped
 		if readErr != nil {
 			return nil, readErr
 		}
@@ -272,8 +505,11 @@ func (f *Flasher) Flash(ctx context.Context) (*FlashResult, error) {
 		}
 	}
 
+	// Bytes of the image on the device now, whether written or not
+	processedBytes := writtenBytes + identicalBytes
+
 	// 5. Sync
-	f.reportPhaseWithBytes("syncing", writtenBytes)
+	f.reportPhaseWithBytes("syncing", processedBytes)
 
 	// Start a goroutine to update elapsed time during sync
 	syncDone := make(chan struct{})
@@ -283,7 +519,7 @@ func (f *Flasher) Flash(ctx context.Context) (*FlashResult, error) {
 		for {
 			select {
 			case <-ticker.C:
-				f.reportPhaseWithBytes("syncing", writtenBytes)
+				f.reportPhaseWithBytes("syncing", processedBytes)
 			case <-syncDone:
 				return
 			}
@@ -296,6 +532,18 @@ func (f *Flasher) Flash(ctx context.Context) (*FlashResult, error) {
 	}
 	close(syncDone)
 
+	// The device holds what was read, but that may not be the image
+	// published: fail before it is verified and ejected as good.
+	if srcHash != nil {
+		got, err := srcHash.sum(fi.Size())
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash image: %w", err)
+		}
+		if err := wantSum.Check(got, filepath.Base(f.opts.ImagePath)); err != nil {
+			return nil, fmt.Errorf("%w; the device holds a corrupt image", err)
+		}
+	}
+
 	// 6. Verification
 	verificationDone := false
 	if !f.opts.NoVerify {
@@ -306,8 +554,10 @@ func (f *Flasher) Flash(ctx context.Context) (*FlashResult, error) {
 		v := NewVerifier(f.opts)
 		if bm != nil {
 			v.SetBmap(bm)
+		} else if sparseBmap != nil {
+			v.SetBmap(sparseBmap)
 		}
-		v.SetDecompressedSize(writtenBytes)
+		v.SetDecompressedSize(processedBytes)
 
 		if err := v.Verify(ctx); err != nil {
 			return nil, fmt.Errorf("verification failed: %w", err)
@@ -317,11 +567,30 @@ func (f *Flasher) Flash(ctx context.Context) (*FlashResult, error) {
 		dev.Close()
 	}
 
-	// 7. Eject
+	// 7. Re-read partitions so the new layout is usable right away when the
+	// device stays attached.
+	var partitions []partition.Partition
+	if f.opts.NoEject {
+		f.reportPhaseWithBytes("rescanning", processedBytes)
+		timeout := f.opts.PartitionTimeout
+		if timeout == 0 {
+			timeout = defaultPartitionTimeout
+		}
+		parts, err := platform.RereadPartitions(f.opts.DevicePath, timeout)
+		partitions = parts
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to re-read partition table: %v\n", err)
+		}
+	}
+
+	// 8. Eject
 	deviceEjected := false
+	var ejectSteps []platform.EjectStep
 	if !f.opts.NoEject {
-		f.reportPhaseWithBytes("ejecting", writtenBytes)
-		if err := platform.EjectDevice(f.opts.DevicePath); err != nil {
+		f.reportPhaseWithBytes("ejecting", processedBytes)
+		steps, err := platform.EjectDevice(f.opts.DevicePath)
+		ejectSteps = steps
+		if err != nil {
 			fmt.Fprintf(os.Stderr, "Warning: failed to eject device: %v\n", err)
 		} else {
 			deviceEjected = true
@@ -330,12 +599,12 @@ func (f *Flasher) Flash(ctx context.Context) (*FlashResult, error) {
 
 	// Calculate final statistics
 	duration := time.Since(startTime)
-	avgSpeed := float64(writtenBytes) / duration.Seconds()
+	avgSpeed := float64(processedBytes) / duration.Seconds()
 
 	// Calculate blocks written (for bmap mode)
 	var blocksWritten int64
 	if bm != nil {
-		blocksWritten = bm.MappedBlocksCount
+		blocksWritten = bm.MappedBlocksCount - skippedBlocks
 	} else {
 		// For raw copy, calculate approximate blocks
 		blockSize := int64(4096) // Standard block size
@@ -345,16 +614,66 @@ func (f *Flasher) Flash(ctx context.Context) (*FlashResult, error) {
 	result := &FlashResult{
 		BytesWritten:     writtenBytes,
 		BlocksWritten:    blocksWritten,
+		BytesSkipped:     skippedBytes,
+		BytesIdentical:   identicalBytes,
 		Duration:         duration,
 		AverageSpeed:     avgSpeed,
 		UsedBmap:         bm != nil,
+		Format:           formatName,
+		ImageEntry:       imageEntry,
 		VerificationDone: verificationDone,
 		DeviceEjected:    deviceEjected,
+		EjectSteps:       ejectSteps,
+		Partitions:       partitions,
+		Signature:        sig,
+	}
+	if wantSum != nil {
+		result.Checksum = wantSum.String()
 	}
 
 	return result, nil
 }
 
+// checkSignature verifies the bmap's detached signature against the keyring.
+// With RequireSignature any failure is fatal; otherwise only a trusted key's
+// signature that doesn't match is, and other problems are warnings.
+func (f *Flasher) checkSignature(bm *bmap.Bmap) (*signature.Result, error) {
+	if bm == nil {
+		if f.opts.RequireSignature {
+			return nil, fmt.Errorf("signature required, but the image has no bmap: %w", signature.ErrUnsigned)
+		}
+		return nil, nil
+	}
+	if f.opts.RequireSignature && f.opts.NoVerify {
+		return nil, fmt.Errorf("signature required: verification can't be skipped, it checks the image against the signed bmap")
+	}
+
+	sigs := signature.FindSignatures(f.opts.BmapPath)
+	if len(sigs) == 0 && !f.opts.RequireSignature {
+		return nil, nil
+	}
+
+	dir := f.opts.KeyringDir
+	if dir == "" {
+		dir = signature.DefaultKeyringDir()
+	}
+	keyring, err := signature.LoadKeyring(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := keyring.VerifyFile(f.opts.BmapPath)
+	if err != nil {
+		var bad *signature.BadSignatureError
+		if f.opts.RequireSignature || errors.As(err, &bad) {
+			return nil, fmt.Errorf("bmap signature check failed: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "Warning: bmap signature not verified: %v\n", err)
+		return nil, nil
+	}
+	return res, nil
+}
+
 func (f *Flasher) reportPhase(phase string) {
 	if f.opts.ProgressCb != nil {
 		f.opts.ProgressCb(Progress{
@@ -0,0 +1,940 @@
+package flash_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"pvflasher/internal/bmap"
+	"pvflasher/internal/checksum"
+	"pvflasher/internal/image"
+	"pvflasher/internal/platform"
+	"pvflasher/internal/signature"
+	"pvflasher/pkg/flash"
+)
+
+// writeTarget creates an empty file of the given size to flash into.
+func writeTarget(t *testing.T, dir string, size int64) string {
+	t.Helper()
+	path := filepath.Join(dir, "target.img")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create target: %v", err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatalf("failed to size target: %v", err)
+	}
+	f.Close()
+	return path
+}
+
+func TestFlashReportsPartitions(t *testing.T) {
+	dir := t.TempDir()
+
+	// 1MB image with an MBR holding a FAT and a Linux partition.
+	img := make([]byte, 1024*1024)
+	entry := func(idx int, typ byte, first, count uint32) {
+		e := img[446+idx*16:]
+		e[4] = typ
+		binary.LittleEndian.PutUint32(e[8:12], first)
+		binary.LittleEndian.PutUint32(e[12:16], count)
+	}
+	entry(0, 0x0c, 64, 512)
+	entry(1, 0x83, 576, 1024)
+	img[510], img[511] = 0x55, 0xaa
+
+	imagePath := filepath.Join(dir, "disk.img")
+	if err := os.WriteFile(imagePath, img, 0644); err != nil {
+		t.Fatal(err)
+	}
+	target := writeTarget(t, dir, int64(len(img)))
+
+	result, err := flash.NewFlasher(flash.Options{
+		ImagePath:  imagePath,
+		DevicePath: target,
+		Force:      true,
+		NoEject:    true,
+	}).Flash(context.Background())
+	if err != nil {
+		t.Fatalf("flash failed: %v", err)
+	}
+
+	if len(result.Partitions) != 2 {
+		t.Fatalf("got %d partitions, want 2: %+v", len(result.Partitions), result.Partitions)
+	}
+	p := result.Partitions[1]
+	if p.Number != 2 || p.Start != 576*512 || p.Size != 1024*512 || p.Type != "0x83" {
+		t.Errorf("partition 2 = %+v", p)
+	}
+}
+
+func TestFlashRefusesLockedDevice(t *testing.T) {
+	dir := t.TempDir()
+	imagePath := filepath.Join(dir, "disk.img")
+	if err := os.WriteFile(imagePath, make([]byte, 64*1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	target := writeTarget(t, dir, 64*1024)
+
+	lock, err := platform.LockDevice(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Unlock()
+
+	_, err = flash.NewFlasher(flash.Options{
+		ImagePath:  imagePath,
+		DevicePath: target,
+		Force:      true,
+		NoEject:    true,
+	}).Flash(context.Background())
+	if !errors.Is(err, platform.ErrDeviceLocked) {
+		t.Fatalf("Flash() = %v, want ErrDeviceLocked", err)
+	}
+}
+
+func TestFlashVerifiesLegacyBmap(t *testing.T) {
+	dir := t.TempDir()
+
+	// 4 blocks; blocks 0-1 and 3 hold data, block 2 is a hole.
+	img := make([]byte, 4*4096)
+	for i := range img {
+		if i/4096 != 2 {
+			img[i] = byte(i)
+		}
+	}
+	imagePath := filepath.Join(dir, "disk.img")
+	if err := os.WriteFile(imagePath, img, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	writeBmap := func(corrupt bool) string {
+		first := sha1.Sum(img[:2*4096])
+		last := sha1.Sum(img[3*4096:])
+		if corrupt {
+			last[0] ^= 0xff
+		}
+		content := fmt.Sprintf(`<?xml version="1.0" ?>
+<bmap version="1.2">
+    <ImageSize> %d </ImageSize>
+    <BlockSize> 4096 </BlockSize>
+    <BlocksCount> 4 </BlocksCount>
+    <MappedBlocksCount> 3 </MappedBlocksCount>
+    <BlockMap>
+        <Range sha1="%x"> 0-1 </Range>
+        <Range sha1="%x"> 3 </Range>
+    </BlockMap>
+</bmap>`, len(img), first, last)
+		path := filepath.Join(dir, fmt.Sprintf("disk-%v.bmap", corrupt))
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	for _, corrupt := range []bool{false, true} {
+		target := writeTarget(t, dir, int64(len(img)))
+		result, err := flash.NewFlasher(flash.Options{
+			ImagePath:  imagePath,
+			BmapPath:   writeBmap(corrupt),
+			DevicePath: target,
+			Force:      true,
+			NoEject:    true,
+		}).Flash(context.Background())
+
+		if corrupt {
+			if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+				t.Errorf("corrupt bmap: Flash() = %v, want checksum mismatch", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Flash() failed: %v", err)
+		}
+		if !result.UsedBmap || !result.VerificationDone {
+			t.Errorf("UsedBmap = %v, VerificationDone = %v, want both true", result.UsedBmap, result.VerificationDone)
+		}
+	}
+}
+
+func TestFlashRejectsInvalidBmapBeforeWriting(t *testing.T) {
+	dir := t.TempDir()
+	img := make([]byte, 4*4096)
+	for i := range img {
+		img[i] = 0xaa
+	}
+	imagePath := filepath.Join(dir, "disk.img")
+	if err := os.WriteFile(imagePath, img, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ranges 2-3 and 1-2 are out of order, which a stream can't seek back for.
+	sum := strings.Repeat("0", 64)
+	bmapPath := filepath.Join(dir, "disk.bmap")
+	content := fmt.Sprintf(`<?xml version="1.0" ?>
+<bmap version="2.0">
+    <ImageSize> %d </ImageSize>
+    <BlockSize> 4096 </BlockSize>
+    <BlocksCount> 4 </BlocksCount>
+    <MappedBlocksCount> 4 </MappedBlocksCount>
+    <ChecksumType> sha256 </ChecksumType>
+    <BlockMap>
+        <Range chksum="%s"> 2-3 </Range>
+        <Range chksum="%s"> 1-2 </Range>
+    </BlockMap>
+</bmap>`, len(img), sum, sum)
+	if err := os.WriteFile(bmapPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	target := writeTarget(t, dir, int64(len(img)))
+
+	_, err := flash.NewFlasher(flash.Options{
+		ImagePath:  imagePath,
+		BmapPath:   bmapPath,
+		DevicePath: target,
+		Force:      true,
+		NoEject:    true,
+	}).Flash(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "range 2 (1-2) is not sorted after 2-3") {
+		t.Fatalf("Flash() = %v, want a validation error", err)
+	}
+
+	written, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range written {
+		if b != 0 {
+			t.Fatal("target was written despite the invalid bmap")
+		}
+	}
+}
+
+func TestFlashRequireSignature(t *testing.T) {
+	dir := t.TempDir()
+	img := make([]byte, 2*4096)
+	for i := range img {
+		img[i] = byte(i)
+	}
+	imagePath := filepath.Join(dir, "disk.img")
+	if err := os.WriteFile(imagePath, img, 0644); err != nil {
+		t.Fatal(err)
+	}
+	bmapData := []byte(fmt.Sprintf(`<?xml version="1.0" ?>
+<bmap version="1.2">
+    <ImageSize> %d </ImageSize>
+    <BlockSize> 4096 </BlockSize>
+    <BlocksCount> 2 </BlocksCount>
+    <MappedBlocksCount> 2 </MappedBlocksCount>
+    <BlockMap>
+        <Range sha1="%x"> 0-1 </Range>
+    </BlockMap>
+</bmap>`, len(img), sha1.Sum(img)))
+
+	trustedPub, trusted, _ := ed25519.GenerateKey(nil)
+	_, stranger, _ := ed25519.GenerateKey(nil)
+	keyring := filepath.Join(dir, "keys")
+	if err := os.Mkdir(keyring, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Minisign keys carry an ID, so a bad signature from a trusted key can be
+	// told apart from an unknown signer.
+	keyID := func(key ed25519.PrivateKey) []byte {
+		id := make([]byte, 8)
+		binary.LittleEndian.PutUint64(id, binary.LittleEndian.Uint64(key.Public().(ed25519.PublicKey)))
+		return id
+	}
+	pub := "untrusted comment: minisign public key\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), keyID(trusted)...), trustedPub...)) + "\n"
+	if err := os.WriteFile(filepath.Join(keyring, "release.pub"), []byte(pub), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// writeBmap writes the bmap, signed by key unless it is nil. tamper
+	// changes the bmap after signing.
+	writeBmap := func(name string, key ed25519.PrivateKey, tamper bool) string {
+		path := filepath.Join(dir, name+".bmap")
+		data := append([]byte(nil), bmapData...)
+		if key != nil {
+			sig := ed25519.Sign(key, data)
+			comment := "timestamp:0\tfile:" + name + ".bmap"
+			global := ed25519.Sign(key, append(append([]byte(nil), sig...), comment...))
+			minisig := "untrusted comment: signature\n" +
+				base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), keyID(key)...), sig...)) + "\n" +
+				"trusted comment: " + comment + "\n" +
+				base64.StdEncoding.EncodeToString(global) + "\n"
+			if err := os.WriteFile(path+".minisig", []byte(minisig), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tamper {
+			data = append(data, '\n')
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name     string
+		bmap     string
+		require  bool
+		noVerify bool
+		wantErr  error  // matched with errors.Is
+		wantMsg  string // matched with strings.Contains
+		signed   bool
+	}{
+		{name: "signed", bmap: writeBmap("signed", trusted, false), require: true, signed: true},
+		{name: "unsigned", bmap: writeBmap("unsigned", nil, false), require: true, wantErr: signature.ErrUnsigned},
+		{name: "no bmap", require: true, wantErr: signature.ErrUnsigned},
+		{name: "untrusted", bmap: writeBmap("untrusted", stranger, false), require: true, wantErr: signature.ErrUntrusted},
+		{name: "untrusted optional", bmap: writeBmap("untrusted-optional", stranger, false)},
+		{name: "tampered optional", bmap: writeBmap("tampered", trusted, true), wantMsg: "bad signature"},
+		{name: "no verify", bmap: writeBmap("no-verify", trusted, false), require: true, noVerify: true, wantMsg: "verification can't be skipped"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := writeTarget(t, t.TempDir(), int64(len(img)))
+			result, err := flash.NewFlasher(flash.Options{
+				ImagePath:        imagePath,
+				BmapPath:         tt.bmap,
+				DevicePath:       target,
+				Force:            true,
+				NoEject:          true,
+				NoVerify:         tt.noVerify,
+				RequireSignature: tt.require,
+				KeyringDir:       keyring,
+			}).Flash(context.Background())
+
+			if tt.wantErr != nil || tt.wantMsg != "" {
+				if err == nil || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) || !strings.Contains(err.Error(), tt.wantMsg) {
+					t.Fatalf("Flash() = %v, want %v %q", err, tt.wantErr, tt.wantMsg)
+				}
+				written, _ := os.ReadFile(target)
+				for _, b := range written {
+					if b != 0 {
+						t.Fatal("target was written despite the signature check failing")
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Flash() failed: %v", err)
+			}
+			if got := result.Signature != nil; got != tt.signed {
+				t.Errorf("Signature = %+v, want signed %v", result.Signature, tt.signed)
+			}
+			if tt.signed && result.Signature.Signer != "release.pub" {
+				t.Errorf("Signer = %q, want release.pub", result.Signature.Signer)
+			}
+		})
+	}
+}
+
+func TestFlashDeltaAgainstBase(t *testing.T) {
+	dir := t.TempDir()
+
+	// 8 blocks with data in 0-1, 3 and 5-6; the new image changes block 5.
+	makeImage := func(name string, fill byte) (string, []byte) {
+		img := make([]byte, 8*4096)
+		for _, blk := range []int{0, 1, 3, 5, 6} {
+			for i := blk * 4096; i < (blk+1)*4096; i++ {
+				img[i] = byte(blk + 1)
+			}
+		}
+		img[5*4096] = fill
+		path := filepath.Join(dir, name+".img")
+		if err := os.WriteFile(path, img, 0644); err != nil {
+			t.Fatal(err)
+		}
+		bm, err := bmap.Create(path, bmap.CreateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bm.Save(path + ".bmap"); err != nil {
+			t.Fatal(err)
+		}
+		return path, img
+	}
+	oldPath, oldImg := makeImage("old", 0x11)
+	newPath, newImg := makeImage("new", 0x22)
+
+	tests := []struct {
+		name        string
+		tamper      bool // Change block 3 on the device after flashing the old image
+		trust       bool
+		wantSkipped int64
+		wantMsg     string
+	}{
+		{name: "unchanged ranges skipped", wantSkipped: 3 * 4096},
+		{name: "modified device rewritten", tamper: true, wantSkipped: 2 * 4096},
+		{name: "trusted base caught by verify", tamper: true, trust: true, wantMsg: "verification failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := writeTarget(t, t.TempDir(), int64(len(oldImg)))
+			if err := os.WriteFile(target, oldImg, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.tamper {
+				f, err := os.OpenFile(target, os.O_WRONLY, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.WriteAt([]byte{0xff}, 3*4096+100)
+				f.Close()
+			}
+
+			result, err := flash.NewFlasher(flash.Options{
+				ImagePath:  newPath,
+				BmapPath:   newPath + ".bmap",
+				BasePath:   oldPath + ".bmap",
+				TrustBase:  tt.trust,
+				DevicePath: target,
+				Force:      true,
+				NoEject:    true,
+			}).Flash(context.Background())
+			if tt.wantMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantMsg) {
+					t.Fatalf("Flash() = %v, want %q", err, tt.wantMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Flash() failed: %v", err)
+			}
+
+			if result.BytesSkipped != tt.wantSkipped || result.BytesWritten != 5*4096-tt.wantSkipped {
+				t.Errorf("skipped %d and wrote %d bytes, want %d and %d", result.BytesSkipped, result.BytesWritten, tt.wantSkipped, 5*4096-tt.wantSkipped)
+			}
+			written, err := os.ReadFile(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(written, newImg) {
+				t.Error("device doesn't hold the new image")
+			}
+		})
+	}
+
+	t.Run("block size mismatch", func(t *testing.T) {
+		bm, err := bmap.Create(oldPath, bmap.CreateOptions{BlockSize: 8192})
+		if err != nil {
+			t.Fatal(err)
+		}
+		base := filepath.Join(dir, "8k.bmap")
+		if err := bm.Save(base); err != nil {
+			t.Fatal(err)
+		}
+		_, err = flash.NewFlasher(flash.Options{
+			ImagePath:  newPath,
+			BmapPath:   newPath + ".bmap",
+			BasePath:   base,
+			DevicePath: writeTarget(t, t.TempDir(), int64(len(newImg))),
+			Force:      true,
+			NoEject:    true,
+		}).Flash(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "block size") {
+			t.Errorf("Flash() = %v, want a block size error", err)
+		}
+	})
+}
+
+func TestFlashSkipIdentical(t *testing.T) {
+	dir := t.TempDir()
+	img := make([]byte, 1024*1024+1000)
+	for i := range img {
+		img[i] = byte(i * 7 / 3)
+	}
+	imagePath := filepath.Join(dir, "disk.img")
+	if err := os.WriteFile(imagePath, img, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The device holds the image except for two bytes in different 64 KiB
+	// segments, one of them in the partial last segment.
+	target := writeTarget(t, dir, int64(len(img)))
+	old := bytes.Clone(img)
+	old[200*1024] ^= 0xff
+	old[len(old)-1] ^= 0xff
+	if err := os.WriteFile(target, old, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := flash.NewFlasher(flash.Options{
+		ImagePath:     imagePath,
+		DevicePath:    target,
+		Force:         true,
+		NoEject:       true,
+		SkipIdentical: true,
+	}).Flash(context.Background())
+	if err != nil {
+		t.Fatalf("Flash() failed: %v", err)
+	}
+
+	if want := int64(64*1024 + 1000); result.BytesWritten != want || result.BytesIdentical != int64(len(img))-want {
+		t.Errorf("wrote %d and skipped %d bytes, want %d and %d", result.BytesWritten, result.BytesIdentical, want, int64(len(img))-want)
+	}
+	written, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, img) {
+		t.Error("device doesn't hold the image")
+	}
+	if !result.VerificationDone {
+		t.Error("verification didn't run")
+	}
+}
+
+// writeSimg writes an Android sparse image with 4096-byte blocks: 2 blocks
+// of data, 3 don't-care blocks, 1 block filled with a pattern and a CRC32
+// chunk. It returns the path and the expected device content, where the
+// don't-care blocks keep the old byte.
+func writeSimg(t *testing.T, dir string, compress bool, old byte) (string, []byte) {
+	t.Helper()
+	const bs = 4096
+	raw := make([]byte, 2*bs)
+	for i := range raw {
+		raw[i] = byte(i % 253)
+	}
+	want := append(append(append([]byte{}, raw...), bytes.Repeat([]byte{old}, 3*bs)...), bytes.Repeat([]byte{1, 2, 3, 4}, bs/4)...)
+	expanded := append(append(append([]byte{}, raw...), make([]byte, 3*bs)...), want[5*bs:]...)
+
+	var simg bytes.Buffer
+	le := binary.LittleEndian
+	simg.Write(le.AppendUint32(nil, 0xed26ff3a))
+	for _, v := range []uint16{1, 0, 28, 12} {
+		simg.Write(le.AppendUint16(nil, v))
+	}
+	for _, v := range []uint32{bs, 6, 4, 0} {
+		simg.Write(le.AppendUint32(nil, v))
+	}
+	chunk := func(kind uint16, blocks uint32, payload []byte) {
+		simg.Write(le.AppendUint16(nil, kind))
+		simg.Write([]byte{0, 0})
+		simg.Write(le.AppendUint32(nil, blocks))
+		simg.Write(le.AppendUint32(nil, uint32(12+len(payload))))
+		simg.Write(payload)
+	}
+	chunk(0xcac1, 2, raw)
+	chunk(0xcac3, 3, nil)
+	chunk(0xcac2, 1, []byte{1, 2, 3, 4})
+	chunk(0xcac4, 0, le.AppendUint32(nil, crc32.ChecksumIEEE(expanded)))
+
+	path := filepath.Join(dir, "system.simg")
+	data := simg.Bytes()
+	if compress {
+		path += ".gz"
+		var gz bytes.Buffer
+		w := gzip.NewWriter(&gz)
+		w.Write(data)
+		w.Close()
+		data = gz.Bytes()
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, want
+}
+
+func TestFlashAndroidSparseImage(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compressed=%v", compress), func(t *testing.T) {
+			dir := t.TempDir()
+			imagePath, want := writeSimg(t, dir, compress, 0x55)
+			target := filepath.Join(dir, "target.img")
+			if err := os.WriteFile(target, bytes.Repeat([]byte{0x55}, len(want)), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := flash.NewFlasher(flash.Options{
+				ImagePath:  imagePath,
+				DevicePath: target,
+				Force:      true,
+				NoEject:    true,
+			}).Flash(context.Background())
+			if err != nil {
+				t.Fatalf("Flash() failed: %v", err)
+			}
+			if result.BytesWritten != 3*4096 || !result.VerificationDone {
+				t.Errorf("BytesWritten = %d, VerificationDone = %v, want %d, true", result.BytesWritten, result.VerificationDone, 3*4096)
+			}
+			written, err := os.ReadFile(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(written, want) {
+				t.Error("device content differs from the expanded image")
+			}
+		})
+	}
+}
+
+// writeQcow2 writes a qcow2 v2 file with 4 KiB clusters for a 32 KiB disk in
+// which only clusters 1 and 2 are allocated. It returns the path and what
+// a device that held old everywhere holds after flashing it.
+func writeQcow2(t *testing.T, dir string, old byte) (string, []byte) {
+	t.Helper()
+	const cs = 4096
+	data := make([]byte, 2*cs)
+	for i := range data {
+		data[i] = byte(i % 241)
+	}
+
+	// Header, L1 table, L2 table, then the two data clusters
+	file := make([]byte, 3*cs)
+	be := binary.BigEndian
+	copy(file, "QFI\xfb")
+	be.PutUint32(file[4:], 2)
+	be.PutUint32(file[20:], 12)
+	be.PutUint64(file[24:], 8*cs)
+	be.PutUint32(file[36:], 1)
+	be.PutUint64(file[40:], cs)
+	be.PutUint64(file[cs:], 2*cs)
+	be.PutUint64(file[2*cs+8:], 3*cs)
+	be.PutUint64(file[2*cs+16:], 4*cs)
+	file = append(file, data...)
+
+	path := filepath.Join(dir, "disk.qcow2")
+	if err := os.WriteFile(path, file, 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := bytes.Repeat([]byte{old}, 8*cs)
+	copy(want[cs:], data)
+	return path, want
+}
+
+func TestFlashVirtualDisk(t *testing.T) {
+	dir := t.TempDir()
+	imagePath, want := writeQcow2(t, dir, 0x55)
+	target := filepath.Join(dir, "target.img")
+	if err := os.WriteFile(target, bytes.Repeat([]byte{0x55}, len(want)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := flash.NewFlasher(flash.Options{
+		ImagePath:  imagePath,
+		DevicePath: target,
+		Force:      true,
+		NoEject:    true,
+	}).Flash(context.Background())
+	if err != nil {
+		t.Fatalf("Flash() failed: %v", err)
+	}
+	if result.BytesWritten != 2*4096 || !result.VerificationDone {
+		t.Errorf("BytesWritten = %d, VerificationDone = %v, want %d, true", result.BytesWritten, result.VerificationDone, 2*4096)
+	}
+	written, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, want) {
+		t.Error("device content differs from the disk, with unallocated clusters left alone")
+	}
+}
+
+func TestFlashDetectsFormatByContent(t *testing.T) {
+	dir := t.TempDir()
+	img := bytes.Repeat([]byte("compressed but misnamed "), 10000)
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(img)
+	w.Close()
+
+	var tarGz bytes.Buffer
+	w = gzip.NewWriter(&tarGz)
+	tw := tar.NewWriter(w)
+	tw.WriteHeader(&tar.Header{Name: "disk.img", Mode: 0644, Size: int64(len(img)), Typeflag: tar.TypeReg})
+	tw.Write(img)
+	tw.Close()
+	w.Close()
+
+	tests := []struct {
+		name   string
+		data   []byte
+		format string
+	}{
+		{"artifact.bin", gz.Bytes(), "raw+gz"},
+		{"artifact.img.xz", gz.Bytes(), "raw+gz"},
+		{"release.dat", tarGz.Bytes(), "tar+gz/raw"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imagePath := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(imagePath, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			target := writeTarget(t, dir, int64(len(img)))
+
+			result, err := flash.NewFlasher(flash.Options{
+				ImagePath:  imagePath,
+				DevicePath: target,
+				Force:      true,
+				NoEject:    true,
+			}).Flash(context.Background())
+			if err != nil {
+				t.Fatalf("Flash() failed: %v", err)
+			}
+			if result.Format != tt.format {
+				t.Errorf("Format = %q, want %q", result.Format, tt.format)
+			}
+			written, err := os.ReadFile(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(written, img) {
+				t.Error("device doesn't hold the decompressed image")
+			}
+		})
+	}
+}
+
+func TestFlashSeekableImage(t *testing.T) {
+	dir := t.TempDir()
+	const frameSize = 64 << 10
+	// 8 frames; data in frames 0 and 5 only.
+	img := make([]byte, 8*frameSize)
+	for i := range img {
+		if f := i / frameSize; f == 0 || f == 5 {
+			img[i] = byte(i * 7)
+		}
+	}
+
+	var packed bytes.Buffer
+	w, err := image.NewSeekableWriter(&packed, "zstd", frameSize, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frameEnds []int
+	for off := 0; off < len(img); off += frameSize {
+		w.Write(img[off : off+frameSize])
+		frameEnds = append(frameEnds, packed.Len())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Break the checksum of frame 2, in a gap of the bmap: read as a
+	// stream, the image fails to decompress.
+	data := packed.Bytes()
+	data[frameEnds[2]-1] ^= 0xff
+	imagePath := filepath.Join(dir, "disk.img.zst")
+	if err := os.WriteFile(imagePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bm, err := bmap.CreateFromReader(bytes.NewReader(img), bmap.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bmapPath := filepath.Join(dir, "disk.img.bmap")
+	if err := bm.Save(bmapPath); err != nil {
+		t.Fatal(err)
+	}
+
+	target := writeTarget(t, dir, int64(len(img)))
+	result, err := flash.NewFlasher(flash.Options{
+		ImagePath:  imagePath,
+		BmapPath:   bmapPath,
+		DevicePath: target,
+		Force:      true,
+		NoEject:    true,
+	}).Flash(context.Background())
+	if err != nil {
+		t.Fatalf("Flash() failed, gaps were decompressed: %v", err)
+	}
+	if result.BytesWritten != 2*frameSize || !result.VerificationDone {
+		t.Errorf("BytesWritten = %d, VerificationDone = %v, want %d, true", result.BytesWritten, result.VerificationDone, 2*frameSize)
+	}
+	written, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, img) {
+		t.Error("device content differs from the image")
+	}
+}
+
+// bz2Image is 32 MiB of 'x' as bzip2 -1 compresses it, in seven blocks of
+// under 5 MiB each, small enough to finish decoding soon after a cancel:
+// head -c 32M /dev/zero | tr '\0' x | bzip2 -1 | base64
+const bz2Image = "" +
+	"QlpoMTFBWSZTWVCn3V4ADQSAgIBAAAggACCkCDSoKjEqCo5igrJMprKhT7q8ABoJ" +
+	"AQEAgAAQQABBSBBpUFRiVBUcxQVkmU1lQp91eAA0EgICAQAAIIAAgpAg0qCoxKgq" +
+	"OYoKyTKayoU+6vAAaCQEBAIAAEEAAQUgQaVBUYlQVHMUFZJlNZUKfdXgANBICAgE" +
+	"AACCAAIKQINKgqMSoKjmKCskymsqFPurwAGgkBAQCAABBAAEFIEGlQVGJUFRzFBW" +
+	"SZTWWgAXvcAFqqAgIBAAAggADCATUbYpJFlSSRcXckU4UJA5n1J7"
+
+func TestFlashCancelStopsDecoders(t *testing.T) {
+	dir := t.TempDir()
+	bz2, err := base64.StdEncoding.DecodeString(bz2Image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	images := map[string][]byte{"image.img.bz2": bz2}
+	// Multi-block xz and multi-frame zstd, decoded in parallel.
+	data := bytes.Repeat([]byte{'x'}, 32<<20)
+	for _, compression := range []string{"xz", "zstd"} {
+		var buf bytes.Buffer
+		w, err := image.NewSeekableWriter(&buf, compression, 1<<20, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		images["image.img."+compression] = buf.Bytes()
+	}
+	defer func(workers int) { image.DecodeWorkers = workers }(image.DecodeWorkers)
+	image.DecodeWorkers = 4
+
+	for name, compressed := range images {
+		t.Run(name, func(t *testing.T) {
+			imagePath := filepath.Join(dir, name)
+			if err := os.WriteFile(imagePath, compressed, 0644); err != nil {
+				t.Fatal(err)
+			}
+			target := writeTarget(t, dir, 256<<20)
+			before := runtime.NumGoroutine()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			_, err := flash.NewFlasher(flash.Options{
+				ImagePath:  imagePath,
+				DevicePath: target,
+				Force:      true,
+				NoEject:    true,
+				ProgressCb: func(flash.Progress) { cancel() },
+			}).Flash(ctx)
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("Flash() error = %v, want context.Canceled", err)
+			}
+
+			// The decoders' goroutines wind down once Flash returns.
+			deadline := time.Now().Add(5 * time.Second)
+			for runtime.NumGoroutine() > before {
+				if time.Now().After(deadline) {
+					stacks := make([]byte, 1<<20)
+					stacks = stacks[:runtime.Stack(stacks, true)]
+					t.Fatalf("%d goroutines left running, %d before Flash:\n%s", runtime.NumGoroutine(), before, stacks)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestFlashChecksumFile(t *testing.T) {
+	dir := t.TempDir()
+	// Data in the first 64 KiB only; the bmap leaves out the rest.
+	img := make([]byte, 1<<20)
+	for i := range 64 << 10 {
+		img[i] = byte(i * 13)
+	}
+	bm, err := bmap.CreateFromReader(bytes.NewReader(img), bmap.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bmapPath := filepath.Join(dir, "disk.bmap")
+	if err := bm.Save(bmapPath); err != nil {
+		t.Fatal(err)
+	}
+
+	var gz, seekable, tarball bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(img)
+	w.Close()
+	sw, err := image.NewSeekableWriter(&seekable, "zstd", 64<<10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sw.Write(img)
+	sw.Close()
+	tw := tar.NewWriter(&tarball)
+	tw.WriteHeader(&tar.Header{Name: "disk.img", Mode: 0644, Size: int64(len(img)), Typeflag: tar.TypeReg})
+	tw.Write(img)
+	tw.Close()
+
+	tests := []struct {
+		name      string
+		data      []byte
+		bmap      string
+		sums      string // Checksum file name
+		corrupt   bool   // List a wrong checksum
+		untouched bool   // The device is left alone on a mismatch
+	}{
+		{name: "disk.img", data: img, sums: "disk.img.sha256"},
+		{name: "disk.img.gz", data: gz.Bytes(), bmap: bmapPath, sums: "SHA256SUMS"},
+		{name: "disk.img.zst", data: seekable.Bytes(), bmap: bmapPath, sums: "SHA512SUMS"},
+		{name: "release.tar", data: tarball.Bytes(), sums: "SHA256SUMS"},
+		{name: "disk.img.gz", data: gz.Bytes(), bmap: bmapPath, sums: "SHA256SUMS", corrupt: true},
+		{name: "release.tar", data: tarball.Bytes(), sums: "SHA256SUMS", corrupt: true, untouched: true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%s/corrupt=%v", tt.name, tt.sums, tt.corrupt), func(t *testing.T) {
+			dir := t.TempDir()
+			imagePath := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(imagePath, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			sum := fmt.Sprintf("%x", sha256.Sum256(tt.data))
+			if tt.sums == "SHA512SUMS" {
+				sum = fmt.Sprintf("%x", sha512.Sum512(tt.data))
+			}
+			if tt.corrupt {
+				sum = strings.Repeat("0", len(sum))
+			}
+			sumsPath := filepath.Join(dir, tt.sums)
+			if err := os.WriteFile(sumsPath, []byte(sum+"  other.img\n"+sum+"  "+tt.name+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			target := writeTarget(t, dir, int64(len(img)))
+
+			result, err := flash.NewFlasher(flash.Options{
+				ImagePath:    imagePath,
+				BmapPath:     tt.bmap,
+				ChecksumPath: sumsPath,
+				DevicePath:   target,
+				Force:        true,
+				NoEject:      true,
+			}).Flash(context.Background())
+			written, _ := os.ReadFile(target)
+			if tt.corrupt {
+				if !errors.Is(err, checksum.ErrMismatch) {
+					t.Fatalf("Flash() = %v, want a checksum mismatch", err)
+				}
+				if tt.untouched && !bytes.Equal(written, make([]byte, len(img))) {
+					t.Error("device written though the archive doesn't match its checksum")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Flash() failed: %v", err)
+			}
+			if !strings.HasSuffix(result.Checksum, sum) {
+				t.Errorf("Checksum = %q, want the one listed, %s", result.Checksum, sum)
+			}
+			if !bytes.Equal(written, img) {
+				t.Error("device content differs from the image")
+			}
+		})
+	}
+}
@@ -1,6 +1,12 @@
 package flash
 
-import "time"
+import (
+	"time"
+
+	"pvflasher/internal/partition"
+	"pvflasher/internal/platform"
+	"pvflasher/internal/signature"
+)
 
 type Progress struct {
 	Phase          string  `json:"phase"`
@@ -15,21 +21,50 @@ type Progress struct {
 type ProgressCallback func(Progress)
 
 type FlashResult struct {
-	BytesWritten     int64         `json:"bytes_written"`
-	BlocksWritten    int64         `json:"blocks_written"`
-	Duration         time.Duration `json:"duration"`
-	AverageSpeed     float64       `json:"average_speed"`
-	UsedBmap         bool          `json:"used_bmap"`
-	VerificationDone bool          `json:"verification_done"`
-	DeviceEjected    bool          `json:"device_ejected"`
+	BytesWritten     int64                 `json:"bytes_written"`
+	BlocksWritten    int64                 `json:"blocks_written"`
+	BytesSkipped     int64                 `json:"bytes_skipped,omitempty"`   // Mapped bytes already on the device (BasePath)
+	BytesIdentical   int64                 `json:"bytes_identical,omitempty"` // Bytes not written because the device held them (SkipIdentical)
+	Duration         time.Duration         `json:"duration"`
+	AverageSpeed     float64               `json:"average_speed"`
+	UsedBmap         bool                  `json:"used_bmap"`
+	Format           string                `json:"format"`                // Detected image format, e.g. "raw+xz", or "tar+gz/raw+zstd" for an archive
+	ImageEntry       string                `json:"image_entry,omitempty"` // Archive entry flashed, for an archive
+	VerificationDone bool                  `json:"verification_done"`
+	DeviceEjected    bool                  `json:"device_ejected"`
+	EjectSteps       []platform.EjectStep  `json:"eject_steps,omitempty"` // Outcome of each eject step
+	Partitions       []partition.Partition `json:"partitions,omitempty"`  // Partitions found after flashing with NoEject
+	Signature        *signature.Result     `json:"signature,omitempty"`   // Verified bmap signature, if any
+	Checksum         string                `json:"checksum,omitempty"`    // Image file checksum matched with ChecksumPath, like "sha256:…"
 }
 
 type Options struct {
-	ImagePath  string
-	DevicePath string
-	BmapPath   string // Optional
-	NoVerify   bool
-	NoEject    bool // Don't eject device after flash
-	Force      bool // Allow writing to mounted devices
-	ProgressCb ProgressCallback
+	ImagePath   string
+	DevicePath  string
+	BmapPath    string // Optional
+	ImageEntry  string // Archive entry to flash (default: the first image archive.ListImages finds)
+	NoVerify    bool
+	NoEject     bool // Don't eject device after flash
+	Force       bool // Allow writing to mounted devices
+	LazyUnmount bool // Detach busy mount points instead of failing (Linux only)
+	// RequireSignature refuses to flash unless the bmap has a detached
+	// signature from a key in KeyringDir. It implies bmap mode and
+	// verification, since the signed range checksums are only checked then.
+	RequireSignature bool
+	KeyringDir       string // Trusted keys (default ~/.pvflasher/keys)
+	// ChecksumPath is a checksum file, like SHA256SUMS or image.sha256,
+	// listing the image file. The flash fails if the file read doesn't match.
+	ChecksumPath string
+	// BasePath is the bmap of the image currently on the device. Ranges of
+	// the new bmap with the same blocks and checksum in it are hashed on the
+	// device and only written if the device data differs.
+	BasePath  string
+	TrustBase bool // Skip ranges that match BasePath without reading the device
+	// SkipIdentical reads every region back from the device before writing
+	// it and only writes what differs, trading a read for a write.
+	SkipIdentical bool
+	// PartitionTimeout bounds the wait for partition nodes after flashing with
+	// NoEject (default 10s).
+	PartitionTimeout time.Duration
+	ProgressCb       ProgressCallback
 }
@@ -1,10 +1,16 @@
 package flash
 
 import (
+	"bytes"
 	"errors"
 	"io"
 )
 
+// compareSize is the granularity of skip-identical writes: with compare on,
+// only the compareSize-aligned segments of a buffer that differ from the
+// device are written.
+const compareSize = 64 * 1024
+
 // devicePipe overlaps image decompression with device writes. The producer
 // (the caller's goroutine in flasher.go) fills borrowed buffers from the
 // decompressed image stream and submits them tagged with the absolute device
@@ -15,8 +21,13 @@ import (
 // Buffers are recycled through a fixed free-list, so there is no per-chunk
 // allocation and the producer fills a free-list buffer directly (no extra copy).
 // Read-ahead is bounded by numBufs*bufSize.
+//
+// With compare set, the consumer first reads each region back from the device
+// and only writes the segments that differ, which saves time and flash wear
+// when the device already holds most of the image.
 type devicePipe struct {
-	dev    io.WriteSeeker
+	dev    io.ReadWriteSeeker
+	cmp    []byte // Buffer for reading the device back, nil unless comparing
 	free   chan []byte
 	filled chan pipeChunk
 	done   chan struct{} // closed by the consumer if a write fails
@@ -24,9 +35,11 @@ type devicePipe struct {
 
 	onProgress func(written, sourceRead int64)
 
-	// written/err are owned by the consumer goroutine and are only read by the
-	// producer after finish() observes <-fin (a happens-before edge).
+	// written/skipped/err are owned by the consumer goroutine and are only
+	// read by the producer after finish() observes <-fin (a happens-before
+	// edge). skipped counts bytes the device already held.
 	written int64
+	skipped int64
 	err     error
 }
 
@@ -38,7 +51,9 @@ type pipeChunk struct {
 
 var errZeroWrite = errors.New("device write returned 0 bytes")
 
-func newDevicePipe(dev io.WriteSeeker, numBufs, bufSize int, onProgress func(written, sourceRead int64)) *devicePipe {
+// newDevicePipe starts the consumer. onProgress is called with the bytes
+// handled so far, written or skipped.
+func newDevicePipe(dev io.ReadWriteSeeker, numBufs, bufSize int, compare bool, onProgress func(written, sourceRead int64)) *devicePipe {
 	p := &devicePipe{
 		dev:        dev,
 		free:       make(chan []byte, numBufs),
@@ -50,6 +65,9 @@ func newDevicePipe(dev io.WriteSeeker, numBufs, bufSize int, onProgress func(wri
 	for i := 0; i < numBufs; i++ {
 		p.free <- make([]byte, bufSize)
 	}
+	if compare {
+		p.cmp = make([]byte, bufSize)
+	}
 	go p.consume()
 	return p
 }
@@ -58,37 +76,95 @@ func (p *devicePipe) consume() {
 	defer close(p.fin)
 	cur := int64(-1) // unknown device position
 	for c := range p.filled {
-		if c.off != cur {
-			if _, err := p.dev.Seek(c.off, io.SeekStart); err != nil {
-				p.err = err
-				close(p.done)
-				return
-			}
-			cur = c.off
+		var err error
+		if p.cmp != nil {
+			err = p.writeChanged(c.off, c.buf, &cur)
+		} else {
+			err = p.writeAt(c.off, c.buf, &cur)
 		}
-		for w := 0; w < len(c.buf); {
-			n, err := p.dev.Write(c.buf[w:])
-			if err != nil {
-				p.err = err
-				close(p.done)
-				return
-			}
-			if n == 0 {
-				p.err = errZeroWrite
-				close(p.done)
-				return
-			}
-			w += n
+		if err != nil {
+			p.err = err
+			close(p.done)
+			return
 		}
-		cur += int64(len(c.buf))
-		p.written += int64(len(c.buf))
 		if p.onProgress != nil {
-			p.onProgress(p.written, c.sourceRead)
+			p.onProgress(p.written+p.skipped, c.sourceRead)
 		}
 		p.free <- c.buf[:cap(c.buf)]
 	}
 }
 
+// writeAt writes data at device offset off. cur tracks the device position
+// so the device is only seeked when offsets are discontinuous.
+func (p *devicePipe) writeAt(off int64, data []byte, cur *int64) error {
+	if off != *cur {
+		if _, err := p.dev.Seek(off, io.SeekStart); err != nil {
+			*cur = -1
+			return err
+		}
+		*cur = off
+	}
+	for w := 0; w < len(data); {
+		n, err := p.dev.Write(data[w:])
+		*cur += int64(n)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return errZeroWrite
+		}
+		w += n
+	}
+	p.written += int64(len(data))
+	return nil
+}
+
+// writeChanged reads the region at off back from the device and writes the
+// compareSize segments of data that differ from it, merging neighbouring
+// ones into one write.
+func (p *devicePipe) writeChanged(off int64, data []byte, cur *int64) error {
+	existing := p.cmp[:len(data)]
+	if off != *cur {
+		if _, err := p.dev.Seek(off, io.SeekStart); err != nil {
+			*cur = -1
+			return err
+		}
+	}
+	n, err := io.ReadFull(p.dev, existing)
+	*cur = off + int64(n)
+	if err != nil {
+		// The region can't be read back, e.g. because it is past the end
+		// of the device: write it all and let the write report the problem.
+		return p.writeAt(off, data, cur)
+	}
+
+	// Segments are aligned to device offsets, so the outcome doesn't depend
+	// on how the producer happened to cut the stream into buffers.
+	segmentEnd := func(i int) int {
+		return min(int((off+int64(i))/compareSize+1)*compareSize-int(off), len(data))
+	}
+	for start := 0; start < len(data); {
+		end := segmentEnd(start)
+		if bytes.Equal(data[start:end], existing[start:end]) {
+			p.skipped += int64(end - start)
+			start = end
+			continue
+		}
+		for end < len(data) {
+			next := segmentEnd(end)
+			if bytes.Equal(data[end:next], existing[end:next]) {
+				break
+			}
+			end = next
+		}
+		if err := p.writeAt(off+int64(start), data[start:end], cur); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
 // get returns a buffer to fill, or ok=false if the consumer has aborted.
 func (p *devicePipe) get() (buf []byte, ok bool) {
 	select {
@@ -0,0 +1,62 @@
+package flash
+
+import (
+	"fmt"
+	"hash"
+
+	"pvflasher/internal/bmap"
+)
+
+// rangeBuilder records the checksums of data written in block-aligned
+// extents, in ascending order, as a bmap. Flash uses it to verify Android
+// sparse images and virtual disks, which carry no range checksums of their
+// own.
+type rangeBuilder struct {
+	bm          *bmap.Bmap
+	start, next int64 // Byte extent of the open range
+	hasher      hash.Hash
+}
+
+func newRangeBuilder(blockSize int) *rangeBuilder {
+	return &rangeBuilder{bm: &bmap.Bmap{
+		Version:      "2.0",
+		BlockSize:    blockSize,
+		ChecksumType: "sha256",
+		BlockMap:     make([]bmap.Range, 0),
+	}}
+}
+
+// extent starts the extent of n bytes at off. Its data is then passed to
+// Write. An extent right after the previous one extends its range.
+func (b *rangeBuilder) extent(off, n int64) {
+	if b.hasher == nil || off != b.next {
+		b.closeRange()
+		b.hasher, _ = bmap.GetHasher(b.bm.ChecksumType)
+		b.start = off
+	}
+	b.next = off + n
+}
+
+func (b *rangeBuilder) Write(p []byte) (int, error) {
+	return b.hasher.Write(p)
+}
+
+func (b *rangeBuilder) closeRange() {
+	if b.hasher == nil {
+		return
+	}
+	bs := int64(b.bm.BlockSize)
+	first, last := b.start/bs, (b.next-1)/bs
+	b.bm.BlockMap = append(b.bm.BlockMap, bmap.NewRange(first, last, fmt.Sprintf("%x", b.hasher.Sum(nil))))
+	b.bm.MappedBlocksCount += last - first + 1
+	b.hasher = nil
+}
+
+// finish returns the bmap of an image of the given size.
+func (b *rangeBuilder) finish(imageSize int64) *bmap.Bmap {
+	b.closeRange()
+	bs := int64(b.bm.BlockSize)
+	b.bm.ImageSize = imageSize
+	b.bm.BlocksCount = (imageSize + bs - 1) / bs
+	return b.bm
+}
@@ -45,29 +45,24 @@ func (v *Verifier) Verify(ctx context.Context) error {
 }
 
 func (v *Verifier) verifyWithBmap(ctx context.Context) error {
-	// 1. Open Device
-	dev, err := platform.OpenDevice(v.opts.DevicePath)
-	if err != nil {
-		return fmt.Errorf("failed to open device: %w", err)
-	}
-	defer dev.Close()
-
-	// 2. Load Bmap
+	// 1. Load Bmap
 	var bm *bmap.Bmap
 	if v.bm != nil {
 		bm = v.bm
 	} else {
-		bmapFile, err := os.Open(v.opts.BmapPath)
+		var err error
+		bm, err = bmap.ParseFile(v.opts.BmapPath)
 		if err != nil {
 			return err
 		}
-		defer bmapFile.Close()
+	}
 
-		bm, err = bmap.Parse(bmapFile)
-		if err != nil {
-			return err
-		}
+	// 2. Open Device
+	dev, err := platform.OpenDevice(v.opts.DevicePath)
+	if err != nil {
+		return fmt.Errorf("failed to open device: %w", err)
 	}
+	defer dev.Close()
 
 	// 3. Verification Loop
 	startTime := time.Now()
@@ -132,9 +127,9 @@ func (v *Verifier) verifyWithBmap(ctx context.Context) error {
 			v.reportProgress(verifiedBytes, totalBytes, startTime)
 		}
 
-		// Compare checksums
+		// Compare checksums. Early 1.x bmaps may omit range checksums.
 		calculatedSum := fmt.Sprintf("%x", hasher.Sum(nil))
-		if calculatedSum != parsedRange.Checksum {
+		if parsedRange.Checksum != "" && calculatedSum != parsedRange.Checksum {
 			return fmt.Errorf("checksum mismatch at range %s: expected %s, got %s", rng.Text, parsedRange.Checksum, calculatedSum)
 		}
 	}
@@ -158,14 +153,14 @@ func (v *Verifier) verifyRaw(ctx context.Context) error {
 	if archive.IsArchive(v.opts.ImagePath) {
 		entry := v.imageEntry
 		if entry == "" {
-			pair, err := archive.GetArchivePair(v.opts.ImagePath)
+			pair, err := archive.GetArchivePair(ctx, v.opts.ImagePath, v.opts.ImageEntry)
 			if err != nil {
 				return fmt.Errorf("failed to scan archive: %w", err)
 			}
 			entry = pair.ImageEntry
 		}
 
-		rc, _, err := archive.OpenArchiveImage(v.opts.ImagePath, entry)
+		rc, _, err := archive.OpenArchiveImage(ctx, v.opts.ImagePath, entry)
 		if err != nil {
 			return fmt.Errorf("failed to open archive entry: %w", err)
 		}
@@ -175,11 +170,13 @@ func (v *Verifier) verifyRaw(ctx context.Context) error {
 		// unless we knew uncompressed size. We can skip totalBytes or use compressed size as estimate.
 		totalBytes = 0
 
-		imgReader, err = image.Decompressor(entry, rc)
+		dec, err := image.Decompressor(ctx, entry, rc)
 		if err != nil {
 			cleanup()
 			return err
 		}
+		imgReader = dec
+		cleanup = func() { dec.Close(); rc.Close() }
 	} else {
 		imgFile, err := os.Open(v.opts.ImagePath)
 		if err != nil {
@@ -197,11 +194,13 @@ func (v *Verifier) verifyRaw(ctx context.Context) error {
 			totalBytes = fi.Size()
 		}
 
-		imgReader, err = image.Decompressor(v.opts.ImagePath, imgFile)
+		dec, err := image.Decompressor(ctx, v.opts.ImagePath, imgFile)
 		if err != nil {
 			cleanup()
 			return err
 		}
+		imgReader = dec
+		cleanup = func() { dec.Close(); imgFile.Close() }
 	}
 	defer cleanup()
 